@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"io"
+	"reflect"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Record holds the result of inspecting a single packet in the stream. Offset is the byte offset of the first byte of
+// the packet's fixed header within the stream. If the packet could not be decoded, Error is set, and Header may be set
+// if the fixed header could be read.
+type Record struct {
+	Offset int64
+	Header *mqtt.PacketHeader
+	Packet mqtt.Packet
+	Error  error
+}
+
+// Inspect decodes all packets in the given data. Malformed packets whose fixed header could be read are skipped
+// according to their remaining length. If a fixed header can not be read, or the stream ends prematurely, inspection
+// stops after reporting the error.
+func Inspect(data []byte) (records []*Record) {
+	r := bytes.NewReader(data)
+
+	for r.Len() > 0 {
+		offset := int64(len(data) - r.Len())
+		record := &Record{Offset: offset}
+		records = append(records, record)
+
+		header, err := mqtt.ReadHeaderFrom(r)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			record.Error = fmt.Errorf("error reading fixed header at offset %d: %w", errorOffset(err, offset), err)
+			return
+		}
+		record.Header = header
+
+		start := int64(len(data) - r.Len())
+		end := start + int64(header.Length)
+		if end > int64(len(data)) {
+			record.Error = fmt.Errorf("packet at offset %d is truncated: remaining length is %d, but only %d bytes are left",
+				offset, header.Length, int64(len(data))-start)
+			return
+		}
+
+		record.Packet, err = mqtt.DecodePacket(bytes.NewBuffer(data[start:end]), header)
+		if err != nil {
+			record.Error = fmt.Errorf("error decoding %s at offset %d: %w", header.Type, errorOffset(err, start), err)
+		}
+
+		_, _ = r.Seek(end, io.SeekStart)
+	}
+
+	return
+}
+
+// errorOffset returns the absolute offset in the stream of the field that caused the given decoding error. base is the
+// offset at which the decoder started reading.
+func errorOffset(err error, base int64) int64 {
+	var malformed *mqtt.MalformedPacketError
+	var violation *mqtt.ProtocolError
+
+	if errors.As(err, &malformed) {
+		return base + int64(malformed.Offset)
+	}
+	if errors.As(err, &violation) {
+		return base + int64(violation.Offset)
+	}
+	return base
+}
+
+// writeFields writes the exported fields of the packet one per line.
+func writeFields(buf *bytes.Buffer, indent string, packet mqtt.Packet) {
+	v := reflect.Indirect(reflect.ValueOf(packet))
+	writeStructFields(buf, indent, v)
+}
+
+func writeStructFields(buf *bytes.Buffer, indent string, v reflect.Value) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			writeStructFields(buf, indent, v.Field(i))
+			continue
+		}
+
+		fmt.Fprintf(buf, "%s%s: %s\n", indent, field.Name, formatValue(v.Field(i)))
+	}
+}
+
+func formatValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return fmt.Sprintf("%q", v.String())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return formatBytes(v.Bytes())
+		}
+		if v.Type().Elem().Kind() == reflect.Struct {
+			s := "["
+			for i := 0; i < v.Len(); i++ {
+				if i > 0 {
+					s += ", "
+				}
+				s += fmt.Sprintf("%+v", v.Index(i).Interface())
+			}
+			return s + "]"
+		}
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
+
+// formatBytes returns the bytes as quoted string if they are printable UTF-8 text, or as hex otherwise.
+func formatBytes(b []byte) string {
+	if b == nil {
+		return "<nil>"
+	}
+	if utf8.Valid(b) && isPrintable(string(b)) {
+		return fmt.Sprintf("%q (%d bytes)", b, len(b))
+	}
+	return fmt.Sprintf("0x%x (%d bytes)", b, len(b))
+}
+
+func isPrintable(s string) bool {
+	for _, r := range s {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"strings"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	records := Inspect(stream)
+	if len(records) != 2 {
+		t.Fatal("expected 2 records, got", len(records))
+	}
+	for i, offset := range []int64{0, 2} {
+		if records[i].Offset != offset || records[i].Error != nil {
+			t.Errorf("unexpected record %d: offset %d, error %v", i, records[i].Offset, records[i].Error)
+		}
+	}
+	if records[0].Packet.Type() != mqtt.TypePingReq {
+		t.Error("expected PINGREQ, got", records[0].Packet)
+	}
+	if p := records[1].Packet.(*mqtt.PublishPacket); p.TopicName != "t" || string(p.Payload) != "a" {
+		t.Error("unexpected PUBLISH", p)
+	}
+}
+
+func TestInspect_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		records int    // the number of records, the last of which has the error
+		offset  int64  // the offset of the record with the error
+		message string // a part of the error message, which includes the offset of the error in the stream
+	}{
+		{
+			name:    "truncated fixed header",
+			data:    append(stream, 0x30, 0x80),
+			records: 3,
+			offset:  8,
+			message: "fixed header at offset 10",
+		},
+		{
+			name:    "truncated packet",
+			data:    append(stream, 0x30, 0x05, 0x00, 0x01),
+			records: 3,
+			offset:  8,
+			message: "remaining length is 5, but only 2 bytes are left",
+		},
+		{
+			name:    "malformed field",
+			data:    append([]byte{0x30, 0x03, 0x00, 0x05, 't'}, stream...),
+			records: 3,
+			offset:  0,
+			message: "PUBLISH at offset 2",
+		},
+		{
+			name:    "protocol violation",
+			data:    append(stream, 0x00, 0x01, 0xff),
+			records: 3,
+			offset:  8,
+			message: "Reserved at offset 10",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records := Inspect(tt.data)
+			var failed *Record
+			for _, record := range records {
+				if record.Error != nil {
+					failed = record
+					break
+				}
+			}
+			if failed == nil {
+				t.Fatal("expected record with error")
+			}
+			if failed.Offset != tt.offset {
+				t.Errorf("expected error in record at offset %d, got %d", tt.offset, failed.Offset)
+			}
+			if !strings.Contains(failed.Error.Error(), tt.message) {
+				t.Errorf("expected error containing %q, got %q", tt.message, failed.Error)
+			}
+			if len(records) != tt.records {
+				t.Errorf("expected %d records, got %d", tt.records, len(records))
+			}
+		})
+	}
+}
+
+// TestInspect_SkipsMalformedPacket checks that inspection continues with the packet after a malformed packet.
+func TestInspect_SkipsMalformedPacket(t *testing.T) {
+	records := Inspect(append([]byte{0x30, 0x03, 0x00, 0x05, 't'}, stream...))
+	if len(records) != 3 {
+		t.Fatal("expected 3 records, got", len(records))
+	}
+	if records[0].Error == nil || records[1].Error != nil || records[2].Error != nil {
+		t.Error("expected only the first record to have an error")
+	}
+	if records[1].Offset != 5 || records[1].Packet.Type() != mqtt.TypePingReq {
+		t.Error("unexpected record", records[1].Offset, records[1].Packet)
+	}
+}
+
+func TestTextPrinter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for _, record := range Inspect(stream) {
+		if err := NewTextPrinter(buf).Print(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := []string{"00000000  PINGREQ", "00000002  PUBLISH", `TopicName: "t"`, `Payload: "a" (1 bytes)`}
+	for _, expected := range lines {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, buf)
+		}
+	}
+}
+
+func TestJsonPrinter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for _, record := range Inspect(append(stream, 0x30, 0x05)) {
+		if err := NewJsonPrinter(buf).Print(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatal("expected 3 lines, got", buf.String())
+	}
+	if !strings.HasPrefix(lines[0], `{"offset":0,"type":"PINGREQ"`) {
+		t.Error("unexpected first line", lines[0])
+	}
+	if !strings.HasPrefix(lines[2], `{"offset":8,"type":"PUBLISH"`) || !strings.Contains(lines[2], `"error":`) {
+		t.Error("unexpected last line", lines[2])
+	}
+}
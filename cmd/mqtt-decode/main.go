@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const usage = `Usage: mqtt-decode [flags] [file]
+
+Decodes a stream of MQTT packets and prints every packet. The input is read from
+the given file, or from stdin if no file (or "-") is given. It may be a hex
+stream (e.g., copied from Wireshark), base64, or raw binary data. The format
+is not guessed, since a hex stream is also valid base64.
+
+Flags:
+`
+
+func main() {
+	formatPtr := flag.String("format", "hex", "input format: hex, base64, or raw")
+	jsonPtr := flag.Bool("json", false, "print packets as JSON (one object per line)")
+
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	input, err := readInput(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading input:", err)
+		os.Exit(1)
+	}
+
+	data, err := decodeInput(input, *formatPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error decoding input:", err)
+		os.Exit(1)
+	}
+
+	var printer Printer
+	if *jsonPtr {
+		printer = NewJsonPrinter(os.Stdout)
+	} else {
+		printer = NewTextPrinter(os.Stdout)
+	}
+
+	malformed := false
+	for _, record := range Inspect(data) {
+		if record.Error != nil {
+			malformed = true
+		}
+		if err := printer.Print(record); err != nil {
+			fmt.Fprintln(os.Stderr, "error writing output:", err)
+			os.Exit(1)
+		}
+	}
+
+	if malformed {
+		os.Exit(1)
+	}
+}
+
+func readInput(name string) ([]byte, error) {
+	if name == "" || name == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+// decodeInput converts the input into the raw bytes of the packet stream according to the given format.
+func decodeInput(input []byte, format string) ([]byte, error) {
+	switch format {
+	case "raw":
+		return input, nil
+	case "hex":
+		return decodeHex(input)
+	case "base64":
+		return decodeBase64(input)
+	default:
+		return nil, errors.New("unknown input format " + format)
+	}
+}
+
+// decodeHex decodes a hex stream, ignoring whitespace, "0x" prefixes, and ':' or '-' byte separators.
+func decodeHex(input []byte) ([]byte, error) {
+	var sb strings.Builder
+
+	for _, field := range strings.Fields(string(input)) {
+		field = strings.TrimPrefix(strings.TrimPrefix(field, "0x"), "0X")
+		field = strings.NewReplacer(":", "", "-", "").Replace(field)
+		sb.WriteString(field)
+	}
+
+	if sb.Len() == 0 {
+		return nil, errors.New("empty hex input")
+	}
+
+	return hex.DecodeString(sb.String())
+}
+
+func decodeBase64(input []byte) ([]byte, error) {
+	str := strings.Join(strings.Fields(string(input)), "")
+	if len(str) == 0 {
+		return nil, errors.New("empty base64 input")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return base64.RawStdEncoding.DecodeString(str)
+	}
+	return data, err
+}
+
+// Printer writes inspected packet records to an output.
+type Printer interface {
+	Print(record *Record) error
+}
+
+type jsonPrinter struct {
+	enc *json.Encoder
+}
+
+func NewJsonPrinter(w io.Writer) Printer {
+	return &jsonPrinter{json.NewEncoder(w)}
+}
+
+type jsonRecord struct {
+	Offset int64       `json:"offset"`
+	Type   string      `json:"type,omitempty"`
+	Flags  *uint8      `json:"flags,omitempty"`
+	Length *uint32     `json:"length,omitempty"`
+	Packet interface{} `json:"packet,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+func (p *jsonPrinter) Print(record *Record) error {
+	jr := jsonRecord{
+		Offset: record.Offset,
+	}
+
+	if h := record.Header; h != nil {
+		jr.Type = h.Type.String()
+		jr.Flags = &h.Flags
+		jr.Length = &h.Length
+	}
+	if record.Packet != nil {
+		jr.Packet = record.Packet
+	}
+	if record.Error != nil {
+		jr.Error = record.Error.Error()
+	}
+
+	return p.enc.Encode(jr)
+}
+
+type textPrinter struct {
+	w io.Writer
+}
+
+func NewTextPrinter(w io.Writer) Printer {
+	return &textPrinter{w}
+}
+
+func (p *textPrinter) Print(record *Record) error {
+	buf := new(bytes.Buffer)
+
+	fmt.Fprintf(buf, "%08x", record.Offset)
+	if h := record.Header; h != nil {
+		fmt.Fprintf(buf, "  %-11s  flags=0x%x length=%d", h.Type, h.Flags, h.Length)
+	}
+	buf.WriteByte('\n')
+
+	if record.Packet != nil {
+		writeFields(buf, "    ", record.Packet)
+	}
+	if record.Error != nil {
+		fmt.Fprintf(buf, "    error: %s\n", record.Error)
+	}
+
+	_, err := buf.WriteTo(p.w)
+	return err
+}
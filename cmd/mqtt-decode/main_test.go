@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// a PINGREQ and a PUBLISH of "a" to topic "t"
+var stream = []byte{0xc0, 0x00, 0x30, 0x04, 0x00, 0x01, 't', 'a'}
+
+func TestDecodeInput(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		format string
+	}{
+		{"raw", string(stream), "raw"},
+		{"hex", "c0003004000174 61", "hex"},
+		{"hex with prefixes", "0xc0 0x00 0x30 0x04\n0x00 0x01 0x74 0x61", "hex"},
+		{"hex with separators", "c0:00:30:04-00-01-74-61", "hex"},
+		{"base64", "wAAwBAABdGE=", "base64"},
+		{"base64 without padding", "wAAwBAABdGE", "base64"},
+		{"base64 with line breaks", "wAAw\nBAABdGE=\n", "base64"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := decodeInput([]byte(tt.input), tt.format)
+			if err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			if !bytes.Equal(stream, data) {
+				t.Errorf("expected %x, got %x", stream, data)
+			}
+		})
+	}
+}
+
+func TestDecodeInput_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		format string
+	}{
+		{"empty hex", " \n", "hex"},
+		{"odd hex", "c00", "hex"},
+		{"invalid hex", "c0 zz", "hex"},
+		{"empty base64", "", "base64"},
+		{"invalid base64", "wAA*", "base64"},
+		{"unknown format", "c000", "auto"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if data, err := decodeInput([]byte(tt.input), tt.format); err == nil {
+				t.Errorf("expected error, got %x", data)
+			}
+		})
+	}
+}
+
+// TestDecodeInput_HexDigitsInBase64 checks that the format is never guessed: base64 that only consists of hex digits
+// is decoded as base64.
+func TestDecodeInput_HexDigitsInBase64(t *testing.T) {
+	data, err := decodeInput([]byte("c000"), "base64")
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if !bytes.Equal([]byte{0x73, 0x4d, 0x34}, data) {
+		t.Errorf("unexpected data %x", data)
+	}
+}
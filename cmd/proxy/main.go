@@ -1,17 +1,92 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
 	"github.com/edgerun/emma-mqtt-proxy/pkg/proxy"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	hostPtr := flag.String("host", "127.0.0.1", "host to bind to")
 	portPtr := flag.Int("port", 1883, "the server port")
+	brokerPtr := flag.String("broker", proxy.DefaultBrokerAddress, "the address of the MQTT broker")
+	strictPtr := flag.Bool("strict", false, "close connections of clients that violate the MQTT specification")
+	utf8ModePtr := flag.String("utf8", mqtt.UTF8PassThrough.String(), "how to handle invalid UTF-8 strings in client "+
+		"packets (pass-through, reject or replace)")
+	maxPacketSizePtr := flag.Uint("max-packet-size", 0, "the maximum size in bytes of client packets (0 = no limit)")
+	sharedPtr := flag.Bool("shared-subscriptions", false, "let the proxy implement shared subscriptions "+
+		"($share/group/filter) for brokers that do not support them")
+	remapPtr := flag.Bool("remap-packet-ids", false, "rewrite the packet identifiers of clients, so that the proxy "+
+		"can publish the wills it keeps over the connections of the clients")
+	retainedCachePtr := flag.Bool("retained-cache", false, "cache retained messages of the broker in the proxy, and "+
+		"serve them to clients as soon as the broker grants their subscriptions")
+	localKeepAlivePtr := flag.Bool("local-keep-alive", false, "answer PINGREQ packets of clients in the proxy, and "+
+		"keep the connections to the broker alive on their behalf")
+	keepWillsPtr := flag.Bool("keep-wills", false, "keep the wills of clients in the proxy instead of the broker, "+
+		"and publish them only if a client connection breaks")
+	storeAndForwardPtr := flag.String("store-and-forward", "", "store messages of clients in this directory while "+
+		"the broker is unreachable, and forward them later (empty = disabled)")
+	storeAndForwardMaxBytesPtr := flag.Int64("store-and-forward-max-bytes", 0, "the maximum size in bytes of the "+
+		"stored messages, beyond which the oldest ones are dropped (0 = no limit)")
+	storeAndForwardMaxAgePtr := flag.Duration("store-and-forward-max-age", 0, "the maximum time for which messages "+
+		"are stored, after which they are dropped (0 = no limit)")
+	multiplexPtr := flag.Int("multiplex", 0, "bridge lightweight clients over this number of shared connections to "+
+		"the broker (0 = one connection per client)")
+	connectTimeoutPtr := flag.Duration("connect-timeout", 10*time.Second, "the maximum time to wait for a CONNECT")
+	writeTimeoutPtr := flag.Duration("write-timeout", 0, "the maximum time a write may block (0 = no limit)")
+	shutdownTimeoutPtr := flag.Duration("shutdown-timeout", 5*time.Second, "the maximum time to wait for connections "+
+		"to close on shutdown")
+	verbosePtr := flag.Bool("verbose", false, "log every packet that clients send")
 
 	flag.Parse()
 
+	utf8Mode, err := mqtt.ParseUTF8Mode(*utf8ModePtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := proxy.NewServer(*brokerPtr)
+	server.Strict = *strictPtr
+	server.UTF8Mode = utf8Mode
+	server.SharedSubscriptions = *sharedPtr
+	server.RemapPacketIds = *remapPtr
+	server.RetainedCache = *retainedCachePtr
+	server.LocalKeepAlive = *localKeepAlivePtr
+	server.KeepWills = *keepWillsPtr
+	server.StoreAndForwardDir = *storeAndForwardPtr
+	server.StoreAndForwardMaxBytes = *storeAndForwardMaxBytesPtr
+	server.StoreAndForwardMaxAge = *storeAndForwardMaxAgePtr
+	server.Multiplex = *multiplexPtr
+	server.MaxPacketSize = uint32(*maxPacketSizePtr)
+	server.ConnectTimeout = *connectTimeoutPtr
+	server.WriteTimeout = *writeTimeoutPtr
+	server.Verbose = *verbosePtr
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		log.Println("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutPtr)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("error shutting down:", err)
+		}
+		os.Exit(0)
+	}()
+
 	address := fmt.Sprintf("%s:%d", *hostPtr, *portPtr)
-	proxy.Serve("tcp", address)
+	err = server.ListenAndServe("tcp", address)
+	if err != proxy.ErrServerClosed {
+		log.Fatal(err)
+	}
+	select {} // wait for the shutdown to complete
 }
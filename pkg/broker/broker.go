@@ -0,0 +1,327 @@
+// Package broker implements a small in-memory MQTT 3.1.1 broker for tests and local development.
+//
+// The broker supports subscriptions with wildcards, QoS 0, 1 and 2, retained messages, wills, and clean and persistent
+// sessions. Shared subscriptions are refused, like by brokers that do not support them. Sessions and messages are only
+// kept in memory. It can serve connections from a net.Listener, or from
+// in-process pipes, which allows hermetic end-to-end tests:
+//
+//	b := broker.New()
+//	defer b.Close()
+//	conn := b.Pipe() // the client side of a new connection to the broker
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/topic"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrBrokerClosed is returned by Serve after Close has been called.
+var ErrBrokerClosed = errors.New("broker: closed")
+
+const (
+	// ConnectTimeout is the maximum time to wait for the CONNECT of a new connection.
+	ConnectTimeout = 10 * time.Second
+	// outboxSize is the number of packets that can be queued for a connection before delivering to it blocks.
+	outboxSize = 1024
+)
+
+// Broker is an in-memory MQTT broker. The zero value is not usable, use New.
+type Broker struct {
+	// Logger receives the log messages of the broker. If it is nil, nothing is logged.
+	Logger *log.Logger
+
+	mu            sync.Mutex
+	sessions      map[string]*session
+	subscriptions *topic.Matcher // topic filter -> *session
+	retained      map[string]*mqtt.PublishPacket
+	listeners     map[net.Listener]struct{}
+	conns         map[*conn]struct{}
+	closed        bool
+	nextClientId  int
+	wg            sync.WaitGroup
+}
+
+func New() *Broker {
+	return &Broker{
+		sessions:      make(map[string]*session),
+		subscriptions: topic.NewMatcher(),
+		retained:      make(map[string]*mqtt.PublishPacket),
+		listeners:     make(map[net.Listener]struct{}),
+		conns:         make(map[*conn]struct{}),
+	}
+}
+
+// Serve accepts connections on the listener and serves each of them in a new goroutine. It blocks until accepting a
+// connection fails, and returns ErrBrokerClosed after Close has been called.
+func (b *Broker) Serve(ln net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		ln.Close()
+		return ErrBrokerClosed
+	}
+	b.listeners[ln] = struct{}{}
+	b.mu.Unlock()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			b.mu.Lock()
+			delete(b.listeners, ln)
+			closed := b.closed
+			b.mu.Unlock()
+
+			if closed {
+				return ErrBrokerClosed
+			}
+			return err
+		}
+		b.goServeConn(c)
+	}
+}
+
+// Pipe returns the client side of a new in-process connection to the broker.
+func (b *Broker) Pipe() net.Conn {
+	client, server := net.Pipe()
+	b.goServeConn(server)
+	return client
+}
+
+func (b *Broker) goServeConn(c net.Conn) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.ServeConn(c)
+	}()
+}
+
+// ServeConn serves the MQTT connection until it is closed.
+func (b *Broker) ServeConn(c net.Conn) {
+	cn := newConn(b, c)
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		c.Close()
+		return
+	}
+	b.conns[cn] = struct{}{}
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, cn)
+		b.mu.Unlock()
+	}()
+
+	cn.serve()
+}
+
+// Close closes all listeners and connections, and waits until the connections have been served.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	for ln := range b.listeners {
+		ln.Close()
+	}
+	for cn := range b.conns {
+		cn.conn.Close()
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	return nil
+}
+
+// Retained returns the retained message of the topic, or nil if there is none.
+func (b *Broker) Retained(topicName string) *mqtt.PublishPacket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if p, ok := b.retained[topicName]; ok {
+		return p.Clone().(*mqtt.PublishPacket)
+	}
+	return nil
+}
+
+// SessionPresent returns true if the broker has a session for the client.
+func (b *Broker) SessionPresent(clientId string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.sessions[clientId]
+	return ok
+}
+
+// Publish publishes a message to the subscribers of its topic, as if it had been published by a client.
+func (b *Broker) Publish(p *mqtt.PublishPacket) {
+	b.route(p)
+}
+
+func (b *Broker) logf(format string, v ...interface{}) {
+	if b.Logger != nil {
+		b.Logger.Printf(format, v...)
+	}
+}
+
+// delivery is a packet to be written to a connection after the broker lock has been released.
+type delivery struct {
+	conn   *conn
+	packet mqtt.Packet
+}
+
+func deliver(deliveries []delivery) {
+	for _, d := range deliveries {
+		d.conn.send(d.packet)
+	}
+}
+
+// route stores the message if it is retained, and delivers it to all sessions with matching subscriptions.
+func (b *Broker) route(p *mqtt.PublishPacket) {
+	b.mu.Lock()
+
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.TopicName)
+		} else {
+			retained := p.Clone().(*mqtt.PublishPacket)
+			retained.Dup = false
+			b.retained[p.TopicName] = retained
+		}
+	}
+
+	// a session with several matching subscriptions receives the message once, with the maximum QoS
+	var receivers []*session
+	qos := make(map[*session]mqtt.QoS)
+	for _, filter := range b.subscriptions.MatchFilters(p.TopicName) {
+		for _, v := range b.subscriptions.Values(filter) {
+			s := v.(*session)
+			q, seen := qos[s]
+			if !seen {
+				receivers = append(receivers, s)
+			}
+			if subQoS := s.subscriptions[filter]; !seen || subQoS > q {
+				qos[s] = subQoS
+			}
+		}
+	}
+
+	var deliveries []delivery
+	for _, s := range receivers {
+		message := &mqtt.PublishPacket{TopicName: p.TopicName, QoS: minQoS(p.QoS, qos[s]), Payload: p.Payload}
+		deliveries = s.enqueue(deliveries, message)
+	}
+	b.mu.Unlock()
+
+	deliver(deliveries)
+}
+
+func minQoS(a mqtt.QoS, b mqtt.QoS) mqtt.QoS {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// session is the state of a client that outlives its connections if the session is persistent.
+type session struct {
+	clientId      string
+	clean         bool
+	conn          *conn // nil if the client is not connected
+	subscriptions map[string]mqtt.QoS
+
+	packetId uint16
+	inflight []*mqtt.PublishPacket // outgoing QoS 1 and 2 messages that have not been acknowledged, in order
+	released map[uint16]struct{}   // outgoing QoS 2 messages for which a PUBREL has been sent
+	received map[uint16]struct{}   // incoming QoS 2 messages that have not been released
+}
+
+func newSession(clientId string, clean bool) *session {
+	return &session{
+		clientId:      clientId,
+		clean:         clean,
+		subscriptions: make(map[string]mqtt.QoS),
+		released:      make(map[uint16]struct{}),
+		received:      make(map[uint16]struct{}),
+	}
+}
+
+// enqueue assigns a packet identifier to QoS 1 and 2 messages and stores them until they are acknowledged, and adds
+// the message to the deliveries if the client is connected. It needs to be called with the broker lock held.
+func (s *session) enqueue(deliveries []delivery, p *mqtt.PublishPacket) []delivery {
+	if p.QoS > mqtt.QoS0 {
+		id, ok := s.allocate()
+		if !ok {
+			return deliveries // the message is dropped, like messages that exceed the queue of a real broker
+		}
+		p.PacketId = id
+		s.inflight = append(s.inflight, p)
+	}
+	if s.conn == nil {
+		return deliveries
+	}
+	deliveries = append(deliveries, delivery{s.conn, p.Clone()})
+	// the stored message is only sent again, with the DUP flag [MQTT-3.3.1-1]
+	p.Dup = true
+	return deliveries
+}
+
+func (s *session) allocate() (uint16, bool) {
+	for i := 0; i < 65535; i++ {
+		s.packetId++
+		if s.packetId == 0 {
+			s.packetId = 1
+		}
+		if !s.inUse(s.packetId) {
+			return s.packetId, true
+		}
+	}
+	return 0, false
+}
+
+func (s *session) inUse(id uint16) bool {
+	if _, ok := s.released[id]; ok {
+		return true
+	}
+	for _, p := range s.inflight {
+		if p.PacketId == id {
+			return true
+		}
+	}
+	return false
+}
+
+// acknowledge removes the message with the packet identifier from the in-flight messages, and returns false if there
+// is none.
+func (s *session) acknowledge(id uint16) bool {
+	for i, p := range s.inflight {
+		if p.PacketId == id {
+			s.inflight = append(s.inflight[:i], s.inflight[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// resume returns the packets that need to be sent when a persistent session is resumed: the unacknowledged messages
+// (with the DUP flag set if they have been sent before), and the PUBRELs of released QoS 2 messages [MQTT-4.4.0-1].
+func (s *session) resume(c *conn) []delivery {
+	var deliveries []delivery
+	for _, p := range s.inflight {
+		deliveries = append(deliveries, delivery{c, p.Clone()})
+		p.Dup = true
+	}
+	for id := range s.released {
+		deliveries = append(deliveries, delivery{c, &mqtt.PubRelPacket{PacketId: id}})
+	}
+	return deliveries
+}
+
+func (s *session) String() string {
+	return fmt.Sprintf("session(%s)", s.clientId)
+}
@@ -0,0 +1,387 @@
+package broker
+
+import (
+	"context"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testClient is a raw MQTT connection to the broker, which is scripted by the tests.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	ch   mqtt.Channel
+}
+
+func newTestBroker(t *testing.T) *Broker {
+	b := New()
+	t.Cleanup(func() { _ = b.Close() })
+	return b
+}
+
+// dial connects a new client with the CONNECT built by the builder, and returns it with the CONNACK of the broker.
+func dial(t *testing.T, b *Broker, connect *mqtt.ConnectBuilder) (*testClient, *mqtt.ConnAckPacket) {
+	t.Helper()
+
+	p, err := connect.Build()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	return dialPacket(t, b, p)
+}
+
+func dialPacket(t *testing.T, b *Broker, connect *mqtt.ConnectPacket) (*testClient, *mqtt.ConnAckPacket) {
+	t.Helper()
+
+	conn := b.Pipe()
+	c := &testClient{t: t, conn: conn, ch: mqtt.NewChannel(conn)}
+	t.Cleanup(func() { conn.Close() })
+
+	c.write(connect)
+	return c, c.read().(*mqtt.ConnAckPacket)
+}
+
+func (c *testClient) read() mqtt.Packet {
+	c.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	p, err := mqtt.ReadNextContext(ctx, c.ch)
+	if err != nil {
+		c.t.Fatal("error reading from broker", err)
+	}
+	return p
+}
+
+func (c *testClient) write(p mqtt.Packet) {
+	c.t.Helper()
+	if err := c.ch.WritePacket(p); err != nil {
+		c.t.Fatal("error writing to broker", err)
+	}
+}
+
+func (c *testClient) subscribe(id uint16, filter string, qos mqtt.QoS) *mqtt.SubAckPacket {
+	c.t.Helper()
+
+	sub, _ := mqtt.NewSubscribe(id).Add(filter, qos).Build()
+	c.write(sub)
+	return c.read().(*mqtt.SubAckPacket)
+}
+
+// sync sends a PINGREQ and waits for the PINGRESP. Since the broker sends the packets of a connection in order, all
+// packets that were routed to the client before have been read when sync returns. It fails if there are any.
+func (c *testClient) sync() {
+	c.t.Helper()
+
+	c.write(&mqtt.PingReqPacket{})
+	if p := c.read(); p.Type() != mqtt.TypePingResp {
+		c.t.Fatalf("unexpected %s", p)
+	}
+}
+
+func (c *testClient) readPublish() *mqtt.PublishPacket {
+	c.t.Helper()
+
+	p, ok := c.read().(*mqtt.PublishPacket)
+	if !ok {
+		c.t.Fatal("expected PUBLISH")
+	}
+	return p
+}
+
+func assertPublish(t *testing.T, p *mqtt.PublishPacket, topicName string, payload string, qos mqtt.QoS) {
+	t.Helper()
+	if p.TopicName != topicName || string(p.Payload) != payload || p.QoS != qos {
+		t.Errorf("expected PUBLISH to %s with payload %q and QoS %d, got %s", topicName, payload, qos, p)
+	}
+}
+
+func TestBroker_Connect_UnsupportedVersion(t *testing.T) {
+	b := newTestBroker(t)
+
+	_, connAck := dial(t, b, mqtt.NewConnect().ClientId("c").Version(mqtt.ProtocolLevel5))
+	assertIntEquals(t, int(mqtt.ConnectUnacceptableProtocolVersion), int(connAck.ReturnCode))
+}
+
+func TestBroker_Connect_EmptyClientIdWithoutCleanSession(t *testing.T) {
+	b := newTestBroker(t)
+
+	connect, _ := mqtt.NewConnect().Build()
+	connect.CleanSession = false // the builder refuses this
+	_, connAck := dialPacket(t, b, connect)
+	assertIntEquals(t, int(mqtt.ConnectIdentifierRejected), int(connAck.ReturnCode))
+}
+
+func TestBroker_PublishSubscribe(t *testing.T) {
+	b := newTestBroker(t)
+	sub, _ := dial(t, b, mqtt.NewConnect().ClientId("sub"))
+	pub, _ := dial(t, b, mqtt.NewConnect().ClientId("pub"))
+
+	subAck := sub.subscribe(1, "sensors/+/temperature", mqtt.QoS0)
+	assertIntEquals(t, 1, int(subAck.PacketId))
+	assertIntEquals(t, int(mqtt.QoS0), int(subAck.ReturnCodes[0]))
+
+	pub.write(&mqtt.PublishPacket{TopicName: "sensors/1/humidity", Payload: []byte("40")})
+	pub.write(&mqtt.PublishPacket{TopicName: "sensors/1/temperature", Payload: []byte("21.5")})
+	pub.sync()
+
+	assertPublish(t, sub.readPublish(), "sensors/1/temperature", "21.5", mqtt.QoS0)
+	sub.sync()
+}
+
+func TestBroker_PublishSubscribe_OverlappingSubscriptions(t *testing.T) {
+	b := newTestBroker(t)
+	sub, _ := dial(t, b, mqtt.NewConnect().ClientId("sub"))
+
+	sub.subscribe(1, "a/#", mqtt.QoS0)
+	sub.subscribe(2, "a/+", mqtt.QoS1)
+
+	// the message is delivered once, with the maximum QoS of the matching subscriptions
+	b.Publish(&mqtt.PublishPacket{TopicName: "a/b", QoS: mqtt.QoS2, Payload: []byte("x")})
+	p := sub.readPublish()
+	assertPublish(t, p, "a/b", "x", mqtt.QoS1)
+	sub.write(&mqtt.PubAckPacket{PacketId: p.PacketId})
+	sub.sync()
+}
+
+func TestBroker_Unsubscribe(t *testing.T) {
+	b := newTestBroker(t)
+	sub, _ := dial(t, b, mqtt.NewConnect().ClientId("sub"))
+	sub.subscribe(1, "a", mqtt.QoS0)
+
+	sub.write(&mqtt.UnsubscribePacket{PacketId: 2, TopicFilters: []string{"a"}})
+	assertIntEquals(t, 2, int(sub.read().(*mqtt.UnsubAckPacket).PacketId))
+
+	b.Publish(&mqtt.PublishPacket{TopicName: "a", Payload: []byte("x")})
+	sub.sync()
+}
+
+func TestBroker_QoS1(t *testing.T) {
+	b := newTestBroker(t)
+	sub, _ := dial(t, b, mqtt.NewConnect().ClientId("sub"))
+	pub, _ := dial(t, b, mqtt.NewConnect().ClientId("pub"))
+	sub.subscribe(1, "a", mqtt.QoS1)
+
+	pub.write(&mqtt.PublishPacket{TopicName: "a", QoS: mqtt.QoS1, PacketId: 7, Payload: []byte("x")})
+	assertIntEquals(t, 7, int(pub.read().(*mqtt.PubAckPacket).PacketId))
+
+	p := sub.readPublish()
+	assertPublish(t, p, "a", "x", mqtt.QoS1)
+	if p.PacketId == 0 {
+		t.Error("expected packet identifier")
+	}
+	sub.write(&mqtt.PubAckPacket{PacketId: p.PacketId})
+	sub.sync()
+}
+
+func TestBroker_QoS2(t *testing.T) {
+	b := newTestBroker(t)
+	sub, _ := dial(t, b, mqtt.NewConnect().ClientId("sub"))
+	pub, _ := dial(t, b, mqtt.NewConnect().ClientId("pub"))
+	sub.subscribe(1, "a", mqtt.QoS2)
+
+	// the message is delivered once, even if the publisher sends it again before releasing it
+	pub.write(&mqtt.PublishPacket{TopicName: "a", QoS: mqtt.QoS2, PacketId: 7, Payload: []byte("x")})
+	assertIntEquals(t, 7, int(pub.read().(*mqtt.PubRecPacket).PacketId))
+	pub.write(&mqtt.PublishPacket{TopicName: "a", QoS: mqtt.QoS2, PacketId: 7, Dup: true, Payload: []byte("x")})
+	assertIntEquals(t, 7, int(pub.read().(*mqtt.PubRecPacket).PacketId))
+	pub.write(&mqtt.PubRelPacket{PacketId: 7})
+	assertIntEquals(t, 7, int(pub.read().(*mqtt.PubCompPacket).PacketId))
+
+	p := sub.readPublish()
+	assertPublish(t, p, "a", "x", mqtt.QoS2)
+	sub.write(&mqtt.PubRecPacket{PacketId: p.PacketId})
+	assertIntEquals(t, int(p.PacketId), int(sub.read().(*mqtt.PubRelPacket).PacketId))
+	sub.write(&mqtt.PubCompPacket{PacketId: p.PacketId})
+	sub.sync()
+}
+
+func TestBroker_Retained(t *testing.T) {
+	b := newTestBroker(t)
+	pub, _ := dial(t, b, mqtt.NewConnect().ClientId("pub"))
+
+	pub.write(&mqtt.PublishPacket{TopicName: "status/1", Retain: true, Payload: []byte("online")})
+	pub.write(&mqtt.PublishPacket{TopicName: "status/2", Retain: true, Payload: []byte("offline")})
+	pub.sync()
+
+	// retained messages are sent after the SUBACK, with the retain flag set
+	sub, _ := dial(t, b, mqtt.NewConnect().ClientId("sub"))
+	sub.subscribe(1, "status/1", mqtt.QoS1)
+	p := sub.readPublish()
+	assertPublish(t, p, "status/1", "online", mqtt.QoS0)
+	if !p.Retain {
+		t.Error("expected retain flag")
+	}
+	sub.sync()
+
+	// messages to current subscribers are sent without the retain flag
+	pub.write(&mqtt.PublishPacket{TopicName: "status/1", Retain: true, Payload: []byte("busy")})
+	p = sub.readPublish()
+	assertPublish(t, p, "status/1", "busy", mqtt.QoS0)
+	if p.Retain {
+		t.Error("unexpected retain flag")
+	}
+	assertStringEquals(t, "busy", string(b.Retained("status/1").Payload))
+
+	// a retained message with an empty payload deletes the retained message of the topic
+	pub.write(&mqtt.PublishPacket{TopicName: "status/1", Retain: true})
+	pub.sync()
+	if r := b.Retained("status/1"); r != nil {
+		t.Error("expected retained message to be deleted, got", r)
+	}
+}
+
+func TestBroker_Will(t *testing.T) {
+	b := newTestBroker(t)
+	sub, _ := dial(t, b, mqtt.NewConnect().ClientId("sub"))
+	sub.subscribe(1, "status/#", mqtt.QoS1)
+
+	c, _ := dial(t, b, mqtt.NewConnect().ClientId("c").Will("status/c", []byte("offline"), mqtt.QoS1, false))
+	c.conn.Close()
+
+	p := sub.readPublish()
+	assertPublish(t, p, "status/c", "offline", mqtt.QoS1)
+	sub.write(&mqtt.PubAckPacket{PacketId: p.PacketId})
+}
+
+func TestBroker_Will_GracefulDisconnect(t *testing.T) {
+	b := newTestBroker(t)
+	sub, _ := dial(t, b, mqtt.NewConnect().ClientId("sub"))
+	sub.subscribe(1, "status/#", mqtt.QoS0)
+
+	c, _ := dial(t, b, mqtt.NewConnect().ClientId("c").Will("status/c", []byte("offline"), mqtt.QoS0, false))
+	c.write(&mqtt.DisconnectPacket{})
+	if _, err := c.ch.Next(); err != io.EOF {
+		t.Fatal("expected EOF, got", err)
+	}
+
+	// the will is published before the connection is closed, so it would have been routed by now
+	sub.sync()
+}
+
+func TestBroker_PersistentSession(t *testing.T) {
+	b := newTestBroker(t)
+	connect := mqtt.NewConnect().ClientId("c").CleanSession(false)
+
+	c, connAck := dial(t, b, connect)
+	if connAck.SessionPresent {
+		t.Error("unexpected session present")
+	}
+	c.subscribe(1, "a", mqtt.QoS1)
+
+	b.Publish(&mqtt.PublishPacket{TopicName: "a", QoS: mqtt.QoS1, Payload: []byte("1")})
+	first := c.readPublish()
+	c.conn.Close() // without acknowledging the message
+
+	b.Publish(&mqtt.PublishPacket{TopicName: "a", QoS: mqtt.QoS1, Payload: []byte("2")})
+
+	c, connAck = dial(t, b, connect)
+	if !connAck.SessionPresent {
+		t.Error("expected session present")
+	}
+
+	// the unacknowledged message is sent again with the DUP flag and the same packet identifier
+	p := c.readPublish()
+	assertPublish(t, p, "a", "1", mqtt.QoS1)
+	assertIntEquals(t, int(first.PacketId), int(p.PacketId))
+	if !p.Dup {
+		t.Error("expected DUP flag")
+	}
+	c.write(&mqtt.PubAckPacket{PacketId: p.PacketId})
+
+	p = c.readPublish()
+	assertPublish(t, p, "a", "2", mqtt.QoS1)
+	c.write(&mqtt.PubAckPacket{PacketId: p.PacketId})
+	c.sync()
+}
+
+func TestBroker_CleanSession(t *testing.T) {
+	b := newTestBroker(t)
+
+	c, _ := dial(t, b, mqtt.NewConnect().ClientId("c").CleanSession(false))
+	c.subscribe(1, "a", mqtt.QoS1)
+	c.write(&mqtt.DisconnectPacket{})
+	_, _ = c.ch.Next()
+
+	// a clean session discards the previous session
+	c, connAck := dial(t, b, mqtt.NewConnect().ClientId("c"))
+	if connAck.SessionPresent {
+		t.Error("unexpected session present")
+	}
+	b.Publish(&mqtt.PublishPacket{TopicName: "a", Payload: []byte("x")})
+	c.sync()
+
+	c.write(&mqtt.DisconnectPacket{})
+	_, _ = c.ch.Next()
+	if b.SessionPresent("c") {
+		t.Error("expected clean session to be removed")
+	}
+}
+
+func TestBroker_Takeover(t *testing.T) {
+	b := newTestBroker(t)
+
+	first, _ := dial(t, b, mqtt.NewConnect().ClientId("c"))
+	second, _ := dial(t, b, mqtt.NewConnect().ClientId("c"))
+
+	if _, err := first.ch.Next(); err != io.EOF {
+		t.Error("expected first connection to be closed, got", err)
+	}
+	second.sync()
+}
+
+func TestBroker_SharedSubscriptionsRefused(t *testing.T) {
+	b := newTestBroker(t)
+	c, _ := dial(t, b, mqtt.NewConnect().ClientId("c"))
+
+	sub, _ := mqtt.NewSubscribe(1).Add("$share/g/a", mqtt.QoS0).Add("a", mqtt.QoS1).Build()
+	c.write(sub)
+	subAck := c.read().(*mqtt.SubAckPacket)
+	assertIntEquals(t, int(mqtt.Failure), int(subAck.ReturnCodes[0]))
+	assertIntEquals(t, int(mqtt.QoS1), int(subAck.ReturnCodes[1]))
+}
+
+func TestBroker_Serve(t *testing.T) {
+	b := New()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- b.Serve(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testClient{t: t, conn: conn, ch: mqtt.NewChannel(conn)}
+	connect, _ := mqtt.NewConnect().ClientId("c").Build()
+	c.write(connect)
+	assertIntEquals(t, int(mqtt.ConnectAccepted), int(c.read().(*mqtt.ConnAckPacket).ReturnCode))
+
+	_ = b.Close()
+	if err := <-errs; err != ErrBrokerClosed {
+		t.Error("expected ErrBrokerClosed, got", err)
+	}
+	if _, err := c.ch.Next(); err == nil {
+		t.Error("expected connection to be closed")
+	}
+}
+
+func assertIntEquals(t *testing.T, expected int, actual int) {
+	t.Helper()
+	if expected != actual {
+		t.Errorf("expected %d, got %d", expected, actual)
+	}
+}
+
+func assertStringEquals(t *testing.T, expected string, actual string) {
+	t.Helper()
+	if expected != actual {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
@@ -0,0 +1,328 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/topic"
+	"net"
+	"sync"
+	"time"
+)
+
+// conn is a client connection. Packets for the client are queued in the outbox, and written by a separate goroutine,
+// so that routing a message never waits for a slow client while holding the broker lock.
+type conn struct {
+	broker  *Broker
+	conn    net.Conn
+	channel mqtt.Channel
+	outbox  chan mqtt.Packet
+	done    chan struct{}
+	once    sync.Once
+
+	session   *session
+	connect   *mqtt.ConnectPacket
+	keepAlive time.Duration
+}
+
+func newConn(b *Broker, c net.Conn) *conn {
+	return &conn{
+		broker:  b,
+		conn:    c,
+		channel: mqtt.NewChannel(c),
+		outbox:  make(chan mqtt.Packet, outboxSize),
+		done:    make(chan struct{}),
+	}
+}
+
+// send queues the packet for the client. It is dropped if the connection has been closed.
+func (c *conn) send(p mqtt.Packet) {
+	select {
+	case c.outbox <- p:
+	case <-c.done:
+	}
+}
+
+func (c *conn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *conn) write() {
+	for {
+		select {
+		case p := <-c.outbox:
+			if err := c.channel.WritePacket(p); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *conn) serve() {
+	defer c.close()
+	go c.write()
+
+	if err := c.handshake(); err != nil {
+		c.broker.logf("closing connection %s: %v", c.conn.RemoteAddr(), err)
+		return
+	}
+
+	err := c.run()
+	graceful := err == nil
+	if !graceful {
+		c.broker.logf("closing connection of %s: %v", c.session.clientId, err)
+	}
+	c.broker.detach(c, graceful)
+}
+
+// handshake reads the CONNECT, attaches the connection to the session of the client, and sends the CONNACK.
+func (c *conn) handshake() error {
+	_ = c.conn.SetReadDeadline(time.Now().Add(ConnectTimeout))
+	packet, err := mqtt.ReadNext(c.channel)
+	_ = c.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		var protocolErr *mqtt.ProtocolError
+		if errors.As(err, &protocolErr) && protocolErr.Type == mqtt.TypeConnect && protocolErr.Field == "ClientId" {
+			// the decoder refuses an empty client identifier without clean session [MQTT-3.1.3-9]. The connection is
+			// closed right away, so the CONNACK is written directly.
+			_ = c.channel.WritePacket(&mqtt.ConnAckPacket{ReturnCode: mqtt.ConnectIdentifierRejected})
+		}
+		return err
+	}
+
+	connect, ok := packet.(*mqtt.ConnectPacket)
+	if !ok {
+		return fmt.Errorf("expected CONNECT, got %s", packet.Type())
+	}
+	if connect.ProtocolLevel != mqtt.ProtocolLevel31 && connect.ProtocolLevel != mqtt.ProtocolLevel311 {
+		_ = c.channel.WritePacket(&mqtt.ConnAckPacket{ReturnCode: mqtt.ConnectUnacceptableProtocolVersion})
+		return fmt.Errorf("unsupported protocol level %d", connect.ProtocolLevel)
+	}
+	if err = mqtt.ValidatePacket(connect); err != nil {
+		return err
+	}
+
+	c.connect = connect
+	c.keepAlive = time.Duration(connect.KeepAlive) * time.Second
+	c.broker.attach(c)
+	return nil
+}
+
+// run handles the packets of the client until it disconnects (returning nil) or an error occurs.
+func (c *conn) run() error {
+	for {
+		if c.keepAlive > 0 {
+			// the connection is closed if the client sends no packet within one and a half times the keep alive
+			// [MQTT-3.1.2-24]
+			_ = c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		}
+
+		packet, err := mqtt.ReadNext(c.channel)
+		if err != nil {
+			return err
+		}
+		if _, ok := packet.(*mqtt.DisconnectPacket); ok {
+			return nil
+		}
+		if err = c.handle(packet); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *conn) handle(packet mqtt.Packet) error {
+	b := c.broker
+	s := c.session
+
+	switch p := packet.(type) {
+	case *mqtt.PublishPacket:
+		if err := mqtt.ValidatePacket(p); err != nil {
+			return err
+		}
+		switch p.QoS {
+		case mqtt.QoS0:
+			b.route(p)
+		case mqtt.QoS1:
+			b.route(p)
+			c.send(&mqtt.PubAckPacket{PacketId: p.PacketId})
+		default:
+			b.mu.Lock()
+			_, duplicate := s.received[p.PacketId]
+			s.received[p.PacketId] = struct{}{}
+			b.mu.Unlock()
+
+			if !duplicate {
+				b.route(p)
+			}
+			c.send(&mqtt.PubRecPacket{PacketId: p.PacketId})
+		}
+
+	case *mqtt.PubRelPacket:
+		b.mu.Lock()
+		delete(s.received, p.PacketId)
+		b.mu.Unlock()
+		c.send(&mqtt.PubCompPacket{PacketId: p.PacketId})
+
+	case *mqtt.PubAckPacket:
+		b.mu.Lock()
+		s.acknowledge(p.PacketId)
+		b.mu.Unlock()
+
+	case *mqtt.PubRecPacket:
+		b.mu.Lock()
+		if s.acknowledge(p.PacketId) {
+			s.released[p.PacketId] = struct{}{}
+		}
+		b.mu.Unlock()
+		c.send(&mqtt.PubRelPacket{PacketId: p.PacketId})
+
+	case *mqtt.PubCompPacket:
+		b.mu.Lock()
+		delete(s.released, p.PacketId)
+		b.mu.Unlock()
+
+	case *mqtt.SubscribePacket:
+		if err := mqtt.ValidatePacket(p); err != nil {
+			return err
+		}
+		b.subscribe(c, p)
+
+	case *mqtt.UnsubscribePacket:
+		if err := mqtt.ValidatePacket(p); err != nil {
+			return err
+		}
+		b.unsubscribe(s, p.TopicFilters)
+		c.send(&mqtt.UnsubAckPacket{PacketId: p.PacketId})
+
+	case *mqtt.PingReqPacket:
+		c.send(&mqtt.PingRespPacket{})
+
+	default:
+		return fmt.Errorf("unexpected %s packet", packet.Type())
+	}
+	return nil
+}
+
+// attach attaches the connection to the session of the client, taking over the session from an existing connection.
+// A clean session replaces the previous session of the client. The CONNACK is sent before any message of the session.
+func (b *Broker) attach(c *conn) {
+	connect := c.connect
+
+	b.mu.Lock()
+	if connect.ClientId == "" {
+		b.nextClientId++
+		connect.ClientId = fmt.Sprintf("broker-generated-%d", b.nextClientId)
+	}
+
+	s, sessionPresent := b.sessions[connect.ClientId]
+	if sessionPresent && s.conn != nil {
+		// the existing client is disconnected [MQTT-3.1.4-2]
+		s.conn.close()
+	}
+	if sessionPresent && connect.CleanSession {
+		b.removeSession(s)
+		sessionPresent = false
+	}
+	if !sessionPresent {
+		s = newSession(connect.ClientId, connect.CleanSession)
+		b.sessions[connect.ClientId] = s
+	}
+	s.clean = connect.CleanSession
+	s.conn = c
+	c.session = s
+
+	// the outbox of the new connection is empty, so this does not block
+	c.send(&mqtt.ConnAckPacket{SessionPresent: sessionPresent})
+	deliveries := s.resume(c)
+	b.mu.Unlock()
+
+	deliver(deliveries)
+}
+
+// detach detaches the connection from its session, publishes the will of the client if it did not disconnect
+// gracefully, and removes clean sessions.
+func (b *Broker) detach(c *conn, graceful bool) {
+	b.mu.Lock()
+	s := c.session
+	current := s.conn == c
+	if current {
+		s.conn = nil
+		if s.clean {
+			b.removeSession(s)
+		}
+	}
+	b.mu.Unlock()
+
+	if !graceful && c.connect.WillFlag {
+		b.route(&mqtt.PublishPacket{
+			TopicName: c.connect.WillTopic,
+			QoS:       c.connect.WillQoS,
+			Retain:    c.connect.WillRetain,
+			Payload:   c.connect.WillMessage,
+		})
+	}
+}
+
+// removeSession removes the session and its subscriptions. It needs to be called with the broker lock held.
+func (b *Broker) removeSession(s *session) {
+	for filter := range s.subscriptions {
+		b.subscriptions.Remove(filter, s)
+	}
+	if b.sessions[s.clientId] == s {
+		delete(b.sessions, s.clientId)
+	}
+}
+
+// subscribe adds the subscriptions of the client, sends the SUBACK, and then the retained messages that match the
+// filters [MQTT-3.3.1-6].
+func (b *Broker) subscribe(c *conn, p *mqtt.SubscribePacket) {
+	s := c.session
+	subAck := &mqtt.SubAckPacket{PacketId: p.PacketId, ReturnCodes: make([]mqtt.SubAckCode, len(p.Subscriptions))}
+
+	b.mu.Lock()
+	var retained []*mqtt.PublishPacket
+	for i, sub := range p.Subscriptions {
+		if topic.IsShared(sub.TopicFilter) {
+			subAck.ReturnCodes[i] = mqtt.Failure
+			continue
+		}
+
+		s.subscriptions[sub.TopicFilter] = sub.QoS
+		_ = b.subscriptions.Add(sub.TopicFilter, s)
+		subAck.ReturnCodes[i] = sub.QoS
+
+		for name, message := range b.retained {
+			if topic.Match(sub.TopicFilter, name) {
+				r := message.Clone().(*mqtt.PublishPacket)
+				r.QoS = minQoS(r.QoS, sub.QoS)
+				retained = append(retained, r)
+			}
+		}
+	}
+
+	deliveries := []delivery{{c, subAck}}
+	for _, r := range retained {
+		deliveries = s.enqueue(deliveries, r)
+	}
+	b.mu.Unlock()
+
+	deliver(deliveries)
+}
+
+func (b *Broker) unsubscribe(s *session, filters []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, filter := range filters {
+		if _, ok := s.subscriptions[filter]; ok {
+			delete(s.subscriptions, filter)
+			b.subscriptions.Remove(filter, s)
+		}
+	}
+}
@@ -0,0 +1,772 @@
+// Package client implements an MQTT 3.1.1 client on top of the codecs of package mqtt.
+//
+// A Client connects to a broker (or to the proxy), publishes messages with QoS 0, 1 and 2, and dispatches the messages
+// of its subscriptions to per-filter handlers. It sends PINGREQ packets to keep the connection alive, and reconnects
+// (and subscribes again) when the connection is lost, e.g.:
+//
+//	c := client.New("127.0.0.1:1883", "sensor-1")
+//	if err := c.Connect(ctx); err != nil { ... }
+//	_, err := c.Subscribe(ctx, "commands/sensor-1/#", mqtt.QoS1, func(c *client.Client, p *mqtt.PublishPacket) { ... })
+//	err = c.Publish(ctx, "sensors/1/temperature", []byte("21.5"), mqtt.QoS1, false)
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/topic"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotConnected is returned by operations that require a connection while the client is not connected.
+	ErrNotConnected = errors.New("client: not connected")
+	// ErrConnectionLost is returned by operations that were waiting for an acknowledgement when the connection was lost,
+	// unless the client continues them after reconnecting.
+	ErrConnectionLost = errors.New("client: connection lost")
+	// ErrClosed is returned after Disconnect has been called.
+	ErrClosed = errors.New("client: closed")
+	// ErrKeepAliveTimeout is the cause of a lost connection if the broker did not answer a PINGREQ in time.
+	ErrKeepAliveTimeout = errors.New("client: keep alive timeout")
+	// ErrNoPacketIds is returned if all packet identifiers are in use by unacknowledged packets.
+	ErrNoPacketIds = mqtt.ErrNoPacketIds
+	// ErrSubscriptionRefused is returned by Subscribe if the broker refused the subscription.
+	ErrSubscriptionRefused = errors.New("client: subscription refused")
+)
+
+// ConnectError is returned by Connect if the broker refused the connection.
+type ConnectError struct {
+	ReturnCode byte
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("client: connection refused with return code %d", e.ReturnCode)
+}
+
+// MessageHandler is called with the messages of a subscription. Handlers are called by the goroutine that reads from
+// the connection, so they should not block, and must not wait for acknowledgements (e.g., by publishing with QoS > 0).
+type MessageHandler func(c *Client, p *mqtt.PublishPacket)
+
+// Client is an MQTT client. Its exported fields configure the connection and need to be set before Connect is called.
+// The methods of a Client are safe for concurrent use.
+type Client struct {
+	// Address is the TCP address of the broker.
+	Address string
+	// Dial opens the connection to the broker. If it is nil, the client connects to Address via TCP.
+	Dial func(ctx context.Context) (net.Conn, error)
+
+	ClientId     string
+	CleanSession bool
+	UserName     string
+	Password     []byte
+	// Will is published by the broker if the connection of the client is closed without a DISCONNECT.
+	Will *mqtt.PublishPacket
+
+	// KeepAlive is the maximum time between two packets sent by the client. The client sends a PINGREQ if it has
+	// nothing else to send, and closes the connection if the broker does not answer within KeepAlive. 0 disables
+	// keep alive.
+	KeepAlive time.Duration
+	// ConnectTimeout is the maximum time to wait for the CONNACK. 0 means no timeout.
+	ConnectTimeout time.Duration
+
+	// AutoReconnect enables reconnecting when the connection is lost. After reconnecting, the client subscribes to all
+	// filters again, unless the broker has kept the session.
+	AutoReconnect bool
+	// ReconnectDelay is the time to wait between two attempts to reconnect.
+	ReconnectDelay time.Duration
+
+	// MaxInFlight is the maximum number of QoS 1 and 2 messages that wait for their acknowledgement. Publish blocks
+	// while it is reached. 0 means 65535, the maximum.
+	MaxInFlight uint16
+	// RetryTimeout is the time after which packets that have not been acknowledged are sent again. 0 disables
+	// retransmission while connected; unacknowledged packets are always sent again after reconnecting.
+	RetryTimeout time.Duration
+
+	// DefaultHandler is called with messages that match none of the subscriptions (e.g., of a persistent session).
+	DefaultHandler MessageHandler
+	// OnConnectionLost is called when the connection is lost, before reconnecting.
+	OnConnectionLost func(c *Client, err error)
+
+	mu       sync.Mutex
+	conn     *connection
+	closed   bool
+	inflight *mqtt.InFlightWindow
+	pending  map[uint16]chan mqtt.Packet // waiting for PUBACK, PUBCOMP, SUBACK or UNSUBACK
+	subs     map[string]*subscription
+	handlers *topic.Matcher      // topic filter -> *subscription
+	received map[uint16]struct{} // ids of QoS 2 messages that have been received, but not released
+	// the SUBSCRIBE requests of a session that the broker has discarded, which wait for the subscriptions to be restored
+	restoring []*restoredSubscribe
+}
+
+type restoredSubscribe struct {
+	packet *mqtt.SubscribePacket
+	ack    chan mqtt.Packet
+}
+
+type subscription struct {
+	filter  string
+	qos     mqtt.QoS
+	handler MessageHandler
+}
+
+// connection is a connection to the broker. A new connection is created for every reconnect.
+type connection struct {
+	conn    net.Conn
+	channel mqtt.Channel
+	writeMu sync.Mutex
+	done    chan struct{} // closed when the connection is lost or closed
+
+	pingMu       sync.Mutex
+	pingPending  bool
+	pingSent     time.Time
+	lastActivity time.Time
+}
+
+// New returns a client for the broker at the given address, with a clean session, a keep alive of one minute,
+// automatic reconnects, and a retry timeout of 30 seconds.
+func New(address string, clientId string) *Client {
+	return &Client{
+		Address:        address,
+		ClientId:       clientId,
+		CleanSession:   true,
+		KeepAlive:      time.Minute,
+		ConnectTimeout: 10 * time.Second,
+		AutoReconnect:  true,
+		ReconnectDelay: time.Second,
+		RetryTimeout:   30 * time.Second,
+	}
+}
+
+// Connect connects to the broker and waits for the CONNACK. It returns a ConnectError if the broker refused the
+// connection.
+func (c *Client) Connect(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.init()
+	c.mu.Unlock()
+
+	_, err := c.connect(ctx)
+	return err
+}
+
+// IsConnected returns true if the client currently has a connection to the broker.
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// Disconnect sends a DISCONNECT and closes the connection. The client can not be used afterwards.
+func (c *Client) Disconnect() error {
+	c.mu.Lock()
+	c.closed = true
+	cn := c.conn
+	if cn == nil {
+		// the requests that wait for a reconnect fail
+		c.failPending()
+	}
+	c.mu.Unlock()
+
+	if cn == nil {
+		return nil
+	}
+	err := cn.write(&mqtt.DisconnectPacket{})
+	c.lost(cn, ErrClosed)
+	return err
+}
+
+// init initializes the internal state. It needs to be called with c.mu held.
+func (c *Client) init() {
+	if c.pending == nil {
+		c.inflight = mqtt.NewInFlightWindow(c.MaxInFlight, c.RetryTimeout)
+		c.pending = make(map[uint16]chan mqtt.Packet)
+		c.subs = make(map[string]*subscription)
+		c.handlers = topic.NewMatcher()
+		c.received = make(map[uint16]struct{})
+	}
+}
+
+func (c *Client) connectPacket() (*mqtt.ConnectPacket, error) {
+	b := mqtt.NewConnect().
+		ClientId(c.ClientId).
+		CleanSession(c.CleanSession).
+		KeepAlive(uint16(c.KeepAlive / time.Second))
+	if c.Will != nil {
+		b.Will(c.Will.TopicName, c.Will.Payload, c.Will.QoS, c.Will.Retain)
+	}
+	if c.UserName != "" {
+		b.Credentials(c.UserName, c.Password)
+	}
+	return b.Build()
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	if c.Dial != nil {
+		return c.Dial(ctx)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", c.Address)
+}
+
+// connect opens a new connection, and returns whether the broker has kept the session.
+func (c *Client) connect(ctx context.Context) (sessionPresent bool, err error) {
+	connect, err := c.connectPacket()
+	if err != nil {
+		return false, err
+	}
+
+	if c.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.ConnectTimeout)
+		defer cancel()
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	cn := &connection{conn: conn, channel: mqtt.NewChannel(conn), done: make(chan struct{})}
+
+	connAck, err := cn.handshake(ctx, connect)
+	if err != nil {
+		conn.Close()
+		return false, err
+	}
+	if connAck.ReturnCode != mqtt.ConnectAccepted {
+		conn.Close()
+		return false, &ConnectError{connAck.ReturnCode}
+	}
+
+	// the flows that have not been completed on the previous connection are continued [MQTT-4.4.0-1], before the
+	// connection is used for new requests
+	resend := c.inflight.Resend(time.Now())
+	if !connAck.SessionPresent {
+		resend = c.discardSession(resend)
+	}
+	for _, p := range resend {
+		if err = cn.write(p); err != nil {
+			conn.Close()
+			return false, err
+		}
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return false, ErrClosed
+	}
+	c.conn = cn
+	if !connAck.SessionPresent {
+		// the broker does not know about QoS 2 messages of a previous session
+		c.received = make(map[uint16]struct{})
+	}
+	c.mu.Unlock()
+
+	go c.run(cn)
+	if c.KeepAlive > 0 {
+		go c.keepAlive(cn)
+	}
+	if c.RetryTimeout > 0 {
+		go c.retry(cn)
+	}
+	return connAck.SessionPresent, nil
+}
+
+// discardSession removes the flows of a session that the broker has discarded from the packets to resend, and returns
+// the remaining packets. A PUBREL would refer to a message that the broker does not know anymore, so the flow is
+// complete, since the broker has already received the message. An UNSUBSCRIBE is complete, since the new session has
+// no subscriptions. A SUBSCRIBE waits for resubscribe, which subscribes to its filters again.
+func (c *Client) discardSession(packets []mqtt.Packet) []mqtt.Packet {
+	var resend []mqtt.Packet
+	for _, packet := range packets {
+		var ack mqtt.Packet
+		switch p := packet.(type) {
+		case *mqtt.PubRelPacket:
+			ack = &mqtt.PubCompPacket{PacketId: p.PacketId}
+		case *mqtt.UnsubscribePacket:
+			ack = &mqtt.UnsubAckPacket{PacketId: p.PacketId}
+		case *mqtt.SubscribePacket:
+			c.mu.Lock()
+			if ch, ok := c.pending[p.PacketId]; ok {
+				delete(c.pending, p.PacketId)
+				c.restoring = append(c.restoring, &restoredSubscribe{p, ch})
+			}
+			c.mu.Unlock()
+			c.inflight.Remove(p.PacketId)
+			continue
+		default:
+			resend = append(resend, packet)
+			continue
+		}
+		id, _ := mqtt.PacketId(ack)
+		c.complete(ack)
+		c.inflight.Remove(id)
+	}
+	return resend
+}
+
+// handshake sends the CONNECT and reads the CONNACK.
+func (cn *connection) handshake(ctx context.Context, connect *mqtt.ConnectPacket) (*mqtt.ConnAckPacket, error) {
+	if err := cn.channel.(mqtt.ContextWriter).WritePacketContext(ctx, connect); err != nil {
+		return nil, err
+	}
+	packet, err := mqtt.ReadNextContext(ctx, cn.channel)
+	if err != nil {
+		return nil, err
+	}
+	connAck, ok := packet.(*mqtt.ConnAckPacket)
+	if !ok {
+		return nil, fmt.Errorf("client: expected CONNACK, got %s", packet.Type())
+	}
+	return connAck, nil
+}
+
+func (cn *connection) write(packet mqtt.Packet) error {
+	cn.writeMu.Lock()
+	defer cn.writeMu.Unlock()
+
+	cn.pingMu.Lock()
+	cn.lastActivity = time.Now()
+	cn.pingMu.Unlock()
+
+	return cn.channel.WritePacket(packet)
+}
+
+// run reads and handles the packets of the connection until it fails.
+func (c *Client) run(cn *connection) {
+	for {
+		packet, err := mqtt.ReadNext(cn.channel)
+		if err != nil {
+			c.lost(cn, err)
+			return
+		}
+		if err = c.handle(cn, packet); err != nil {
+			c.lost(cn, err)
+			return
+		}
+	}
+}
+
+func (c *Client) handle(cn *connection, packet mqtt.Packet) error {
+	switch p := packet.(type) {
+	case *mqtt.PublishPacket:
+		return c.receive(cn, p)
+	case *mqtt.PubRelPacket:
+		c.mu.Lock()
+		delete(c.received, p.PacketId)
+		c.mu.Unlock()
+		return cn.write(&mqtt.PubCompPacket{PacketId: p.PacketId})
+	case *mqtt.PubRecPacket:
+		c.inflight.Acknowledge(p)
+		return cn.write(&mqtt.PubRelPacket{PacketId: p.PacketId})
+	case *mqtt.PubAckPacket, *mqtt.PubCompPacket, *mqtt.SubAckPacket, *mqtt.UnsubAckPacket:
+		if _, done := c.inflight.Acknowledge(p); done {
+			c.complete(packet)
+		}
+	case *mqtt.PingRespPacket:
+		cn.pingMu.Lock()
+		cn.pingPending = false
+		cn.pingMu.Unlock()
+	default:
+		return fmt.Errorf("client: unexpected %s packet", packet.Type())
+	}
+	return nil
+}
+
+// receive dispatches an incoming message, and acknowledges it according to its QoS. QoS 2 messages are dispatched only
+// once, even if the broker sends them again before releasing them.
+func (c *Client) receive(cn *connection, p *mqtt.PublishPacket) error {
+	switch p.QoS {
+	case mqtt.QoS0:
+		c.dispatch(p)
+		return nil
+	case mqtt.QoS1:
+		c.dispatch(p)
+		return cn.write(&mqtt.PubAckPacket{PacketId: p.PacketId})
+	default:
+		c.mu.Lock()
+		_, duplicate := c.received[p.PacketId]
+		c.received[p.PacketId] = struct{}{}
+		c.mu.Unlock()
+
+		if !duplicate {
+			c.dispatch(p)
+		}
+		return cn.write(&mqtt.PubRecPacket{PacketId: p.PacketId})
+	}
+}
+
+func (c *Client) dispatch(p *mqtt.PublishPacket) {
+	matches := c.handlers.Match(p.TopicName)
+	if len(matches) == 0 {
+		if c.DefaultHandler != nil {
+			c.DefaultHandler(c, p)
+		}
+		return
+	}
+	for i, v := range matches {
+		sub := v.(*subscription)
+		if i+1 < len(matches) && matches[i+1].(*subscription).filter == sub.filter {
+			// the subscription is being replaced by the next one, which has been added to the same filter
+			continue
+		}
+		sub.handler(c, p)
+	}
+}
+
+// lost closes the connection. If the client has not been closed and reconnects automatically, it reconnects in the
+// background, and the operations that are waiting for acknowledgements are continued on the new connection. Otherwise,
+// they fail.
+func (c *Client) lost(cn *connection, err error) {
+	c.mu.Lock()
+	if c.conn != cn {
+		c.mu.Unlock()
+		return
+	}
+	c.conn = nil
+	close(cn.done)
+	cn.conn.Close()
+
+	reconnect := c.AutoReconnect && !c.closed
+	if !reconnect {
+		c.failPending()
+	}
+	c.mu.Unlock()
+
+	if err == ErrClosed {
+		return
+	}
+	if c.OnConnectionLost != nil {
+		c.OnConnectionLost(c, err)
+	}
+	if reconnect {
+		go c.reconnect()
+	}
+}
+
+// failPending fails all operations that are waiting for acknowledgements. It needs to be called with c.mu held.
+func (c *Client) failPending() {
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+		c.inflight.Remove(id)
+	}
+	for _, r := range c.restoring {
+		close(r.ack)
+	}
+	c.restoring = nil
+}
+
+// reconnect connects again until it succeeds or the client is closed, and then restores the subscriptions.
+func (c *Client) reconnect() {
+	for {
+		time.Sleep(c.ReconnectDelay)
+
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+
+		sessionPresent, err := c.connect(context.Background())
+		if err != nil {
+			log.Println("client: error reconnecting", err)
+			continue
+		}
+		c.mu.Lock()
+		restore := !sessionPresent || len(c.restoring) > 0
+		c.mu.Unlock()
+		if restore {
+			c.resubscribe()
+		}
+		return
+	}
+}
+
+// resubscribe subscribes to all filters again, and completes the SUBSCRIBE requests of the discarded session with the
+// return codes of their filters.
+func (c *Client) resubscribe() {
+	c.mu.Lock()
+	restoring := c.restoring
+	c.restoring = nil
+	subscribe := &mqtt.SubscribePacket{}
+	for _, sub := range c.subs {
+		subscribe.Subscriptions = append(subscribe.Subscriptions, mqtt.Subscription{TopicFilter: sub.filter, QoS: sub.qos})
+	}
+	c.mu.Unlock()
+
+	codes := make(map[string]mqtt.SubAckCode)
+	if len(subscribe.Subscriptions) > 0 {
+		ack, err := c.request(context.Background(), subscribe)
+		if err != nil {
+			log.Println("client: error restoring subscriptions", err)
+			for _, r := range restoring {
+				close(r.ack)
+			}
+			return
+		}
+		for i, code := range ack.(*mqtt.SubAckPacket).ReturnCodes {
+			if i < len(subscribe.Subscriptions) {
+				codes[subscribe.Subscriptions[i].TopicFilter] = code
+			}
+		}
+	}
+
+	for _, r := range restoring {
+		subAck := &mqtt.SubAckPacket{PacketId: r.packet.PacketId}
+		for _, sub := range r.packet.Subscriptions {
+			code, ok := codes[sub.TopicFilter]
+			if !ok {
+				// the filter has been unsubscribed in the meantime
+				code = mqtt.Failure
+			}
+			subAck.ReturnCodes = append(subAck.ReturnCodes, code)
+		}
+		r.ack <- subAck
+	}
+}
+
+// retry sends the packets again that have not been acknowledged within the retry timeout, until the connection is lost.
+func (c *Client) retry(cn *connection) {
+	ticker := time.NewTicker(c.RetryTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cn.done:
+			return
+		case now := <-ticker.C:
+			for _, p := range c.inflight.Expired(now) {
+				if err := cn.write(p); err != nil {
+					c.lost(cn, err)
+					return
+				}
+			}
+		}
+	}
+}
+
+// keepAlive sends a PINGREQ whenever the client has not sent a packet for half of the keep alive interval, and closes
+// the connection if the broker does not answer a PINGREQ within the keep alive interval.
+func (c *Client) keepAlive(cn *connection) {
+	ticker := time.NewTicker(c.KeepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cn.done:
+			return
+		case <-ticker.C:
+		}
+
+		cn.pingMu.Lock()
+		timeout := cn.pingPending && time.Since(cn.pingSent) >= c.KeepAlive
+		ping := !cn.pingPending && time.Since(cn.lastActivity) >= c.KeepAlive/2
+		if ping {
+			cn.pingPending = true
+			cn.pingSent = time.Now()
+		}
+		cn.pingMu.Unlock()
+
+		if timeout {
+			c.lost(cn, ErrKeepAliveTimeout)
+			return
+		}
+		if ping {
+			if err := cn.write(&mqtt.PingReqPacket{}); err != nil {
+				c.lost(cn, err)
+				return
+			}
+		}
+	}
+}
+
+// Publish publishes a message. With QoS 1 it waits for the PUBACK, with QoS 2 for the PUBCOMP.
+func (c *Client) Publish(ctx context.Context, topicName string, payload []byte, qos mqtt.QoS, retain bool) error {
+	p := &mqtt.PublishPacket{TopicName: topicName, QoS: qos, Retain: retain, Payload: payload}
+	if qos == mqtt.QoS0 {
+		if err := mqtt.ValidatePacket(p); err != nil {
+			return err
+		}
+		cn, err := c.connection()
+		if err != nil {
+			return err
+		}
+		return cn.write(p)
+	}
+
+	_, err := c.request(ctx, p)
+	return err
+}
+
+// Subscribe subscribes to the topic filter, and calls the handler with the messages of the subscription. It returns the
+// QoS granted by the broker, or ErrSubscriptionRefused. Subscribing to a filter again replaces its handler.
+func (c *Client) Subscribe(ctx context.Context, filter string, qos mqtt.QoS, handler MessageHandler) (mqtt.QoS, error) {
+	if err := topic.ValidateFilter(filter); err != nil {
+		return 0, err
+	}
+
+	// the handler is registered first, since messages may arrive before the SUBACK. The handler of an existing
+	// subscription is removed after the new one has been added, so that no message is missed in between.
+	sub := &subscription{filter, qos, handler}
+	c.mu.Lock()
+	c.init()
+	old := c.subs[filter]
+	c.subs[filter] = sub
+	c.mu.Unlock()
+	_ = c.handlers.Add(handlerFilter(filter), sub)
+	if old != nil {
+		c.handlers.Remove(handlerFilter(filter), old)
+	}
+
+	ack, err := c.request(ctx, &mqtt.SubscribePacket{Subscriptions: []mqtt.Subscription{{TopicFilter: filter, QoS: qos}}})
+	var code mqtt.SubAckCode
+	if err == nil {
+		if codes := ack.(*mqtt.SubAckPacket).ReturnCodes; len(codes) != 1 {
+			err = &mqtt.ProtocolError{Type: mqtt.TypeSubAck, Field: "ReturnCodes",
+				Reason: fmt.Sprintf("expected 1 return code, got %d", len(codes)), Rule: "MQTT-3.8.4-5"}
+		} else if code = codes[0]; code == mqtt.Failure {
+			err = ErrSubscriptionRefused
+		}
+	}
+	if err != nil {
+		c.removeSubscription(sub)
+		return 0, err
+	}
+	return code, nil
+}
+
+// Unsubscribe removes the subscriptions to the filters, and waits for the UNSUBACK.
+func (c *Client) Unsubscribe(ctx context.Context, filters ...string) error {
+	c.mu.Lock()
+	c.init()
+	var subs []*subscription
+	for _, filter := range filters {
+		if sub, ok := c.subs[filter]; ok {
+			subs = append(subs, sub)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, sub := range subs {
+		c.removeSubscription(sub)
+	}
+	_, err := c.request(ctx, &mqtt.UnsubscribePacket{TopicFilters: filters})
+	return err
+}
+
+func (c *Client) removeSubscription(sub *subscription) {
+	c.mu.Lock()
+	if c.subs[sub.filter] == sub {
+		delete(c.subs, sub.filter)
+	}
+	c.mu.Unlock()
+	c.handlers.Remove(handlerFilter(sub.filter), sub)
+}
+
+// handlerFilter returns the filter that the topics of the messages of a subscription match: the topic filter of
+// shared subscriptions, since their messages are published to the topics without the "$share/{group}/" prefix.
+func handlerFilter(filter string) string {
+	if _, topicFilter, err := topic.ParseShared(filter); err == nil {
+		return topicFilter
+	}
+	return filter
+}
+
+func (c *Client) connection() (*connection, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if c.conn == nil {
+		return nil, ErrNotConnected
+	}
+	return c.conn, nil
+}
+
+// request assigns a packet identifier to the packet, sends it, and waits for the acknowledgement that completes the
+// flow. It waits while the maximum number of messages are in flight.
+func (c *Client) request(ctx context.Context, packet mqtt.Packet) (mqtt.Packet, error) {
+	if _, err := c.connection(); err != nil {
+		return nil, err
+	}
+	id, err := c.inflight.Add(ctx, packet)
+	if err != nil {
+		return nil, err
+	}
+
+	// the connection may have been lost while waiting for the window
+	c.mu.Lock()
+	cn := c.conn
+	if c.closed || cn == nil {
+		closed := c.closed
+		c.mu.Unlock()
+		c.inflight.Remove(id)
+		if closed {
+			return nil, ErrClosed
+		}
+		return nil, ErrNotConnected
+	}
+	ack := make(chan mqtt.Packet, 1)
+	c.pending[id] = ack
+	c.mu.Unlock()
+
+	if err := mqtt.ValidatePacket(packet); err != nil {
+		c.release(id)
+		return nil, err
+	}
+	if err := cn.write(packet); err != nil {
+		c.release(id)
+		c.lost(cn, err)
+		return nil, err
+	}
+
+	select {
+	case p, ok := <-ack:
+		if !ok {
+			return nil, ErrConnectionLost
+		}
+		return p, nil
+	case <-ctx.Done():
+		c.release(id)
+		return nil, ctx.Err()
+	}
+}
+
+// release stops waiting for the acknowledgement. The identifier is only released if the request still owns it, since
+// it may have been reused after the flow has been completed or discarded in the meantime.
+func (c *Client) release(id uint16) {
+	c.mu.Lock()
+	_, ok := c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+	if ok {
+		c.inflight.Remove(id)
+	}
+}
+
+// complete passes the acknowledgement to the request that waits for it.
+func (c *Client) complete(ack mqtt.Packet) {
+	id, _ := mqtt.PacketId(ack)
+
+	c.mu.Lock()
+	ch, ok := c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+
+	if ok {
+		ch <- ack
+	}
+}
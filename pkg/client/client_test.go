@@ -0,0 +1,656 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+)
+
+// testBroker is the broker side of the connections of a client, which is scripted by the tests.
+type testBroker struct {
+	t     *testing.T
+	conns chan net.Conn
+	conn  net.Conn // the last accepted connection
+}
+
+func newTestClient(t *testing.T) (*Client, *testBroker) {
+	b := &testBroker{t: t, conns: make(chan net.Conn, 4)}
+	c := New("", "test-client")
+	c.ReconnectDelay = 10 * time.Millisecond
+	c.Dial = func(ctx context.Context) (net.Conn, error) {
+		client, broker := net.Pipe()
+		b.conns <- broker
+		return client, nil
+	}
+	return c, b
+}
+
+// accept returns the next connection of the client after reading its CONNECT and answering with the CONNACK. The
+// packets of the client are decoded in strict mode, so that every test checks that they follow the specification.
+func (b *testBroker) accept(connAck *mqtt.ConnAckPacket) (mqtt.Channel, *mqtt.ConnectPacket) {
+	b.t.Helper()
+
+	select {
+	case b.conn = <-b.conns:
+	case <-time.After(time.Second):
+		b.t.Fatal("client did not connect")
+	}
+	streamer := mqtt.NewDecodingStreamer(b.conn)
+	streamer.SetStrict(true)
+	ch := mqtt.NewCodecChannel(streamer, mqtt.NewEncoder(b.conn))
+	connect := b.read(ch).(*mqtt.ConnectPacket)
+	b.write(ch, connAck)
+	return ch, connect
+}
+
+// close closes the connection and the client.
+func (b *testBroker) close(c *Client) {
+	if b.conn != nil {
+		b.conn.Close()
+	}
+	_ = c.Disconnect()
+}
+
+func (b *testBroker) read(ch mqtt.Channel) mqtt.Packet {
+	b.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	p, err := mqtt.ReadNextContext(ctx, ch)
+	if err != nil {
+		b.t.Fatal("error reading from client", err)
+	}
+	return p
+}
+
+func (b *testBroker) write(ch mqtt.Channel, p mqtt.Packet) {
+	b.t.Helper()
+	if err := ch.WritePacket(p); err != nil {
+		b.t.Fatal("error writing to client", err)
+	}
+}
+
+// connect connects the client and returns the broker side of the connection.
+func connect(t *testing.T, c *Client, b *testBroker) mqtt.Channel {
+	t.Helper()
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.Connect(context.Background()) }()
+	ch, _ := b.accept(&mqtt.ConnAckPacket{})
+	if err := <-errs; err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	return ch
+}
+
+func async(fn func() error) chan error {
+	errs := make(chan error, 1)
+	go func() { errs <- fn() }()
+	return errs
+}
+
+func await(t *testing.T, errs chan error) error {
+	t.Helper()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+		return nil
+	}
+}
+
+func TestClient_Connect(t *testing.T) {
+	c, b := newTestClient(t)
+	c.KeepAlive = 30 * time.Second
+	c.UserName = "user"
+	c.Password = []byte("secret")
+	c.Will = &mqtt.PublishPacket{TopicName: "status", Payload: []byte("offline"), QoS: mqtt.QoS1, Retain: true}
+	defer b.close(c)
+
+	errs := async(func() error { return c.Connect(context.Background()) })
+	_, connect := b.accept(&mqtt.ConnAckPacket{})
+	if err := await(t, errs); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	expected, _ := mqtt.NewConnect().ClientId("test-client").KeepAlive(30).
+		Will("status", []byte("offline"), mqtt.QoS1, true).Credentials("user", []byte("secret")).Build()
+	if !expected.Equal(connect) {
+		t.Errorf("unexpected CONNECT %s", connect)
+	}
+	if !c.IsConnected() {
+		t.Error("expected client to be connected")
+	}
+}
+
+func TestClient_Connect_Refused(t *testing.T) {
+	c, b := newTestClient(t)
+
+	errs := async(func() error { return c.Connect(context.Background()) })
+	b.accept(&mqtt.ConnAckPacket{ReturnCode: mqtt.ConnectNotAuthorized})
+
+	var e *ConnectError
+	if err := await(t, errs); !errors.As(err, &e) || e.ReturnCode != mqtt.ConnectNotAuthorized {
+		t.Error("expected ConnectError, got", err)
+	}
+	if c.IsConnected() {
+		t.Error("expected client not to be connected")
+	}
+}
+
+func TestClient_Publish_NotConnected(t *testing.T) {
+	c, _ := newTestClient(t)
+	if err := c.Publish(context.Background(), "a", nil, mqtt.QoS1, false); err != ErrNotConnected {
+		t.Error("expected ErrNotConnected, got", err)
+	}
+}
+
+func TestClient_Publish_QoS0(t *testing.T) {
+	c, b := newTestClient(t)
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	errs := async(func() error { return c.Publish(context.Background(), "a/b", []byte("hi"), mqtt.QoS0, true) })
+	p := b.read(ch).(*mqtt.PublishPacket)
+	if err := await(t, errs); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	expected := &mqtt.PublishPacket{TopicName: "a/b", Retain: true, Payload: []byte("hi")}
+	if !expected.Equal(p) {
+		t.Errorf("unexpected PUBLISH %s", p)
+	}
+}
+
+func TestClient_Publish_QoS1(t *testing.T) {
+	c, b := newTestClient(t)
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	errs := async(func() error { return c.Publish(context.Background(), "a/b", []byte("hi"), mqtt.QoS1, false) })
+	p := b.read(ch).(*mqtt.PublishPacket)
+	if p.QoS != mqtt.QoS1 || p.PacketId == 0 {
+		t.Fatalf("unexpected PUBLISH %s", p)
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatal("publish returned before PUBACK", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	b.write(ch, &mqtt.PubAckPacket{PacketId: p.PacketId})
+	if err := await(t, errs); err != nil {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestClient_Publish_QoS2(t *testing.T) {
+	c, b := newTestClient(t)
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	errs := async(func() error { return c.Publish(context.Background(), "a/b", []byte("hi"), mqtt.QoS2, false) })
+	p := b.read(ch).(*mqtt.PublishPacket)
+
+	b.write(ch, &mqtt.PubRecPacket{PacketId: p.PacketId})
+	rel := b.read(ch).(*mqtt.PubRelPacket)
+	assertIntEquals(t, int(p.PacketId), int(rel.PacketId))
+
+	b.write(ch, &mqtt.PubCompPacket{PacketId: p.PacketId})
+	if err := await(t, errs); err != nil {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestClient_Publish_ContextDone(t *testing.T) {
+	c, b := newTestClient(t)
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := async(func() error { return c.Publish(ctx, "a/b", nil, mqtt.QoS1, false) })
+	p := b.read(ch).(*mqtt.PublishPacket)
+	cancel()
+	if err := await(t, errs); err != context.Canceled {
+		t.Error("expected context.Canceled, got", err)
+	}
+
+	// a late acknowledgement is ignored
+	b.write(ch, &mqtt.PubAckPacket{PacketId: p.PacketId})
+	errs = async(func() error { return c.Publish(context.Background(), "a/b", nil, mqtt.QoS0, false) })
+	b.read(ch)
+	if err := await(t, errs); err != nil {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestClient_Publish_MaxInFlight(t *testing.T) {
+	c, b := newTestClient(t)
+	c.MaxInFlight = 1
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	first := async(func() error { return c.Publish(context.Background(), "a", []byte("1"), mqtt.QoS1, false) })
+	p := b.read(ch).(*mqtt.PublishPacket)
+
+	// the second message is sent when the first has been acknowledged
+	second := async(func() error { return c.Publish(context.Background(), "a", []byte("2"), mqtt.QoS1, false) })
+	select {
+	case err := <-second:
+		t.Fatal("publish returned before the window had room", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	b.write(ch, &mqtt.PubAckPacket{PacketId: p.PacketId})
+	if err := await(t, first); err != nil {
+		t.Error("unexpected error", err)
+	}
+	p = b.read(ch).(*mqtt.PublishPacket)
+	assertStringEquals(t, "2", string(p.Payload))
+	b.write(ch, &mqtt.PubAckPacket{PacketId: p.PacketId})
+	if err := await(t, second); err != nil {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestClient_Subscribe(t *testing.T) {
+	c, b := newTestClient(t)
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	messages := make(chan string, 10)
+	handler := func(prefix string) MessageHandler {
+		return func(c *Client, p *mqtt.PublishPacket) {
+			messages <- prefix + ":" + p.TopicName + ":" + string(p.Payload)
+		}
+	}
+
+	var granted mqtt.QoS
+	errs := async(func() (err error) {
+		granted, err = c.Subscribe(context.Background(), "a/+", mqtt.QoS2, handler("plus"))
+		return
+	})
+	sub := b.read(ch).(*mqtt.SubscribePacket)
+	assertStringEquals(t, "a/+", sub.Subscriptions[0].TopicFilter)
+	b.write(ch, &mqtt.SubAckPacket{PacketId: sub.PacketId, ReturnCodes: []mqtt.SubAckCode{mqtt.MaxQoS1}})
+	if err := await(t, errs); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertIntEquals(t, int(mqtt.MaxQoS1), int(granted))
+
+	errs = async(func() error {
+		_, err := c.Subscribe(context.Background(), "a/#", mqtt.QoS0, handler("hash"))
+		return err
+	})
+	sub = b.read(ch).(*mqtt.SubscribePacket)
+	b.write(ch, &mqtt.SubAckPacket{PacketId: sub.PacketId, ReturnCodes: []mqtt.SubAckCode{mqtt.MaxQoS0}})
+	if err := await(t, errs); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	b.write(ch, &mqtt.PublishPacket{TopicName: "a/b", QoS: mqtt.QoS1, PacketId: 7, Payload: []byte("1")})
+	assertIntEquals(t, 7, int(b.read(ch).(*mqtt.PubAckPacket).PacketId))
+	assertMessages(t, messages, "hash:a/b:1", "plus:a/b:1")
+
+	b.write(ch, &mqtt.PublishPacket{TopicName: "a/b/c", Payload: []byte("2")})
+	assertMessages(t, messages, "hash:a/b/c:2")
+
+	// unsubscribe
+	errs = async(func() error { return c.Unsubscribe(context.Background(), "a/#") })
+	unsub := b.read(ch).(*mqtt.UnsubscribePacket)
+	b.write(ch, &mqtt.UnsubAckPacket{PacketId: unsub.PacketId})
+	if err := await(t, errs); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	b.write(ch, &mqtt.PublishPacket{TopicName: "a/b/c", Payload: []byte("3")})
+	b.write(ch, &mqtt.PublishPacket{TopicName: "a/b", Payload: []byte("4")})
+	assertMessages(t, messages, "plus:a/b:4")
+}
+
+func TestClient_Subscribe_Replace(t *testing.T) {
+	c, b := newTestClient(t)
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	messages := make(chan string, 10)
+	handler := func(prefix string) MessageHandler {
+		return func(c *Client, p *mqtt.PublishPacket) {
+			messages <- prefix + ":" + string(p.Payload)
+		}
+	}
+	subscribe := func(prefix string) {
+		errs := async(func() error {
+			_, err := c.Subscribe(context.Background(), "a", mqtt.QoS0, handler(prefix))
+			return err
+		})
+		sub := b.read(ch).(*mqtt.SubscribePacket)
+		// a message that arrives before the SUBACK is passed to the new handler
+		b.write(ch, &mqtt.PublishPacket{TopicName: "a", Payload: []byte(prefix)})
+		b.write(ch, &mqtt.SubAckPacket{PacketId: sub.PacketId, ReturnCodes: []mqtt.SubAckCode{mqtt.MaxQoS0}})
+		if err := await(t, errs); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+
+	subscribe("old")
+	assertMessages(t, messages, "old:old")
+	subscribe("new")
+	assertMessages(t, messages, "new:new")
+}
+
+func TestClient_Subscribe_Shared(t *testing.T) {
+	c, b := newTestClient(t)
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	messages := make(chan string, 10)
+	errs := async(func() error {
+		_, err := c.Subscribe(context.Background(), "$share/g/a/+", mqtt.QoS0, func(c *Client, p *mqtt.PublishPacket) {
+			messages <- p.TopicName
+		})
+		return err
+	})
+	sub := b.read(ch).(*mqtt.SubscribePacket)
+	assertStringEquals(t, "$share/g/a/+", sub.Subscriptions[0].TopicFilter)
+	b.write(ch, &mqtt.SubAckPacket{PacketId: sub.PacketId, ReturnCodes: []mqtt.SubAckCode{mqtt.MaxQoS0}})
+	if err := await(t, errs); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	// messages of shared subscriptions are published to the topics without the share prefix
+	b.write(ch, &mqtt.PublishPacket{TopicName: "a/b", Payload: []byte("1")})
+	assertMessages(t, messages, "a/b")
+}
+
+func TestClient_Subscribe_Refused(t *testing.T) {
+	c, b := newTestClient(t)
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	errs := async(func() error {
+		_, err := c.Subscribe(context.Background(), "a", mqtt.QoS0, func(*Client, *mqtt.PublishPacket) {})
+		return err
+	})
+	sub := b.read(ch).(*mqtt.SubscribePacket)
+	b.write(ch, &mqtt.SubAckPacket{PacketId: sub.PacketId, ReturnCodes: []mqtt.SubAckCode{mqtt.Failure}})
+	if err := await(t, errs); err != ErrSubscriptionRefused {
+		t.Error("expected ErrSubscriptionRefused, got", err)
+	}
+	assertIntEquals(t, 0, c.handlers.Len())
+}
+
+func TestClient_Subscribe_EmptySubAck(t *testing.T) {
+	c, b := newTestClient(t)
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	errs := async(func() error {
+		_, err := c.Subscribe(context.Background(), "a", mqtt.QoS0, func(*Client, *mqtt.PublishPacket) {})
+		return err
+	})
+	sub := b.read(ch).(*mqtt.SubscribePacket)
+	b.write(ch, &mqtt.SubAckPacket{PacketId: sub.PacketId})
+	var protocolErr *mqtt.ProtocolError
+	if err := await(t, errs); !errors.As(err, &protocolErr) {
+		t.Error("expected ProtocolError, got", err)
+	}
+	assertIntEquals(t, 0, c.handlers.Len())
+}
+
+func TestClient_ReceiveQoS2(t *testing.T) {
+	c, b := newTestClient(t)
+	messages := make(chan string, 10)
+	c.DefaultHandler = func(c *Client, p *mqtt.PublishPacket) {
+		messages <- string(p.Payload)
+	}
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	p := &mqtt.PublishPacket{TopicName: "a", QoS: mqtt.QoS2, PacketId: 3, Payload: []byte("once")}
+	b.write(ch, p)
+	assertIntEquals(t, 3, int(b.read(ch).(*mqtt.PubRecPacket).PacketId))
+
+	// the broker sends the message again, since it has not received the PUBREC
+	p.Dup = true
+	b.write(ch, p)
+	assertIntEquals(t, 3, int(b.read(ch).(*mqtt.PubRecPacket).PacketId))
+
+	b.write(ch, &mqtt.PubRelPacket{PacketId: 3})
+	assertIntEquals(t, 3, int(b.read(ch).(*mqtt.PubCompPacket).PacketId))
+	assertMessages(t, messages, "once")
+}
+
+func TestClient_KeepAlive(t *testing.T) {
+	c, b := newTestClient(t)
+	c.KeepAlive = 50 * time.Millisecond
+	c.AutoReconnect = false
+	lost := make(chan error, 1)
+	c.OnConnectionLost = func(c *Client, err error) { lost <- err }
+	ch := connect(t, c, b)
+
+	_ = b.read(ch).(*mqtt.PingReqPacket)
+	b.write(ch, &mqtt.PingRespPacket{})
+
+	// the second PINGREQ is not answered
+	_ = b.read(ch).(*mqtt.PingReqPacket)
+	if err := await(t, lost); err != ErrKeepAliveTimeout {
+		t.Error("expected ErrKeepAliveTimeout, got", err)
+	}
+	if c.IsConnected() {
+		t.Error("expected client not to be connected")
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	c, b := newTestClient(t)
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	errs := async(func() error {
+		_, err := c.Subscribe(context.Background(), "a/+", mqtt.QoS1, func(*Client, *mqtt.PublishPacket) {})
+		return err
+	})
+	sub := b.read(ch).(*mqtt.SubscribePacket)
+	b.write(ch, &mqtt.SubAckPacket{PacketId: sub.PacketId, ReturnCodes: []mqtt.SubAckCode{mqtt.MaxQoS1}})
+	if err := await(t, errs); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	b.conn.Close()
+
+	// the client reconnects and subscribes again
+	ch, _ = b.accept(&mqtt.ConnAckPacket{})
+	sub = b.read(ch).(*mqtt.SubscribePacket)
+	expected := []mqtt.Subscription{{TopicFilter: "a/+", QoS: mqtt.QoS1}}
+	if !(&mqtt.SubscribePacket{PacketId: sub.PacketId, Subscriptions: expected}).Equal(sub) {
+		t.Errorf("unexpected SUBSCRIBE %s", sub)
+	}
+}
+
+func TestClient_Reconnect_InFlight(t *testing.T) {
+	c, b := newTestClient(t)
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	qos1 := async(func() error { return c.Publish(context.Background(), "a", []byte("1"), mqtt.QoS1, false) })
+	first := b.read(ch).(*mqtt.PublishPacket)
+	qos2 := async(func() error { return c.Publish(context.Background(), "b", []byte("2"), mqtt.QoS2, false) })
+	second := b.read(ch).(*mqtt.PublishPacket)
+	b.write(ch, &mqtt.PubRecPacket{PacketId: second.PacketId})
+	_ = b.read(ch).(*mqtt.PubRelPacket)
+
+	// the connection is lost before the flows are complete
+	b.conn.Close()
+	select {
+	case err := <-qos1:
+		t.Fatal("publish returned after the connection was lost", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// after reconnecting, the client sends the PUBLISH again with the DUP flag, and the PUBREL of the QoS 2 flow, before
+	// the connection can be used for other packets
+	ch, _ = b.accept(&mqtt.ConnAckPacket{SessionPresent: true})
+	errs := async(func() error { return c.Publish(context.Background(), "c", nil, mqtt.QoS0, false) })
+	if err := await(t, errs); err != ErrNotConnected {
+		t.Error("expected ErrNotConnected, got", err)
+	}
+	p := b.read(ch).(*mqtt.PublishPacket)
+	first.Dup = true
+	if !first.Equal(p) {
+		t.Errorf("expected %s, got %s", first, p)
+	}
+	assertIntEquals(t, int(second.PacketId), int(b.read(ch).(*mqtt.PubRelPacket).PacketId))
+
+	b.write(ch, &mqtt.PubAckPacket{PacketId: p.PacketId})
+	b.write(ch, &mqtt.PubCompPacket{PacketId: second.PacketId})
+	if err := await(t, qos1); err != nil {
+		t.Error("unexpected error", err)
+	}
+	if err := await(t, qos2); err != nil {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestClient_Reconnect_SessionDiscarded(t *testing.T) {
+	c, b := newTestClient(t)
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	var granted mqtt.QoS
+	subscribe := async(func() (err error) {
+		granted, err = c.Subscribe(context.Background(), "a/+", mqtt.QoS1, func(*Client, *mqtt.PublishPacket) {})
+		return
+	})
+	_ = b.read(ch).(*mqtt.SubscribePacket)
+	unsubscribe := async(func() error { return c.Unsubscribe(context.Background(), "b") })
+	_ = b.read(ch).(*mqtt.UnsubscribePacket)
+	publish := async(func() error { return c.Publish(context.Background(), "c", nil, mqtt.QoS2, false) })
+	p := b.read(ch).(*mqtt.PublishPacket)
+	b.write(ch, &mqtt.PubRecPacket{PacketId: p.PacketId})
+	_ = b.read(ch).(*mqtt.PubRelPacket)
+
+	b.conn.Close()
+
+	// the broker has discarded the session: the PUBREL and the UNSUBSCRIBE are not sent again, and the SUBSCRIBE is
+	// replaced by the one that restores the subscriptions
+	ch, _ = b.accept(&mqtt.ConnAckPacket{})
+	sub := b.read(ch).(*mqtt.SubscribePacket)
+	expected := []mqtt.Subscription{{TopicFilter: "a/+", QoS: mqtt.QoS1}}
+	if !(&mqtt.SubscribePacket{PacketId: sub.PacketId, Subscriptions: expected}).Equal(sub) {
+		t.Errorf("unexpected SUBSCRIBE %s", sub)
+	}
+	b.write(ch, &mqtt.SubAckPacket{PacketId: sub.PacketId, ReturnCodes: []mqtt.SubAckCode{mqtt.MaxQoS1}})
+
+	for _, errs := range []chan error{subscribe, unsubscribe, publish} {
+		if err := await(t, errs); err != nil {
+			t.Error("unexpected error", err)
+		}
+	}
+	assertIntEquals(t, int(mqtt.MaxQoS1), int(granted))
+
+	errs := async(func() error { return c.Publish(context.Background(), "d", nil, mqtt.QoS0, false) })
+	assertStringEquals(t, "d", b.read(ch).(*mqtt.PublishPacket).TopicName)
+	if err := await(t, errs); err != nil {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestClient_Reconnect_Disconnect(t *testing.T) {
+	c, b := newTestClient(t)
+	c.ReconnectDelay = time.Hour
+	ch := connect(t, c, b)
+
+	errs := async(func() error { return c.Publish(context.Background(), "a", nil, mqtt.QoS1, false) })
+	b.read(ch)
+	b.conn.Close()
+	for c.IsConnected() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the publish that waits for the reconnect fails when the client is closed
+	_ = c.Disconnect()
+	if err := await(t, errs); err != ErrConnectionLost {
+		t.Error("expected ErrConnectionLost, got", err)
+	}
+}
+
+func TestClient_RetryTimeout(t *testing.T) {
+	c, b := newTestClient(t)
+	c.RetryTimeout = 20 * time.Millisecond
+	ch := connect(t, c, b)
+	defer b.close(c)
+
+	errs := async(func() error { return c.Publish(context.Background(), "a", nil, mqtt.QoS1, false) })
+	p := b.read(ch).(*mqtt.PublishPacket)
+
+	// the PUBACK is missing, so the client sends the PUBLISH again on the same connection
+	dup := b.read(ch).(*mqtt.PublishPacket)
+	if !dup.Dup || dup.PacketId != p.PacketId {
+		t.Errorf("unexpected PUBLISH %s", dup)
+	}
+	b.write(ch, &mqtt.PubAckPacket{PacketId: p.PacketId})
+	if err := await(t, errs); err != nil {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestClient_Disconnect(t *testing.T) {
+	c, b := newTestClient(t)
+	ch := connect(t, c, b)
+
+	errs := async(c.Disconnect)
+	_ = b.read(ch).(*mqtt.DisconnectPacket)
+	if err := await(t, errs); err != nil {
+		t.Error("unexpected error", err)
+	}
+	if err := c.Publish(context.Background(), "a", nil, mqtt.QoS0, false); err != ErrClosed {
+		t.Error("expected ErrClosed, got", err)
+	}
+	if err := c.Connect(context.Background()); err != ErrClosed {
+		t.Error("expected ErrClosed, got", err)
+	}
+}
+
+func assertMessages(t *testing.T, messages chan string, expected ...string) {
+	t.Helper()
+
+	received := make(map[string]bool)
+	for range expected {
+		select {
+		case m := <-messages:
+			received[m] = true
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for messages", expected)
+		}
+	}
+	for _, m := range expected {
+		if !received[m] {
+			t.Errorf("expected message %s, got %v", m, received)
+		}
+	}
+	select {
+	case m := <-messages:
+		t.Error("unexpected message", m)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func assertIntEquals(t *testing.T, expected int, actual int) {
+	t.Helper()
+	if expected != actual {
+		t.Errorf("expected %d, got %d", expected, actual)
+	}
+}
+
+func assertStringEquals(t *testing.T, expected string, actual string) {
+	t.Helper()
+	if expected != actual {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
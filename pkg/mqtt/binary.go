@@ -4,29 +4,47 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"io"
 	"math"
 )
 
 const cMask = 0b10000000 // 128 -- mask for continuation bit in variable integer
 const dMask = 0b01111111 // 127 -- mask for data in variable integer
 
+// ErrVariableByteIntegerTooLong is returned when a variable byte integer is encoded in more than four bytes.
+var ErrVariableByteIntegerTooLong = errors.New("variable byte integer exceeds four bytes")
+
+// Uint16 reads a big endian uint16 from the buffer. It panics if the buffer holds less than two bytes, use ReadUint16
+// if the buffer length has not been checked.
 func Uint16(buf *bytes.Buffer) uint16 {
 	return binary.BigEndian.Uint16(buf.Next(2))
 }
 
+// ReadUint16 reads a big endian uint16 from the buffer, or returns io.ErrUnexpectedEOF if the buffer is too short.
+func ReadUint16(buf *bytes.Buffer) (uint16, error) {
+	if buf.Len() < 2 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return Uint16(buf), nil
+}
+
 func PutUint16(buf *bytes.Buffer, val uint16) {
 	buf.WriteByte(byte(val >> 8))
 	buf.WriteByte(byte(val))
 }
 
 func LengthEncodedString(buf *bytes.Buffer) (str string, err error) {
-	strLen := int(Uint16(buf))
+	n, err := ReadUint16(buf)
+	if err != nil {
+		return
+	}
+	strLen := int(n)
 	if strLen == 0 {
 		return
 	}
 
 	if buf.Len() < strLen {
-		err = errors.New("buffer too short")
+		err = io.ErrUnexpectedEOF
 		return
 	}
 
@@ -49,14 +67,18 @@ func PutLengthEncodedString(buf *bytes.Buffer, str string) {
 }
 
 func LengthEncodedField(buf *bytes.Buffer) (field []byte, err error) {
-	fieldLen := int(Uint16(buf))
+	n, err := ReadUint16(buf)
+	if err != nil {
+		return
+	}
+	fieldLen := int(n)
 	if fieldLen == 0 {
 		field = []byte{}
 		return
 	}
 
 	if buf.Len() < fieldLen {
-		err = errors.New("buffer to short")
+		err = io.ErrUnexpectedEOF
 		return
 	}
 
@@ -89,7 +111,7 @@ func PutLengthEncodedField(buf *bytes.Buffer, field []byte) {
 func VariableByteUint32(buf *bytes.Buffer) (result uint32, err error) {
 	var b byte
 
-	for read := 0; read <= 4; read++ {
+	for read := 0; read < 4; read++ {
 		b, err = buf.ReadByte()
 		if err != nil {
 			return
@@ -98,11 +120,21 @@ func VariableByteUint32(buf *bytes.Buffer) (result uint32, err error) {
 		result += uint32(b&dMask) << (7 * read)
 
 		if b&cMask == 0 {
-			break
+			return
 		}
 	}
 
-	return
+	return 0, ErrVariableByteIntegerTooLong
+}
+
+// VariableByteUint32Size returns the number of bytes needed to encode the value as variable byte integer.
+func VariableByteUint32Size(val uint32) int {
+	n := 1
+	for val > dMask {
+		val >>= 7
+		n++
+	}
+	return n
 }
 
 func PutVariableByteUint32(buf *bytes.Buffer, val uint32) {
@@ -191,3 +191,21 @@ func TestPutVariableByteUint32(t *testing.T) {
 		t.Error("unexpected buffer length ", buf.Len())
 	}
 }
+
+func TestLengthEncodedString_ShortBuffer(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{0, 4, 77, 81})
+
+	_, err := LengthEncodedString(buf)
+	if err != io.ErrUnexpectedEOF {
+		t.Error("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
+
+func TestLengthEncodedString_MissingLength(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{0})
+
+	_, err := LengthEncodedString(buf)
+	if err != io.ErrUnexpectedEOF {
+		t.Error("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
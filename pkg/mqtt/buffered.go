@@ -0,0 +1,151 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultBufferSize is the buffer size of a BufferedEncoder created with a size <= 0.
+const DefaultBufferSize = 32 * 1024
+
+// BufferedEncoder is an Encoder that coalesces multiple packets into a single write to the underlying writer, to avoid
+// sending many small TCP segments. Buffered packets are written when the buffer exceeds its size, when Flush is called,
+// or (if a linger duration is set) at most the linger duration after the first packet was buffered.
+//
+// Like a bufio.Writer, a BufferedEncoder remembers the first write error, which is then returned by all subsequent
+// calls. Unlike an Encoder, it is safe for concurrent use.
+type BufferedEncoder struct {
+	w      io.Writer
+	size   int
+	linger time.Duration
+
+	mu    sync.Mutex
+	buf   *bytes.Buffer // packets that have not been flushed yet
+	enc   *Encoder      // encodes packets into buf
+	timer *time.Timer   // flushes the buffer after the linger duration, nil if not running
+	err   error         // the first write error
+}
+
+// NewBufferedEncoder creates a new BufferedEncoder that writes to w once more than size bytes have been buffered. If
+// linger is > 0, buffered packets are also written after the linger duration has passed. Otherwise they are only
+// written when the buffer is full or by Flush.
+func NewBufferedEncoder(w io.Writer, size int, linger time.Duration) *BufferedEncoder {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	return &BufferedEncoder{
+		w:      w,
+		size:   size,
+		linger: linger,
+		buf:    buf,
+		enc:    NewEncoder(buf),
+	}
+}
+
+// WritePacket encodes the packet into the buffer, and writes the buffer if it is full.
+func (b *BufferedEncoder) WritePacket(packet Packet) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+	n := b.buf.Len()
+	if err := b.enc.WritePacket(packet); err != nil {
+		b.buf.Truncate(n) // discard what has been written of an incomplete packet
+		return err
+	}
+	return b.buffered()
+}
+
+// ReadPacketFrom reads the next packet from the reader into the buffer, and writes the buffer if it is full.
+func (b *BufferedEncoder) ReadPacketFrom(r Reader) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+	n := b.buf.Len()
+	if err := b.enc.ReadPacketFrom(r); err != nil {
+		b.buf.Truncate(n) // discard what has been written of an incomplete packet
+		return err
+	}
+	return b.buffered()
+}
+
+// WritePublishStream writes all buffered packets, and then the PUBLISH packet directly to the underlying writer (see
+// Encoder.WritePublishStream), so that the payload is not buffered.
+func (b *BufferedEncoder) WritePublishStream(ps *PublishStream) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.flush(); err != nil {
+		return err
+	}
+	if err := NewEncoder(b.w).WritePublishStream(ps); err != nil {
+		b.err = err
+	}
+	return b.err
+}
+
+// Flush writes all buffered packets to the underlying writer.
+func (b *BufferedEncoder) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.flush()
+}
+
+// Buffered returns the number of bytes that have not been flushed yet.
+func (b *BufferedEncoder) Buffered() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Len()
+}
+
+// buffered is called after a packet has been written into the buffer. It writes the buffer if it is full, or otherwise
+// makes sure the linger timer is running.
+func (b *BufferedEncoder) buffered() error {
+	if b.buf.Len() >= b.size {
+		return b.flush()
+	}
+
+	if b.linger > 0 && b.timer == nil {
+		b.timer = time.AfterFunc(b.linger, b.lingerFlush)
+	}
+	return nil
+}
+
+func (b *BufferedEncoder) lingerFlush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.timer = nil
+	_ = b.flush() // the error is returned by the next call
+}
+
+func (b *BufferedEncoder) flush() error {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	if b.err != nil {
+		return b.err
+	}
+	if b.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := b.buf.WriteTo(b.w)
+	if err != nil {
+		b.err = err
+	}
+	return err
+}
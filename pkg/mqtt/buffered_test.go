@@ -0,0 +1,200 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingWriter records every call to Write.
+type recordingWriter struct {
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.writes = append(w.writes, append([]byte{}, p...))
+	return len(p), nil
+}
+
+func (w *recordingWriter) numWrites() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.writes)
+}
+
+func TestBufferedEncoder_Flush(t *testing.T) {
+	w := &recordingWriter{}
+	enc := NewBufferedEncoder(w, 1024, 0)
+
+	for i := 0; i < 3; i++ {
+		if err := enc.WritePacket(&PublishPacket{TopicName: "test", Payload: []byte("test")}); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+	assertIntEquals(t, 0, w.numWrites())
+	assertIntEquals(t, 3*len(publishPacketBytes), enc.Buffered())
+
+	if err := enc.Flush(); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	assertIntEquals(t, 1, w.numWrites())
+	expected := bytes.Repeat(publishPacketBytes, 3)
+	if !bytes.Equal(expected, w.writes[0]) {
+		t.Errorf("unexpected output %v", w.writes[0])
+	}
+	assertIntEquals(t, 0, enc.Buffered())
+}
+
+func TestBufferedEncoder_FlushesWhenFull(t *testing.T) {
+	w := &recordingWriter{}
+	enc := NewBufferedEncoder(w, 2*len(publishPacketBytes), 0)
+
+	for i := 0; i < 3; i++ {
+		if err := enc.WritePacket(&PublishPacket{TopicName: "test", Payload: []byte("test")}); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+
+	assertIntEquals(t, 1, w.numWrites())
+	assertIntEquals(t, 2*len(publishPacketBytes), len(w.writes[0]))
+	assertIntEquals(t, len(publishPacketBytes), enc.Buffered())
+}
+
+func TestBufferedEncoder_Linger(t *testing.T) {
+	w := &recordingWriter{}
+	enc := NewBufferedEncoder(w, 1024, 10*time.Millisecond)
+
+	if err := enc.WritePacket(&PingReqPacket{}); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertIntEquals(t, 0, w.numWrites())
+
+	deadline := time.Now().Add(time.Second)
+	for w.numWrites() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assertIntEquals(t, 1, w.numWrites())
+	if !bytes.Equal([]byte{192, 0}, w.writes[0]) {
+		t.Errorf("unexpected output %v", w.writes[0])
+	}
+}
+
+func TestBufferedEncoder_ReadPacketFrom(t *testing.T) {
+	w := &recordingWriter{}
+	enc := NewBufferedEncoder(w, 1024, 0)
+
+	src := NewDecodingStreamer(bytes.NewReader(publishPacketBytes))
+	if _, err := src.Next(); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if err := Copy(src, enc); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	assertIntEquals(t, 1, w.numWrites())
+	if !bytes.Equal(publishPacketBytes, w.writes[0]) {
+		t.Errorf("unexpected output %v", w.writes[0])
+	}
+}
+
+func TestBufferedEncoder_ReadPacketFrom_DiscardsIncompletePacket(t *testing.T) {
+	enc := NewBufferedEncoder(ioutil.Discard, 1024, 0)
+
+	src := NewDecodingStreamer(bytes.NewReader(publishPacketBytes[:8]))
+	if _, err := src.Next(); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if err := Copy(src, enc); err == nil {
+		t.Fatal("expected error")
+	}
+
+	assertIntEquals(t, 0, enc.Buffered())
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestBufferedEncoder_StickyError(t *testing.T) {
+	enc := NewBufferedEncoder(errWriter{}, 1024, 0)
+
+	if err := enc.WritePacket(&PingReqPacket{}); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if err := enc.Flush(); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatal("expected io.ErrClosedPipe, got", err)
+	}
+	if err := enc.WritePacket(&PingReqPacket{}); !errors.Is(err, io.ErrClosedPipe) {
+		t.Error("expected io.ErrClosedPipe, got", err)
+	}
+}
+
+// tcpSink returns a TCP connection whose peer discards everything it receives.
+func tcpSink(b *testing.B) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return conn
+}
+
+func benchmarkWritePublish(b *testing.B, w Writer, flush func() error) {
+	p := &PublishPacket{TopicName: "sensors/temperature", QoS: QoS1, PacketId: 1, Payload: make([]byte, 64)}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(2 + 2 + len(p.TopicName) + 2 + len(p.Payload)))
+	for i := 0; i < b.N; i++ {
+		if err := w.WritePacket(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if flush != nil {
+		if err := flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncoder_WritePacket_TCP(b *testing.B) {
+	conn := tcpSink(b)
+	defer conn.Close()
+
+	benchmarkWritePublish(b, NewEncoder(conn), nil)
+}
+
+func BenchmarkBufferedEncoder_WritePacket_TCP(b *testing.B) {
+	conn := tcpSink(b)
+	defer conn.Close()
+
+	enc := NewBufferedEncoder(conn, DefaultBufferSize, time.Millisecond)
+	benchmarkWritePublish(b, enc, enc.Flush)
+}
@@ -0,0 +1,223 @@
+package mqtt
+
+import (
+	"fmt"
+)
+
+// maxClientIdLength31 is the maximum length of client identifiers in MQTT 3.1.
+const maxClientIdLength31 = 23
+
+// ConnectBuilder builds CONNECT packets. The connect flags are derived from the fields that have been set, and the
+// packet is validated against the chosen protocol version when it is built, e.g.:
+//
+//	connect, err := NewConnect().ClientId("sensor-1").Will("sensors/1/status", []byte("offline"), QoS1, true).
+//		Credentials("user", []byte("secret")).Version(ProtocolLevel5).Build()
+type ConnectBuilder struct {
+	p ConnectPacket
+}
+
+// NewConnect returns a builder for an MQTT 3.1.1 CONNECT packet with clean session set.
+func NewConnect() *ConnectBuilder {
+	return &ConnectBuilder{ConnectPacket{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: ProtocolLevel311,
+		ConnectFlags:  ConnectFlags{CleanSession: true},
+	}}
+}
+
+// Version sets the protocol level (ProtocolLevel31, ProtocolLevel311 or ProtocolLevel5), and the corresponding
+// protocol name.
+func (b *ConnectBuilder) Version(level uint8) *ConnectBuilder {
+	b.p.ProtocolLevel = level
+	if level == ProtocolLevel31 {
+		b.p.ProtocolName = "MQIsdp"
+	} else {
+		b.p.ProtocolName = "MQTT"
+	}
+	return b
+}
+
+func (b *ConnectBuilder) ClientId(id string) *ConnectBuilder {
+	b.p.ClientId = id
+	return b
+}
+
+func (b *ConnectBuilder) CleanSession(cleanSession bool) *ConnectBuilder {
+	b.p.CleanSession = cleanSession
+	return b
+}
+
+// KeepAlive sets the keep alive interval in seconds.
+func (b *ConnectBuilder) KeepAlive(seconds uint16) *ConnectBuilder {
+	b.p.KeepAlive = seconds
+	return b
+}
+
+// Will sets the will message and the will flag.
+func (b *ConnectBuilder) Will(topic string, message []byte, qos QoS, retain bool) *ConnectBuilder {
+	b.p.WillFlag = true
+	b.p.WillTopic = topic
+	b.p.WillMessage = message
+	b.p.WillQoS = qos
+	b.p.WillRetain = retain
+	return b
+}
+
+// Credentials sets the user name, and the password unless it is nil.
+func (b *ConnectBuilder) Credentials(userName string, password []byte) *ConnectBuilder {
+	b.p.UserNameFlag = true
+	b.p.UserName = userName
+	return b.Password(password)
+}
+
+// Password sets the password without a user name, which is only allowed in MQTT 5. A nil password removes it.
+func (b *ConnectBuilder) Password(password []byte) *ConnectBuilder {
+	b.p.PasswordFlag = password != nil
+	b.p.Password = password
+	return b
+}
+
+// Properties sets the encoded CONNECT properties (MQTT 5 only).
+func (b *ConnectBuilder) Properties(properties []byte) *ConnectBuilder {
+	b.p.Properties = properties
+	return b
+}
+
+// WillProperties sets the encoded will properties (MQTT 5 only).
+func (b *ConnectBuilder) WillProperties(properties []byte) *ConnectBuilder {
+	b.p.WillProperties = properties
+	return b
+}
+
+// Build validates the packet against the protocol version (see ValidatePacket) and returns a new CONNECT packet.
+// Violations are returned as ProtocolError, and unknown protocol levels as UnsupportedVersionError.
+func (b *ConnectBuilder) Build() (*ConnectPacket, error) {
+	p := b.p.Clone().(*ConnectPacket)
+
+	switch p.ProtocolLevel {
+	case ProtocolLevel31:
+		if len(p.ClientId) == 0 || len(p.ClientId) > maxClientIdLength31 {
+			return nil, violation(p, "ClientId", "",
+				fmt.Sprintf("MQTT 3.1 client identifiers must have 1 to %d characters", maxClientIdLength31))
+		}
+	case ProtocolLevel311, ProtocolLevel5:
+	default:
+		return nil, &UnsupportedVersionError{p.ProtocolName, p.ProtocolLevel}
+	}
+
+	if p.ProtocolLevel != ProtocolLevel5 {
+		if len(p.Properties) > 0 {
+			return nil, violation(p, "Properties", "", "properties require MQTT 5")
+		}
+		if len(p.WillProperties) > 0 {
+			return nil, violation(p, "WillProperties", "", "will properties require MQTT 5")
+		}
+	} else if len(p.WillProperties) > 0 && !p.WillFlag {
+		return nil, violation(p, "WillProperties", "", "will properties set without will")
+	}
+
+	if err := ValidatePacket(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// PublishBuilder builds PUBLISH packets, e.g.:
+//
+//	publish, err := NewPublish("sensors/1/temperature").Payload([]byte("21.5")).QoS(QoS1, 42).Retain().Build()
+type PublishBuilder struct {
+	p PublishPacket
+}
+
+// NewPublish returns a builder for a PUBLISH packet with QoS 0 to the given topic.
+func NewPublish(topic string) *PublishBuilder {
+	return &PublishBuilder{PublishPacket{TopicName: topic}}
+}
+
+func (b *PublishBuilder) Payload(payload []byte) *PublishBuilder {
+	b.p.Payload = payload
+	return b
+}
+
+// QoS sets the QoS level and the packet identifier, which is only used if the QoS level is > 0.
+func (b *PublishBuilder) QoS(qos QoS, packetId uint16) *PublishBuilder {
+	b.p.QoS = qos
+	b.p.PacketId = packetId
+	return b
+}
+
+func (b *PublishBuilder) Retain() *PublishBuilder {
+	b.p.Retain = true
+	return b
+}
+
+// Dup marks the packet as redelivery.
+func (b *PublishBuilder) Dup() *PublishBuilder {
+	b.p.Dup = true
+	return b
+}
+
+// Build validates the packet (see ValidatePacket) and returns a new PUBLISH packet.
+func (b *PublishBuilder) Build() (*PublishPacket, error) {
+	p := b.p.Clone().(*PublishPacket)
+	if p.QoS == QoS0 {
+		p.PacketId = 0
+	}
+
+	if err := ValidatePacket(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SubscribeBuilder builds SUBSCRIBE packets, e.g.:
+//
+//	subscribe, err := NewSubscribe(1).Add("sensors/+/temperature", QoS1).Add("alerts/#", QoS2).Build()
+type SubscribeBuilder struct {
+	p SubscribePacket
+}
+
+func NewSubscribe(packetId uint16) *SubscribeBuilder {
+	return &SubscribeBuilder{SubscribePacket{PacketId: packetId}}
+}
+
+// Add adds a subscription to the topic filter with the requested QoS.
+func (b *SubscribeBuilder) Add(topicFilter string, qos QoS) *SubscribeBuilder {
+	b.p.Subscriptions = append(b.p.Subscriptions, Subscription{topicFilter, qos})
+	return b
+}
+
+// Build validates the packet (see ValidatePacket) and returns a new SUBSCRIBE packet.
+func (b *SubscribeBuilder) Build() (*SubscribePacket, error) {
+	p := b.p.Clone().(*SubscribePacket)
+	if err := ValidatePacket(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// UnsubscribeBuilder builds UNSUBSCRIBE packets, e.g.:
+//
+//	unsubscribe, err := NewUnsubscribe(2).Add("sensors/+/temperature").Build()
+type UnsubscribeBuilder struct {
+	p UnsubscribePacket
+}
+
+func NewUnsubscribe(packetId uint16) *UnsubscribeBuilder {
+	return &UnsubscribeBuilder{UnsubscribePacket{PacketId: packetId}}
+}
+
+// Add adds a topic filter to unsubscribe from.
+func (b *UnsubscribeBuilder) Add(topicFilter string) *UnsubscribeBuilder {
+	b.p.TopicFilters = append(b.p.TopicFilters, topicFilter)
+	return b
+}
+
+// Build validates the packet (see ValidatePacket) and returns a new UNSUBSCRIBE packet.
+func (b *UnsubscribeBuilder) Build() (*UnsubscribePacket, error) {
+	p := b.p.Clone().(*UnsubscribePacket)
+	if err := ValidatePacket(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
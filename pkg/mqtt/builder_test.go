@@ -0,0 +1,159 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestConnectBuilder(t *testing.T) {
+	p, err := NewConnect().
+		ClientId("sensor-1").
+		KeepAlive(30).
+		Will("sensors/1/status", []byte("offline"), QoS1, true).
+		Credentials("user", []byte("secret")).
+		Build()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	expected := &ConnectPacket{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: ProtocolLevel311,
+		ConnectFlags: ConnectFlags{
+			CleanSession: true,
+			WillFlag:     true,
+			WillQoS:      QoS1,
+			WillRetain:   true,
+			PasswordFlag: true,
+			UserNameFlag: true,
+		},
+		KeepAlive:   30,
+		ClientId:    "sensor-1",
+		WillTopic:   "sensors/1/status",
+		WillMessage: []byte("offline"),
+		UserName:    "user",
+		Password:    []byte("secret"),
+	}
+	if !expected.Equal(p) {
+		t.Errorf("unexpected packet %s", p)
+	}
+}
+
+func TestConnectBuilder_Version(t *testing.T) {
+	p, err := NewConnect().ClientId("a").Version(ProtocolLevel31).Build()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertStringEquals(t, "MQIsdp", p.ProtocolName)
+
+	p, err = NewConnect().Version(ProtocolLevel5).Properties([]byte{0x11, 0, 0, 0, 60}).Build()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertStringEquals(t, "MQTT", p.ProtocolName)
+	assertIntEquals(t, 5, int(p.ProtocolLevel))
+
+	_, err = NewConnect().Version(6).Build()
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Error("expected unsupported version error, got", err)
+	}
+}
+
+func TestConnectBuilder_VersionSpecificRules(t *testing.T) {
+	// MQTT 3.1 requires client identifiers with 1 to 23 characters
+	_, err := NewConnect().Version(ProtocolLevel31).Build()
+	assertViolation(t, err, "")
+	_, err = NewConnect().ClientId("a-client-id-that-is-too-long").Version(ProtocolLevel31).Build()
+	assertViolation(t, err, "")
+
+	// properties require MQTT 5
+	_, err = NewConnect().Properties([]byte{0x11, 0, 0, 0, 60}).Build()
+	assertViolation(t, err, "")
+
+	// a password without user name is only allowed in MQTT 5
+	_, err = NewConnect().Password([]byte("secret")).Build()
+	assertViolation(t, err, "MQTT-3.1.2-22")
+	if _, err = NewConnect().Password([]byte("secret")).Version(ProtocolLevel5).Build(); err != nil {
+		t.Error("unexpected error", err)
+	}
+
+	// a session requires a client identifier
+	_, err = NewConnect().CleanSession(false).Build()
+	assertViolation(t, err, "MQTT-3.1.3-8")
+}
+
+func TestConnectBuilder_BuildsIndependentPackets(t *testing.T) {
+	b := NewConnect().ClientId("a")
+	p1, _ := b.Build()
+	p2, _ := b.ClientId("b").Build()
+
+	assertStringEquals(t, "a", p1.ClientId)
+	assertStringEquals(t, "b", p2.ClientId)
+}
+
+func TestPublishBuilder(t *testing.T) {
+	p, err := NewPublish("a/b").Payload([]byte("hello")).QoS(QoS1, 42).Retain().Build()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	expected := &PublishPacket{TopicName: "a/b", QoS: QoS1, PacketId: 42, Retain: true, Payload: []byte("hello")}
+	if !expected.Equal(p) {
+		t.Errorf("unexpected packet %s", p)
+	}
+
+	buf := new(bytes.Buffer)
+	if err = NewEncoder(buf).WritePacket(p); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	decoded, err := ReadNext(NewDecodingStreamer(buf))
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if !expected.Equal(decoded) {
+		t.Errorf("unexpected decoded packet %s", decoded)
+	}
+}
+
+func TestPublishBuilder_Invalid(t *testing.T) {
+	_, err := NewPublish("a/+").Build()
+	assertViolation(t, err, "MQTT-3.3.2-2")
+
+	_, err = NewPublish("a/b").QoS(QoS1, 0).Build()
+	assertViolation(t, err, "MQTT-2.3.1-1")
+
+	p, err := NewPublish("a/b").QoS(QoS0, 42).Build()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertIntEquals(t, 0, int(p.PacketId))
+}
+
+func TestSubscribeBuilder(t *testing.T) {
+	p, err := NewSubscribe(1).Add("a/+", QoS1).Add("b/#", QoS2).Build()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	expected := &SubscribePacket{PacketId: 1, Subscriptions: []Subscription{{"a/+", QoS1}, {"b/#", QoS2}}}
+	if !expected.Equal(p) {
+		t.Errorf("unexpected packet %s", p)
+	}
+
+	_, err = NewSubscribe(1).Build()
+	assertViolation(t, err, "MQTT-3.8.3-3")
+}
+
+func TestUnsubscribeBuilder(t *testing.T) {
+	p, err := NewUnsubscribe(2).Add("a/+").Build()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	expected := &UnsubscribePacket{PacketId: 2, TopicFilters: []string{"a/+"}}
+	if !expected.Equal(p) {
+		t.Errorf("unexpected packet %s", p)
+	}
+
+	_, err = NewUnsubscribe(0).Add("a").Build()
+	assertViolation(t, err, "MQTT-2.3.1-1")
+}
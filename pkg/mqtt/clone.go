@@ -0,0 +1,219 @@
+package mqtt
+
+import (
+	"bytes"
+)
+
+// cloneHeader returns a headerContainer with a copy of the header.
+func (p *headerContainer) cloneHeader() headerContainer {
+	if p.header == nil {
+		return headerContainer{}
+	}
+	h := *p.header
+	return headerContainer{&h}
+}
+
+// cloneBytes copies b, keeping the distinction between nil and empty slices.
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (p *ConnectPacket) Clone() Packet {
+	c := *p
+	c.headerContainer = p.cloneHeader()
+	c.WillMessage = cloneBytes(p.WillMessage)
+	c.Password = cloneBytes(p.Password)
+	c.Properties = cloneBytes(p.Properties)
+	c.WillProperties = cloneBytes(p.WillProperties)
+	return &c
+}
+
+func (p *ConnectPacket) Equal(other Packet) bool {
+	o, ok := other.(*ConnectPacket)
+	return ok &&
+		p.ConnectFlags == o.ConnectFlags &&
+		p.ProtocolName == o.ProtocolName &&
+		p.ProtocolLevel == o.ProtocolLevel &&
+		p.KeepAlive == o.KeepAlive &&
+		p.ClientId == o.ClientId &&
+		p.WillTopic == o.WillTopic &&
+		bytes.Equal(p.WillMessage, o.WillMessage) &&
+		p.UserName == o.UserName &&
+		bytes.Equal(p.Password, o.Password) &&
+		bytes.Equal(p.Properties, o.Properties) &&
+		bytes.Equal(p.WillProperties, o.WillProperties)
+}
+
+func (p *ConnAckPacket) Clone() Packet {
+	c := *p
+	c.headerContainer = p.cloneHeader()
+	return &c
+}
+
+func (p *ConnAckPacket) Equal(other Packet) bool {
+	o, ok := other.(*ConnAckPacket)
+	return ok && p.SessionPresent == o.SessionPresent && p.ReturnCode == o.ReturnCode
+}
+
+func (p *PublishPacket) Clone() Packet {
+	c := *p
+	c.headerContainer = p.cloneHeader()
+	c.Payload = cloneBytes(p.Payload)
+	return &c
+}
+
+func (p *PublishPacket) Equal(other Packet) bool {
+	o, ok := other.(*PublishPacket)
+	return ok &&
+		p.Dup == o.Dup &&
+		p.QoS == o.QoS &&
+		p.Retain == o.Retain &&
+		p.TopicName == o.TopicName &&
+		p.PacketId == o.PacketId &&
+		bytes.Equal(p.Payload, o.Payload)
+}
+
+func (p *PubAckPacket) Clone() Packet {
+	c := *p
+	c.headerContainer = p.cloneHeader()
+	return &c
+}
+
+func (p *PubAckPacket) Equal(other Packet) bool {
+	o, ok := other.(*PubAckPacket)
+	return ok && p.PacketId == o.PacketId
+}
+
+func (p *PubRecPacket) Clone() Packet {
+	c := *p
+	c.headerContainer = p.cloneHeader()
+	return &c
+}
+
+func (p *PubRecPacket) Equal(other Packet) bool {
+	o, ok := other.(*PubRecPacket)
+	return ok && p.PacketId == o.PacketId
+}
+
+func (p *PubRelPacket) Clone() Packet {
+	c := *p
+	c.headerContainer = p.cloneHeader()
+	return &c
+}
+
+func (p *PubRelPacket) Equal(other Packet) bool {
+	o, ok := other.(*PubRelPacket)
+	return ok && p.PacketId == o.PacketId
+}
+
+func (p *PubCompPacket) Clone() Packet {
+	c := *p
+	c.headerContainer = p.cloneHeader()
+	return &c
+}
+
+func (p *PubCompPacket) Equal(other Packet) bool {
+	o, ok := other.(*PubCompPacket)
+	return ok && p.PacketId == o.PacketId
+}
+
+func (p *SubscribePacket) Clone() Packet {
+	c := *p
+	c.headerContainer = p.cloneHeader()
+	if p.Subscriptions != nil {
+		c.Subscriptions = append([]Subscription{}, p.Subscriptions...)
+	}
+	return &c
+}
+
+func (p *SubscribePacket) Equal(other Packet) bool {
+	o, ok := other.(*SubscribePacket)
+	if !ok || p.PacketId != o.PacketId || len(p.Subscriptions) != len(o.Subscriptions) {
+		return false
+	}
+	for i := range p.Subscriptions {
+		if p.Subscriptions[i] != o.Subscriptions[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *SubAckPacket) Clone() Packet {
+	c := *p
+	c.headerContainer = p.cloneHeader()
+	if p.ReturnCodes != nil {
+		c.ReturnCodes = append([]SubAckCode{}, p.ReturnCodes...)
+	}
+	return &c
+}
+
+func (p *SubAckPacket) Equal(other Packet) bool {
+	o, ok := other.(*SubAckPacket)
+	return ok && p.PacketId == o.PacketId && bytes.Equal(p.ReturnCodes, o.ReturnCodes)
+}
+
+func (p *UnsubscribePacket) Clone() Packet {
+	c := *p
+	c.headerContainer = p.cloneHeader()
+	if p.TopicFilters != nil {
+		c.TopicFilters = append([]string{}, p.TopicFilters...)
+	}
+	return &c
+}
+
+func (p *UnsubscribePacket) Equal(other Packet) bool {
+	o, ok := other.(*UnsubscribePacket)
+	if !ok || p.PacketId != o.PacketId || len(p.TopicFilters) != len(o.TopicFilters) {
+		return false
+	}
+	for i := range p.TopicFilters {
+		if p.TopicFilters[i] != o.TopicFilters[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *UnsubAckPacket) Clone() Packet {
+	c := *p
+	c.headerContainer = p.cloneHeader()
+	return &c
+}
+
+func (p *UnsubAckPacket) Equal(other Packet) bool {
+	o, ok := other.(*UnsubAckPacket)
+	return ok && p.PacketId == o.PacketId
+}
+
+func (p *PingReqPacket) Clone() Packet {
+	return &PingReqPacket{p.cloneHeader()}
+}
+
+func (p *PingReqPacket) Equal(other Packet) bool {
+	_, ok := other.(*PingReqPacket)
+	return ok
+}
+
+func (p *PingRespPacket) Clone() Packet {
+	return &PingRespPacket{p.cloneHeader()}
+}
+
+func (p *PingRespPacket) Equal(other Packet) bool {
+	_, ok := other.(*PingRespPacket)
+	return ok
+}
+
+func (p *DisconnectPacket) Clone() Packet {
+	c := *p
+	c.headerContainer = p.cloneHeader()
+	return &c
+}
+
+func (p *DisconnectPacket) Equal(other Packet) bool {
+	o, ok := other.(*DisconnectPacket)
+	return ok && p.ReasonCode == o.ReasonCode
+}
@@ -0,0 +1,96 @@
+package mqtt
+
+import (
+	"testing"
+)
+
+func TestPacket_Clone(t *testing.T) {
+	for _, p := range allPackets() {
+		p.setHeader(&PacketHeader{Type: p.Type(), Flags: p.Flags(), Length: 42})
+
+		c := p.Clone()
+
+		if !p.Equal(c) || !c.Equal(p) {
+			t.Errorf("clone %s is not equal to %s", c, p)
+		}
+		if c.Header() == p.Header() {
+			t.Errorf("clone of %s shares the header", p)
+		}
+		if *c.Header() != *p.Header() {
+			t.Errorf("unexpected header of clone %v", c.Header())
+		}
+	}
+}
+
+func TestPacket_Clone_SharesNoMemory(t *testing.T) {
+	connect := allPackets()[0].(*ConnectPacket)
+	connectClone := connect.Clone().(*ConnectPacket)
+	connectClone.WillMessage[0] = 'X'
+	connectClone.Password[0] = 0
+	assertStringEquals(t, "offline", string(connect.WillMessage))
+	assertIntEquals(t, 0xFF, int(connect.Password[0]))
+
+	publish := &PublishPacket{TopicName: "a", Payload: []byte("hello")}
+	publishClone := publish.Clone().(*PublishPacket)
+	publishClone.Payload[0] = 'j'
+	assertStringEquals(t, "hello", string(publish.Payload))
+
+	subscribe := &SubscribePacket{PacketId: 1, Subscriptions: []Subscription{{"a", QoS0}}}
+	subscribeClone := subscribe.Clone().(*SubscribePacket)
+	subscribeClone.Subscriptions[0].TopicFilter = "b"
+	assertStringEquals(t, "a", subscribe.Subscriptions[0].TopicFilter)
+
+	unsubscribe := &UnsubscribePacket{PacketId: 1, TopicFilters: []string{"a"}}
+	unsubscribeClone := unsubscribe.Clone().(*UnsubscribePacket)
+	unsubscribeClone.TopicFilters[0] = "b"
+	assertStringEquals(t, "a", unsubscribe.TopicFilters[0])
+
+	subAck := &SubAckPacket{PacketId: 1, ReturnCodes: []SubAckCode{MaxQoS0}}
+	subAckClone := subAck.Clone().(*SubAckPacket)
+	subAckClone.ReturnCodes[0] = Failure
+	if subAck.ReturnCodes[0] != MaxQoS0 {
+		t.Error("clone shares return codes")
+	}
+}
+
+func TestPacket_Equal(t *testing.T) {
+	packets := allPackets()
+	for i, p := range packets {
+		for j, other := range packets {
+			if (i == j) != p.Equal(other) {
+				t.Errorf("unexpected result of %s.Equal(%s)", p, other)
+			}
+		}
+	}
+}
+
+func TestPacket_Equal_IgnoresHeader(t *testing.T) {
+	p := &PublishPacket{TopicName: "a", Payload: []byte{}}
+	other := &PublishPacket{TopicName: "a"}
+	other.setHeader(&PacketHeader{Type: TypePublish, Length: 3})
+
+	if !p.Equal(other) {
+		t.Error("expected packets to be equal")
+	}
+}
+
+func TestPacket_Equal_DifferentFields(t *testing.T) {
+	unequal := [][2]Packet{
+		{&PublishPacket{TopicName: "a"}, &PublishPacket{TopicName: "b"}},
+		{&PublishPacket{Payload: []byte("a")}, &PublishPacket{Payload: []byte("b")}},
+		{&PubAckPacket{PacketId: 1}, &PubRecPacket{PacketId: 1}},
+		{&SubscribePacket{Subscriptions: []Subscription{{"a", QoS0}}}, &SubscribePacket{}},
+		{
+			&SubscribePacket{Subscriptions: []Subscription{{"a", QoS0}}},
+			&SubscribePacket{Subscriptions: []Subscription{{"a", QoS1}}},
+		},
+		{&UnsubscribePacket{TopicFilters: []string{"a"}}, &UnsubscribePacket{TopicFilters: []string{"b"}}},
+		{&ConnectPacket{ClientId: "a"}, &ConnectPacket{ClientId: "b"}},
+		{&DisconnectPacket{}, &DisconnectPacket{ReasonCode: ReasonPacketTooLarge}},
+	}
+	for _, pair := range unequal {
+		if pair[0].Equal(pair[1]) {
+			t.Errorf("expected %s and %s not to be equal", pair[0], pair[1])
+		}
+	}
+}
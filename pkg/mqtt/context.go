@@ -0,0 +1,230 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ContextStreamer is a Streamer whose Next can be cancelled.
+type ContextStreamer interface {
+	Streamer
+
+	// NextContext is like Next, but returns ctx.Err() if the context is done before the next header has been read.
+	NextContext(ctx context.Context) (*PacketHeader, error)
+}
+
+// ContextWriter is a Writer whose WritePacket can be cancelled.
+type ContextWriter interface {
+	Writer
+
+	// WritePacketContext is like WritePacket, but returns ctx.Err() if the context is done before the packet has been
+	// written.
+	WritePacketContext(ctx context.Context, packet Packet) error
+}
+
+// readDeadliner is implemented by readers that support read deadlines, like net.Conn.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// writeDeadliner is implemented by writers that support write deadlines, like net.Conn.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// aLongTimeAgo is a deadline in the past that interrupts blocked reads and writes.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watcherIdleTimeout is the time after which the goroutine of a deadline that is no longer used stops.
+const watcherIdleTimeout = time.Minute
+
+// NextContext is like Next, but can be cancelled with the context. If the underlying reader supports read deadlines
+// (like a net.Conn), the deadline of the context is set as read deadline, and a cancellation of the context interrupts
+// a blocking read. The read deadline stays set until it is changed by the next call to NextContext or reset by Next,
+// so it also applies to reading the rest of the packet. Otherwise, the context is only checked before reading.
+//
+// Since the stream may end up in the middle of a packet header, the streamer should not be used after NextContext has
+// returned an error.
+func (s *DecodingStreamer) NextContext(ctx context.Context) (*PacketHeader, error) {
+	if s.deadline == nil {
+		var set func(time.Time) error
+		if d, ok := s.src.(readDeadliner); ok {
+			set = d.SetReadDeadline
+		}
+		s.deadline = newDeadline(set)
+	}
+
+	var h *PacketHeader
+	err := s.deadline.do(ctx, func() (err error) {
+		h, err = s.next()
+		return
+	})
+	return h, err
+}
+
+// WritePacketContext is like WritePacket, but can be cancelled with the context. If the underlying writer supports
+// write deadlines, the deadline of the context is set as write deadline, and a cancellation of the context interrupts a
+// blocking write. Otherwise, the context is only checked before writing.
+func (w *Encoder) WritePacketContext(ctx context.Context, packet Packet) error {
+	if w.deadline == nil {
+		var set func(time.Time) error
+		if d, ok := w.w.(writeDeadliner); ok {
+			set = d.SetWriteDeadline
+		}
+		w.deadline = newDeadline(set)
+	}
+
+	return w.deadline.do(ctx, func() error {
+		return w.writePacket(packet)
+	})
+}
+
+// WritePacketContext writes the packet with the context if the sink of the channel supports it (see ContextWriter),
+// and checks the context before calling WritePacket otherwise.
+func (c *codecChannel) WritePacketContext(ctx context.Context, packet Packet) error {
+	if cw, ok := c.PacketSink.(ContextWriter); ok {
+		return cw.WritePacketContext(ctx, packet)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.WritePacket(packet)
+}
+
+// ReadNextContext is like ReadNext, but uses NextContext if the streamer is a ContextStreamer. Only reading the header
+// can be cancelled, since the rest of the packet is expected to arrive shortly after.
+func ReadNextContext(ctx context.Context, s Streamer) (Packet, error) {
+	cs, ok := s.(ContextStreamer)
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return ReadNext(s)
+	}
+
+	_, err := cs.NextContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.ReadPacket()
+}
+
+// deadline applies the deadlines and cancellation of contexts to the reads or writes of a stream. The deadline of the
+// connection is only set when it changes, and a cancellation is detected by a single goroutine per stream, which is
+// started on demand and stops once the stream is no longer used. Like the reads or writes of a stream, do must not be
+// called concurrently.
+type deadline struct {
+	set     func(time.Time) error // sets the deadline of the connection, nil if it does not support deadlines
+	current time.Time             // the deadline that is set on the connection
+
+	mu      sync.Mutex
+	running bool                 // whether the watcher goroutine is running
+	watch   chan context.Context // passes the context of a call to the watcher
+	release chan struct{}        // signals the watcher that the call has returned
+}
+
+func newDeadline(set func(time.Time) error) *deadline {
+	return &deadline{set: set, watch: make(chan context.Context, 1), release: make(chan struct{})}
+}
+
+// do calls fn with the deadline of the context set (if the connection supports deadlines), and interrupts fn by
+// setting a deadline in the past if the context is cancelled. If the context is done when fn returns an error, the
+// error of the context is returned instead.
+func (d *deadline) do(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d.set == nil {
+		return fn()
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if !deadline.Equal(d.current) {
+		if err := d.set(deadline); err != nil {
+			return err
+		}
+		d.current = deadline
+	}
+
+	var err error
+	if ctx.Done() == nil {
+		// the context can not be cancelled
+		err = fn()
+	} else {
+		d.mu.Lock()
+		if !d.running {
+			d.running = true
+			go d.run()
+		}
+		d.watch <- ctx
+		d.mu.Unlock()
+
+		err = fn()
+
+		d.release <- struct{}{}
+		if ctx.Err() != nil {
+			// the watcher may have set a deadline in the past
+			d.current = aLongTimeAgo
+		}
+	}
+
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() && hasDeadline && !time.Now().Before(deadline) {
+		// the deadline of the connection can expire slightly before the context
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// reset removes the deadline from the connection, if one has been set. It is called by the reads or writes that do
+// not take a context.
+func (d *deadline) reset() {
+	if d != nil && !d.current.IsZero() {
+		_ = d.set(time.Time{})
+		d.current = time.Time{}
+	}
+}
+
+// run interrupts the calls whose context is cancelled until no call has been made for watcherIdleTimeout.
+func (d *deadline) run() {
+	idle := time.NewTimer(watcherIdleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case ctx := <-d.watch:
+			select {
+			case <-ctx.Done():
+				_ = d.set(aLongTimeAgo)
+				<-d.release
+			case <-d.release:
+			}
+
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(watcherIdleTimeout)
+		case <-idle.C:
+			d.mu.Lock()
+			if len(d.watch) == 0 {
+				d.running = false
+				d.mu.Unlock()
+				return
+			}
+			d.mu.Unlock()
+			idle.Reset(watcherIdleTimeout)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDecodingStreamer_NextContext_Cancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	streamer := NewDecodingStreamer(server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	_, err := streamer.NextContext(ctx)
+	if err != context.Canceled {
+		t.Error("expected context.Canceled, got", err)
+	}
+}
+
+func TestDecodingStreamer_NextContext_Timeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	streamer := NewDecodingStreamer(server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := streamer.NextContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Error("expected context.DeadlineExceeded, got", err)
+	}
+}
+
+func TestDecodingStreamer_NextContext_ResetsDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = client.Write([]byte{192, 0}) // PINGREQ
+		time.Sleep(30 * time.Millisecond)
+		_, _ = client.Write([]byte{192, 0})
+	}()
+
+	streamer := NewDecodingStreamer(server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := ReadNextContext(ctx, streamer); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	// the second packet arrives after the deadline of the first read
+	p, err := ReadNext(streamer)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if p.Type() != TypePingReq {
+		t.Error("unexpected packet", p)
+	}
+}
+
+func TestDecodingStreamer_NextContext_CancelAfterRead(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = client.Write([]byte{192, 0, 192, 0})
+	}()
+
+	streamer := NewDecodingStreamer(server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := ReadNextContext(ctx, streamer); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	// the cancellation of the first context must not interrupt the next read
+	cancel()
+
+	if _, err := ReadNextContext(context.Background(), streamer); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// deadlineReader is a reader that supports read deadlines, but never blocks.
+type deadlineReader struct {
+	*bytes.Reader
+	deadlines int
+}
+
+func (r *deadlineReader) SetReadDeadline(time.Time) error {
+	r.deadlines++
+	return nil
+}
+
+func TestDecodingStreamer_NextContext_Overhead(t *testing.T) {
+	r := &deadlineReader{Reader: bytes.NewReader(bytes.Repeat([]byte{192, 0}, 1000))}
+	streamer := NewDecodingStreamer(r)
+	streamer.SetPooled(true)
+
+	read := func(ctx context.Context) func() {
+		return func() {
+			if _, err := streamer.NextContext(ctx); err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			if _, err := streamer.WriteTo(ioutil.Discard); err != nil {
+				t.Fatal("unexpected error", err)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// a cancellable context does not cost more allocations than one that can not be cancelled
+	expected := testing.AllocsPerRun(100, read(context.Background()))
+	if allocs := testing.AllocsPerRun(100, read(ctx)); allocs > expected {
+		t.Errorf("expected at most %v allocations per read, got %v", expected, allocs)
+	}
+
+	// the deadline is set once for all reads with the same context
+	r.deadlines = 0
+	for i := 0; i < 10; i++ {
+		read(ctx)()
+	}
+	assertIntEquals(t, 0, r.deadlines)
+}
+
+func TestDecodingStreamer_NextContext_WithoutDeadlineSupport(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader(publishPacketBytes))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := streamer.NextContext(ctx); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	cancel()
+	if _, err := ReadNextContext(ctx, streamer); err != context.Canceled {
+		t.Error("expected context.Canceled, got", err)
+	}
+}
+
+func TestEncoder_WritePacketContext_Cancel(t *testing.T) {
+	client, server := net.Pipe() // writes block until the other end reads
+	defer client.Close()
+	defer server.Close()
+
+	ch := NewChannel(server).(ContextWriter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	err := ch.WritePacketContext(ctx, &PingReqPacket{})
+	if err != context.Canceled {
+		t.Error("expected context.Canceled, got", err)
+	}
+}
+
+func TestEncoder_WritePacket_EmptyBodyOnPipe(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = ReadNext(NewDecodingStreamer(server))
+	}()
+
+	// net.Pipe blocks on empty writes until the other side reads, so the empty body must not be written
+	done := make(chan error, 1)
+	go func() { done <- NewEncoder(client).WritePacket(&PingReqPacket{}) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("unexpected error", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("WritePacket blocked")
+	}
+}
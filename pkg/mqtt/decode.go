@@ -1,14 +1,17 @@
 package mqtt
 
 import (
+	"bufio"
 	"bytes"
-	"errors"
 	"fmt"
 	"io"
 )
 
+// DecodingStreamer reads MQTT packets from a stream. It reads from the underlying reader through a bufio.Reader, so
+// once a DecodingStreamer has been created, the underlying reader should only be read through it.
 type DecodingStreamer struct {
-	r io.Reader // the underlying stream
+	src io.Reader     // the underlying stream
+	r   *bufio.Reader // the buffered underlying stream
 
 	// stateful packet processing internals
 	limR   *io.LimitedReader // to limit the reading
@@ -16,13 +19,24 @@ type DecodingStreamer struct {
 	buf    *bytes.Buffer     // buffer for the packet
 	header *PacketHeader     // the last read packet header
 
-	consumed bool // flag if packet has been consumed
+	consumed bool          // flag if packet has been consumed
+	opts     decodeOptions // options passed to the packet decoder
+	replaced bool          // whether a string of the current packet has been replaced (see UTF8Replace)
+	maxSize  uint32        // the maximum packet size, 0 if there is no limit
+	deadline *deadline     // the read deadline set by NextContext, created on first use
+
+	// used instead of newly allocated headers in pooled mode
+	hdr      PacketHeader
+	hdrBytes [5]byte
 }
 
 func NewDecodingStreamer(r io.Reader) *DecodingStreamer {
+	br := bufio.NewReader(r) // returns r if it already is a bufio.Reader with the default size
+
 	s := &DecodingStreamer{
-		r:        r,
-		limR:     &io.LimitedReader{R: r},
+		src:      r,
+		r:        br,
+		limR:     &io.LimitedReader{R: br},
 		hBuf:     bytes.NewBuffer(make([]byte, 5)),
 		buf:      bytes.NewBuffer(make([]byte, 4096)),
 		consumed: true,
@@ -31,20 +45,82 @@ func NewDecodingStreamer(r io.Reader) *DecodingStreamer {
 	return s
 }
 
+// SetStrict enables or disables strict mode. In strict mode, the streamer checks every packet against the rules of the
+// MQTT specification: fixed headers are validated by Next (see ValidateHeader), and decoded packets by DecodePacket
+// (see ValidatePacket). Since packets need to be decoded to be validated, WriteTo also decodes every packet before
+// writing its original bytes. Violations are returned as ProtocolError.
+//
+// Strict mode covers the packets of MQTT 3.1 and 3.1.1, and the CONNECT of MQTT 5. The other MQTT 5 packets are
+// outside its scope, so it should be disabled once a client has connected with MQTT 5.
+func (s *DecodingStreamer) SetStrict(strict bool) {
+	s.opts.strict = strict
+}
+
+// SetUTF8Mode sets how strings that are not allowed by the specification are handled (see UTF8Mode). Like strict mode,
+// rejecting or replacing strings requires packets to be decoded, so WriteTo decodes every packet as well. If strings
+// have been replaced, WriteTo writes the re-encoded packet instead of the original bytes.
+func (s *DecodingStreamer) SetUTF8Mode(mode UTF8Mode) {
+	s.opts.utf8 = mode
+	s.opts.replaced = &s.replaced
+}
+
+// SetPooled enables or disables pooled mode, which avoids allocations on the hot path of high-throughput streams. In
+// pooled mode:
+//   - the header returned by Next is reused by the streamer and only valid until the next call to Next,
+//   - PUBLISH, PUBACK, PUBREC, PUBREL and PUBCOMP packets are taken from a pool and should be returned to it with
+//     ReleasePacket once they are no longer used, so that the packets and their payload buffers can be reused,
+//   - topic names and other strings are reused from a cache of recently decoded strings.
+func (s *DecodingStreamer) SetPooled(pooled bool) {
+	s.opts.pooled = pooled
+	if pooled && s.opts.strings == nil {
+		s.opts.strings = newStringCache()
+	}
+}
+
+// SetMaxPacketSize limits the size of packets (including the fixed header) that the streamer accepts. If a packet
+// exceeds the size, Next returns a PacketTooLargeError before anything but the fixed header is read from the
+// underlying reader. This protects both DecodePacket, which buffers the entire packet, and WriteTo. A size of 0 (the
+// default) disables the limit.
+func (s *DecodingStreamer) SetMaxPacketSize(size uint32) {
+	s.maxSize = size
+}
+
 func (s *DecodingStreamer) ReadPacket() (Packet, error) {
 	return s.DecodePacket()
 }
 
 func (s *DecodingStreamer) Next() (*PacketHeader, error) {
+	s.deadline.reset()
+	return s.next()
+}
+
+func (s *DecodingStreamer) next() (*PacketHeader, error) {
 	if !s.consumed {
 		return nil, StreamStateError
 	}
 
-	header, err := ReadHeaderFrom(s.r)
+	var header *PacketHeader
+	var err error
+	if s.opts.pooled {
+		header = &s.hdr
+		err = readHeader(s.r, header, s.hdrBytes[:])
+	} else {
+		header, err = ReadHeaderFrom(s.r)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	if s.maxSize > 0 && header.Size() > s.maxSize {
+		return nil, &PacketTooLargeError{header.Type, header.Size(), s.maxSize}
+	}
+
+	if s.opts.strict {
+		if err = ValidateHeader(header); err != nil {
+			return nil, err
+		}
+	}
+
 	s.header = header
 	s.consumed = false
 
@@ -58,14 +134,24 @@ func (s *DecodingStreamer) WriteTo(w io.Writer) (n int64, err error) {
 		return 0, StreamStateError
 	}
 
+	if s.opts.strict || s.opts.utf8 != UTF8PassThrough {
+		return s.validateAndWriteTo(w)
+	}
+
 	var nn int64
 
 	nn, err = s.writeHeaderTo(w)
 	n += nn
+	if err != nil {
+		return n, err
+	}
 
 	nn, err = io.CopyN(w, s.r, int64(s.header.Length))
 	n += nn
 
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
 	if err != nil {
 		return n, err
 	}
@@ -74,6 +160,55 @@ func (s *DecodingStreamer) WriteTo(w io.Writer) (n int64, err error) {
 	return
 }
 
+// validateAndWriteTo decodes and validates the current packet before writing the original bytes to the writer. If
+// strings of the packet have been replaced, the decoded packet is written instead.
+func (s *DecodingStreamer) validateAndWriteTo(w io.Writer) (n int64, err error) {
+	err = s.readBody()
+	if err != nil {
+		return
+	}
+
+	raw := s.buf.Bytes() // decoding consumes the buffer, but does not modify the underlying bytes
+
+	s.replaced = false
+	p, err := s.decodeBody()
+	if err != nil {
+		return
+	}
+	if s.replaced {
+		return s.encodeTo(w, p)
+	}
+
+	n, err = s.writeHeaderTo(w)
+	if err != nil {
+		return
+	}
+
+	nn, err := w.Write(raw)
+	n += int64(nn)
+	return
+}
+
+// encodeTo writes the packet with the header of the current packet, and the remaining length of the encoded packet.
+func (s *DecodingStreamer) encodeTo(w io.Writer, p Packet) (int64, error) {
+	body := new(bytes.Buffer)
+	if err := EncodePacket(body, p); err != nil {
+		return 0, err
+	}
+
+	s.hBuf.Reset()
+	h := &PacketHeader{Type: s.header.Type, Flags: s.header.Flags, Length: uint32(body.Len())}
+	if err := EncodeHeader(s.hBuf, h); err != nil {
+		return 0, err
+	}
+	n, err := s.hBuf.WriteTo(w)
+	if err != nil {
+		return n, err
+	}
+	nn, err := body.WriteTo(w)
+	return n + nn, err
+}
+
 func (s *DecodingStreamer) WritePacketTo(writer Writer) error {
 	if wt, ok := writer.(io.Writer); ok {
 		_, err := s.WriteTo(wt)
@@ -100,58 +235,249 @@ func (s *DecodingStreamer) DecodePacket() (Packet, error) {
 		return nil, StreamStateError
 	}
 
+	err := s.readBody()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.decodeBody()
+}
+
+// readBody reads the remaining length of the current packet into the packet buffer. If the stream ends before the
+// packet has been read completely, it returns io.ErrUnexpectedEOF.
+func (s *DecodingStreamer) readBody() error {
 	buf := s.buf
+	length := int(s.header.Length)
+
+	// prepare buffer to read into
+	buf.Reset()
+	buf.Grow(length) // make sure we have enough space
+
+	// read packet data into the free capacity of the buffer
+	b := buf.Bytes()[:length]
+	_, err := io.ReadFull(s.r, b)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	buf.Write(b) // b is the buffer's own memory, so this only extends the buffer to the bytes that have been read
+
+	return nil
+}
+
+// decodeBody decodes the packet in the packet buffer, and marks the current packet as consumed.
+func (s *DecodingStreamer) decodeBody() (Packet, error) {
+	// unmarshal packet into buffer (we've ensured that s.buf is exactly the remaining length of the MQTT packet)
+	p, err := decodePacket(s.buf, s.header, s.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.opts.strict {
+		if err = ValidatePacket(p); err != nil {
+			return nil, err
+		}
+	}
+
+	s.consumed = true
+	return p, nil
+}
+
+// PublishStream is a PUBLISH packet whose payload has not been read from the underlying stream. It allows inspecting
+// (and routing by) the variable header of large messages without buffering the payload in memory.
+type PublishStream struct {
+	// Packet holds the flags and the variable header of the PUBLISH packet. Its Payload is nil.
+	Packet *PublishPacket
+	// PayloadLength is the number of bytes that can be read from Payload.
+	PayloadLength uint32
+	// Payload reads the payload of the packet directly from the underlying stream.
+	Payload io.Reader
+}
+
+// DecodePublishStream decodes the variable header of the current packet, which must be a PUBLISH packet, and returns
+// a PublishStream whose Payload reads the rest of the packet from the underlying stream. The packet is consumed once
+// the payload has been read completely, so it needs to be read (or discarded) before calling Next again.
+func (s *DecodingStreamer) DecodePublishStream() (*PublishStream, error) {
+	if s.header == nil || s.consumed {
+		return nil, StreamStateError
+	}
+	if s.header.Type != TypePublish {
+		return nil, fmt.Errorf("expected PUBLISH packet, got %s", s.header.Type)
+	}
+
 	header := s.header
+	buf := s.buf
 	r := s.limR
 
 	r.N = int64(header.Length)
-	// prepare buffer to read into
 	buf.Reset()
-	buf.Grow(int(header.Length)) // make sure we have enough space
 
-	// read packet data into buffer
-	n, err := buf.ReadFrom(r)
+	// read the topic length first to know the length of the variable header
+	if err := s.readVariableHeader(2, "TopicName"); err != nil {
+		return nil, err
+	}
+	length := 2 + uint32(buf.Bytes()[0])<<8 + uint32(buf.Bytes()[1])
+	field := "TopicName"
+	if (header.Flags&0b0110)>>1 > QoS0 {
+		length += 2
+		field = "PacketId"
+	}
+	if length > header.Length {
+		return nil, &MalformedPacketError{TypePublish, field, 0,
+			fmt.Errorf("variable header exceeds remaining length %d", header.Length)}
+	}
+	if err := s.readVariableHeader(int64(length-2), field); err != nil {
+		return nil, err
+	}
+
+	// the variable header is decoded as a PUBLISH packet without payload
+	vh, err := decodePacket(buf, &PacketHeader{Type: TypePublish, Flags: header.Flags, Length: length},
+		decodeOptions{utf8: s.opts.utf8})
 	if err != nil {
 		return nil, err
 	}
-	if n != int64(header.Length) {
-		panic("did not read complete packet")
+	p := vh.(*PublishPacket)
+	if s.opts.strict {
+		if err = ValidatePacket(p); err != nil {
+			return nil, err
+		}
+	}
+	if s.opts.pooled {
+		// the header is reused by the streamer
+		h := *header
+		p.setHeader(&h)
+	} else {
+		p.setHeader(header)
 	}
 
-	// unmarshal packet into buffer (we've ensured that s.buf is exactly the remaining length of the MQTT packet)
-	p, err := DecodePacket(buf, header)
+	payloadLength := header.Length - length
+	if payloadLength == 0 {
+		s.consumed = true
+	}
+
+	return &PublishStream{
+		Packet:        p,
+		PayloadLength: payloadLength,
+		Payload:       &payloadReader{s, &io.LimitedReader{R: s.r, N: int64(payloadLength)}},
+	}, nil
+}
+
+// readVariableHeader reads n bytes of the current packet into the packet buffer.
+func (s *DecodingStreamer) readVariableHeader(n int64, field string) error {
+	offset := s.buf.Len()
+	_, err := io.CopyN(s.buf, s.limR, n)
+	if err == io.EOF {
+		return &MalformedPacketError{TypePublish, field, offset, io.ErrUnexpectedEOF}
+	}
+	return err
+}
+
+// payloadReader reads the payload of a PublishStream and marks the packet as consumed once it has been read.
+type payloadReader struct {
+	s    *DecodingStreamer
+	limR *io.LimitedReader
+}
+
+func (r *payloadReader) Read(p []byte) (int, error) {
+	limR := r.limR
+	if limR.N == 0 {
+		return 0, io.EOF
+	}
+
+	n, err := limR.Read(p)
+	if limR.N == 0 {
+		r.s.consumed = true
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// DecodePacket decodes the packet described by the given header from the buffer. It consumes exactly the remaining
+// length of the packet from the buffer. Errors are of type MalformedPacketError, ProtocolError or
+// UnsupportedVersionError.
+func DecodePacket(buf *bytes.Buffer, h *PacketHeader) (p Packet, err error) {
+	return decodePacket(buf, h, decodeOptions{})
+}
+
+// decodeOptions control how a packetDecoder decodes packets.
+type decodeOptions struct {
+	strict   bool         // whether to check protocol rules that can only be checked while decoding
+	pooled   bool         // whether to take packets from the packet pools
+	strings  *stringCache // if not nil, strings are reused from the cache
+	utf8     UTF8Mode     // how invalid strings are handled
+	replaced *bool        // if not nil, set to true when a string has been replaced
+}
+
+// decodePacket decodes the packet described by the given header from the buffer. In strict mode, it also checks the
+// rules that can not be checked by ValidatePacket after the packet has been decoded.
+func decodePacket(buf *bytes.Buffer, h *PacketHeader, opts decodeOptions) (p Packet, err error) {
+	length := int(h.Length)
+	if buf.Len() < length {
+		return nil, &MalformedPacketError{h.Type, "RemainingLength", buf.Len(), io.ErrUnexpectedEOF}
+	}
+	if buf.Len() > length {
+		// make sure decoders that read until the end of the buffer only see the bytes of this packet
+		buf = bytes.NewBuffer(buf.Next(length))
+	}
+
+	d := newPacketDecoder(buf, h.Type)
+	d.decodeOptions = opts
+
+	if opts.pooled {
+		p, err = decodePooledPacket(&d, h)
+	} else {
+		p, err = decodeFields(&d, h)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	s.consumed = true
+	if opts.strict && buf.Len() > 0 {
+		if opts.pooled {
+			ReleasePacket(p)
+		}
+		return nil, d.violation("RemainingLength", d.offset(), fmt.Sprintf("%d unexpected bytes at end of packet", buf.Len()))
+	}
+
+	if opts.pooled {
+		setHeaderCopy(p, h)
+	} else {
+		p.setHeader(h)
+	}
 	return p, nil
 }
 
-func DecodePacket(buf *bytes.Buffer, h *PacketHeader) (p Packet, err error) {
+// decodeFields decodes the fields of the packet described by the given header into a newly allocated packet.
+func decodeFields(d *packetDecoder, h *PacketHeader) (p Packet, err error) {
+	buf := d.buf
+
+	// all packets with fields are decoded through the packet decoder, so that they are checked according to its options
 	switch h.Type {
 	case TypeConnect:
-		p, err = DecodeConnectPacket(buf)
+		p, err = decodeConnectPacket(d)
 	case TypeConnAck:
-		p, err = DecodeConnAckPacket(buf)
+		p, err = decodeConnAckPacket(d)
 	case TypePublish:
-		p, err = DecodePublishPacket(buf, h)
+		p, err = decodePublishPacket(d, h, &PublishPacket{})
 	case TypePubAck:
-		p, err = DecodePubAckPacket(buf)
+		p, err = decodePubAckPacket(d)
 	case TypePubRec:
-		p, err = DecodePubRecPacket(buf)
+		p, err = decodePubRecPacket(d)
 	case TypePubRel:
-		p, err = DecodePubRelPacket(buf)
+		p, err = decodePubRelPacket(d)
 	case TypePubComp:
-		p, err = DecodePubCompPacket(buf)
+		p, err = decodePubCompPacket(d)
 	case TypeSubscribe:
-		p, err = DecodeSubscribePacket(buf)
+		p, err = decodeSubscribePacket(d)
 	case TypeSubAck:
-		p, err = DecodeSubAckPacket(buf)
+		p, err = decodeSubAckPacket(d)
 	case TypeUnsubscribe:
-		p, err = DecodeUnsubscribePacket(buf)
+		p, err = decodeUnsubscribePacket(d)
 	case TypeUnsubAck:
-		p, err = DecodeUnsubAckPacket(buf)
+		p, err = decodeUnsubAckPacket(d)
 	case TypePingReq:
 		p, err = DecodePingReqPacket(buf)
 	case TypePingResp:
@@ -159,39 +485,61 @@ func DecodePacket(buf *bytes.Buffer, h *PacketHeader) (p Packet, err error) {
 	case TypeDisconnect:
 		p, err = DecodeDisconnectPacket(buf)
 	default:
-		return nil, errors.New(fmt.Sprintf("unknown packet type %d", h.Type))
+		reason := fmt.Sprintf("unsupported packet type %d", h.Type)
+		return nil, &ProtocolError{Type: h.Type, Field: "PacketType", Reason: reason}
 	}
 
-	if p != nil {
-		p.setHeader(h)
+	if err != nil {
+		return nil, err
 	}
-
-	return p, err
+	return p, nil
 }
 
 func ReadHeaderFrom(r io.Reader) (h *PacketHeader, err error) {
-	// FIXME seems unnecessarily complicated
-	buf := make([]byte, 5)
-
-	n, err := r.Read(buf[:2])
+	h = &PacketHeader{}
+	err = readHeader(r, h, make([]byte, 5))
 	if err != nil {
-		return
+		return nil, err
 	}
-	if n != 2 {
-		// FIXME
-		err = errors.New("error reading header")
+	return
+}
+
+// readHeader reads a fixed header from the reader into h, using buf (which needs to be at least five bytes long) to
+// read the bytes of the header.
+//
+// If the reader is at the end of the stream, io.EOF is returned. If the stream ends within the header, or the remaining
+// length is encoded in more than four bytes, a MalformedPacketError is returned.
+func readHeader(r io.Reader, h *PacketHeader, buf []byte) (err error) {
+	// the first byte is read separately, since the stream may end cleanly before it
+	if _, err = io.ReadFull(r, buf[:1]); err != nil {
 		return
 	}
 
-	for i := 1; (buf[i]&cMask) > 0 && i < 5; i++ {
-		n, err = r.Read(buf[i+1 : i+2])
-		if err != nil {
+	for i := 1; ; i++ {
+		if i == 5 {
+			// the remaining length is encoded in at most four bytes
+			return &MalformedPacketError{PacketType(buf[0] >> 4), FieldFixedHeader, i, ErrVariableByteIntegerTooLong}
+		}
+		if _, err = io.ReadFull(r, buf[i:i+1]); err != nil {
+			if err == io.EOF {
+				err = &MalformedPacketError{PacketType(buf[0] >> 4), FieldFixedHeader, i, io.ErrUnexpectedEOF}
+			}
 			return
 		}
+		if buf[i]&cMask == 0 {
+			break
+		}
 	}
 
-	h = &PacketHeader{}
-	err = DecodeHeader(bytes.NewBuffer(buf), h)
+	h.Type = PacketType(buf[0] >> 4)
+	h.Flags = buf[0] & 0b00001111
+	h.Length = 0
+	for i := 1; ; i++ {
+		h.Length += uint32(buf[i]&dMask) << (7 * (i - 1))
+		if buf[i]&cMask == 0 {
+			break
+		}
+	}
 	return
 }
 
@@ -204,24 +552,147 @@ func DecodeHeader(buf *bytes.Buffer, h *PacketHeader) (err error) {
 	h.Flags = typeAndFlags & 0b00001111
 
 	length, err := VariableByteUint32(buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
-		return
+		return &MalformedPacketError{h.Type, FieldFixedHeader, 1, err}
 	}
 	h.Length = length
 
 	return
 }
 
+// packetDecoder reads the fields of a packet from a buffer. Read errors are returned as MalformedPacketError that
+// carry the name of the field and its offset within the packet.
+type packetDecoder struct {
+	decodeOptions
+	buf  *bytes.Buffer
+	typ  PacketType
+	size int // the length of the buffer before decoding started
+}
+
+func newPacketDecoder(buf *bytes.Buffer, t PacketType) packetDecoder {
+	return packetDecoder{buf: buf, typ: t, size: buf.Len()}
+}
+
+// offset returns the number of bytes that have been read so far.
+func (d *packetDecoder) offset() int {
+	return d.size - d.buf.Len()
+}
+
+func (d *packetDecoder) malformed(field string, offset int, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &MalformedPacketError{d.typ, field, offset, err}
+}
+
+func (d *packetDecoder) violation(field string, offset int, reason string) error {
+	return &ProtocolError{Type: d.typ, Field: field, Offset: offset, Reason: reason}
+}
+
+func (d *packetDecoder) readByte(field string) (b byte, err error) {
+	offset := d.offset()
+	b, err = d.buf.ReadByte()
+	if err != nil {
+		err = d.malformed(field, offset, err)
+	}
+	return
+}
+
+func (d *packetDecoder) readUint16(field string) (v uint16, err error) {
+	offset := d.offset()
+	v, err = ReadUint16(d.buf)
+	if err != nil {
+		err = d.malformed(field, offset, err)
+	}
+	return
+}
+
+func (d *packetDecoder) readString(field string) (str string, err error) {
+	offset := d.offset()
+	if d.strings != nil {
+		str, err = d.readCachedString()
+	} else {
+		str, err = LengthEncodedString(d.buf)
+	}
+	if err != nil {
+		return "", d.malformed(field, offset, err)
+	}
+
+	if d.utf8 != UTF8PassThrough {
+		if err = CheckString(str); err != nil {
+			if d.utf8 == UTF8Reject {
+				return "", d.malformed(field, offset, err)
+			}
+			str = replaceInvalid(str)
+			if d.replaced != nil {
+				*d.replaced = true
+			}
+		}
+	}
+	return str, nil
+}
+
+// readCachedString reads a length encoded string and returns the equal string from the string cache if there is one.
+func (d *packetDecoder) readCachedString() (string, error) {
+	n, err := ReadUint16(d.buf)
+	if err != nil {
+		return "", err
+	}
+	if d.buf.Len() < int(n) {
+		return "", io.ErrUnexpectedEOF
+	}
+	return d.strings.get(d.buf.Next(int(n))), nil
+}
+
+func (d *packetDecoder) readField(field string) (b []byte, err error) {
+	offset := d.offset()
+	b, err = LengthEncodedField(d.buf)
+	if err != nil {
+		err = d.malformed(field, offset, err)
+	}
+	return
+}
+
+// readProperties reads MQTT 5 properties (a variable byte integer length followed by the encoded properties) without
+// interpreting them.
+func (d *packetDecoder) readProperties(field string) (b []byte, err error) {
+	offset := d.offset()
+	n, err := VariableByteUint32(d.buf)
+	if err != nil {
+		err = d.malformed(field, offset, err)
+		return
+	}
+	if d.buf.Len() < int(n) {
+		err = d.malformed(field, offset, io.ErrUnexpectedEOF)
+		return
+	}
+	b = make([]byte, n)
+	_, _ = d.buf.Read(b)
+	return
+}
+
 func DecodeConnAckPacket(buf *bytes.Buffer) (p *ConnAckPacket, err error) {
+	d := newPacketDecoder(buf, TypeConnAck)
+	return decodeConnAckPacket(&d)
+}
+
+func decodeConnAckPacket(d *packetDecoder) (p *ConnAckPacket, err error) {
 	p = &ConnAckPacket{}
 
-	ackFlags, err := buf.ReadByte()
+	ackFlags, err := d.readByte("ConnectAcknowledgeFlags")
 	if err != nil {
 		return
 	}
+	if d.strict && ackFlags&0xFE != 0 {
+		err = d.violation("ConnectAcknowledgeFlags", 0, "reserved connect acknowledge flags set")
+		return
+	}
 	p.SessionPresent = (ackFlags & 0x1) > 0
 
-	p.ReturnCode, err = buf.ReadByte()
+	p.ReturnCode, err = d.readByte("ReturnCode")
 	if err != nil {
 		return
 	}
@@ -230,61 +701,103 @@ func DecodeConnAckPacket(buf *bytes.Buffer) (p *ConnAckPacket, err error) {
 }
 
 func DecodeConnectPacket(buf *bytes.Buffer) (p *ConnectPacket, err error) {
+	d := newPacketDecoder(buf, TypeConnect)
+	return decodeConnectPacket(&d)
+}
+
+func decodeConnectPacket(d *packetDecoder) (p *ConnectPacket, err error) {
 	p = &ConnectPacket{}
 
-	p.ProtocolName, err = LengthEncodedString(buf)
+	p.ProtocolName, err = d.readString("ProtocolName")
+	if err != nil {
+		return
+	}
 
 	switch p.ProtocolName {
 	case "MQTT", "MQIsdp":
 		break
 	default:
-		err = errors.New("unknown protocol type " + p.ProtocolName)
+		err = &UnsupportedVersionError{ProtocolName: p.ProtocolName}
 		return
 	}
 
 	// protocol level
-	p.ProtocolLevel, err = buf.ReadByte()
+	p.ProtocolLevel, err = d.readByte("ProtocolLevel")
 	if err != nil {
 		return
 	}
 
-	connectFlagByte, err := buf.ReadByte()
+	switch p.ProtocolLevel {
+	case ProtocolLevel31, ProtocolLevel311, ProtocolLevel5:
+		break
+	default:
+		err = &UnsupportedVersionError{p.ProtocolName, p.ProtocolLevel}
+		return
+	}
+
+	offset := d.offset()
+	connectFlagByte, err := d.readByte("ConnectFlags")
 	if err != nil {
 		return
 	}
+	if d.strict && connectFlagByte&0x1 != 0 {
+		err = &ProtocolError{Type: TypeConnect, Field: "ConnectFlags", Offset: offset, Reason: "reserved flag set",
+			Rule: "MQTT-3.1.2-3"}
+		return
+	}
 	p.ConnectFlags = DecodeConnectFlags(connectFlagByte)
 
-	p.KeepAlive = Uint16(buf)
+	p.KeepAlive, err = d.readUint16("KeepAlive")
+	if err != nil {
+		return
+	}
+
+	if p.ProtocolLevel == ProtocolLevel5 {
+		p.Properties, err = d.readProperties("Properties")
+		if err != nil {
+			return
+		}
+	}
 
-	p.ClientId, err = LengthEncodedString(buf)
+	offset = d.offset()
+	p.ClientId, err = d.readString("ClientId")
 	if err != nil {
 		return
 	}
-	if len(p.ClientId) == 0 {
-		err = errors.New("missing ClientId in CONNECT packet")
+	if len(p.ClientId) == 0 && !p.CleanSession && p.ProtocolLevel != ProtocolLevel5 {
+		// a zero-length ClientId is only allowed if the server should create a new session for the client, which the
+		// server then assigns a unique ClientId [MQTT-3.1.3-6, MQTT-3.1.3-7] (MQTT 5 servers assign one regardless)
+		err = &ProtocolError{Type: TypeConnect, Field: "ClientId", Offset: offset,
+			Reason: "missing ClientId in CONNECT packet without clean session", Rule: "MQTT-3.1.3-8"}
 		return
 	}
 
 	if p.ConnectFlags.WillFlag {
-		p.WillTopic, err = LengthEncodedString(buf)
+		if p.ProtocolLevel == ProtocolLevel5 {
+			p.WillProperties, err = d.readProperties("WillProperties")
+			if err != nil {
+				return
+			}
+		}
+		p.WillTopic, err = d.readString("WillTopic")
 		if err != nil {
 			return
 		}
-		p.WillMessage, err = LengthEncodedField(buf)
+		p.WillMessage, err = d.readField("WillMessage")
 		if err != nil {
 			return
 		}
 	}
 
 	if p.ConnectFlags.UserNameFlag {
-		p.UserName, err = LengthEncodedString(buf)
+		p.UserName, err = d.readString("UserName")
 		if err != nil {
 			return
 		}
 	}
 
 	if p.ConnectFlags.PasswordFlag {
-		p.Password, err = LengthEncodedField(buf)
+		p.Password, err = d.readField("Password")
 	}
 
 	return
@@ -302,91 +815,132 @@ func DecodeConnectFlags(b byte) ConnectFlags {
 }
 
 func DecodePublishPacket(buf *bytes.Buffer, header *PacketHeader) (p *PublishPacket, err error) {
-	p = &PublishPacket{}
+	d := newPacketDecoder(buf, TypePublish)
+	return decodePublishPacket(&d, header, &PublishPacket{})
+}
+
+// decodePublishPacket decodes the fields of a PUBLISH packet into p. The payload buffer of p is reused if it has
+// enough capacity.
+func decodePublishPacket(d *packetDecoder, header *PacketHeader, p *PublishPacket) (_ *PublishPacket, err error) {
+	buf := d.buf
 
 	p.Dup = (header.Flags & 0b1000) > 0
 	p.QoS = (header.Flags & 0b0110) >> 1
 	p.Retain = (header.Flags & 0b0001) > 0
 
-	varHeaderLen := 0
-	p.TopicName, err = LengthEncodedString(buf)
+	p.TopicName, err = d.readString("TopicName")
 	if err != nil {
 		return
 	}
-	varHeaderLen += len(p.TopicName) + 2 // length encoded string field length
 	if p.QoS > QoS0 {
-		p.PacketId = Uint16(buf)
-		varHeaderLen += 2
+		p.PacketId, err = d.readUint16("PacketId")
+		if err != nil {
+			return
+		}
 	}
 
 	// copy the remaining length of the packet into the payload buffer
-	remLen := int(header.Length) - varHeaderLen
+	offset := d.offset()
+	remLen := int(header.Length) - offset
+	if remLen < 0 {
+		err = d.malformed("TopicName", 0, fmt.Errorf("variable header exceeds remaining length %d", header.Length))
+		return
+	}
 	if remLen > 0 {
-		p.Payload = make([]byte, remLen)
-		_, err = buf.Read(p.Payload)
-		if err != nil {
+		if buf.Len() < remLen {
+			err = d.malformed("Payload", offset, io.ErrUnexpectedEOF)
 			return
 		}
+		p.Payload = append(p.Payload[:0], buf.Next(remLen)...)
 	}
 
-	return
+	return p, nil
 }
 
 func DecodePubAckPacket(buf *bytes.Buffer) (p *PubAckPacket, err error) {
-	p = &PubAckPacket{
-		PacketId: Uint16(buf),
-	}
+	d := newPacketDecoder(buf, TypePubAck)
+	return decodePubAckPacket(&d)
+}
+
+func decodePubAckPacket(d *packetDecoder) (p *PubAckPacket, err error) {
+	p = &PubAckPacket{}
+	p.PacketId, err = d.readUint16("PacketId")
 	return
 }
 
 func DecodePubRecPacket(buf *bytes.Buffer) (p *PubRecPacket, err error) {
-	p = &PubRecPacket{
-		PacketId: Uint16(buf),
-	}
+	d := newPacketDecoder(buf, TypePubRec)
+	return decodePubRecPacket(&d)
+}
+
+func decodePubRecPacket(d *packetDecoder) (p *PubRecPacket, err error) {
+	p = &PubRecPacket{}
+	p.PacketId, err = d.readUint16("PacketId")
 	return
 }
 
 func DecodePubRelPacket(buf *bytes.Buffer) (p *PubRelPacket, err error) {
-	p = &PubRelPacket{
-		PacketId: Uint16(buf),
-	}
+	d := newPacketDecoder(buf, TypePubRel)
+	return decodePubRelPacket(&d)
+}
+
+func decodePubRelPacket(d *packetDecoder) (p *PubRelPacket, err error) {
+	p = &PubRelPacket{}
+	p.PacketId, err = d.readUint16("PacketId")
 	return
 }
 
 func DecodePubCompPacket(buf *bytes.Buffer) (p *PubCompPacket, err error) {
-	p = &PubCompPacket{
-		PacketId: Uint16(buf),
-	}
+	d := newPacketDecoder(buf, TypePubComp)
+	return decodePubCompPacket(&d)
+}
+
+func decodePubCompPacket(d *packetDecoder) (p *PubCompPacket, err error) {
+	p = &PubCompPacket{}
+	p.PacketId, err = d.readUint16("PacketId")
 	return
 }
 
-func decodeSubscription(buf *bytes.Buffer) (s Subscription, err error) {
+func decodeSubscription(d *packetDecoder) (s Subscription, err error) {
 	s = Subscription{}
 
-	s.TopicFilter, err = LengthEncodedString(buf)
+	s.TopicFilter, err = d.readString("TopicFilter")
 	if err != nil {
 		return
 	}
-	qosByte, err := buf.ReadByte()
+	offset := d.offset()
+	qosByte, err := d.readByte("RequestedQoS")
 	if err != nil {
 		return
 	}
+	if d.strict && qosByte&0b11111100 != 0 {
+		err = &ProtocolError{Type: TypeSubscribe, Field: "RequestedQoS", Offset: offset, Reason: "reserved bits set",
+			Rule: "MQTT-3.8.3-4"}
+		return
+	}
 	s.QoS = qosByte & 0b00000011
 
 	return
 }
 
 func DecodeSubscribePacket(buf *bytes.Buffer) (p *SubscribePacket, err error) {
+	d := newPacketDecoder(buf, TypeSubscribe)
+	return decodeSubscribePacket(&d)
+}
+
+func decodeSubscribePacket(d *packetDecoder) (p *SubscribePacket, err error) {
 	p = &SubscribePacket{}
 
-	p.PacketId = Uint16(buf)
+	p.PacketId, err = d.readUint16("PacketId")
+	if err != nil {
+		return
+	}
 
 	var subs []Subscription
 
-	// FIXME: read number of bytes specified in the header
-	for buf.Len() > 0 {
+	for d.buf.Len() > 0 {
 		var sub Subscription
-		sub, err = decodeSubscription(buf)
+		sub, err = decodeSubscription(d)
 		if err != nil {
 			return
 		}
@@ -399,31 +953,45 @@ func DecodeSubscribePacket(buf *bytes.Buffer) (p *SubscribePacket, err error) {
 }
 
 func DecodeSubAckPacket(buf *bytes.Buffer) (p *SubAckPacket, err error) {
-	p = &SubAckPacket{}
-
-	p.PacketId = Uint16(buf)
+	d := newPacketDecoder(buf, TypeSubAck)
+	return decodeSubAckPacket(&d)
+}
 
-	// FIXME: read number of bytes specified in the header
-	n := buf.Len()
-	var codes = make([]SubAckCode, n)
+func decodeSubAckPacket(d *packetDecoder) (p *SubAckPacket, err error) {
+	p = &SubAckPacket{}
 
-	_, err = buf.Read(codes)
+	p.PacketId, err = d.readUint16("PacketId")
 	if err != nil {
 		return
 	}
 
+	n := d.buf.Len()
+	var codes = make([]SubAckCode, n)
+	_, _ = d.buf.Read(codes)
+
 	p.ReturnCodes = codes
 
 	return
 }
 
 func DecodeUnsubscribePacket(buf *bytes.Buffer) (p *UnsubscribePacket, err error) {
+	d := newPacketDecoder(buf, TypeUnsubscribe)
+	return decodeUnsubscribePacket(&d)
+}
+
+// decodeUnsubscribePacket reads the topic filters with readString, so that they are checked according to the UTF-8
+// mode of the decoder.
+func decodeUnsubscribePacket(d *packetDecoder) (p *UnsubscribePacket, err error) {
 	p = &UnsubscribePacket{}
-	p.PacketId = Uint16(buf)
+
+	p.PacketId, err = d.readUint16("PacketId")
+	if err != nil {
+		return
+	}
 
 	var filters []string
-	for buf.Len() > 0 {
-		filter, err := LengthEncodedString(buf)
+	for d.buf.Len() > 0 {
+		filter, err := d.readString("TopicFilter")
 		if err != nil {
 			return p, err
 		}
@@ -435,8 +1003,13 @@ func DecodeUnsubscribePacket(buf *bytes.Buffer) (p *UnsubscribePacket, err error
 }
 
 func DecodeUnsubAckPacket(buf *bytes.Buffer) (p *UnsubAckPacket, err error) {
+	d := newPacketDecoder(buf, TypeUnsubAck)
+	return decodeUnsubAckPacket(&d)
+}
+
+func decodeUnsubAckPacket(d *packetDecoder) (p *UnsubAckPacket, err error) {
 	p = &UnsubAckPacket{}
-	p.PacketId = Uint16(buf)
+	p.PacketId, err = d.readUint16("PacketId")
 	return
 }
 
@@ -450,7 +1023,12 @@ func DecodePingReqPacket(_ *bytes.Buffer) (packet *PingReqPacket, err error) {
 	return
 }
 
-func DecodeDisconnectPacket(_ *bytes.Buffer) (packet *DisconnectPacket, err error) {
+func DecodeDisconnectPacket(buf *bytes.Buffer) (packet *DisconnectPacket, err error) {
 	packet = &DisconnectPacket{}
+
+	// MQTT 5 DISCONNECT packets may have a reason code (and properties, which are ignored)
+	if buf.Len() > 0 {
+		packet.ReasonCode, _ = buf.ReadByte()
+	}
 	return
 }
@@ -5,12 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 )
 
 type Encoder struct {
 	w    io.Writer     // the underlying writer to write to
 	hBuf *bytes.Buffer // buffer used for the header
 	pBuf *bytes.Buffer // buffer used for the packet
+	bufs [2][]byte     // header and packet buffer that are written at once
+
+	deadline *deadline // the write deadline set by WritePacketContext, created on first use
 }
 
 func NewEncoder(w io.Writer) *Encoder {
@@ -22,6 +26,8 @@ func NewEncoder(w io.Writer) *Encoder {
 }
 
 func (w *Encoder) ReadPacketFrom(r Reader) error {
+	w.deadline.reset()
+
 	// if we can write directly to the underlying io writer (e.g., because we are using a DecodingStreamer)
 	if wt, ok := r.(io.WriterTo); ok {
 		_, err := wt.WriteTo(w.w)
@@ -40,9 +46,13 @@ func (w *Encoder) ReadPacketFrom(r Reader) error {
 //  1. serialize the packet into a byte buffer to know how long it is
 //  2. update the remaining length field of the header to the length that was written into byte buffer holding the packet
 //  3. serialize the header into a byte buffer
-//  4. write the header buffer
-//  5. write the packet buffer
-func (w *Encoder) WritePacket(packet Packet) (err error) {
+//  4. write the header and the packet buffer (with a single writev system call if the writer is a network connection)
+func (w *Encoder) WritePacket(packet Packet) error {
+	w.deadline.reset()
+	return w.writePacket(packet)
+}
+
+func (w *Encoder) writePacket(packet Packet) (err error) {
 	// reset buffers
 	hBuf := w.hBuf
 	pBuf := w.pBuf
@@ -70,18 +80,55 @@ func (w *Encoder) WritePacket(packet Packet) (err error) {
 		return
 	}
 
-	// write header buffer
+	// write header and packet buffer
+	w.bufs[0], w.bufs[1] = hBuf.Bytes(), pBuf.Bytes()
+	bufs := net.Buffers(w.bufs[:])
+	if pBuf.Len() == 0 {
+		// some writers (like net.Pipe) block on empty writes
+		bufs = bufs[:1]
+	}
+	_, err = bufs.WriteTo(w.w)
+	return
+}
+
+// WritePublishStream writes a PUBLISH packet whose payload is read from the given PublishStream, without buffering the
+// payload. Exactly PayloadLength bytes are copied from the payload reader; if it returns fewer bytes, the packet is
+// incomplete and io.ErrUnexpectedEOF is returned.
+func (w *Encoder) WritePublishStream(ps *PublishStream) (err error) {
+	w.deadline.reset()
+
+	hBuf := w.hBuf
+	pBuf := w.pBuf
+	hBuf.Reset()
+	pBuf.Reset()
+
+	encodePublishVariableHeader(pBuf, ps.Packet)
+
+	h := &PacketHeader{
+		Length: uint32(pBuf.Len()) + ps.PayloadLength,
+		Type:   TypePublish,
+		Flags:  ps.Packet.Flags(),
+	}
+
+	err = EncodeHeader(hBuf, h)
+	if err != nil {
+		return
+	}
+
 	_, err = hBuf.WriteTo(w.w)
 	if err != nil {
 		return
 	}
 
-	// write packet buffer
 	_, err = pBuf.WriteTo(w.w)
 	if err != nil {
 		return
 	}
 
+	_, err = io.CopyN(w.w, ps.Payload, int64(ps.PayloadLength))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	return
 }
 
@@ -112,7 +159,9 @@ func EncodePacket(buf *bytes.Buffer, p Packet) (err error) {
 		return EncodeUnsubscribePacket(buf, p.(*UnsubscribePacket))
 	case TypeUnsubAck:
 		return EncodeUnsubAckPacket(buf, p.(*UnsubAckPacket))
-	case TypePingReq, TypePingResp, TypeDisconnect:
+	case TypeDisconnect:
+		return EncodeDisconnectPacket(buf, p.(*DisconnectPacket))
+	case TypePingReq, TypePingResp:
 		return
 	default:
 		return errors.New(fmt.Sprintf("unknown packet type %d", p.Type()))
@@ -130,8 +179,14 @@ func EncodeConnectPacket(buf *bytes.Buffer, p *ConnectPacket) (err error) {
 	buf.WriteByte(p.ProtocolLevel)
 	_ = encodeConnectFlags(buf, p)
 	PutUint16(buf, p.KeepAlive)
+	if p.ProtocolLevel == ProtocolLevel5 {
+		putProperties(buf, p.Properties)
+	}
 	PutLengthEncodedString(buf, p.ClientId)
 	if p.WillFlag {
+		if p.ProtocolLevel == ProtocolLevel5 {
+			putProperties(buf, p.WillProperties)
+		}
 		PutLengthEncodedString(buf, p.WillTopic)
 		PutLengthEncodedField(buf, p.WillMessage)
 	}
@@ -145,6 +200,12 @@ func EncodeConnectPacket(buf *bytes.Buffer, p *ConnectPacket) (err error) {
 	return
 }
 
+// putProperties writes encoded MQTT 5 properties prefixed by their length.
+func putProperties(buf *bytes.Buffer, properties []byte) {
+	PutVariableByteUint32(buf, uint32(len(properties)))
+	buf.Write(properties)
+}
+
 func encodeConnectFlags(buf *bytes.Buffer, p *ConnectPacket) (err error) {
 	var flags byte
 
@@ -184,12 +245,19 @@ func EncodeConnAckPacket(buf *bytes.Buffer, p *ConnAckPacket) (err error) {
 }
 
 func EncodePublishPacket(buf *bytes.Buffer, p *PublishPacket) (err error) {
-	PutLengthEncodedString(buf, p.TopicName)
+	encodePublishVariableHeader(buf, p)
 	buf.Write(p.Payload)
 
 	return
 }
 
+func encodePublishVariableHeader(buf *bytes.Buffer, p *PublishPacket) {
+	PutLengthEncodedString(buf, p.TopicName)
+	if p.QoS > QoS0 {
+		PutUint16(buf, p.PacketId)
+	}
+}
+
 func EncodePubAckPacket(buf *bytes.Buffer, p *PubAckPacket) (err error) {
 	PutUint16(buf, p.PacketId)
 	return
@@ -245,3 +313,10 @@ func EncodeUnsubAckPacket(buf *bytes.Buffer, p *UnsubAckPacket) (err error) {
 	PutUint16(buf, p.PacketId)
 	return
 }
+
+func EncodeDisconnectPacket(buf *bytes.Buffer, p *DisconnectPacket) (err error) {
+	if p.ReasonCode != ReasonNormalDisconnection {
+		buf.WriteByte(p.ReasonCode)
+	}
+	return
+}
@@ -2,6 +2,9 @@ package mqtt
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
 	"testing"
 )
 
@@ -119,3 +122,212 @@ func TestEncoder_StreamDecoderIntegration(t *testing.T) {
 		}
 	}
 }
+
+func TestEncoder_StrictRoundTrip(t *testing.T) {
+	for _, p := range allPackets() {
+		buf := new(bytes.Buffer)
+		if err := NewEncoder(buf).WritePacket(p); err != nil {
+			t.Errorf("unexpected error encoding %s: %v", p.Type(), err)
+			continue
+		}
+
+		// the encoded packets conform to the specification, including their fixed header flags
+		streamer := NewDecodingStreamer(buf)
+		streamer.SetStrict(true)
+		actual, err := ReadNext(streamer)
+		if err != nil {
+			t.Errorf("unexpected error decoding %s: %v", p.Type(), err)
+			continue
+		}
+		if !p.Equal(actual) {
+			t.Errorf("round trip mismatch: %s != %s", actual, p)
+		}
+	}
+}
+
+func TestEncoder_MQTT5ConnectRoundTrip(t *testing.T) {
+	expected := &ConnectPacket{
+		ProtocolName:   "MQTT",
+		ProtocolLevel:  ProtocolLevel5,
+		ConnectFlags:   ConnectFlags{CleanSession: true, WillFlag: true},
+		KeepAlive:      30,
+		ClientId:       "client",
+		Properties:     []byte{0x11, 0, 0, 0, 60}, // session expiry interval
+		WillTopic:      "will",
+		WillMessage:    []byte("bye"),
+		WillProperties: []byte{0x01, 1}, // payload format indicator
+	}
+
+	buf := new(bytes.Buffer)
+	if err := NewEncoder(buf).WritePacket(expected); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	actual, err := ReadNext(NewDecodingStreamer(buf))
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if !expected.Equal(actual) {
+		t.Errorf("round trip mismatch: %v != %v", actual, expected)
+	}
+}
+
+func TestEncodeDisconnectPacket_ReasonCode(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := NewEncoder(buf).WritePacket(&DisconnectPacket{ReasonCode: ReasonPacketTooLarge}); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if !bytes.Equal([]byte{224, 1, 0x95}, buf.Bytes()) {
+		t.Fatalf("unexpected output %v", buf.Bytes())
+	}
+
+	p, err := ReadNext(NewDecodingStreamer(buf))
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if p.(*DisconnectPacket).ReasonCode != ReasonPacketTooLarge {
+		t.Error("unexpected reason code", p.(*DisconnectPacket).ReasonCode)
+	}
+}
+
+func TestEncodeDisconnectPacket_NormalDisconnection(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := NewEncoder(buf).WritePacket(&DisconnectPacket{}); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if !bytes.Equal([]byte{224, 0}, buf.Bytes()) {
+		t.Errorf("unexpected output %v", buf.Bytes())
+	}
+}
+
+func TestEncodePublishPacket_QoS1(t *testing.T) {
+	expected := []byte{
+		0, 1, 97, // Topic (a)
+		0, 42, // Packet id
+		104, 105, // Payload (hi)
+	}
+
+	buf := new(bytes.Buffer)
+	err := EncodePacket(buf, &PublishPacket{TopicName: "a", QoS: QoS1, PacketId: 42, Payload: []byte("hi")})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if !bytes.Equal(expected, buf.Bytes()) {
+		t.Errorf("unexpected output %v", buf.Bytes())
+	}
+}
+
+func TestDecodingStreamer_DecodePublishStream(t *testing.T) {
+	input := []byte{
+		50, 9, // Header (publish, QoS 1)
+		0, 1, 97, // Topic (a)
+		0, 42, // Packet id
+		104, 101, 108, 108, // Payload (hell)
+		192, 0, // Header (pingreq)
+	}
+	streamer := NewDecodingStreamer(bytes.NewReader(input))
+
+	_, err := streamer.Next()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	ps, err := streamer.DecodePublishStream()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertStringEquals(t, "a", ps.Packet.TopicName)
+	assertIntEquals(t, 42, int(ps.Packet.PacketId))
+	assertIntEquals(t, 4, int(ps.PayloadLength))
+
+	// the packet has not been consumed until the payload has been read
+	_, err = streamer.Next()
+	if err != StreamStateError {
+		t.Error("expected StreamStateError, got", err)
+	}
+
+	payload, err := ioutil.ReadAll(ps.Payload)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertStringEquals(t, "hell", string(payload))
+
+	p, err := ReadNext(streamer)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if p.Type() != TypePingReq {
+		t.Error("unexpected packet", p)
+	}
+}
+
+func TestDecodingStreamer_DecodePublishStream_Truncated(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader([]byte{
+		48, 10, // Header (publish)
+		0, 4, 116, 101, 115, 116, // Topic (test)
+		116, 101, // Payload (truncated)
+	}))
+
+	_, err := streamer.Next()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	ps, err := streamer.DecodePublishStream()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	_, err = ioutil.ReadAll(ps.Payload)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
+
+func TestDecodingStreamer_DecodePublishStream_TopicExceedsRemainingLength(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader([]byte{
+		48, 4, // Header (publish)
+		0, 8, 116, 101, // Topic (truncated)
+	}))
+
+	_, err := streamer.Next()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	_, err = streamer.DecodePublishStream()
+	if !errors.Is(err, ErrMalformedPacket) {
+		t.Error("expected malformed packet error, got", err)
+	}
+}
+
+func TestEncoder_WritePublishStream(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader(publishPacketBytes))
+	_, err := streamer.Next()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	ps, err := streamer.DecodePublishStream()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	out := new(bytes.Buffer)
+	err = NewEncoder(out).WritePublishStream(ps)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if !bytes.Equal(publishPacketBytes, out.Bytes()) {
+		t.Errorf("unexpected output %v", out.Bytes())
+	}
+}
+
+func TestEncoder_WritePublishStream_ShortPayload(t *testing.T) {
+	ps := &PublishStream{
+		Packet:        &PublishPacket{TopicName: "a"},
+		PayloadLength: 10,
+		Payload:       bytes.NewReader([]byte("short")),
+	}
+
+	err := NewEncoder(new(bytes.Buffer)).WritePublishStream(ps)
+	if err != io.ErrUnexpectedEOF {
+		t.Error("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
@@ -0,0 +1,106 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error kinds that can be used with errors.Is to classify errors returned by the decoding functions, e.g.:
+//
+//	if errors.Is(err, ErrMalformedPacket) { ... }
+//
+// Use errors.As with the corresponding error types to get details of the error.
+var (
+	// ErrMalformedPacket is the kind of MalformedPacketError.
+	ErrMalformedPacket = errors.New("malformed packet")
+	// ErrProtocolViolation is the kind of ProtocolError.
+	ErrProtocolViolation = errors.New("protocol violation")
+	// ErrUnsupportedVersion is the kind of UnsupportedVersionError.
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	// ErrPacketTooLarge is the kind of PacketTooLargeError.
+	ErrPacketTooLarge = errors.New("packet too large")
+)
+
+// MalformedPacketError is returned when the bytes of a packet can not be decoded, e.g., because the packet is shorter
+// than its fields indicate. Err holds the underlying cause (typically io.ErrUnexpectedEOF).
+//
+// Offset is the position in bytes of the field that could not be decoded, counted from the first byte after the fixed
+// header. Errors in the fixed header itself have Field set to FieldFixedHeader, and their Offset is counted from the
+// first byte of the packet.
+type MalformedPacketError struct {
+	Type   PacketType
+	Field  string
+	Offset int
+	Err    error
+}
+
+// FieldFixedHeader is the Field of errors that occur while reading the fixed header of a packet.
+const FieldFixedHeader = "FixedHeader"
+
+func (e *MalformedPacketError) Error() string {
+	return fmt.Sprintf("malformed %s packet: field %s at offset %d: %v", e.Type, e.Field, e.Offset, e.Err)
+}
+
+func (e *MalformedPacketError) Unwrap() error {
+	return e.Err
+}
+
+func (e *MalformedPacketError) Is(target error) bool {
+	return target == ErrMalformedPacket
+}
+
+// ProtocolError is returned when a packet could be decoded, but its contents violate the MQTT protocol. Offset has the
+// same semantics as in MalformedPacketError. Rule is the identifier of the violated normative statement of the
+// specification (e.g., "MQTT-3.1.2-3"), if there is one.
+type ProtocolError struct {
+	Type   PacketType
+	Field  string
+	Offset int
+	Reason string
+	Rule   string
+}
+
+func (e *ProtocolError) Error() string {
+	msg := fmt.Sprintf("protocol violation in %s packet: field %s at offset %d: %s", e.Type, e.Field, e.Offset,
+		e.Reason)
+	if e.Rule != "" {
+		msg += " [" + e.Rule + "]"
+	}
+	return msg
+}
+
+func (e *ProtocolError) Is(target error) bool {
+	return target == ErrProtocolViolation
+}
+
+// PacketTooLargeError is returned by a DecodingStreamer when the size of a packet (including the fixed header) exceeds
+// the configured maximum packet size. Since the packet has not been read, the stream can not be used any further. It is
+// a protocol violation, so errors.Is matches both ErrPacketTooLarge and ErrProtocolViolation.
+type PacketTooLargeError struct {
+	Type    PacketType
+	Size    uint32
+	MaxSize uint32
+}
+
+func (e *PacketTooLargeError) Error() string {
+	return fmt.Sprintf("%s packet of %d bytes exceeds maximum packet size of %d bytes", e.Type, e.Size, e.MaxSize)
+}
+
+func (e *PacketTooLargeError) Is(target error) bool {
+	return target == ErrPacketTooLarge || target == ErrProtocolViolation
+}
+
+// UnsupportedVersionError is returned when decoding a CONNECT packet with a protocol name or level that is not
+// supported. A server should respond with a CONNACK with return code 0x01 (unacceptable protocol version).
+type UnsupportedVersionError struct {
+	ProtocolName  string
+	ProtocolLevel uint8
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %s/%d", e.ProtocolName, e.ProtocolLevel)
+}
+
+func (e *UnsupportedVersionError) Is(target error) bool {
+	return target == ErrUnsupportedVersion
+}
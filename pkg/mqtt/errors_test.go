@@ -0,0 +1,263 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDecodePacket_TruncatedConnect_ReturnsMalformedPacketError(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{
+		0, 4, // protocol name length
+		77, 81, 84, 84, // "MQTT"
+		4,     // protocol level
+		2,     // connect flags (X clean session)
+		0, 60, // keepalive (60)
+		0, 15, // client id length
+		109, 111, 115, // mos (truncated)
+	})
+	h := &PacketHeader{Type: TypeConnect, Length: uint32(buf.Len())}
+
+	_, err := DecodePacket(buf, h)
+	if !errors.Is(err, ErrMalformedPacket) {
+		t.Fatal("expected malformed packet error, got", err)
+	}
+
+	var e *MalformedPacketError
+	if !errors.As(err, &e) {
+		t.Fatal("expected MalformedPacketError, got", err)
+	}
+	assertStringEquals(t, "ClientId", e.Field)
+	assertIntEquals(t, 10, e.Offset)
+	if e.Type != TypeConnect {
+		t.Error("unexpected packet type", e.Type)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("expected underlying cause to be io.ErrUnexpectedEOF, got", e.Err)
+	}
+}
+
+func TestDecodePacket_EmptyClientId(t *testing.T) {
+	connect := func(flags byte) (Packet, error) {
+		buf := bytes.NewBuffer([]byte{
+			0, 4, // protocol name length
+			77, 81, 84, 84, // "MQTT"
+			4,     // protocol level
+			flags, // connect flags
+			0, 60, // keepalive (60)
+			0, 0, // client id length
+		})
+		return DecodePacket(buf, &PacketHeader{Type: TypeConnect, Length: uint32(buf.Len())})
+	}
+
+	// a client that does not need a session may let the server assign a ClientId [MQTT-3.1.3-7]
+	p, err := connect(2)
+	if err != nil {
+		t.Fatal("unexpected error for empty client id with clean session", err)
+	}
+	assertStringEquals(t, "", p.(*ConnectPacket).ClientId)
+
+	// MQTT 5 servers assign a ClientId regardless of clean start
+	buf := bytes.NewBuffer([]byte{0, 4, 77, 81, 84, 84, 5, 0, 0, 60, 0, 0, 0})
+	if _, err = DecodePacket(buf, &PacketHeader{Type: TypeConnect, Length: uint32(buf.Len())}); err != nil {
+		t.Error("unexpected error for empty client id of MQTT 5 client", err)
+	}
+
+	_, err = connect(0)
+	var e *ProtocolError
+	if !errors.As(err, &e) {
+		t.Fatal("expected ProtocolError, got", err)
+	}
+	assertStringEquals(t, "ClientId", e.Field)
+	assertStringEquals(t, "MQTT-3.1.3-8", e.Rule)
+	assertIntEquals(t, 10, e.Offset)
+}
+
+func TestDecodePacket_UnknownProtocol_ReturnsUnsupportedVersionError(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{
+		0, 4, // protocol name length
+		77, 81, 84, 88, // "MQTX"
+		4, 2, 0, 60, 0, 1, 97,
+	})
+	h := &PacketHeader{Type: TypeConnect, Length: uint32(buf.Len())}
+
+	_, err := DecodePacket(buf, h)
+
+	var e *UnsupportedVersionError
+	if !errors.As(err, &e) {
+		t.Fatal("expected UnsupportedVersionError, got", err)
+	}
+	assertStringEquals(t, "MQTX", e.ProtocolName)
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Error("expected error to be ErrUnsupportedVersion")
+	}
+	if errors.Is(err, ErrMalformedPacket) {
+		t.Error("did not expect error to be ErrMalformedPacket")
+	}
+}
+
+func TestDecodePacket_UnsupportedProtocolLevel_ReturnsUnsupportedVersionError(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{
+		0, 4, // protocol name length
+		77, 81, 84, 84, // "MQTT"
+		42, 2, 0, 60, 0, 1, 97,
+	})
+	h := &PacketHeader{Type: TypeConnect, Length: uint32(buf.Len())}
+
+	_, err := DecodePacket(buf, h)
+
+	var e *UnsupportedVersionError
+	if !errors.As(err, &e) {
+		t.Fatal("expected UnsupportedVersionError, got", err)
+	}
+	assertIntEquals(t, 42, int(e.ProtocolLevel))
+}
+
+func TestDecodePacket_MissingClientId_ReturnsProtocolError(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{
+		0, 4, // protocol name length
+		77, 81, 84, 84, // "MQTT"
+		4, 0, 0, 60,
+		0, 0, // client id length
+	})
+	h := &PacketHeader{Type: TypeConnect, Length: uint32(buf.Len())}
+
+	_, err := DecodePacket(buf, h)
+	if !errors.Is(err, ErrProtocolViolation) {
+		t.Fatal("expected protocol violation, got", err)
+	}
+
+	var e *ProtocolError
+	if !errors.As(err, &e) {
+		t.Fatal("expected ProtocolError, got", err)
+	}
+	assertStringEquals(t, "ClientId", e.Field)
+	assertIntEquals(t, 10, e.Offset)
+}
+
+func TestDecodePacket_ReservedType_ReturnsProtocolError(t *testing.T) {
+	_, err := DecodePacket(bytes.NewBuffer(nil), &PacketHeader{Type: TypeReserved})
+
+	if !errors.Is(err, ErrProtocolViolation) {
+		t.Error("expected protocol violation, got", err)
+	}
+}
+
+func TestDecodePacket_ShortBuffer_ReturnsMalformedPacketError(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{0, 4, 116, 101})
+	h := &PacketHeader{Type: TypePublish, Length: 10}
+
+	_, err := DecodePacket(buf, h)
+
+	var e *MalformedPacketError
+	if !errors.As(err, &e) {
+		t.Fatal("expected MalformedPacketError, got", err)
+	}
+	assertStringEquals(t, "RemainingLength", e.Field)
+}
+
+func TestDecodePacket_PublishTopicExceedsRemainingLength(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{
+		0, 4, 116, 101, 115, 116, // topic "test"
+		0, 1, // packet id
+	})
+	h := &PacketHeader{Type: TypePublish, Flags: 0b0010, Length: 7}
+
+	_, err := DecodePacket(buf, h)
+	if !errors.Is(err, ErrMalformedPacket) {
+		t.Error("expected malformed packet error, got", err)
+	}
+}
+
+func TestDecodePacket_SubscribeWithMissingQoS_ReturnsMalformedPacketError(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{
+		0, 42, // packet id
+		0, 3, 0x61, 0x2F, 0x62, // a/b
+	})
+	h := &PacketHeader{Type: TypeSubscribe, Flags: 0b0010, Length: uint32(buf.Len())}
+
+	_, err := DecodePacket(buf, h)
+
+	var e *MalformedPacketError
+	if !errors.As(err, &e) {
+		t.Fatal("expected MalformedPacketError, got", err)
+	}
+	assertStringEquals(t, "RequestedQoS", e.Field)
+	assertIntEquals(t, 7, e.Offset)
+}
+
+func TestDecodePacket_PubAckTooShort_ReturnsMalformedPacketError(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{1})
+	h := &PacketHeader{Type: TypePubAck, Length: 1}
+
+	_, err := DecodePacket(buf, h)
+
+	var e *MalformedPacketError
+	if !errors.As(err, &e) {
+		t.Fatal("expected MalformedPacketError, got", err)
+	}
+	assertStringEquals(t, "PacketId", e.Field)
+	assertIntEquals(t, 0, e.Offset)
+}
+
+func TestDecodePacket_ConsumesOnlyRemainingLength(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{
+		0, 42, // packet id
+		0, 3, 0x61, 0x2F, 0x62, 1, // a/b
+		0, 3, 0x63, 0x2F, 0x64, 2, // c/d (next packet)
+	})
+	h := &PacketHeader{Type: TypeSubscribe, Flags: 0b0010, Length: 8}
+
+	p, err := DecodePacket(buf, h)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	assertIntEquals(t, 1, len(p.(*SubscribePacket).Subscriptions))
+	assertIntEquals(t, 6, buf.Len())
+}
+
+func TestDecodingStreamer_MaxPacketSize(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader(publishPacketBytes))
+	streamer.SetMaxPacketSize(uint32(len(publishPacketBytes)) - 1)
+
+	_, err := streamer.Next()
+
+	var e *PacketTooLargeError
+	if !errors.As(err, &e) {
+		t.Fatal("expected PacketTooLargeError, got", err)
+	}
+	assertIntEquals(t, len(publishPacketBytes), int(e.Size))
+	if e.Type != TypePublish {
+		t.Error("unexpected packet type", e.Type)
+	}
+	if !errors.Is(err, ErrPacketTooLarge) || !errors.Is(err, ErrProtocolViolation) {
+		t.Error("expected error to be ErrPacketTooLarge and ErrProtocolViolation")
+	}
+}
+
+func TestDecodingStreamer_MaxPacketSize_AcceptsPacketOfMaxSize(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader(publishPacketBytes))
+	streamer.SetMaxPacketSize(uint32(len(publishPacketBytes)))
+
+	_, err := streamer.Next()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	out := new(bytes.Buffer)
+	_, err = streamer.WriteTo(out)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if !bytes.Equal(publishPacketBytes, out.Bytes()) {
+		t.Errorf("unexpected output %v", out.Bytes())
+	}
+}
+
+func TestPacketHeader_Size(t *testing.T) {
+	assertIntEquals(t, 2, int((&PacketHeader{Type: TypePingReq}).Size()))
+	assertIntEquals(t, 129, int((&PacketHeader{Type: TypePublish, Length: 127}).Size()))
+	assertIntEquals(t, 131, int((&PacketHeader{Type: TypePublish, Length: 128}).Size()))
+}
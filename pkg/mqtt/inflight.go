@@ -0,0 +1,248 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrWindowFull is returned by InFlightWindow.TryAdd if the receive maximum has been reached.
+var ErrWindowFull = errors.New("in-flight window full")
+
+// InFlightWindow tracks the outgoing packets of a connection that wait for an acknowledgement: QoS 1 and 2 PUBLISH
+// packets until their PUBACK or PUBCOMP, and SUBSCRIBE and UNSUBSCRIBE packets until their SUBACK or UNSUBACK. It
+// allocates their packet identifiers, limits the number of unacknowledged PUBLISH packets to the receive maximum of the
+// peer, and returns the packets that need to be retransmitted, e.g.:
+//
+//	w := NewInFlightWindow(20, 10*time.Second)
+//	id, err := w.Add(ctx, publish) // blocks while 20 PUBLISH packets are unacknowledged
+//	...
+//	packet, done := w.Acknowledge(ack) // when a PUBACK, PUBREC, PUBCOMP, SUBACK or UNSUBACK arrives
+//	...
+//	for _, p := range w.Expired(time.Now()) { ... } // periodically, to retransmit
+//
+// An InFlightWindow is safe for concurrent use.
+type InFlightWindow struct {
+	ids          *PacketIdAllocator
+	slots        chan struct{} // holds one element per unacknowledged PUBLISH
+	retryTimeout time.Duration
+
+	mu      sync.Mutex
+	entries map[uint16]*inFlight
+	seq     uint64
+}
+
+type inFlight struct {
+	packet  Packet // the PUBLISH, SUBSCRIBE or UNSUBSCRIBE, or the PUBREL once a QoS 2 PUBLISH has been received
+	seq     uint64 // the packets are retransmitted in the order in which they have been added [MQTT-4.6.0-1]
+	sent    time.Time
+	publish bool // the packet holds a slot of the window
+}
+
+// NewInFlightWindow returns a window that allows receiveMaximum unacknowledged PUBLISH packets (0 means 65535, the
+// maximum), and retransmits packets that have not been acknowledged within retryTimeout (0 disables retransmission
+// by timeout, see Expired).
+func NewInFlightWindow(receiveMaximum uint16, retryTimeout time.Duration) *InFlightWindow {
+	if receiveMaximum == 0 {
+		receiveMaximum = 65535
+	}
+	return &InFlightWindow{
+		ids:          NewPacketIdAllocator(),
+		slots:        make(chan struct{}, receiveMaximum),
+		retryTimeout: retryTimeout,
+		entries:      make(map[uint16]*inFlight),
+	}
+}
+
+// ReceiveMaximum returns the maximum number of unacknowledged PUBLISH packets.
+func (w *InFlightWindow) ReceiveMaximum() int {
+	return cap(w.slots)
+}
+
+// Add assigns a free packet identifier to the packet and tracks it until it is acknowledged. If the packet is a
+// PUBLISH and the receive maximum has been reached, Add blocks until a PUBLISH is acknowledged or the context is done.
+// The packet must be a QoS 1 or 2 PUBLISH, a SUBSCRIBE or an UNSUBSCRIBE. The window keeps a copy of the packet.
+func (w *InFlightWindow) Add(ctx context.Context, packet Packet) (uint16, error) {
+	return w.add(ctx, packet)
+}
+
+// TryAdd is like Add, but returns ErrWindowFull instead of blocking.
+func (w *InFlightWindow) TryAdd(packet Packet) (uint16, error) {
+	return w.add(nil, packet)
+}
+
+func (w *InFlightWindow) add(ctx context.Context, packet Packet) (uint16, error) {
+	publish := false
+	switch p := packet.(type) {
+	case *PublishPacket:
+		if p.QoS == QoS0 {
+			return 0, errors.New("QoS 0 PUBLISH packets are not acknowledged")
+		}
+		publish = true
+	case *SubscribePacket, *UnsubscribePacket:
+	default:
+		return 0, fmt.Errorf("%s packets are not acknowledged", packet.Type())
+	}
+
+	if publish {
+		if ctx == nil {
+			select {
+			case w.slots <- struct{}{}:
+			default:
+				return 0, ErrWindowFull
+			}
+		} else {
+			select {
+			case w.slots <- struct{}{}:
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+	}
+
+	id, err := w.ids.Allocate()
+	if err != nil {
+		if publish {
+			<-w.slots
+		}
+		return 0, err
+	}
+	SetPacketId(packet, id)
+
+	w.mu.Lock()
+	w.seq++
+	w.entries[id] = &inFlight{packet: packet.Clone(), seq: w.seq, sent: time.Now(), publish: publish}
+	w.mu.Unlock()
+	return id, nil
+}
+
+// Acknowledge processes an acknowledgement of the peer. It returns the in-flight packet that the acknowledgement
+// refers to, and whether its flow is complete, in which case the packet is removed from the window and its identifier
+// is released. A PUBREC completes the first part of the QoS 2 flow: the PUBLISH is replaced by a PUBREL (which the
+// caller needs to send), which remains in the window until the PUBCOMP. If the window has no matching packet (e.g.,
+// because the identifier is unknown or the acknowledgement has the wrong type), Acknowledge returns nil.
+func (w *InFlightWindow) Acknowledge(ack Packet) (Packet, bool) {
+	id, _ := PacketId(ack)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	e, ok := w.entries[id]
+	if !ok {
+		return nil, false
+	}
+	packet := e.packet
+
+	switch ack.(type) {
+	case *PubAckPacket:
+		if p, ok := packet.(*PublishPacket); !ok || p.QoS != QoS1 {
+			return nil, false
+		}
+	case *PubRecPacket:
+		if p, ok := packet.(*PublishPacket); ok && p.QoS == QoS2 {
+			e.packet = &PubRelPacket{PacketId: id}
+			e.sent = time.Now()
+			return packet, false
+		}
+		if _, ok := packet.(*PubRelPacket); ok {
+			// the PUBREC has been sent again, e.g., because the PUBREL got lost
+			return packet, false
+		}
+		return nil, false
+	case *PubCompPacket:
+		if _, ok := packet.(*PubRelPacket); !ok {
+			return nil, false
+		}
+	case *SubAckPacket:
+		if _, ok := packet.(*SubscribePacket); !ok {
+			return nil, false
+		}
+	case *UnsubAckPacket:
+		if _, ok := packet.(*UnsubscribePacket); !ok {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	w.remove(id, e)
+	return packet, true
+}
+
+// Remove stops tracking the packet with the identifier (e.g., because the caller has given up waiting for its
+// acknowledgement), and releases the identifier. It returns the removed packet, or nil if there is none.
+func (w *InFlightWindow) Remove(id uint16) Packet {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	e, ok := w.entries[id]
+	if !ok {
+		return nil
+	}
+	w.remove(id, e)
+	return e.packet
+}
+
+// remove needs to be called with w.mu held.
+func (w *InFlightWindow) remove(id uint16, e *inFlight) {
+	delete(w.entries, id)
+	w.ids.Release(id)
+	if e.publish {
+		<-w.slots
+	}
+}
+
+// Expired returns the packets that have not been acknowledged within the retry timeout since they have last been
+// sent, in the order in which they have been added, and marks them as sent at the given time. PUBLISH packets are
+// returned as copies with the DUP flag set [MQTT-3.3.1-1]. Expired returns nil if the retry timeout is 0.
+func (w *InFlightWindow) Expired(now time.Time) []Packet {
+	if w.retryTimeout <= 0 {
+		return nil
+	}
+	return w.retransmit(now, func(e *inFlight) bool {
+		return now.Sub(e.sent) >= w.retryTimeout
+	})
+}
+
+// Resend returns all packets in the window like Expired, e.g., to send them again after reconnecting with a
+// persistent session [MQTT-4.4.0-1].
+func (w *InFlightWindow) Resend(now time.Time) []Packet {
+	return w.retransmit(now, func(*inFlight) bool {
+		return true
+	})
+}
+
+func (w *InFlightWindow) retransmit(now time.Time, due func(e *inFlight) bool) []Packet {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var entries []*inFlight
+	for _, e := range w.entries {
+		if due(e) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+
+	packets := make([]Packet, len(entries))
+	for i, e := range entries {
+		e.sent = now
+		if p, ok := e.packet.(*PublishPacket); ok {
+			p.Dup = true
+		}
+		packets[i] = e.packet.Clone()
+	}
+	return packets
+}
+
+// Len returns the number of packets in the window.
+func (w *InFlightWindow) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.entries)
+}
@@ -0,0 +1,182 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestInFlightWindow_QoS1(t *testing.T) {
+	w := NewInFlightWindow(0, 0)
+
+	p := &PublishPacket{TopicName: "a", QoS: QoS1}
+	id, err := w.Add(context.Background(), p)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertIntEquals(t, 1, int(id))
+	assertIntEquals(t, 1, int(p.PacketId))
+
+	if packet, done := w.Acknowledge(&PubRecPacket{PacketId: id}); packet != nil || done {
+		t.Error("PUBREC does not acknowledge a QoS 1 PUBLISH")
+	}
+	packet, done := w.Acknowledge(&PubAckPacket{PacketId: id})
+	if !done || !p.Equal(packet) {
+		t.Errorf("expected PUBLISH to be acknowledged, got %v", packet)
+	}
+	assertIntEquals(t, 0, w.Len())
+
+	if packet, _ = w.Acknowledge(&PubAckPacket{PacketId: id}); packet != nil {
+		t.Error("unexpected packet", packet)
+	}
+}
+
+func TestInFlightWindow_QoS2(t *testing.T) {
+	w := NewInFlightWindow(0, 0)
+
+	id, _ := w.Add(context.Background(), &PublishPacket{TopicName: "a", QoS: QoS2})
+	packet, done := w.Acknowledge(&PubRecPacket{PacketId: id})
+	if done || packet.Type() != TypePublish {
+		t.Errorf("expected PUBLISH to be received, got %v", packet)
+	}
+
+	// the PUBREL is retransmitted until the PUBCOMP arrives
+	resent := w.Resend(time.Now())
+	if len(resent) != 1 || !resent[0].Equal(&PubRelPacket{PacketId: id}) {
+		t.Errorf("expected PUBREL, got %v", resent)
+	}
+
+	packet, done = w.Acknowledge(&PubCompPacket{PacketId: id})
+	if !done || packet.Type() != TypePubRel {
+		t.Errorf("expected PUBREL to be completed, got %v", packet)
+	}
+	assertIntEquals(t, 0, w.Len())
+}
+
+func TestInFlightWindow_SubscribeUnsubscribe(t *testing.T) {
+	w := NewInFlightWindow(1, 0)
+
+	// SUBSCRIBE and UNSUBSCRIBE packets do not count towards the receive maximum
+	_, _ = w.TryAdd(&PublishPacket{TopicName: "a", QoS: QoS1})
+	sub, err := w.TryAdd(&SubscribePacket{Subscriptions: []Subscription{{"a", QoS0}}})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	unsub, _ := w.TryAdd(&UnsubscribePacket{TopicFilters: []string{"a"}})
+
+	if packet, _ := w.Acknowledge(&UnsubAckPacket{PacketId: sub}); packet != nil {
+		t.Error("UNSUBACK does not acknowledge a SUBSCRIBE")
+	}
+	if _, done := w.Acknowledge(&SubAckPacket{PacketId: sub, ReturnCodes: []SubAckCode{MaxQoS0}}); !done {
+		t.Error("expected SUBSCRIBE to be acknowledged")
+	}
+	if _, done := w.Acknowledge(&UnsubAckPacket{PacketId: unsub}); !done {
+		t.Error("expected UNSUBSCRIBE to be acknowledged")
+	}
+	assertIntEquals(t, 1, w.Len())
+}
+
+func TestInFlightWindow_ReceiveMaximum(t *testing.T) {
+	w := NewInFlightWindow(2, 0)
+	assertIntEquals(t, 2, w.ReceiveMaximum())
+
+	first, _ := w.TryAdd(&PublishPacket{TopicName: "a", QoS: QoS1})
+	_, _ = w.TryAdd(&PublishPacket{TopicName: "a", QoS: QoS2})
+	if _, err := w.TryAdd(&PublishPacket{TopicName: "a", QoS: QoS1}); err != ErrWindowFull {
+		t.Error("expected ErrWindowFull, got", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := w.Add(ctx, &PublishPacket{TopicName: "a", QoS: QoS1}); err != context.DeadlineExceeded {
+		t.Error("expected context.DeadlineExceeded, got", err)
+	}
+
+	// Add blocks until a PUBLISH is acknowledged
+	added := make(chan uint16)
+	go func() {
+		id, _ := w.Add(context.Background(), &PublishPacket{TopicName: "a", QoS: QoS1})
+		added <- id
+	}()
+	select {
+	case <-added:
+		t.Fatal("expected Add to block")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	w.Acknowledge(&PubAckPacket{PacketId: first})
+	select {
+	case id := <-added:
+		assertIntEquals(t, 3, int(id))
+	case <-time.After(time.Second):
+		t.Fatal("expected Add to return")
+	}
+}
+
+func TestInFlightWindow_Expired(t *testing.T) {
+	w := NewInFlightWindow(0, 10*time.Second)
+	start := time.Now()
+
+	first, _ := w.TryAdd(&PublishPacket{TopicName: "a", QoS: QoS1, Payload: []byte("1")})
+	second, _ := w.TryAdd(&PublishPacket{TopicName: "a", QoS: QoS2, Payload: []byte("2")})
+	w.Acknowledge(&PubRecPacket{PacketId: second})
+
+	if expired := w.Expired(start.Add(5 * time.Second)); len(expired) != 0 {
+		t.Error("unexpected expired packets", expired)
+	}
+
+	// expired packets are returned in order, PUBLISH packets with the DUP flag
+	expired := w.Expired(start.Add(11 * time.Second))
+	expected := []Packet{
+		&PublishPacket{TopicName: "a", QoS: QoS1, PacketId: first, Dup: true, Payload: []byte("1")},
+		&PubRelPacket{PacketId: second},
+	}
+	if len(expired) != len(expected) {
+		t.Fatalf("expected %d packets, got %v", len(expected), expired)
+	}
+	for i := range expected {
+		if !expected[i].Equal(expired[i]) {
+			t.Errorf("expected %s, got %s", expected[i], expired[i])
+		}
+	}
+
+	// the retry timeout starts again when the packets are retransmitted
+	if expired = w.Expired(start.Add(15 * time.Second)); len(expired) != 0 {
+		t.Error("unexpected expired packets", expired)
+	}
+	assertIntEquals(t, 2, len(w.Expired(start.Add(21*time.Second))))
+
+	if NewInFlightWindow(0, 0).Expired(start.Add(time.Hour)) != nil {
+		t.Error("expected no expired packets without retry timeout")
+	}
+}
+
+func TestInFlightWindow_Remove(t *testing.T) {
+	w := NewInFlightWindow(1, 0)
+
+	id, _ := w.TryAdd(&PublishPacket{TopicName: "a", QoS: QoS1})
+	if p := w.Remove(id); p == nil {
+		t.Error("expected removed packet")
+	}
+	if p := w.Remove(id); p != nil {
+		t.Error("unexpected packet", p)
+	}
+
+	// the slot and the identifier have been released
+	if _, err := w.TryAdd(&PublishPacket{TopicName: "a", QoS: QoS1}); err != nil {
+		t.Error("unexpected error", err)
+	}
+	assertIntEquals(t, 1, w.Len())
+}
+
+func TestInFlightWindow_Add_Unacknowledged(t *testing.T) {
+	w := NewInFlightWindow(0, 0)
+
+	if _, err := w.TryAdd(&PublishPacket{TopicName: "a"}); err == nil {
+		t.Error("expected error for QoS 0 PUBLISH")
+	}
+	if _, err := w.TryAdd(&PingReqPacket{}); err == nil {
+		t.Error("expected error for PINGREQ")
+	}
+	assertIntEquals(t, 0, w.Len())
+}
@@ -42,6 +42,13 @@ type PacketSink interface {
 	Writer
 }
 
+// WriterFunc is an adapter to use a function as a Writer, e.g., as the target of a router that intercepts packets.
+type WriterFunc func(packet Packet) error
+
+func (f WriterFunc) WritePacket(packet Packet) error {
+	return f(packet)
+}
+
 // The StreamReader wraps a Streamer as a Reader that calls Next on the Streamer implicitly when getting ReadPacket.
 type StreamReader struct {
 	s Streamer
@@ -70,14 +77,14 @@ func ReadNext(s Streamer) (Packet, error) {
 // WriterTo interfaces to give the underlying implementations an opportunity to optimize the copying process. Otherwise
 // it simply reads (and potentially decodes) the next packet and writes it to the writer.
 func Copy(src Reader, dst Writer) error {
-	if wt, ok := dst.(WriterTo); ok {
-		err := wt.WritePacketTo(dst)
-		return err
-	}
 	if rf, ok := dst.(ReaderFrom); ok {
 		err := rf.ReadPacketFrom(src)
 		return err
 	}
+	if wt, ok := src.(WriterTo); ok {
+		err := wt.WritePacketTo(dst)
+		return err
+	}
 
 	packet, err := src.ReadPacket()
 	if err != nil {
@@ -93,12 +100,16 @@ type Channel interface {
 
 type codecChannel struct {
 	*DecodingStreamer
-	*Encoder
+	PacketSink
 }
 
 func NewChannel(rw io.ReadWriter) Channel {
-	return &codecChannel{
-		NewDecodingStreamer(rw),
-		NewEncoder(rw),
-	}
+	return NewCodecChannel(NewDecodingStreamer(rw), NewEncoder(rw))
+}
+
+// NewCodecChannel creates a Channel that reads packets from the given DecodingStreamer and writes them into the given
+// sink (typically an Encoder or a BufferedEncoder). Use it instead of NewChannel to configure the streamer (e.g., with
+// SetStrict).
+func NewCodecChannel(s *DecodingStreamer, e PacketSink) Channel {
+	return &codecChannel{s, e}
 }
@@ -0,0 +1,69 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+type writerFunc func(packet Packet) error
+
+func (f writerFunc) WritePacket(packet Packet) error {
+	return f(packet)
+}
+
+var publishPacketBytes = []byte{
+	48, 10, // Header (publish)
+	0, 4, // Topic length
+	116, 101, 115, 116, // Topic (test)
+	116, 101, 115, 116, // Payload (test),
+}
+
+func TestCopy_ChannelToChannel(t *testing.T) {
+	src := NewChannel(readWriter{bytes.NewReader(publishPacketBytes), new(bytes.Buffer)})
+
+	out := new(bytes.Buffer)
+	dst := NewChannel(readWriter{bytes.NewReader(nil), out})
+
+	_, err := src.Next()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	err = Copy(src, dst)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if !bytes.Equal(publishPacketBytes, out.Bytes()) {
+		t.Errorf("unexpected output %v", out.Bytes())
+	}
+}
+
+func TestCopy_ToWriter(t *testing.T) {
+	src := NewDecodingStreamer(bytes.NewReader(publishPacketBytes))
+
+	var packets []Packet
+	dst := writerFunc(func(packet Packet) error {
+		packets = append(packets, packet)
+		return nil
+	})
+
+	_, err := src.Next()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	err = Copy(src, dst)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	assertIntEquals(t, 1, len(packets))
+	assertStringEquals(t, "test", packets[0].(*PublishPacket).TopicName)
+}
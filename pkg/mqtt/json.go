@@ -0,0 +1,503 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// MarshalText returns the packet type name (e.g., "PUBLISH").
+func (t PacketType) MarshalText() ([]byte, error) {
+	name, ok := packetTypeNames[t]
+	if !ok {
+		return nil, fmt.Errorf("invalid packet type %d", t)
+	}
+	return []byte(name), nil
+}
+
+// UnmarshalText parses a packet type name (e.g., "PUBLISH").
+func (t *PacketType) UnmarshalText(text []byte) error {
+	for k, v := range packetTypeNames {
+		if v == string(text) {
+			*t = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown packet type %s", text)
+}
+
+// jsonBytes is a binary field that is marshalled as a JSON string if it holds valid UTF-8 text, and as an object
+// {"base64": "..."} otherwise. Both representations are accepted when unmarshalling.
+type jsonBytes []byte
+
+type jsonBase64 struct {
+	Base64 string `json:"base64"`
+}
+
+func (b jsonBytes) MarshalJSON() ([]byte, error) {
+	if b == nil {
+		return []byte("null"), nil
+	}
+	if utf8.Valid(b) {
+		return json.Marshal(string(b))
+	}
+	return json.Marshal(jsonBase64{base64.StdEncoding.EncodeToString(b)})
+}
+
+func (b *jsonBytes) UnmarshalJSON(data []byte) (err error) {
+	if string(data) == "null" {
+		*b = nil
+		return
+	}
+
+	if len(data) > 0 && data[0] == '"' {
+		var str string
+		if err = json.Unmarshal(data, &str); err != nil {
+			return
+		}
+		*b = []byte(str)
+		return
+	}
+
+	var obj jsonBase64
+	if err = json.Unmarshal(data, &obj); err != nil {
+		return
+	}
+	*b, err = base64.StdEncoding.DecodeString(obj.Base64)
+	return
+}
+
+// UnmarshalPacketJSON creates a packet from its JSON representation. The concrete packet type is determined by the
+// "type" field.
+func UnmarshalPacketJSON(data []byte) (Packet, error) {
+	var typed struct {
+		Type *PacketType `json:"type"`
+	}
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return nil, err
+	}
+	if typed.Type == nil {
+		return nil, errors.New("missing packet type")
+	}
+
+	p, err := newPacket(*typed.Type)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// newPacket returns an empty packet of the given type.
+func newPacket(t PacketType) (Packet, error) {
+	switch t {
+	case TypeConnect:
+		return &ConnectPacket{}, nil
+	case TypeConnAck:
+		return &ConnAckPacket{}, nil
+	case TypePublish:
+		return &PublishPacket{}, nil
+	case TypePubAck:
+		return &PubAckPacket{}, nil
+	case TypePubRec:
+		return &PubRecPacket{}, nil
+	case TypePubRel:
+		return &PubRelPacket{}, nil
+	case TypePubComp:
+		return &PubCompPacket{}, nil
+	case TypeSubscribe:
+		return &SubscribePacket{}, nil
+	case TypeSubAck:
+		return &SubAckPacket{}, nil
+	case TypeUnsubscribe:
+		return &UnsubscribePacket{}, nil
+	case TypeUnsubAck:
+		return &UnsubAckPacket{}, nil
+	case TypePingReq:
+		return &PingReqPacket{}, nil
+	case TypePingResp:
+		return &PingRespPacket{}, nil
+	case TypeDisconnect:
+		return &DisconnectPacket{}, nil
+	default:
+		return nil, fmt.Errorf("unknown packet type %d", t)
+	}
+}
+
+// checkJsonType makes sure that the (optional) type field of a JSON packet matches the expected type.
+func checkJsonType(expected PacketType, actual *PacketType) error {
+	if actual != nil && *actual != expected {
+		return fmt.Errorf("cannot unmarshal %s into %s packet", *actual, expected)
+	}
+	return nil
+}
+
+type connectPacketJSON struct {
+	Type          *PacketType `json:"type"`
+	ProtocolName  string      `json:"protocolName"`
+	ProtocolLevel uint8       `json:"protocolLevel"`
+	CleanSession  bool        `json:"cleanSession"`
+	KeepAlive     uint16      `json:"keepAlive"`
+	ClientId      string      `json:"clientId"`
+	WillFlag      bool        `json:"willFlag,omitempty"`
+	WillQoS       QoS         `json:"willQos,omitempty"`
+	WillRetain    bool        `json:"willRetain,omitempty"`
+	WillTopic     string      `json:"willTopic,omitempty"`
+	WillMessage   jsonBytes   `json:"willMessage,omitempty"`
+	UserNameFlag  bool        `json:"userNameFlag,omitempty"`
+	UserName      string      `json:"userName,omitempty"`
+	PasswordFlag  bool        `json:"passwordFlag,omitempty"`
+	Password      jsonBytes   `json:"password,omitempty"`
+	// PasswordRedacted marks a password that has been left out by MarshalJSON.
+	PasswordRedacted bool `json:"passwordRedacted,omitempty"`
+
+	Properties     jsonBytes `json:"properties,omitempty"`
+	WillProperties jsonBytes `json:"willProperties,omitempty"`
+}
+
+// MarshalJSON returns the JSON representation of the packet. Like String, it does not include the password, so that
+// packets can be logged safely; passwordRedacted marks that the client sent one. UnmarshalJSON rejects such packets,
+// since they would encode differently than the original packet.
+func (p *ConnectPacket) MarshalJSON() ([]byte, error) {
+	t := p.Type()
+	return json.Marshal(connectPacketJSON{
+		Type:          &t,
+		ProtocolName:  p.ProtocolName,
+		ProtocolLevel: p.ProtocolLevel,
+		CleanSession:  p.CleanSession,
+		KeepAlive:     p.KeepAlive,
+		ClientId:      p.ClientId,
+		WillFlag:      p.WillFlag,
+		WillQoS:       p.WillQoS,
+		WillRetain:    p.WillRetain,
+		WillTopic:     p.WillTopic,
+		WillMessage:   p.WillMessage,
+		UserNameFlag:  p.UserNameFlag,
+		UserName:      p.UserName,
+		PasswordFlag:  p.PasswordFlag,
+
+		PasswordRedacted: p.PasswordFlag,
+
+		Properties:     p.Properties,
+		WillProperties: p.WillProperties,
+	})
+}
+
+func (p *ConnectPacket) UnmarshalJSON(data []byte) error {
+	var v connectPacketJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if err := checkJsonType(p.Type(), v.Type); err != nil {
+		return err
+	}
+	if v.PasswordRedacted {
+		return errors.New("the password of the CONNECT packet has been redacted")
+	}
+
+	p.ProtocolName = v.ProtocolName
+	p.ProtocolLevel = v.ProtocolLevel
+	p.KeepAlive = v.KeepAlive
+	p.ClientId = v.ClientId
+	p.WillTopic = v.WillTopic
+	p.WillMessage = v.WillMessage
+	p.UserName = v.UserName
+	p.Password = v.Password
+	p.Properties = v.Properties
+	p.WillProperties = v.WillProperties
+	p.ConnectFlags = ConnectFlags{
+		CleanSession: v.CleanSession,
+		WillFlag:     v.WillFlag,
+		WillQoS:      v.WillQoS,
+		WillRetain:   v.WillRetain,
+		PasswordFlag: v.PasswordFlag,
+		UserNameFlag: v.UserNameFlag,
+	}
+	return nil
+}
+
+type connAckPacketJSON struct {
+	Type           *PacketType `json:"type"`
+	SessionPresent bool        `json:"sessionPresent"`
+	ReturnCode     byte        `json:"returnCode"`
+}
+
+func (p *ConnAckPacket) MarshalJSON() ([]byte, error) {
+	t := p.Type()
+	return json.Marshal(connAckPacketJSON{&t, p.SessionPresent, p.ReturnCode})
+}
+
+func (p *ConnAckPacket) UnmarshalJSON(data []byte) error {
+	var v connAckPacketJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if err := checkJsonType(p.Type(), v.Type); err != nil {
+		return err
+	}
+
+	p.SessionPresent = v.SessionPresent
+	p.ReturnCode = v.ReturnCode
+	return nil
+}
+
+type publishPacketJSON struct {
+	Type      *PacketType `json:"type"`
+	Dup       bool        `json:"dup"`
+	QoS       QoS         `json:"qos"`
+	Retain    bool        `json:"retain"`
+	TopicName string      `json:"topicName"`
+	PacketId  uint16      `json:"packetId,omitempty"`
+	Payload   jsonBytes   `json:"payload"`
+}
+
+func (p *PublishPacket) MarshalJSON() ([]byte, error) {
+	t := p.Type()
+	return json.Marshal(publishPacketJSON{&t, p.Dup, p.QoS, p.Retain, p.TopicName, p.PacketId, p.Payload})
+}
+
+func (p *PublishPacket) UnmarshalJSON(data []byte) error {
+	var v publishPacketJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if err := checkJsonType(p.Type(), v.Type); err != nil {
+		return err
+	}
+
+	p.Dup = v.Dup
+	p.QoS = v.QoS
+	p.Retain = v.Retain
+	p.TopicName = v.TopicName
+	p.PacketId = v.PacketId
+	p.Payload = v.Payload
+	return nil
+}
+
+// packetIdJSON is the JSON representation of all packets that only hold a packet id.
+type packetIdJSON struct {
+	Type     *PacketType `json:"type"`
+	PacketId uint16      `json:"packetId"`
+}
+
+func marshalPacketIdJSON(t PacketType, id uint16) ([]byte, error) {
+	return json.Marshal(packetIdJSON{&t, id})
+}
+
+func unmarshalPacketIdJSON(t PacketType, data []byte, id *uint16) error {
+	var v packetIdJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if err := checkJsonType(t, v.Type); err != nil {
+		return err
+	}
+	*id = v.PacketId
+	return nil
+}
+
+func (p *PubAckPacket) MarshalJSON() ([]byte, error) {
+	return marshalPacketIdJSON(p.Type(), p.PacketId)
+}
+
+func (p *PubAckPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalPacketIdJSON(p.Type(), data, &p.PacketId)
+}
+
+func (p *PubRecPacket) MarshalJSON() ([]byte, error) {
+	return marshalPacketIdJSON(p.Type(), p.PacketId)
+}
+
+func (p *PubRecPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalPacketIdJSON(p.Type(), data, &p.PacketId)
+}
+
+func (p *PubRelPacket) MarshalJSON() ([]byte, error) {
+	return marshalPacketIdJSON(p.Type(), p.PacketId)
+}
+
+func (p *PubRelPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalPacketIdJSON(p.Type(), data, &p.PacketId)
+}
+
+func (p *PubCompPacket) MarshalJSON() ([]byte, error) {
+	return marshalPacketIdJSON(p.Type(), p.PacketId)
+}
+
+func (p *PubCompPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalPacketIdJSON(p.Type(), data, &p.PacketId)
+}
+
+func (p *UnsubAckPacket) MarshalJSON() ([]byte, error) {
+	return marshalPacketIdJSON(p.Type(), p.PacketId)
+}
+
+func (p *UnsubAckPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalPacketIdJSON(p.Type(), data, &p.PacketId)
+}
+
+type subscriptionJSON struct {
+	TopicFilter string `json:"topicFilter"`
+	QoS         QoS    `json:"qos"`
+}
+
+type subscribePacketJSON struct {
+	Type          *PacketType        `json:"type"`
+	PacketId      uint16             `json:"packetId"`
+	Subscriptions []subscriptionJSON `json:"subscriptions"`
+}
+
+func (p *SubscribePacket) MarshalJSON() ([]byte, error) {
+	t := p.Type()
+	v := subscribePacketJSON{
+		Type:          &t,
+		PacketId:      p.PacketId,
+		Subscriptions: make([]subscriptionJSON, len(p.Subscriptions)),
+	}
+	for i, sub := range p.Subscriptions {
+		v.Subscriptions[i] = subscriptionJSON{sub.TopicFilter, sub.QoS}
+	}
+	return json.Marshal(v)
+}
+
+func (p *SubscribePacket) UnmarshalJSON(data []byte) error {
+	var v subscribePacketJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if err := checkJsonType(p.Type(), v.Type); err != nil {
+		return err
+	}
+
+	p.PacketId = v.PacketId
+	p.Subscriptions = nil
+	for _, sub := range v.Subscriptions {
+		p.Subscriptions = append(p.Subscriptions, Subscription{sub.TopicFilter, sub.QoS})
+	}
+	return nil
+}
+
+type subAckPacketJSON struct {
+	Type        *PacketType `json:"type"`
+	PacketId    uint16      `json:"packetId"`
+	ReturnCodes []int       `json:"returnCodes"`
+}
+
+func (p *SubAckPacket) MarshalJSON() ([]byte, error) {
+	t := p.Type()
+	v := subAckPacketJSON{
+		Type:        &t,
+		PacketId:    p.PacketId,
+		ReturnCodes: make([]int, len(p.ReturnCodes)),
+	}
+	// SubAckCode is a byte, so we need to convert the codes to ints, otherwise they would be encoded as base64
+	for i, code := range p.ReturnCodes {
+		v.ReturnCodes[i] = int(code)
+	}
+	return json.Marshal(v)
+}
+
+func (p *SubAckPacket) UnmarshalJSON(data []byte) error {
+	var v subAckPacketJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if err := checkJsonType(p.Type(), v.Type); err != nil {
+		return err
+	}
+
+	p.PacketId = v.PacketId
+	p.ReturnCodes = nil
+	for _, code := range v.ReturnCodes {
+		if code < 0 || code > 0xFF {
+			return fmt.Errorf("invalid return code %d", code)
+		}
+		p.ReturnCodes = append(p.ReturnCodes, SubAckCode(code))
+	}
+	return nil
+}
+
+type unsubscribePacketJSON struct {
+	Type         *PacketType `json:"type"`
+	PacketId     uint16      `json:"packetId"`
+	TopicFilters []string    `json:"topicFilters"`
+}
+
+func (p *UnsubscribePacket) MarshalJSON() ([]byte, error) {
+	t := p.Type()
+	return json.Marshal(unsubscribePacketJSON{&t, p.PacketId, p.TopicFilters})
+}
+
+func (p *UnsubscribePacket) UnmarshalJSON(data []byte) error {
+	var v unsubscribePacketJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if err := checkJsonType(p.Type(), v.Type); err != nil {
+		return err
+	}
+
+	p.PacketId = v.PacketId
+	p.TopicFilters = v.TopicFilters
+	return nil
+}
+
+// emptyPacketJSON is the JSON representation of all packets that have no variable header or payload.
+type emptyPacketJSON struct {
+	Type *PacketType `json:"type"`
+}
+
+func marshalEmptyPacketJSON(t PacketType) ([]byte, error) {
+	return json.Marshal(emptyPacketJSON{&t})
+}
+
+func unmarshalEmptyPacketJSON(t PacketType, data []byte) error {
+	var v emptyPacketJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return checkJsonType(t, v.Type)
+}
+
+func (p *PingReqPacket) MarshalJSON() ([]byte, error) {
+	return marshalEmptyPacketJSON(p.Type())
+}
+
+func (p *PingReqPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalEmptyPacketJSON(p.Type(), data)
+}
+
+func (p *PingRespPacket) MarshalJSON() ([]byte, error) {
+	return marshalEmptyPacketJSON(p.Type())
+}
+
+func (p *PingRespPacket) UnmarshalJSON(data []byte) error {
+	return unmarshalEmptyPacketJSON(p.Type(), data)
+}
+
+type disconnectPacketJSON struct {
+	Type       *PacketType `json:"type"`
+	ReasonCode byte        `json:"reasonCode,omitempty"`
+}
+
+func (p *DisconnectPacket) MarshalJSON() ([]byte, error) {
+	t := p.Type()
+	return json.Marshal(disconnectPacketJSON{&t, p.ReasonCode})
+}
+
+func (p *DisconnectPacket) UnmarshalJSON(data []byte) error {
+	var v disconnectPacketJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if err := checkJsonType(p.Type(), v.Type); err != nil {
+		return err
+	}
+
+	p.ReasonCode = v.ReasonCode
+	return nil
+}
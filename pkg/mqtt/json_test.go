@@ -0,0 +1,192 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func allPackets() []Packet {
+	return []Packet{
+		&ConnectPacket{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: 4,
+			ConnectFlags: ConnectFlags{
+				CleanSession: true,
+				WillFlag:     true,
+				WillQoS:      QoS1,
+				WillRetain:   true,
+				PasswordFlag: true,
+				UserNameFlag: true,
+			},
+			KeepAlive:   60,
+			ClientId:    "mosqpub|9408-om",
+			WillTopic:   "clients/mosqpub/status",
+			WillMessage: []byte("offline"),
+			UserName:    "user",
+			Password:    []byte{0xFF, 0x00, 0x01},
+		},
+		&ConnAckPacket{SessionPresent: true},
+		&PublishPacket{Dup: true, QoS: QoS1, Retain: true, TopicName: "a/b", PacketId: 42, Payload: []byte("hello")},
+		&PubAckPacket{PacketId: 1},
+		&PubRecPacket{PacketId: 2},
+		&PubRelPacket{PacketId: 3},
+		&PubCompPacket{PacketId: 4},
+		&SubscribePacket{PacketId: 5, Subscriptions: []Subscription{{"a/+", QoS1}, {"b/#", QoS2}}},
+		&SubAckPacket{PacketId: 6, ReturnCodes: []SubAckCode{MaxQoS1, Failure}},
+		&UnsubscribePacket{PacketId: 7, TopicFilters: []string{"a/+", "b/#"}},
+		&UnsubAckPacket{PacketId: 8},
+		&PingReqPacket{},
+		&PingRespPacket{},
+		&DisconnectPacket{},
+	}
+}
+
+func TestUnmarshalPacketJSON_RoundTrip(t *testing.T) {
+	for _, p := range allPackets() {
+		data, err := json.Marshal(p)
+		if err != nil {
+			t.Errorf("unexpected error marshalling %s: %v", p.Type(), err)
+			continue
+		}
+
+		actual, err := UnmarshalPacketJSON(data)
+		if connect, ok := p.(*ConnectPacket); ok && connect.PasswordFlag {
+			// the password is not marshalled, so the packet can not be restored
+			if err == nil {
+				t.Errorf("expected error unmarshalling %s", data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error unmarshalling %s: %v", data, err)
+			continue
+		}
+		if !p.Equal(actual) {
+			t.Errorf("round trip mismatch: %s != %s", actual, p)
+		}
+	}
+}
+
+func TestConnectPacket_UnmarshalJSON_RoundTrip(t *testing.T) {
+	p := &ConnectPacket{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: 4,
+		ConnectFlags:  ConnectFlags{UserNameFlag: true},
+		ClientId:      "client",
+		UserName:      "user",
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	actual, err := UnmarshalPacketJSON(data)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if !p.Equal(actual) {
+		t.Errorf("round trip mismatch: %s != %s", actual, p)
+	}
+
+	// both packets encode to the same bytes
+	expected, encoded := new(bytes.Buffer), new(bytes.Buffer)
+	_ = NewEncoder(expected).WritePacket(p)
+	_ = NewEncoder(encoded).WritePacket(actual)
+	if !bytes.Equal(expected.Bytes(), encoded.Bytes()) {
+		t.Errorf("expected %x, got %x", expected.Bytes(), encoded.Bytes())
+	}
+}
+
+func TestConnectPacket_MarshalJSON_OmitsPassword(t *testing.T) {
+	p := &ConnectPacket{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: 4,
+		ConnectFlags:  ConnectFlags{UserNameFlag: true, PasswordFlag: true},
+		ClientId:      "client",
+		UserName:      "user",
+		Password:      []byte("secret"),
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if strings.Contains(string(data), "secret") || strings.Contains(string(data), `"password":`) {
+		t.Error("expected password to be omitted, got", string(data))
+	}
+	if !strings.Contains(string(data), `"passwordFlag":true`) {
+		t.Error("expected password flag, got", string(data))
+	}
+	if !strings.Contains(string(data), `"passwordRedacted":true`) {
+		t.Error("expected redaction marker, got", string(data))
+	}
+	if _, err = UnmarshalPacketJSON(data); err == nil {
+		t.Error("expected error unmarshalling a redacted password")
+	}
+}
+
+func TestConnectPacket_UnmarshalJSON_Password(t *testing.T) {
+	p := &ConnectPacket{}
+	if err := json.Unmarshal([]byte(`{"passwordFlag":true,"password":"secret"}`), p); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertStringEquals(t, "secret", string(p.Password))
+}
+
+func TestPublishPacket_MarshalJSON(t *testing.T) {
+	p := &PublishPacket{QoS: QoS1, TopicName: "a/b", PacketId: 42, Payload: []byte("hello")}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	expected := `{"type":"PUBLISH","dup":false,"qos":1,"retain":false,"topicName":"a/b","packetId":42,"payload":"hello"}`
+	assertStringEquals(t, expected, string(data))
+}
+
+func TestPublishPacket_MarshalJSON_BinaryPayload(t *testing.T) {
+	p := &PublishPacket{TopicName: "a/b", Payload: []byte{0xFF, 0xFE, 0x00}}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if !strings.Contains(string(data), `"payload":{"base64":"//4A"}`) {
+		t.Error("expected base64 encoded payload, got", string(data))
+	}
+
+	actual := &PublishPacket{}
+	if err = json.Unmarshal(data, actual); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if !reflect.DeepEqual(p.Payload, actual.Payload) {
+		t.Errorf("unexpected payload %v", actual.Payload)
+	}
+}
+
+func TestUnmarshalJSON_TypeMismatch(t *testing.T) {
+	p := &PubAckPacket{}
+
+	err := json.Unmarshal([]byte(`{"type":"PUBREC","packetId":1}`), p)
+	if err == nil {
+		t.Error("expected error when unmarshalling PUBREC into PUBACK")
+	}
+}
+
+func TestUnmarshalPacketJSON_MissingType(t *testing.T) {
+	_, err := UnmarshalPacketJSON([]byte(`{"packetId":1}`))
+	if err == nil {
+		t.Error("expected error for missing type")
+	}
+}
+
+func TestUnmarshalPacketJSON_UnknownType(t *testing.T) {
+	_, err := UnmarshalPacketJSON([]byte(`{"type":"FOO"}`))
+	if err == nil {
+		t.Error("expected error for unknown type")
+	}
+}
@@ -0,0 +1,141 @@
+package mqtt
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNoPacketIds is returned by PacketIdAllocator.Allocate if all packet identifiers are in use.
+var ErrNoPacketIds = errors.New("no free packet identifier")
+
+// PacketId returns the packet identifier of the packet, and false if the packet has none (e.g., a QoS 0 PUBLISH).
+func PacketId(packet Packet) (uint16, bool) {
+	switch p := packet.(type) {
+	case *PublishPacket:
+		return p.PacketId, p.QoS > QoS0
+	case *PubAckPacket:
+		return p.PacketId, true
+	case *PubRecPacket:
+		return p.PacketId, true
+	case *PubRelPacket:
+		return p.PacketId, true
+	case *PubCompPacket:
+		return p.PacketId, true
+	case *SubscribePacket:
+		return p.PacketId, true
+	case *SubAckPacket:
+		return p.PacketId, true
+	case *UnsubscribePacket:
+		return p.PacketId, true
+	case *UnsubAckPacket:
+		return p.PacketId, true
+	default:
+		return 0, false
+	}
+}
+
+// SetPacketId sets the packet identifier of the packet, and returns false if the packet has none.
+func SetPacketId(packet Packet, id uint16) bool {
+	switch p := packet.(type) {
+	case *PublishPacket:
+		if p.QoS == QoS0 {
+			return false
+		}
+		p.PacketId = id
+	case *PubAckPacket:
+		p.PacketId = id
+	case *PubRecPacket:
+		p.PacketId = id
+	case *PubRelPacket:
+		p.PacketId = id
+	case *PubCompPacket:
+		p.PacketId = id
+	case *SubscribePacket:
+		p.PacketId = id
+	case *SubAckPacket:
+		p.PacketId = id
+	case *UnsubscribePacket:
+		p.PacketId = id
+	case *UnsubAckPacket:
+		p.PacketId = id
+	default:
+		return false
+	}
+	return true
+}
+
+// PacketIdAllocator allocates the non-zero packet identifiers of one side of a connection. An identifier is in use from
+// its allocation until it is released, i.e., until the flow of the packet has been acknowledged [MQTT-2.3.1-2].
+// Identifiers are allocated in ascending order, wrapping around after 65535, so that a released identifier is not
+// reused right away. The zero value is ready to use, and a PacketIdAllocator is safe for concurrent use.
+type PacketIdAllocator struct {
+	mu   sync.Mutex
+	last uint16
+	used map[uint16]struct{}
+}
+
+func NewPacketIdAllocator() *PacketIdAllocator {
+	return &PacketIdAllocator{}
+}
+
+// Allocate returns the next packet identifier that is not in use, or ErrNoPacketIds if all 65535 are in use.
+func (a *PacketIdAllocator) Allocate() (uint16, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.used) == 65535 {
+		return 0, ErrNoPacketIds
+	}
+	for {
+		a.last++
+		if a.last == 0 {
+			a.last = 1
+		}
+		if _, used := a.used[a.last]; !used {
+			a.use(a.last)
+			return a.last, nil
+		}
+	}
+}
+
+// Reserve marks the packet identifier as in use, e.g., for the messages of a restored session. It returns false if
+// the identifier is 0 or already in use.
+func (a *PacketIdAllocator) Reserve(id uint16) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, used := a.used[id]; used || id == 0 {
+		return false
+	}
+	a.use(id)
+	return true
+}
+
+func (a *PacketIdAllocator) use(id uint16) {
+	if a.used == nil {
+		a.used = make(map[uint16]struct{})
+	}
+	a.used[id] = struct{}{}
+}
+
+// Release marks the packet identifier as free.
+func (a *PacketIdAllocator) Release(id uint16) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.used, id)
+}
+
+// InUse returns true if the packet identifier has been allocated or reserved, and not released.
+func (a *PacketIdAllocator) InUse(id uint16) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, used := a.used[id]
+	return used
+}
+
+// Len returns the number of packet identifiers in use.
+func (a *PacketIdAllocator) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.used)
+}
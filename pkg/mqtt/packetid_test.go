@@ -0,0 +1,93 @@
+package mqtt
+
+import (
+	"testing"
+)
+
+func TestPacketIdAllocator_Allocate(t *testing.T) {
+	a := NewPacketIdAllocator()
+
+	for i := 1; i <= 3; i++ {
+		id, err := a.Allocate()
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		assertIntEquals(t, i, int(id))
+	}
+
+	// released identifiers are not reused before the allocator wraps around
+	a.Release(2)
+	id, _ := a.Allocate()
+	assertIntEquals(t, 4, int(id))
+	assertIntEquals(t, 3, a.Len())
+}
+
+func TestPacketIdAllocator_Wraparound(t *testing.T) {
+	a := &PacketIdAllocator{last: 65534}
+	a.Reserve(1)
+
+	id, _ := a.Allocate()
+	assertIntEquals(t, 65535, int(id))
+
+	// 0 is not a valid identifier, and 1 is in use
+	id, _ = a.Allocate()
+	assertIntEquals(t, 2, int(id))
+}
+
+func TestPacketIdAllocator_Exhausted(t *testing.T) {
+	var a PacketIdAllocator
+	for i := 0; i < 65535; i++ {
+		if _, err := a.Allocate(); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+	if _, err := a.Allocate(); err != ErrNoPacketIds {
+		t.Fatal("expected ErrNoPacketIds, got", err)
+	}
+
+	a.Release(42)
+	id, err := a.Allocate()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertIntEquals(t, 42, int(id))
+}
+
+func TestPacketIdAllocator_Reserve(t *testing.T) {
+	var a PacketIdAllocator
+
+	if !a.Reserve(1) {
+		t.Error("expected 1 to be reserved")
+	}
+	if a.Reserve(1) {
+		t.Error("expected 1 to be in use")
+	}
+	if a.Reserve(0) {
+		t.Error("expected 0 to be refused")
+	}
+	if !a.InUse(1) {
+		t.Error("expected 1 to be in use")
+	}
+
+	id, _ := a.Allocate()
+	assertIntEquals(t, 2, int(id))
+}
+
+func TestSetPacketId(t *testing.T) {
+	p := &PublishPacket{TopicName: "a", QoS: QoS1}
+	if !SetPacketId(p, 7) {
+		t.Error("expected packet identifier to be set")
+	}
+	id, ok := PacketId(p)
+	if !ok {
+		t.Error("expected packet identifier")
+	}
+	assertIntEquals(t, 7, int(id))
+
+	if SetPacketId(&PublishPacket{TopicName: "a"}, 7) {
+		t.Error("QoS 0 PUBLISH packets have no packet identifier")
+	}
+	if _, ok = PacketId(&PingReqPacket{}); ok {
+		t.Error("PINGREQ packets have no packet identifier")
+	}
+}
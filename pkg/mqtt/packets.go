@@ -12,6 +12,31 @@ const (
 	QoS2 QoS = 0x02
 )
 
+// Protocol levels of the supported MQTT versions.
+const (
+	ProtocolLevel31  uint8 = 3 // MQTT 3.1 (protocol name "MQIsdp")
+	ProtocolLevel311 uint8 = 4 // MQTT 3.1.1
+	ProtocolLevel5   uint8 = 5 // MQTT 5
+)
+
+// Return codes of CONNACK packets.
+const (
+	ConnectAccepted                    byte = 0x00
+	ConnectUnacceptableProtocolVersion byte = 0x01
+	ConnectIdentifierRejected          byte = 0x02
+	ConnectServerUnavailable           byte = 0x03
+	ConnectBadUserNameOrPassword       byte = 0x04
+	ConnectNotAuthorized               byte = 0x05
+)
+
+// MQTT 5 reason codes of DISCONNECT packets.
+const (
+	ReasonNormalDisconnection byte = 0x00
+	ReasonServerShuttingDown  byte = 0x8B
+	ReasonKeepAliveTimeout    byte = 0x8D
+	ReasonPacketTooLarge      byte = 0x95
+)
+
 const (
 	MaxQoS0 SubAckCode = 0x00
 	MaxQoS1 SubAckCode = 0x01
@@ -91,6 +116,11 @@ type PacketHeader struct {
 	Length uint32
 }
 
+// Size returns the size in bytes of the entire packet, i.e., the fixed header plus the remaining length.
+func (h *PacketHeader) Size() uint32 {
+	return 1 + uint32(VariableByteUint32Size(h.Length)) + h.Length
+}
+
 type Packet interface {
 	// Type returns the constant identifying this particular packet's type.
 	Type() PacketType
@@ -99,6 +129,12 @@ type Packet interface {
 
 	Header() *PacketHeader
 	setHeader(header *PacketHeader)
+
+	// Clone returns a deep copy of the packet, which shares no memory with the original (including the header).
+	Clone() Packet
+	// Equal reports whether the other packet has the same type and the same field values. The header is not compared,
+	// and nil and empty slices are considered equal.
+	Equal(other Packet) bool
 }
 
 type headerContainer struct {
@@ -124,6 +160,11 @@ type ConnectPacket struct {
 	WillMessage   []byte
 	UserName      string
 	Password      []byte
+
+	// MQTT 5 only: the encoded CONNECT and will properties. They are not interpreted, but kept so that the packet can be
+	// re-encoded faithfully.
+	Properties     []byte
+	WillProperties []byte
 }
 
 type ConnectFlags struct {
@@ -292,7 +333,7 @@ func (*SubscribePacket) Type() PacketType {
 }
 
 func (*SubscribePacket) Flags() Flags {
-	return 0
+	return 2
 }
 
 type SubAckPacket struct {
@@ -345,6 +386,8 @@ func (p UnsubAckPacket) Flags() Flags {
 
 type DisconnectPacket struct {
 	headerContainer
+	// MQTT 5 only: the reason code of the disconnect. It is only encoded if it is not ReasonNormalDisconnection.
+	ReasonCode byte
 }
 
 func (*DisconnectPacket) Type() PacketType {
@@ -0,0 +1,115 @@
+package mqtt
+
+import (
+	"sync"
+)
+
+// pools of the packets that are decoded by a DecodingStreamer in pooled mode (see SetPooled)
+var (
+	publishPool = sync.Pool{New: func() interface{} { return &PublishPacket{} }}
+	pubAckPool  = sync.Pool{New: func() interface{} { return &PubAckPacket{} }}
+	pubRecPool  = sync.Pool{New: func() interface{} { return &PubRecPacket{} }}
+	pubRelPool  = sync.Pool{New: func() interface{} { return &PubRelPacket{} }}
+	pubCompPool = sync.Pool{New: func() interface{} { return &PubCompPacket{} }}
+)
+
+// ReleasePacket returns a packet decoded by a DecodingStreamer in pooled mode to its pool, so that it can be reused for
+// subsequent packets. The packet, its header, and its payload must not be used after it has been released. Packets of
+// types that are not pooled are ignored.
+func ReleasePacket(packet Packet) {
+	switch p := packet.(type) {
+	case *PublishPacket:
+		*p = PublishPacket{headerContainer: p.headerContainer, Payload: p.Payload[:0]}
+		publishPool.Put(p)
+	case *PubAckPacket:
+		p.PacketId = 0
+		pubAckPool.Put(p)
+	case *PubRecPacket:
+		p.PacketId = 0
+		pubRecPool.Put(p)
+	case *PubRelPacket:
+		p.PacketId = 0
+		pubRelPool.Put(p)
+	case *PubCompPacket:
+		p.PacketId = 0
+		pubCompPool.Put(p)
+	}
+}
+
+// decodePooledPacket decodes packets of pooled types into a packet from the pool. Other packets are decoded with
+// decodeFields.
+func decodePooledPacket(d *packetDecoder, h *PacketHeader) (Packet, error) {
+	switch h.Type {
+	case TypePublish:
+		p, err := decodePublishPacket(d, h, publishPool.Get().(*PublishPacket))
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	case TypePubAck, TypePubRec, TypePubRel, TypePubComp:
+		id, err := d.readUint16("PacketId")
+		if err != nil {
+			return nil, err
+		}
+		return pooledAckPacket(h.Type, id), nil
+	default:
+		return decodeFields(d, h)
+	}
+}
+
+func pooledAckPacket(t PacketType, id uint16) Packet {
+	switch t {
+	case TypePubAck:
+		p := pubAckPool.Get().(*PubAckPacket)
+		p.PacketId = id
+		return p
+	case TypePubRec:
+		p := pubRecPool.Get().(*PubRecPacket)
+		p.PacketId = id
+		return p
+	case TypePubRel:
+		p := pubRelPool.Get().(*PubRelPacket)
+		p.PacketId = id
+		return p
+	default:
+		p := pubCompPool.Get().(*PubCompPacket)
+		p.PacketId = id
+		return p
+	}
+}
+
+// setHeaderCopy sets a copy of the header to the packet. The header that a pooled packet already has is reused.
+func setHeaderCopy(p Packet, h *PacketHeader) {
+	if ph := p.Header(); ph != nil {
+		*ph = *h
+		return
+	}
+	hh := *h
+	p.setHeader(&hh)
+}
+
+// maxCachedStrings is the number of strings after which a stringCache is cleared.
+const maxCachedStrings = 1024
+
+// stringCache returns strings for byte slices, reusing previously returned strings with equal contents, so that
+// decoding frequently repeated strings (like topic names) does not allocate.
+type stringCache struct {
+	m map[string]string
+}
+
+func newStringCache() *stringCache {
+	return &stringCache{make(map[string]string)}
+}
+
+func (c *stringCache) get(b []byte) string {
+	if s, ok := c.m[string(b)]; ok { // the conversion does not allocate
+		return s
+	}
+
+	if len(c.m) >= maxCachedStrings {
+		c.m = make(map[string]string)
+	}
+	s := string(b)
+	c.m[s] = s
+	return s
+}
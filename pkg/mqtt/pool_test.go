@@ -0,0 +1,113 @@
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+)
+
+// repeatReader endlessly repeats the given bytes.
+type repeatReader struct {
+	b   []byte
+	off int
+}
+
+func (r *repeatReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		c := copy(p[n:], r.b[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.b)
+	}
+	return
+}
+
+var qos1PublishPacketBytes = []byte{
+	50, 17, // Header (publish, QoS 1)
+	0, 7, 115, 101, 110, 115, 111, 114, 115, // Topic (sensors)
+	0, 42, // Packet id
+	1, 2, 3, 4, 5, 6, // Payload
+}
+
+func TestDecodingStreamer_Pooled(t *testing.T) {
+	input := append(append([]byte{}, qos1PublishPacketBytes...), 64, 2, 0, 42) // followed by a PUBACK
+	streamer := NewDecodingStreamer(bytes.NewReader(input))
+	streamer.SetPooled(true)
+
+	p, err := ReadNext(streamer)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	publish := p.(*PublishPacket)
+	assertStringEquals(t, "sensors", publish.TopicName)
+	assertIntEquals(t, 42, int(publish.PacketId))
+	if !bytes.Equal([]byte{1, 2, 3, 4, 5, 6}, publish.Payload) {
+		t.Errorf("unexpected payload %v", publish.Payload)
+	}
+	assertIntEquals(t, 17, int(publish.Header().Length))
+
+	// the packet keeps its header after the streamer has advanced
+	p, err = ReadNext(streamer)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertIntEquals(t, 42, int(p.(*PubAckPacket).PacketId))
+	if publish.Header().Type != TypePublish {
+		t.Error("unexpected header of released packet", publish.Header())
+	}
+
+	ReleasePacket(publish)
+	ReleasePacket(p)
+}
+
+func TestReleasePacket_ResetsPacket(t *testing.T) {
+	p := &PublishPacket{TopicName: "a", QoS: QoS1, PacketId: 1, Payload: []byte("payload")}
+
+	ReleasePacket(p)
+
+	assertStringEquals(t, "", p.TopicName)
+	assertIntEquals(t, 0, int(p.PacketId))
+	assertIntEquals(t, 0, len(p.Payload))
+}
+
+func TestDecodingStreamer_Pooled_Allocations(t *testing.T) {
+	streamer := NewDecodingStreamer(&repeatReader{b: qos1PublishPacketBytes})
+	streamer.SetPooled(true)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		p, err := ReadNext(streamer)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		ReleasePacket(p)
+	})
+
+	if allocs > 0 {
+		t.Errorf("expected no allocations per packet, got %.1f", allocs)
+	}
+}
+
+func BenchmarkDecodingStreamer_Publish(b *testing.B) {
+	streamer := NewDecodingStreamer(&repeatReader{b: qos1PublishPacketBytes})
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(qos1PublishPacketBytes)))
+	for i := 0; i < b.N; i++ {
+		if _, err := ReadNext(streamer); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodingStreamer_Publish_Pooled(b *testing.B) {
+	streamer := NewDecodingStreamer(&repeatReader{b: qos1PublishPacketBytes})
+	streamer.SetPooled(true)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(qos1PublishPacketBytes)))
+	for i := 0; i < b.N; i++ {
+		p, err := ReadNext(streamer)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ReleasePacket(p)
+	}
+}
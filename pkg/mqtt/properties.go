@@ -0,0 +1,158 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// PropertyId identifies an MQTT 5 property.
+type PropertyId byte
+
+const (
+	PropPayloadFormatIndicator          PropertyId = 0x01
+	PropMessageExpiryInterval           PropertyId = 0x02
+	PropContentType                     PropertyId = 0x03
+	PropResponseTopic                   PropertyId = 0x08
+	PropCorrelationData                 PropertyId = 0x09
+	PropSubscriptionIdentifier          PropertyId = 0x0B
+	PropSessionExpiryInterval           PropertyId = 0x11
+	PropAssignedClientIdentifier        PropertyId = 0x12
+	PropServerKeepAlive                 PropertyId = 0x13
+	PropAuthenticationMethod            PropertyId = 0x15
+	PropAuthenticationData              PropertyId = 0x16
+	PropRequestProblemInformation       PropertyId = 0x17
+	PropWillDelayInterval               PropertyId = 0x18
+	PropRequestResponseInformation      PropertyId = 0x19
+	PropResponseInformation             PropertyId = 0x1A
+	PropServerReference                 PropertyId = 0x1C
+	PropReasonString                    PropertyId = 0x1F
+	PropReceiveMaximum                  PropertyId = 0x21
+	PropTopicAliasMaximum               PropertyId = 0x22
+	PropTopicAlias                      PropertyId = 0x23
+	PropMaximumQoS                      PropertyId = 0x24
+	PropRetainAvailable                 PropertyId = 0x25
+	PropUserProperty                    PropertyId = 0x26
+	PropMaximumPacketSize               PropertyId = 0x27
+	PropWildcardSubscriptionAvailable   PropertyId = 0x28
+	PropSubscriptionIdentifierAvailable PropertyId = 0x29
+	PropSharedSubscriptionAvailable     PropertyId = 0x2A
+)
+
+// propertyType is the data type of the value of a property.
+type propertyType int
+
+const (
+	propByte propertyType = iota
+	propTwoByteInt
+	propFourByteInt
+	propVariableByteInt
+	propString
+	propBinary
+	propStringPair
+)
+
+var propertyTypes = map[PropertyId]propertyType{
+	PropPayloadFormatIndicator:          propByte,
+	PropMessageExpiryInterval:           propFourByteInt,
+	PropContentType:                     propString,
+	PropResponseTopic:                   propString,
+	PropCorrelationData:                 propBinary,
+	PropSubscriptionIdentifier:          propVariableByteInt,
+	PropSessionExpiryInterval:           propFourByteInt,
+	PropAssignedClientIdentifier:        propString,
+	PropServerKeepAlive:                 propTwoByteInt,
+	PropAuthenticationMethod:            propString,
+	PropAuthenticationData:              propBinary,
+	PropRequestProblemInformation:       propByte,
+	PropWillDelayInterval:               propFourByteInt,
+	PropRequestResponseInformation:      propByte,
+	PropResponseInformation:             propString,
+	PropServerReference:                 propString,
+	PropReasonString:                    propString,
+	PropReceiveMaximum:                  propTwoByteInt,
+	PropTopicAliasMaximum:               propTwoByteInt,
+	PropTopicAlias:                      propTwoByteInt,
+	PropMaximumQoS:                      propByte,
+	PropRetainAvailable:                 propByte,
+	PropUserProperty:                    propStringPair,
+	PropMaximumPacketSize:               propFourByteInt,
+	PropWildcardSubscriptionAvailable:   propByte,
+	PropSubscriptionIdentifierAvailable: propByte,
+	PropSharedSubscriptionAvailable:     propByte,
+}
+
+// ErrUnknownProperty is the cause of errors about property identifiers that the specification does not define.
+var ErrUnknownProperty = errors.New("unknown property identifier")
+
+// Property is a decoded MQTT 5 property. Depending on the data type of the property, its value is held by Int (byte,
+// two and four byte integers, and variable byte integers), String (UTF-8 strings), Binary (binary data), or String and
+// Value (the name and value of a user property).
+type Property struct {
+	Id     PropertyId
+	Int    uint32
+	String string
+	Value  string
+	Binary []byte
+}
+
+// DecodeProperties decodes the properties of an MQTT 5 packet, as held by, e.g., ConnectPacket.Properties (i.e.,
+// without the leading property length). The error wraps io.ErrUnexpectedEOF if a value is truncated, and
+// ErrUnknownProperty if an identifier is not defined by the specification.
+func DecodeProperties(b []byte) (properties []Property, err error) {
+	buf := bytes.NewBuffer(b)
+
+	for buf.Len() > 0 {
+		offset := len(b) - buf.Len()
+		id, _ := buf.ReadByte()
+		p := Property{Id: PropertyId(id)}
+
+		t, ok := propertyTypes[p.Id]
+		if !ok {
+			return nil, fmt.Errorf("%w 0x%x at offset %d", ErrUnknownProperty, id, offset)
+		}
+		switch t {
+		case propByte:
+			var v byte
+			v, err = buf.ReadByte()
+			p.Int = uint32(v)
+		case propTwoByteInt:
+			p.Int, err = readUint(buf, 2)
+		case propFourByteInt:
+			p.Int, err = readUint(buf, 4)
+		case propVariableByteInt:
+			p.Int, err = VariableByteUint32(buf)
+		case propString:
+			p.String, err = LengthEncodedString(buf)
+		case propBinary:
+			p.Binary, err = LengthEncodedField(buf)
+		case propStringPair:
+			if p.String, err = LengthEncodedString(buf); err == nil {
+				p.Value, err = LengthEncodedString(buf)
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("property 0x%x at offset %d: %w", id, offset, err)
+		}
+
+		properties = append(properties, p)
+	}
+
+	return properties, nil
+}
+
+func readUint(buf *bytes.Buffer, n int) (uint32, error) {
+	b := buf.Next(n)
+	if len(b) < n {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if n == 2 {
+		return uint32(binary.BigEndian.Uint16(b)), nil
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
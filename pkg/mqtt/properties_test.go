@@ -0,0 +1,65 @@
+package mqtt
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeProperties(t *testing.T) {
+	b := []byte{
+		0x01, 1, // payload format indicator
+		0x21, 0x01, 0x00, // receive maximum (256)
+		0x11, 0x00, 0x00, 0x0e, 0x10, // session expiry interval (3600)
+		0x0B, 0x80, 0x01, // subscription identifier (128)
+		0x03, 0, 4, 't', 'e', 'x', 't', // content type
+		0x09, 0, 2, 0xff, 0x00, // correlation data
+		0x26, 0, 1, 'k', 0, 1, 'v', // user property
+	}
+
+	properties, err := DecodeProperties(b)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	expected := []Property{
+		{Id: PropPayloadFormatIndicator, Int: 1},
+		{Id: PropReceiveMaximum, Int: 256},
+		{Id: PropSessionExpiryInterval, Int: 3600},
+		{Id: PropSubscriptionIdentifier, Int: 128},
+		{Id: PropContentType, String: "text"},
+		{Id: PropCorrelationData, Binary: []byte{0xff, 0x00}},
+		{Id: PropUserProperty, String: "k", Value: "v"},
+	}
+	if !reflect.DeepEqual(expected, properties) {
+		t.Errorf("expected %+v, got %+v", expected, properties)
+	}
+}
+
+func TestDecodeProperties_Empty(t *testing.T) {
+	properties, err := DecodeProperties(nil)
+	if err != nil || len(properties) != 0 {
+		t.Error("expected no properties, got", properties, err)
+	}
+}
+
+func TestDecodeProperties_Truncated(t *testing.T) {
+	for _, b := range [][]byte{
+		{0x01},
+		{0x21, 0x01},
+		{0x11, 0x00, 0x00, 0x0e},
+		{0x03, 0, 4, 't'},
+		{0x26, 0, 1, 'k'},
+	} {
+		if _, err := DecodeProperties(b); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected io.ErrUnexpectedEOF for %x, got %v", b, err)
+		}
+	}
+}
+
+func TestDecodeProperties_UnknownIdentifier(t *testing.T) {
+	if _, err := DecodeProperties([]byte{0x01, 0, 0x04, 0}); !errors.Is(err, ErrUnknownProperty) {
+		t.Error("expected ErrUnknownProperty, got", err)
+	}
+}
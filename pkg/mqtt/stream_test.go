@@ -0,0 +1,173 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+// streamBytes is a stream of a CONNECT, a PUBLISH with a two byte remaining length, and a PINGREQ.
+var streamBytes = func() []byte {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	_ = enc.WritePacket(&ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: 4, ClientId: "client"})
+	_ = enc.WritePacket(&PublishPacket{TopicName: "a/b", QoS: QoS1, PacketId: 7, Payload: bytes.Repeat([]byte("x"), 200)})
+	_ = enc.WritePacket(&PingReqPacket{})
+	return buf.Bytes()
+}()
+
+func TestDecodingStreamer_OneByteReader(t *testing.T) {
+	streamer := NewDecodingStreamer(iotest.OneByteReader(bytes.NewReader(streamBytes)))
+
+	var packets []Packet
+	for {
+		p, err := ReadNext(streamer)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		packets = append(packets, p)
+	}
+
+	assertIntEquals(t, 3, len(packets))
+	assertStringEquals(t, "client", packets[0].(*ConnectPacket).ClientId)
+	assertIntEquals(t, 200, len(packets[1].(*PublishPacket).Payload))
+	assertIntEquals(t, 7, int(packets[1].(*PublishPacket).PacketId))
+	if packets[2].Type() != TypePingReq {
+		t.Error("unexpected packet", packets[2])
+	}
+}
+
+func TestDecodingStreamer_OneByteReader_WriteTo(t *testing.T) {
+	streamer := NewDecodingStreamer(iotest.OneByteReader(bytes.NewReader(streamBytes)))
+
+	out := new(bytes.Buffer)
+	for {
+		_, err := streamer.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		if _, err = streamer.WriteTo(out); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+
+	if !bytes.Equal(streamBytes, out.Bytes()) {
+		t.Errorf("unexpected output %v", out.Bytes())
+	}
+}
+
+func TestDecodingStreamer_OneByteReader_PublishStream(t *testing.T) {
+	streamer := NewDecodingStreamer(iotest.OneByteReader(bytes.NewReader(streamBytes)))
+
+	if _, err := ReadNext(streamer); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if _, err := streamer.Next(); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	ps, err := streamer.DecodePublishStream()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertStringEquals(t, "a/b", ps.Packet.TopicName)
+
+	payload, err := ioutil.ReadAll(ps.Payload)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertIntEquals(t, 200, len(payload))
+}
+
+func TestDecodingStreamer_TruncatedHeader(t *testing.T) {
+	// the remaining length of the PUBLISH is encoded in two bytes, the stream ends after the first
+	streamer := NewDecodingStreamer(iotest.OneByteReader(bytes.NewReader(streamBytes[:len(streamBytes)-210])))
+
+	if _, err := ReadNext(streamer); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	_, err := streamer.Next()
+
+	var e *MalformedPacketError
+	if !errors.As(err, &e) {
+		t.Fatal("expected MalformedPacketError, got", err)
+	}
+	assertStringEquals(t, FieldFixedHeader, e.Field)
+	assertIntEquals(t, 2, e.Offset)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
+
+func TestDecodingStreamer_TruncatedBody(t *testing.T) {
+	streamer := NewDecodingStreamer(iotest.OneByteReader(bytes.NewReader(publishPacketBytes[:8])))
+
+	if _, err := streamer.Next(); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	_, err := streamer.DecodePacket()
+	if err != io.ErrUnexpectedEOF {
+		t.Error("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
+
+func TestDecodingStreamer_TruncatedBody_WriteTo(t *testing.T) {
+	streamer := NewDecodingStreamer(iotest.OneByteReader(bytes.NewReader(publishPacketBytes[:8])))
+
+	if _, err := streamer.Next(); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	_, err := streamer.WriteTo(ioutil.Discard)
+	if err != io.ErrUnexpectedEOF {
+		t.Error("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
+
+func TestDecodingStreamer_RemainingLengthTooLong(t *testing.T) {
+	streamer := NewDecodingStreamer(iotest.OneByteReader(bytes.NewReader([]byte{48, 0x80, 0x80, 0x80, 0x80, 0x01})))
+
+	_, err := streamer.Next()
+	if !errors.Is(err, ErrMalformedPacket) || !errors.Is(err, ErrVariableByteIntegerTooLong) {
+		t.Error("expected malformed packet error, got", err)
+	}
+}
+
+func TestReadHeaderFrom_MaximumRemainingLength(t *testing.T) {
+	// 268,435,455 is the largest remaining length that can be encoded in four bytes
+	h, err := ReadHeaderFrom(iotest.OneByteReader(bytes.NewReader([]byte{48, 0xFF, 0xFF, 0xFF, 0x7F})))
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertIntEquals(t, 268435455, int(h.Length))
+}
+
+func TestDecodingStreamer_DataErrReader(t *testing.T) {
+	// the last read returns data together with io.EOF
+	streamer := NewDecodingStreamer(iotest.DataErrReader(bytes.NewReader(publishPacketBytes)))
+
+	p, err := ReadNext(streamer)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertStringEquals(t, "test", p.(*PublishPacket).TopicName)
+
+	_, err = streamer.Next()
+	if err != io.EOF {
+		t.Error("expected io.EOF, got", err)
+	}
+}
+
+func TestVariableByteUint32_TooLong(t *testing.T) {
+	_, err := VariableByteUint32(bytes.NewBuffer([]byte{0x80, 0x80, 0x80, 0x80, 0x01}))
+	if err != ErrVariableByteIntegerTooLong {
+		t.Error("expected ErrVariableByteIntegerTooLong, got", err)
+	}
+}
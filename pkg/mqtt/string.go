@@ -0,0 +1,145 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxStringPayload is the number of payload bytes shown by the String methods of packets.
+const maxStringPayload = 32
+
+func (p *ConnectPacket) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "%s(clientId=%q protocol=%s/%d keepAlive=%d", p.Type(), p.ClientId, p.ProtocolName,
+		p.ProtocolLevel, p.KeepAlive)
+	if p.CleanSession {
+		sb.WriteString(" cleanSession")
+	}
+	if p.WillFlag {
+		fmt.Fprintf(&sb, " will=(topic=%q qos=%d", p.WillTopic, p.WillQoS)
+		if p.WillRetain {
+			sb.WriteString(" retain")
+		}
+		fmt.Fprintf(&sb, " message=%s)", formatPayload(p.WillMessage))
+	}
+	if p.UserNameFlag {
+		fmt.Fprintf(&sb, " userName=%q", p.UserName)
+	}
+	if p.PasswordFlag {
+		sb.WriteString(" password=***")
+	}
+	sb.WriteString(")")
+
+	return sb.String()
+}
+
+func (p *ConnAckPacket) String() string {
+	return fmt.Sprintf("%s(returnCode=%d sessionPresent=%t)", p.Type(), p.ReturnCode, p.SessionPresent)
+}
+
+func (p *PublishPacket) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "%s(topic=%q qos=%d", p.Type(), p.TopicName, p.QoS)
+	if p.QoS > QoS0 {
+		fmt.Fprintf(&sb, " id=%d", p.PacketId)
+	}
+	if p.Retain {
+		sb.WriteString(" retain")
+	}
+	if p.Dup {
+		sb.WriteString(" dup")
+	}
+	fmt.Fprintf(&sb, " payload=%s)", formatPayload(p.Payload))
+
+	return sb.String()
+}
+
+func (p *PubAckPacket) String() string {
+	return fmt.Sprintf("%s(id=%d)", p.Type(), p.PacketId)
+}
+
+func (p *PubRecPacket) String() string {
+	return fmt.Sprintf("%s(id=%d)", p.Type(), p.PacketId)
+}
+
+func (p *PubRelPacket) String() string {
+	return fmt.Sprintf("%s(id=%d)", p.Type(), p.PacketId)
+}
+
+func (p *PubCompPacket) String() string {
+	return fmt.Sprintf("%s(id=%d)", p.Type(), p.PacketId)
+}
+
+func (p *SubscribePacket) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "%s(id=%d", p.Type(), p.PacketId)
+	for _, sub := range p.Subscriptions {
+		fmt.Fprintf(&sb, " %q:%d", sub.TopicFilter, sub.QoS)
+	}
+	sb.WriteString(")")
+
+	return sb.String()
+}
+
+func (p *SubAckPacket) String() string {
+	return fmt.Sprintf("%s(id=%d returnCodes=%v)", p.Type(), p.PacketId, []byte(p.ReturnCodes))
+}
+
+func (p *UnsubscribePacket) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "%s(id=%d", p.Type(), p.PacketId)
+	for _, filter := range p.TopicFilters {
+		fmt.Fprintf(&sb, " %q", filter)
+	}
+	sb.WriteString(")")
+
+	return sb.String()
+}
+
+func (p *UnsubAckPacket) String() string {
+	return fmt.Sprintf("%s(id=%d)", p.Type(), p.PacketId)
+}
+
+func (p *PingReqPacket) String() string {
+	return p.Type().String()
+}
+
+func (p *PingRespPacket) String() string {
+	return p.Type().String()
+}
+
+func (p *DisconnectPacket) String() string {
+	if p.ReasonCode != ReasonNormalDisconnection {
+		return fmt.Sprintf("%s(reasonCode=0x%x)", p.Type(), p.ReasonCode)
+	}
+	return p.Type().String()
+}
+
+// formatPayload returns a compact representation of binary data. Printable UTF-8 text is quoted and truncated, other
+// data is only represented by its length.
+func formatPayload(b []byte) string {
+	if !utf8.Valid(b) || strings.IndexFunc(string(b), isNotPrintable) >= 0 {
+		return fmt.Sprintf("<%d bytes>", len(b))
+	}
+
+	if len(b) <= maxStringPayload {
+		return fmt.Sprintf("%q", b)
+	}
+
+	// truncate at a rune boundary
+	n := maxStringPayload
+	for n > 0 && !utf8.RuneStart(b[n]) {
+		n--
+	}
+	return fmt.Sprintf("%q...<%d bytes>", b[:n], len(b))
+}
+
+func isNotPrintable(r rune) bool {
+	return !unicode.IsPrint(r) && !unicode.IsSpace(r)
+}
@@ -0,0 +1,50 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPublishPacket_String(t *testing.T) {
+	p := &PublishPacket{QoS: QoS1, Retain: true, TopicName: "a/b", PacketId: 42, Payload: []byte("hello")}
+
+	assertStringEquals(t, `PUBLISH(topic="a/b" qos=1 id=42 retain payload="hello")`, p.String())
+}
+
+func TestPublishPacket_String_BinaryPayload(t *testing.T) {
+	p := &PublishPacket{TopicName: "a/b", Payload: []byte{0xFF, 0x00}}
+
+	assertStringEquals(t, `PUBLISH(topic="a/b" qos=0 payload=<2 bytes>)`, p.String())
+}
+
+func TestPublishPacket_String_LongPayload(t *testing.T) {
+	p := &PublishPacket{TopicName: "a/b", Payload: []byte(strings.Repeat("x", 100))}
+
+	expected := fmt.Sprintf(`PUBLISH(topic="a/b" qos=0 payload="%s"...<100 bytes>)`, strings.Repeat("x", 32))
+	assertStringEquals(t, expected, p.String())
+}
+
+func TestConnectPacket_String(t *testing.T) {
+	p := &ConnectPacket{
+		ProtocolName:  "MQTT",
+		ProtocolLevel: 4,
+		ConnectFlags:  ConnectFlags{CleanSession: true, UserNameFlag: true, PasswordFlag: true},
+		KeepAlive:     60,
+		ClientId:      "client",
+		UserName:      "user",
+		Password:      []byte("secret"),
+	}
+
+	expected := `CONNECT(clientId="client" protocol=MQTT/4 keepAlive=60 cleanSession userName="user" password=***)`
+	assertStringEquals(t, expected, p.String())
+}
+
+func TestPacket_String(t *testing.T) {
+	for _, p := range allPackets() {
+		s := fmt.Sprint(p)
+		if !strings.HasPrefix(s, p.Type().String()) {
+			t.Errorf("expected string of %s packet to start with type name, was %s", p.Type(), s)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// UTF8Mode controls how a DecodingStreamer handles UTF-8 encoded strings (protocol name, client identifier, topic names
+// and filters, will topic and user name) that are not allowed by the specification: strings must be well-formed UTF-8
+// [MQTT-1.5.3-1], which excludes the surrogate code points U+D800 to U+DFFF, and must not contain U+0000
+// [MQTT-1.5.3-2].
+type UTF8Mode uint8
+
+const (
+	// UTF8PassThrough decodes strings without checking them (the default).
+	UTF8PassThrough UTF8Mode = iota
+	// UTF8Reject returns a MalformedPacketError for packets with invalid strings. Its Err is a StringError.
+	UTF8Reject
+	// UTF8Replace replaces ill-formed byte sequences and U+0000 with the replacement character U+FFFD.
+	UTF8Replace
+)
+
+func (m UTF8Mode) String() string {
+	switch m {
+	case UTF8PassThrough:
+		return "pass-through"
+	case UTF8Reject:
+		return "reject"
+	case UTF8Replace:
+		return "replace"
+	default:
+		return fmt.Sprintf("UTF8Mode(%d)", m)
+	}
+}
+
+// ParseUTF8Mode returns the UTF8Mode with the given name (see String).
+func ParseUTF8Mode(name string) (UTF8Mode, error) {
+	for m := UTF8PassThrough; m <= UTF8Replace; m++ {
+		if m.String() == name {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown UTF-8 mode %q", name)
+}
+
+// Reasons why a string is invalid, used as Err of a StringError.
+var (
+	ErrInvalidUTF8   = errors.New("ill-formed UTF-8")
+	ErrNullCharacter = errors.New("null character U+0000")
+)
+
+// StringError describes an invalid UTF-8 encoded string. Index is the position in bytes of the first invalid character
+// within the string, and Err is either ErrInvalidUTF8 or ErrNullCharacter.
+type StringError struct {
+	Index int
+	Err   error
+}
+
+func (e *StringError) Error() string {
+	return fmt.Sprintf("%v at byte %d of string", e.Err, e.Index)
+}
+
+func (e *StringError) Unwrap() error {
+	return e.Err
+}
+
+// CheckString returns a StringError if the string is not well-formed UTF-8 or contains U+0000, and nil otherwise.
+func CheckString(str string) error {
+	for i := 0; i < len(str); {
+		c := str[i]
+		if c == 0 {
+			return &StringError{i, ErrNullCharacter}
+		}
+		if c < utf8.RuneSelf {
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(str[i:])
+		if r == utf8.RuneError && size == 1 {
+			return &StringError{i, ErrInvalidUTF8}
+		}
+		i += size
+	}
+	return nil
+}
+
+// replaceInvalid replaces ill-formed byte sequences and U+0000 in the string with U+FFFD.
+func replaceInvalid(str string) string {
+	str = strings.ToValidUTF8(str, string(utf8.RuneError))
+	return strings.ReplaceAll(str, "\x00", string(utf8.RuneError))
+}
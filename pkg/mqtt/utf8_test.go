@@ -0,0 +1,194 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCheckString(t *testing.T) {
+	for _, str := range []string{"", "a/b", "ü/€/𝄞", "�"} {
+		if err := CheckString(str); err != nil {
+			t.Errorf("unexpected error for %q: %v", str, err)
+		}
+	}
+
+	invalid := []struct {
+		str   string
+		index int
+		err   error
+	}{
+		{"a\x00b", 1, ErrNullCharacter},
+		{"ab\xff", 2, ErrInvalidUTF8},
+		{"ü\xc3", 2, ErrInvalidUTF8},         // truncated sequence
+		{"a\xed\xa0\x80", 1, ErrInvalidUTF8}, // surrogate U+D800
+		{"\xc0\xaf", 0, ErrInvalidUTF8},      // overlong encoding of "/"
+	}
+	for _, tt := range invalid {
+		err := CheckString(tt.str)
+		var e *StringError
+		if !errors.As(err, &e) || !errors.Is(err, tt.err) || e.Index != tt.index {
+			t.Errorf("expected %v at %d for %q, got %v", tt.err, tt.index, tt.str, err)
+		}
+	}
+}
+
+func TestParseUTF8Mode(t *testing.T) {
+	for _, m := range []UTF8Mode{UTF8PassThrough, UTF8Reject, UTF8Replace} {
+		parsed, err := ParseUTF8Mode(m.String())
+		if err != nil || parsed != m {
+			t.Errorf("unexpected result for %s: %v %v", m, parsed, err)
+		}
+	}
+	if _, err := ParseUTF8Mode("ignore"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+// invalidTopicPublishBytes is a QoS 0 PUBLISH packet to the topic "a/\xff\x00".
+var invalidTopicPublishBytes = []byte{
+	48, 8, // Header
+	0, 4, // Topic length
+	97, 47, 0xff, 0x00, // Topic
+	104, 105, // Payload
+}
+
+func TestDecodingStreamer_UTF8PassThrough(t *testing.T) {
+	p, err := ReadNext(NewDecodingStreamer(bytes.NewReader(invalidTopicPublishBytes)))
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertStringEquals(t, "a/\xff\x00", p.(*PublishPacket).TopicName)
+}
+
+func TestDecodingStreamer_UTF8Reject(t *testing.T) {
+	for _, pooled := range []bool{false, true} {
+		streamer := NewDecodingStreamer(bytes.NewReader(invalidTopicPublishBytes))
+		streamer.SetPooled(pooled)
+		streamer.SetUTF8Mode(UTF8Reject)
+
+		_, err := ReadNext(streamer)
+
+		var e *MalformedPacketError
+		if !errors.As(err, &e) {
+			t.Fatal("expected MalformedPacketError, got", err)
+		}
+		assertStringEquals(t, "TopicName", e.Field)
+		assertIntEquals(t, 0, e.Offset)
+		var se *StringError
+		if !errors.As(err, &se) || !errors.Is(err, ErrInvalidUTF8) {
+			t.Fatal("expected StringError, got", err)
+		}
+		assertIntEquals(t, 2, se.Index)
+	}
+}
+
+func TestDecodingStreamer_UTF8Reject_Connect(t *testing.T) {
+	var buf bytes.Buffer
+	_ = NewEncoder(&buf).WritePacket(&ConnectPacket{ProtocolName: "MQTT", ProtocolLevel: 4, ClientId: "client\x00",
+		ConnectFlags: ConnectFlags{UserNameFlag: true}, UserName: "user"})
+
+	streamer := NewDecodingStreamer(&buf)
+	streamer.SetUTF8Mode(UTF8Reject)
+	_, err := ReadNext(streamer)
+
+	var e *MalformedPacketError
+	if !errors.As(err, &e) || !errors.Is(err, ErrNullCharacter) {
+		t.Fatal("expected MalformedPacketError, got", err)
+	}
+	assertStringEquals(t, "ClientId", e.Field)
+	assertIntEquals(t, 10, e.Offset)
+}
+
+func TestDecodingStreamer_UTF8_Unsubscribe(t *testing.T) {
+	// an UNSUBSCRIBE packet with the topic filters "a/+" and "b/\xff"
+	data := []byte{162, 12, 0, 1, 0, 3, 'a', '/', '+', 0, 3, 'b', '/', 0xff}
+
+	for _, pooled := range []bool{false, true} {
+		streamer := NewDecodingStreamer(bytes.NewReader(data))
+		streamer.SetPooled(pooled)
+		streamer.SetUTF8Mode(UTF8Reject)
+
+		_, err := ReadNext(streamer)
+		var e *MalformedPacketError
+		if !errors.As(err, &e) || !errors.Is(err, ErrInvalidUTF8) {
+			t.Fatal("expected MalformedPacketError, got", err)
+		}
+		assertStringEquals(t, "TopicFilter", e.Field)
+		assertIntEquals(t, 7, e.Offset)
+	}
+
+	streamer := NewDecodingStreamer(bytes.NewReader(data))
+	streamer.SetUTF8Mode(UTF8Replace)
+	p, err := ReadNext(streamer)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertStringEquals(t, "b/\uFFFD", p.(*UnsubscribePacket).TopicFilters[1])
+}
+
+func TestDecodingStreamer_UTF8Replace(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader(invalidTopicPublishBytes))
+	streamer.SetUTF8Mode(UTF8Replace)
+
+	p, err := ReadNext(streamer)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertStringEquals(t, "a/��", p.(*PublishPacket).TopicName)
+	assertStringEquals(t, "hi", string(p.(*PublishPacket).Payload))
+}
+
+func TestDecodingStreamer_UTF8Replace_WriteTo(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader(append(invalidTopicPublishBytes, publishPacketBytes...)))
+	streamer.SetUTF8Mode(UTF8Replace)
+
+	out := new(bytes.Buffer)
+	for i := 0; i < 2; i++ {
+		if _, err := streamer.Next(); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		if _, err := streamer.WriteTo(out); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+
+	// the first packet is re-encoded with the replaced topic, the second one is written as is
+	p, err := ReadNext(NewDecodingStreamer(bytes.NewReader(out.Bytes())))
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	expected := &PublishPacket{TopicName: "a/��", Payload: []byte("hi")}
+	if !expected.Equal(p) {
+		t.Errorf("unexpected packet %s", p)
+	}
+	if !bytes.Equal(publishPacketBytes, out.Bytes()[out.Len()-len(publishPacketBytes):]) {
+		t.Error("unexpected bytes of second packet")
+	}
+}
+
+func TestDecodingStreamer_UTF8Reject_WriteTo(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader(invalidTopicPublishBytes))
+	streamer.SetUTF8Mode(UTF8Reject)
+
+	if _, err := streamer.Next(); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	out := new(bytes.Buffer)
+	if _, err := streamer.WriteTo(out); !errors.Is(err, ErrInvalidUTF8) {
+		t.Error("expected ErrInvalidUTF8, got", err)
+	}
+	assertIntEquals(t, 0, out.Len())
+}
+
+func TestDecodingStreamer_UTF8Reject_PublishStream(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader(invalidTopicPublishBytes))
+	streamer.SetUTF8Mode(UTF8Reject)
+
+	if _, err := streamer.Next(); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if _, err := streamer.DecodePublishStream(); !errors.Is(err, ErrInvalidUTF8) {
+		t.Error("expected ErrInvalidUTF8, got", err)
+	}
+}
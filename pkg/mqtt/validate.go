@@ -0,0 +1,404 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/topic"
+)
+
+// The validation functions check packets against the normative statements (MUST rules) of the MQTT 3.1.1
+// specification, and CONNECT packets of MQTT 5 clients against those of MQTT 5, including their properties. All strings
+// must be well-formed UTF-8 without U+0000, regardless of the UTF8Mode of the decoder. Other MQTT 5 packets carry
+// properties and reason codes that the packet types of this package do not model, so they are out of the scope of the
+// validation (the proxy disables strict mode for MQTT 5 clients after the CONNECT). Violations are reported as
+// ProtocolError, with Rule set to the identifier of the violated normative statement where the specification defines
+// one.
+//
+// Some rules can only be checked while decoding, because the decoded packet does not retain the information (e.g., the
+// reserved bit of the CONNECT flags). These are checked by a DecodingStreamer in strict mode (see SetStrict).
+
+// fixedRemainingLength holds the remaining length of packets that have a fixed size.
+var fixedRemainingLength = map[PacketType]uint32{
+	TypeConnAck:    2,
+	TypePubAck:     2,
+	TypePubRec:     2,
+	TypePubRel:     2,
+	TypePubComp:    2,
+	TypeUnsubAck:   2,
+	TypePingReq:    0,
+	TypePingResp:   0,
+	TypeDisconnect: 0,
+}
+
+// reservedFlagsRule holds the normative statements for the packets whose fixed header flags are not zero.
+var reservedFlagsRule = map[PacketType]string{
+	TypePubRel:      "MQTT-3.6.1-1",
+	TypeSubscribe:   "MQTT-3.8.1-1",
+	TypeUnsubscribe: "MQTT-3.10.1-1",
+}
+
+// ValidateHeader checks the fixed header of a packet. This can be done before the packet is read from the stream.
+func ValidateHeader(h *PacketHeader) error {
+	switch h.Type {
+	case TypeReserved, TypeAuth:
+		return headerViolation(h, "PacketType", "", fmt.Sprintf("reserved packet type %d", h.Type))
+	case TypePublish:
+		qos := (h.Flags & 0b0110) >> 1
+		if qos > QoS2 {
+			return headerViolation(h, "Flags", "MQTT-3.3.1-4", "PUBLISH packet with QoS 3")
+		}
+		if qos == QoS0 && h.Flags&0b1000 != 0 {
+			return headerViolation(h, "Flags", "MQTT-3.3.1-2", "DUP flag set on QoS 0 PUBLISH packet")
+		}
+	case TypePubRel, TypeSubscribe, TypeUnsubscribe:
+		if h.Flags != 0b0010 {
+			return headerViolation(h, "Flags", reservedFlagsRule[h.Type],
+				fmt.Sprintf("invalid fixed header flags 0x%x (expected 0x2)", h.Flags))
+		}
+	default:
+		if h.Flags != 0 {
+			return headerViolation(h, "Flags", "MQTT-2.2.2-1",
+				fmt.Sprintf("invalid fixed header flags 0x%x (expected 0x0)", h.Flags))
+		}
+	}
+
+	if length, ok := fixedRemainingLength[h.Type]; ok && h.Length != length {
+		return headerViolation(h, "RemainingLength", "",
+			fmt.Sprintf("invalid remaining length %d (expected %d)", h.Length, length))
+	}
+
+	return nil
+}
+
+func headerViolation(h *PacketHeader, field string, rule string, reason string) error {
+	return &ProtocolError{Type: h.Type, Field: field, Offset: 0, Reason: reason, Rule: rule}
+}
+
+// ValidatePacket checks the contents of a decoded packet.
+func ValidatePacket(p Packet) error {
+	switch p := p.(type) {
+	case *ConnectPacket:
+		return validateConnectPacket(p)
+	case *ConnAckPacket:
+		return validateConnAckPacket(p)
+	case *PublishPacket:
+		return validatePublishPacket(p)
+	case *PubAckPacket:
+		return validatePacketId(p, p.PacketId)
+	case *PubRecPacket:
+		return validatePacketId(p, p.PacketId)
+	case *PubRelPacket:
+		return validatePacketId(p, p.PacketId)
+	case *PubCompPacket:
+		return validatePacketId(p, p.PacketId)
+	case *SubscribePacket:
+		return validateSubscribePacket(p)
+	case *SubAckPacket:
+		return validateSubAckPacket(p)
+	case *UnsubscribePacket:
+		return validateUnsubscribePacket(p)
+	case *UnsubAckPacket:
+		return validatePacketId(p, p.PacketId)
+	}
+	return nil
+}
+
+func violation(p Packet, field string, rule string, reason string) error {
+	return &ProtocolError{Type: p.Type(), Field: field, Reason: reason, Rule: rule}
+}
+
+func validatePacketId(p Packet, id uint16) error {
+	if id == 0 {
+		return violation(p, "PacketId", "MQTT-2.3.1-1", "packet identifier must be non-zero")
+	}
+	return nil
+}
+
+func validateConnectPacket(p *ConnectPacket) error {
+	switch {
+	case p.ProtocolName == "MQTT" && p.ProtocolLevel == ProtocolLevel311:
+	case p.ProtocolName == "MQIsdp" && p.ProtocolLevel == ProtocolLevel31:
+	case p.ProtocolName == "MQTT" && p.ProtocolLevel == ProtocolLevel5:
+	default:
+		return violation(p, "ProtocolName", "MQTT-3.1.2-1",
+			fmt.Sprintf("invalid protocol name %s for protocol level %d", p.ProtocolName, p.ProtocolLevel))
+	}
+
+	v5 := p.ProtocolLevel == ProtocolLevel5
+	if err := validateString(p, "ClientId", p.ClientId, v5); err != nil {
+		return err
+	}
+	if p.UserNameFlag {
+		if err := validateString(p, "UserName", p.UserName, v5); err != nil {
+			return err
+		}
+	}
+
+	// the will flag rules are numbered differently in MQTT 5
+	if p.WillFlag {
+		if p.WillQoS > QoS2 {
+			return violation(p, "ConnectFlags", versionRule(v5, "MQTT-3.1.2-14", "MQTT-3.1.2-12"), "will QoS 3")
+		}
+		if err := validateTopicName(p.WillTopic); err != "" {
+			return violation(p, "WillTopic", "MQTT-3.1.3-10", err)
+		}
+	} else {
+		if p.WillQoS != QoS0 {
+			return violation(p, "ConnectFlags", versionRule(v5, "MQTT-3.1.2-13", "MQTT-3.1.2-11"),
+				"will QoS set without will flag")
+		}
+		if p.WillRetain {
+			return violation(p, "ConnectFlags", versionRule(v5, "MQTT-3.1.2-15", "MQTT-3.1.2-13"),
+				"will retain set without will flag")
+		}
+	}
+
+	if !v5 {
+		if len(p.Properties) > 0 || len(p.WillProperties) > 0 {
+			return violation(p, "Properties", "", "properties require MQTT 5")
+		}
+		if p.PasswordFlag && !p.UserNameFlag {
+			return violation(p, "ConnectFlags", "MQTT-3.1.2-22", "password flag set without user name flag")
+		}
+		// MQTT 5 servers assign a ClientId to any client that sends a zero-length one
+		if len(p.ClientId) == 0 && !p.CleanSession {
+			return violation(p, "ClientId", "MQTT-3.1.3-8", "zero-length ClientId without clean session")
+		}
+		return nil
+	}
+
+	if err := validateConnectProperties(p); err != nil {
+		return err
+	}
+	if p.WillFlag {
+		return validateWillProperties(p)
+	}
+	if len(p.WillProperties) > 0 {
+		return violation(p, "WillProperties", "", "will properties set without will flag")
+	}
+	return nil
+}
+
+// validateString checks that a string of the packet is well-formed UTF-8 and does not contain U+0000. Topic names and
+// filters are checked by the topic package instead.
+func validateString(p Packet, field string, str string, v5 bool) error {
+	err := CheckString(str)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrNullCharacter):
+		return violation(p, field, versionRule(v5, "MQTT-1.5.3-2", "MQTT-1.5.4-2"), err.Error())
+	default:
+		return violation(p, field, versionRule(v5, "MQTT-1.5.3-1", "MQTT-1.5.4-1"), err.Error())
+	}
+}
+
+func versionRule(v5 bool, rule311 string, rule5 string) string {
+	if v5 {
+		return rule5
+	}
+	return rule311
+}
+
+// connectProperties and willProperties hold the properties that are allowed in the CONNECT properties and the will
+// properties.
+var (
+	connectProperties = map[PropertyId]bool{
+		PropSessionExpiryInterval:      true,
+		PropReceiveMaximum:             true,
+		PropMaximumPacketSize:          true,
+		PropTopicAliasMaximum:          true,
+		PropRequestResponseInformation: true,
+		PropRequestProblemInformation:  true,
+		PropUserProperty:               true,
+		PropAuthenticationMethod:       true,
+		PropAuthenticationData:         true,
+	}
+	willProperties = map[PropertyId]bool{
+		PropWillDelayInterval:      true,
+		PropPayloadFormatIndicator: true,
+		PropMessageExpiryInterval:  true,
+		PropContentType:            true,
+		PropResponseTopic:          true,
+		PropCorrelationData:        true,
+		PropUserProperty:           true,
+	}
+)
+
+func validateConnectProperties(p *ConnectPacket) error {
+	properties, err := validateProperties(p, "Properties", p.Properties, connectProperties)
+	if err != nil {
+		return err
+	}
+
+	authMethod := false
+	for _, prop := range properties {
+		switch prop.Id {
+		case PropRequestProblemInformation, PropRequestResponseInformation:
+			if prop.Int > 1 {
+				return violation(p, "Properties", "", fmt.Sprintf("property 0x%x has value %d (expected 0 or 1)",
+					prop.Id, prop.Int))
+			}
+		case PropReceiveMaximum, PropMaximumPacketSize:
+			if prop.Int == 0 {
+				return violation(p, "Properties", "", fmt.Sprintf("property 0x%x has value 0", prop.Id))
+			}
+		case PropAuthenticationMethod:
+			authMethod = true
+		}
+	}
+	for _, prop := range properties {
+		if prop.Id == PropAuthenticationData && !authMethod {
+			return violation(p, "Properties", "", "authentication data without authentication method")
+		}
+	}
+	return nil
+}
+
+func validateWillProperties(p *ConnectPacket) error {
+	properties, err := validateProperties(p, "WillProperties", p.WillProperties, willProperties)
+	if err != nil {
+		return err
+	}
+
+	for _, prop := range properties {
+		switch prop.Id {
+		case PropPayloadFormatIndicator:
+			if prop.Int > 1 {
+				return violation(p, "WillProperties", "",
+					fmt.Sprintf("payload format indicator has value %d (expected 0 or 1)", prop.Int))
+			}
+			if prop.Int == 1 {
+				if err := CheckString(string(p.WillMessage)); err != nil {
+					return violation(p, "WillMessage", "", "will message is not UTF-8 encoded character data: "+
+						err.Error())
+				}
+			}
+		case PropResponseTopic:
+			if err := validateTopicName(prop.String); err != "" {
+				return violation(p, "WillProperties", "", "invalid response topic: "+err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateProperties decodes the properties of an MQTT 5 packet, and checks that they are allowed in the packet, that
+// only user properties are included more than once, and that their strings are well-formed UTF-8.
+func validateProperties(p Packet, field string, b []byte, allowed map[PropertyId]bool) ([]Property, error) {
+	properties, err := DecodeProperties(b)
+	if errors.Is(err, ErrUnknownProperty) {
+		return nil, violation(p, field, "", err.Error())
+	} else if err != nil {
+		return nil, &MalformedPacketError{Type: p.Type(), Field: field, Err: err}
+	}
+
+	seen := make(map[PropertyId]bool, len(properties))
+	for _, prop := range properties {
+		if !allowed[prop.Id] {
+			return nil, violation(p, field, "", fmt.Sprintf("property 0x%x is not allowed in %s", prop.Id, field))
+		}
+		if seen[prop.Id] && prop.Id != PropUserProperty {
+			return nil, violation(p, field, "", fmt.Sprintf("property 0x%x is included more than once", prop.Id))
+		}
+		seen[prop.Id] = true
+
+		for _, str := range []string{prop.String, prop.Value} {
+			if err := CheckString(str); err != nil {
+				return nil, violation(p, field, "MQTT-1.5.4-1", fmt.Sprintf("property 0x%x: %v", prop.Id, err))
+			}
+		}
+	}
+	return properties, nil
+}
+
+func validateConnAckPacket(p *ConnAckPacket) error {
+	if p.ReturnCode > 5 {
+		return violation(p, "ReturnCode", "", fmt.Sprintf("reserved return code %d", p.ReturnCode))
+	}
+	if p.ReturnCode != 0 && p.SessionPresent {
+		return violation(p, "ConnectAcknowledgeFlags", "MQTT-3.2.2-4",
+			"session present set on CONNACK with non-zero return code")
+	}
+	return nil
+}
+
+func validatePublishPacket(p *PublishPacket) error {
+	if p.QoS > QoS2 {
+		return violation(p, "QoS", "MQTT-3.3.1-4", "PUBLISH packet with QoS 3")
+	}
+	if p.QoS == QoS0 && p.Dup {
+		return violation(p, "Dup", "MQTT-3.3.1-2", "DUP flag set on QoS 0 PUBLISH packet")
+	}
+	if err := validateTopicName(p.TopicName); err != "" {
+		return violation(p, "TopicName", "MQTT-3.3.2-2", err)
+	}
+	if p.QoS > QoS0 {
+		return validatePacketId(p, p.PacketId)
+	}
+	return nil
+}
+
+func validateSubscribePacket(p *SubscribePacket) error {
+	if err := validatePacketId(p, p.PacketId); err != nil {
+		return err
+	}
+	if len(p.Subscriptions) == 0 {
+		return violation(p, "Subscriptions", "MQTT-3.8.3-3", "SUBSCRIBE packet without topic filters")
+	}
+	for _, sub := range p.Subscriptions {
+		if err := validateTopicFilter(sub.TopicFilter); err != "" {
+			return violation(p, "TopicFilter", "MQTT-4.7.1-1", err)
+		}
+		if sub.QoS > QoS2 {
+			return violation(p, "RequestedQoS", "MQTT-3.8.3-4", "requested QoS 3")
+		}
+	}
+	return nil
+}
+
+func validateSubAckPacket(p *SubAckPacket) error {
+	if err := validatePacketId(p, p.PacketId); err != nil {
+		return err
+	}
+	for _, code := range p.ReturnCodes {
+		switch code {
+		case MaxQoS0, MaxQoS1, MaxQoS2, Failure:
+			continue
+		default:
+			return violation(p, "ReturnCodes", "MQTT-3.9.3-2", fmt.Sprintf("reserved return code 0x%x", code))
+		}
+	}
+	return nil
+}
+
+func validateUnsubscribePacket(p *UnsubscribePacket) error {
+	if err := validatePacketId(p, p.PacketId); err != nil {
+		return err
+	}
+	if len(p.TopicFilters) == 0 {
+		return violation(p, "TopicFilters", "MQTT-3.10.3-2", "UNSUBSCRIBE packet without topic filters")
+	}
+	for _, filter := range p.TopicFilters {
+		if err := validateTopicFilter(filter); err != "" {
+			return violation(p, "TopicFilter", "MQTT-4.7.1-1", err)
+		}
+	}
+	return nil
+}
+
+// validateTopicName returns a description of why the topic name is invalid, or an empty string if it is valid.
+func validateTopicName(name string) string {
+	if err := topic.ValidateName(name); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// validateTopicFilter returns a description of why the topic filter is invalid, or an empty string if it is valid.
+func validateTopicFilter(filter string) string {
+	if err := topic.ValidateFilter(filter); err != nil {
+		return err.Error()
+	}
+	return ""
+}
@@ -0,0 +1,356 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func assertViolation(t *testing.T, err error, rule string) {
+	t.Helper()
+
+	var e *ProtocolError
+	if !errors.As(err, &e) {
+		t.Errorf("expected ProtocolError with rule %s, got %v", rule, err)
+		return
+	}
+	if e.Rule != rule {
+		t.Errorf("expected violation of rule %s, got %v", rule, err)
+	}
+}
+
+func TestValidateHeader(t *testing.T) {
+	valid := []*PacketHeader{
+		{Type: TypeConnect, Length: 10},
+		{Type: TypePublish, Flags: 0b1011, Length: 10},
+		{Type: TypePubRel, Flags: 0b0010, Length: 2},
+		{Type: TypeSubscribe, Flags: 0b0010, Length: 8},
+		{Type: TypeUnsubscribe, Flags: 0b0010, Length: 7},
+		{Type: TypePingReq},
+	}
+	for _, h := range valid {
+		if err := ValidateHeader(h); err != nil {
+			t.Errorf("unexpected error for header %+v: %v", h, err)
+		}
+	}
+
+	invalid := []struct {
+		header *PacketHeader
+		rule   string
+	}{
+		{&PacketHeader{Type: TypePubRel, Flags: 0, Length: 2}, "MQTT-3.6.1-1"},
+		{&PacketHeader{Type: TypeSubscribe, Flags: 0, Length: 8}, "MQTT-3.8.1-1"},
+		{&PacketHeader{Type: TypeUnsubscribe, Flags: 0b0011, Length: 7}, "MQTT-3.10.1-1"},
+		{&PacketHeader{Type: TypeConnect, Flags: 0b0001, Length: 10}, "MQTT-2.2.2-1"},
+		{&PacketHeader{Type: TypePublish, Flags: 0b0110, Length: 10}, "MQTT-3.3.1-4"},
+		{&PacketHeader{Type: TypePublish, Flags: 0b1000, Length: 10}, "MQTT-3.3.1-2"},
+		{&PacketHeader{Type: TypePingReq, Length: 1}, ""},
+		{&PacketHeader{Type: TypePubAck, Length: 3}, ""},
+		{&PacketHeader{Type: TypeReserved}, ""},
+	}
+	for _, tc := range invalid {
+		assertViolation(t, ValidateHeader(tc.header), tc.rule)
+	}
+}
+
+func TestValidatePacket_Connect(t *testing.T) {
+	valid := func() *ConnectPacket {
+		return &ConnectPacket{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: 4,
+			ClientId:      "client",
+		}
+	}
+
+	if err := ValidatePacket(valid()); err != nil {
+		t.Error("unexpected error", err)
+	}
+
+	p := valid()
+	p.ProtocolName = "MQIsdp"
+	assertViolation(t, ValidatePacket(p), "MQTT-3.1.2-1")
+
+	p = valid()
+	p.PasswordFlag = true
+	p.Password = []byte("secret")
+	assertViolation(t, ValidatePacket(p), "MQTT-3.1.2-22")
+
+	p = valid()
+	p.WillRetain = true
+	assertViolation(t, ValidatePacket(p), "MQTT-3.1.2-15")
+
+	p = valid()
+	p.WillQoS = QoS1
+	assertViolation(t, ValidatePacket(p), "MQTT-3.1.2-13")
+
+	p = valid()
+	p.WillFlag = true
+	p.WillQoS = 3
+	p.WillTopic = "will"
+	assertViolation(t, ValidatePacket(p), "MQTT-3.1.2-14")
+
+	p = valid()
+	p.ClientId = "client\x00"
+	assertViolation(t, ValidatePacket(p), "MQTT-1.5.3-2")
+
+	p = valid()
+	p.UserNameFlag = true
+	p.UserName = "user\xff"
+	assertViolation(t, ValidatePacket(p), "MQTT-1.5.3-1")
+
+	p = valid()
+	p.ClientId = ""
+	assertViolation(t, ValidatePacket(p), "MQTT-3.1.3-8")
+
+	p.CleanSession = true
+	if err := ValidatePacket(p); err != nil {
+		t.Error("unexpected error for empty client id with clean session", err)
+	}
+}
+
+func TestValidatePacket_Connect5(t *testing.T) {
+	valid := func() *ConnectPacket {
+		return &ConnectPacket{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: ProtocolLevel5,
+			ConnectFlags:  ConnectFlags{WillFlag: true, WillQoS: QoS1},
+			ClientId:      "client",
+			WillTopic:     "will",
+			WillMessage:   []byte("bye"),
+			Properties: []byte{
+				0x11, 0, 0, 0, 60, // session expiry interval
+				0x21, 0, 10, // receive maximum
+				0x26, 0, 1, 'k', 0, 1, 'v', // user property
+				0x26, 0, 1, 'k', 0, 1, 'w', // user property
+			},
+			WillProperties: []byte{0x01, 1, 0x08, 0, 1, 'r'}, // payload format indicator, response topic
+		}
+	}
+	if err := ValidatePacket(valid()); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	// MQTT 5 allows a password without user name, and a zero-length ClientId without clean start
+	p := valid()
+	p.PasswordFlag = true
+	p.ClientId = ""
+	if err := ValidatePacket(p); err != nil {
+		t.Error("unexpected error", err)
+	}
+
+	p = valid()
+	p.WillFlag = false
+	assertViolation(t, ValidatePacket(p), "MQTT-3.1.2-11")
+
+	invalidProperties := [][]byte{
+		{0x01, 1},                            // payload format indicator is a will property
+		{0x11, 0, 0, 0, 1, 0x11, 0, 0, 0, 2}, // session expiry interval twice
+		{0x17, 2},                            // request problem information
+		{0x21, 0, 0},                         // receive maximum 0
+		{0x27, 0, 0, 0, 0},                   // maximum packet size 0
+		{0x16, 0, 1, 'x'},                    // authentication data without method
+		{0x26, 0, 1, 0xff, 0, 0},             // user property that is not UTF-8
+		{0x04, 0},                            // unknown property
+	}
+	for _, properties := range invalidProperties {
+		p = valid()
+		p.Properties = properties
+		var e *ProtocolError
+		if err := ValidatePacket(p); !errors.As(err, &e) || e.Field != "Properties" {
+			t.Errorf("expected violation in properties %x, got %v", properties, err)
+		}
+	}
+
+	p = valid()
+	p.Properties = []byte{0x21, 0}
+	if err := ValidatePacket(p); !errors.Is(err, ErrMalformedPacket) {
+		t.Error("expected malformed packet error, got", err)
+	}
+
+	invalidWillProperties := [][]byte{
+		{0x11, 0, 0, 0, 1},          // session expiry interval is a CONNECT property
+		{0x01, 2},                   // payload format indicator
+		{0x08, 0, 3, 'a', '/', '#'}, // response topic with wildcard
+	}
+	for _, properties := range invalidWillProperties {
+		p = valid()
+		p.WillProperties = properties
+		if err := ValidatePacket(p); !errors.Is(err, ErrProtocolViolation) {
+			t.Errorf("expected violation in will properties %x, got %v", properties, err)
+		}
+	}
+
+	p = valid()
+	p.WillMessage = []byte{0xff}
+	if err := ValidatePacket(p); !errors.Is(err, ErrProtocolViolation) {
+		t.Error("expected violation for will message that is not UTF-8, got", err)
+	}
+
+	p = valid()
+	p.ProtocolLevel = ProtocolLevel311
+	if err := ValidatePacket(p); !errors.Is(err, ErrProtocolViolation) {
+		t.Error("expected violation for properties in MQTT 3.1.1 CONNECT, got", err)
+	}
+}
+
+func TestValidatePacket_Publish(t *testing.T) {
+	if err := ValidatePacket(&PublishPacket{TopicName: "a/b", QoS: QoS1, PacketId: 1}); err != nil {
+		t.Error("unexpected error", err)
+	}
+
+	assertViolation(t, ValidatePacket(&PublishPacket{TopicName: "a/+", QoS: QoS0}), "MQTT-3.3.2-2")
+	assertViolation(t, ValidatePacket(&PublishPacket{TopicName: "a/b", QoS: QoS1}), "MQTT-2.3.1-1")
+	assertViolation(t, ValidatePacket(&PublishPacket{TopicName: "a/b", QoS: 3, PacketId: 1}), "MQTT-3.3.1-4")
+	assertViolation(t, ValidatePacket(&PublishPacket{TopicName: "a/b", Dup: true}), "MQTT-3.3.1-2")
+}
+
+func TestValidatePacket_Subscribe(t *testing.T) {
+	valid := &SubscribePacket{PacketId: 1, Subscriptions: []Subscription{{"a/+/c", QoS1}, {"a/#", QoS2}, {"#", QoS0}}}
+	if err := ValidatePacket(valid); err != nil {
+		t.Error("unexpected error", err)
+	}
+
+	assertViolation(t, ValidatePacket(&SubscribePacket{PacketId: 1}), "MQTT-3.8.3-3")
+	assertViolation(t, ValidatePacket(&SubscribePacket{Subscriptions: valid.Subscriptions}), "MQTT-2.3.1-1")
+
+	for _, filter := range []string{"", "a/#/c", "a/b#", "a+/b"} {
+		p := &SubscribePacket{PacketId: 1, Subscriptions: []Subscription{{filter, QoS0}}}
+		assertViolation(t, ValidatePacket(p), "MQTT-4.7.1-1")
+	}
+}
+
+func TestValidatePacket_Unsubscribe(t *testing.T) {
+	assertViolation(t, ValidatePacket(&UnsubscribePacket{PacketId: 1}), "MQTT-3.10.3-2")
+}
+
+func TestValidatePacket_SubAck(t *testing.T) {
+	p := &SubAckPacket{PacketId: 1, ReturnCodes: []SubAckCode{MaxQoS0, 0x03}}
+	assertViolation(t, ValidatePacket(p), "MQTT-3.9.3-2")
+}
+
+func TestDecodingStreamer_Strict_ReservedConnectFlag(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader([]byte{
+		16, 13, // connect
+		0, 4, 77, 81, 84, 84, // "MQTT"
+		4,     // protocol level
+		3,     // connect flags (clean session + reserved)
+		0, 60, // keepalive
+		0, 1, 97, // client id "a"
+	}))
+	streamer.SetStrict(true)
+
+	_, err := streamer.Next()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	_, err = streamer.DecodePacket()
+	assertViolation(t, err, "MQTT-3.1.2-3")
+}
+
+func TestDecodingStreamer_Strict_SubscribeWithoutFilters(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader([]byte{
+		130, 2, // subscribe
+		0, 42, // packet id
+	}))
+	streamer.SetStrict(true)
+
+	_, err := ReadNext(streamer)
+	assertViolation(t, err, "MQTT-3.8.3-3")
+}
+
+func TestDecodingStreamer_Strict_InvalidHeaderFlags(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader([]byte{
+		128, 2, // subscribe with flags 0
+		0, 42, // packet id
+	}))
+	streamer.SetStrict(true)
+
+	_, err := streamer.Next()
+	assertViolation(t, err, "MQTT-3.8.1-1")
+}
+
+func TestDecodingStreamer_Strict_TrailingBytes(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader([]byte{
+		32, 3, // connack with remaining length 3
+		0, 0, 0,
+	}))
+
+	// the fixed length of the CONNACK is checked by ValidateHeader, so we only enable strict decoding here
+	_, err := streamer.Next()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	streamer.SetStrict(true)
+
+	_, err = streamer.DecodePacket()
+	if !errors.Is(err, ErrProtocolViolation) {
+		t.Error("expected protocol violation, got", err)
+	}
+}
+
+func TestDecodingStreamer_NonStrict_AcceptsInvalidPackets(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader([]byte{
+		128, 2, // subscribe with flags 0
+		0, 42, // packet id
+	}))
+
+	p, err := ReadNext(streamer)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertIntEquals(t, 0, len(p.(*SubscribePacket).Subscriptions))
+}
+
+func TestDecodingStreamer_Strict_WriteTo(t *testing.T) {
+	input := []byte{
+		48, 10, // Header (publish)
+		0, 4, // Topic length
+		116, 101, 115, 116, // Topic (test)
+		116, 101, 115, 116, // Payload (test),
+	}
+	streamer := NewDecodingStreamer(bytes.NewReader(input))
+	streamer.SetStrict(true)
+
+	_, err := streamer.Next()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	out := new(bytes.Buffer)
+	n, err := streamer.WriteTo(out)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertIntEquals(t, len(input), int(n))
+	if !bytes.Equal(input, out.Bytes()) {
+		t.Errorf("unexpected output %v", out.Bytes())
+	}
+}
+
+func TestDecodingStreamer_Strict_WriteToInvalidPacket(t *testing.T) {
+	streamer := NewDecodingStreamer(bytes.NewReader([]byte{
+		48, 8, // Header (publish)
+		0, 3, 97, 47, 35, // Topic (a/#)
+		116, 101, 115, // Payload
+	}))
+	streamer.SetStrict(true)
+
+	_, err := streamer.Next()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	out := new(bytes.Buffer)
+	_, err = streamer.WriteTo(out)
+	assertViolation(t, err, "MQTT-3.3.2-2")
+	assertIntEquals(t, 0, out.Len())
+}
+
+func TestReadHeaderFrom_RemainingLengthTooLong(t *testing.T) {
+	_, err := ReadHeaderFrom(bytes.NewReader([]byte{48, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}))
+
+	if !errors.Is(err, ErrMalformedPacket) {
+		t.Error("expected malformed packet error, got", err)
+	}
+}
@@ -1,12 +1,19 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrReadTimeout is returned by a RoutingStreamer if no packet has been received within its read timeout.
+var ErrReadTimeout = errors.New("no packet received within read timeout")
+
 type Router func(header *mqtt.PacketHeader) mqtt.Writer
 
 type Bridge struct {
@@ -18,9 +25,15 @@ type Bridge struct {
 	lStream *RoutingStreamer
 	rStream *RoutingStreamer
 
-	wg sync.WaitGroup
+	wg    sync.WaitGroup
+	first int32 // the direction that stopped first (see LeftStoppedFirst)
 }
 
+const (
+	leftToRight int32 = iota + 1
+	rightToLeft
+)
+
 func NewBridge(left io.ReadWriter, right io.ReadWriter) (b *Bridge) {
 	return NewChannelBridge(mqtt.NewChannel(left), mqtt.NewChannel(right))
 }
@@ -60,6 +73,18 @@ func (b *Bridge) SetRouterRight(router Router) {
 	b.rRouter = router
 }
 
+// SetReadTimeoutLeft sets the read timeout of the left channel (see RoutingStreamer.SetReadTimeout). It needs to be
+// called before the bridge is started.
+func (b *Bridge) SetReadTimeoutLeft(timeout time.Duration) {
+	b.lStream.SetReadTimeout(timeout)
+}
+
+// SetReadTimeoutRight sets the read timeout of the right channel (see RoutingStreamer.SetReadTimeout). It needs to be
+// called before the bridge is started.
+func (b *Bridge) SetReadTimeoutRight(timeout time.Duration) {
+	b.rStream.SetReadTimeout(timeout)
+}
+
 func (b *Bridge) routeLeftToRight(header *mqtt.PacketHeader) mqtt.Writer {
 	return b.lRouter(header)
 }
@@ -73,12 +98,20 @@ func (b *Bridge) Wait() {
 }
 
 func (b *Bridge) Start() chan error {
+	return b.StartContext(context.Background())
+}
+
+// StartContext starts routing packets in both directions until an error occurs or the context is done. The returned
+// channel receives the error of each direction, and is closed when both have stopped. If the channels support it (see
+// mqtt.ContextStreamer), a cancellation of the context interrupts waiting for the next packet, so the bridge can be
+// stopped without closing the underlying connections.
+func (b *Bridge) StartContext(ctx context.Context) chan error {
 	errs := make(chan error, 2)
 	b.wg.Add(2)
 
 	go func() {
-		go func() { errs <- b.lStream.Run(); b.wg.Done() }()
-		go func() { errs <- b.rStream.Run(); b.wg.Done() }()
+		go func() { errs <- b.stopped(leftToRight, b.lStream.RunContext(ctx)); b.wg.Done() }()
+		go func() { errs <- b.stopped(rightToLeft, b.rStream.RunContext(ctx)); b.wg.Done() }()
 
 		b.wg.Wait()
 		close(errs)
@@ -88,17 +121,43 @@ func (b *Bridge) Start() chan error {
 	return errs
 }
 
+func (b *Bridge) stopped(direction int32, err error) error {
+	atomic.CompareAndSwapInt32(&b.first, 0, direction)
+	return err
+}
+
+// LeftStoppedFirst returns true if routing packets from the left channel stopped before routing packets from the right
+// channel, which usually means that the left peer closed its connection, or sent an invalid packet, or nothing within
+// the read timeout. It is meaningful once the first error has been received from the channel of StartContext.
+func (b *Bridge) LeftStoppedFirst() bool {
+	return atomic.LoadInt32(&b.first) == leftToRight
+}
+
 type RoutingStreamer struct {
-	streamer mqtt.Streamer
-	router   Router
+	streamer    mqtt.Streamer
+	router      Router
+	readTimeout time.Duration
 }
 
 func NewRoutingStreamer(streamer mqtt.Streamer, router Router) *RoutingStreamer {
 	return &RoutingStreamer{streamer: streamer, router: router}
 }
 
+// SetReadTimeout sets the maximum time to wait for the next packet (e.g., to enforce the keep-alive of a client). If
+// no packet arrives in time, NextContext returns ErrReadTimeout. A timeout of 0 (the default) disables the timeout.
+// Timeouts require the streamer to be a mqtt.ContextStreamer.
+func (e *RoutingStreamer) SetReadTimeout(timeout time.Duration) {
+	e.readTimeout = timeout
+}
+
 func (e *RoutingStreamer) Next() (header *mqtt.PacketHeader, err error) {
-	header, err = e.streamer.Next()
+	return e.NextContext(context.Background())
+}
+
+// NextContext reads the next header, waiting at most until the context is done or the read timeout has passed, and
+// then copies the packet to the writer returned by the router.
+func (e *RoutingStreamer) NextContext(ctx context.Context) (header *mqtt.PacketHeader, err error) {
+	header, err = e.nextHeader(ctx)
 	if err != nil {
 		return
 	}
@@ -111,9 +170,37 @@ func (e *RoutingStreamer) Next() (header *mqtt.PacketHeader, err error) {
 	return
 }
 
+func (e *RoutingStreamer) nextHeader(ctx context.Context) (*mqtt.PacketHeader, error) {
+	cs, ok := e.streamer.(mqtt.ContextStreamer)
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return e.streamer.Next()
+	}
+
+	if e.readTimeout <= 0 {
+		return cs.NextContext(ctx)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, e.readTimeout)
+	defer cancel()
+
+	header, err := cs.NextContext(tctx)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, ErrReadTimeout
+	}
+	return header, err
+}
+
 func (e *RoutingStreamer) Run() error {
+	return e.RunContext(context.Background())
+}
+
+// RunContext routes packets until an error occurs or the context is done.
+func (e *RoutingStreamer) RunContext(ctx context.Context) error {
 	for {
-		_, err := e.Next()
+		_, err := e.NextContext(ctx)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/client"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/queue"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// forwardRetryDelay is the time to wait before trying again to forward the stored messages to the broker. It
+	// doubles after each failed attempt, up to forwardMaxRetryDelay.
+	forwardRetryDelay = 5 * time.Second
+	// forwardMaxRetryDelay is the maximum time to wait before trying again to forward the stored messages.
+	forwardMaxRetryDelay = time.Minute
+	// forwardTimeout is the maximum time to wait for the broker when connecting or publishing a stored message.
+	forwardTimeout = 10 * time.Second
+	// forwardConsumer is the name of the queue consumer that keeps track of the forwarded messages.
+	forwardConsumer = "forward"
+)
+
+// storeAndForward accepts clients while the broker is unreachable (see Server.StoreAndForwardDir). The proxy answers
+// the CONNECT of these clients itself, stores their QoS 1 and 2 messages in a durable queue, and acknowledges them once
+// they are stored. A forwarder publishes the stored messages to the broker in the order in which they have been
+// received, over its own connection, as soon as the broker is reachable again. Messages are committed to the queue
+// once the broker has acknowledged them, so a message may be published twice if the proxy stops in between.
+//
+// While the broker is unreachable, clients can not subscribe, and QoS 0 messages are dropped. Clients stay
+// disconnected from the broker until they reconnect, so their messages may overtake the stored messages once the
+// broker is reachable again.
+//
+// The forwarder retries with an exponential backoff while the broker is unreachable. Storing messages does not cut the
+// backoff short, only a client that has been bridged to the broker does (see reachable).
+type storeAndForward struct {
+	dial     func() (net.Conn, error)
+	clientId string
+	queue    *queue.Queue
+	consumer *queue.Consumer
+
+	notify    chan struct{} // signals the forwarder that there may be messages to forward
+	reachable chan struct{} // signals the forwarder that the broker is reachable again
+	cancel    context.CancelFunc
+	done      chan struct{} // closed when the forwarder has stopped
+	once      sync.Once
+}
+
+func newStoreAndForward(dial func() (net.Conn, error), clientId string, dir string,
+	opts queue.Options) (*storeAndForward, error) {
+	q, err := queue.Open(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := q.Consumer(forwardConsumer)
+	if err != nil {
+		_ = q.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &storeAndForward{
+		dial:      dial,
+		clientId:  clientId,
+		queue:     q,
+		consumer:  consumer,
+		notify:    make(chan struct{}, 1),
+		reachable: make(chan struct{}, 1),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	go f.run(ctx)
+	return f, nil
+}
+
+// serve handles a client, whose CONNECT has been read, until it disconnects or the context is done.
+func (f *storeAndForward) serve(ctx context.Context, conn net.Conn, channel mqtt.Channel, connect *mqtt.ConnectPacket) {
+	defer conn.Close()
+
+	if err := channel.WritePacket(&mqtt.ConnAckPacket{}); err != nil {
+		log.Printf("error sending CONNACK to client %s: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	err := f.session(ctx, channel, connect)
+	if err == nil {
+		return
+	}
+	logBridgeError(conn, err)
+
+	// clients whose connections are closed by a shutdown of the server have not lost them, and keep their wills
+	if ctx.Err() == nil && connect.WillFlag && connect.WillQoS > mqtt.QoS0 {
+		will := &mqtt.PublishPacket{
+			TopicName: connect.WillTopic,
+			QoS:       connect.WillQoS,
+			Retain:    connect.WillRetain,
+			Payload:   connect.WillMessage,
+		}
+		if err = f.store(will); err != nil {
+			log.Printf("error storing will of client %s: %v\n", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// session handles the packets of the client until it disconnects (returning nil), an error occurs, or the context is
+// done.
+func (f *storeAndForward) session(ctx context.Context, channel mqtt.Channel, connect *mqtt.ConnectPacket) error {
+	// the packet identifiers of QoS 2 messages that have been stored, but not released by the client yet
+	received := make(map[uint16]struct{})
+	for {
+		packet, err := readKeepAlive(ctx, channel, connect.KeepAlive)
+		if err != nil {
+			return err
+		}
+
+		switch p := packet.(type) {
+		case *mqtt.PublishPacket:
+			err = f.publish(channel, p, received)
+		case *mqtt.PubRelPacket:
+			delete(received, p.PacketId)
+			err = channel.WritePacket(&mqtt.PubCompPacket{PacketId: p.PacketId})
+		case *mqtt.SubscribePacket:
+			codes := make([]mqtt.SubAckCode, len(p.Subscriptions))
+			for i := range codes {
+				codes[i] = mqtt.Failure
+			}
+			err = channel.WritePacket(&mqtt.SubAckPacket{PacketId: p.PacketId, ReturnCodes: codes})
+		case *mqtt.UnsubscribePacket:
+			err = channel.WritePacket(&mqtt.UnsubAckPacket{PacketId: p.PacketId})
+		case *mqtt.PingReqPacket:
+			err = channel.WritePacket(&mqtt.PingRespPacket{})
+		case *mqtt.DisconnectPacket:
+			return nil
+		default:
+			return fmt.Errorf("unexpected %s packet while the broker is unreachable", packet.Type())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// publish stores a QoS 1 or 2 message of the client, and acknowledges it.
+func (f *storeAndForward) publish(client mqtt.Writer, p *mqtt.PublishPacket, received map[uint16]struct{}) error {
+	switch p.QoS {
+	case mqtt.QoS0:
+		return nil
+	case mqtt.QoS1:
+		if err := f.store(p); err != nil {
+			return err
+		}
+		return client.WritePacket(&mqtt.PubAckPacket{PacketId: p.PacketId})
+	default:
+		if _, ok := received[p.PacketId]; !ok {
+			// a QoS 2 message that is sent again must not be stored twice [MQTT-4.3.3-2]
+			if err := f.store(p); err != nil {
+				return err
+			}
+			received[p.PacketId] = struct{}{}
+		}
+		return client.WritePacket(&mqtt.PubRecPacket{PacketId: p.PacketId})
+	}
+}
+
+func (f *storeAndForward) store(p *mqtt.PublishPacket) error {
+	stored := &mqtt.PublishPacket{TopicName: p.TopicName, QoS: p.QoS, Retain: p.Retain, Payload: p.Payload}
+	if _, err := f.queue.Append(stored); err != nil {
+		return err
+	}
+	f.wake()
+	return nil
+}
+
+// wake signals the forwarder that there are messages to forward. It has no effect while the forwarder backs off.
+func (f *storeAndForward) wake() {
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+}
+
+// brokerReachable signals the forwarder to forward the stored messages right away, and to reset its backoff, since
+// the broker is reachable again.
+func (f *storeAndForward) brokerReachable() {
+	select {
+	case f.reachable <- struct{}{}:
+	default:
+	}
+}
+
+// run forwards the stored messages to the broker until the context is done.
+func (f *storeAndForward) run(ctx context.Context) {
+	defer close(f.done)
+
+	delay := forwardRetryDelay
+	backoff := false // whether the last attempt failed
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		notify := f.notify
+		if backoff {
+			notify = nil
+		}
+		select {
+		case <-timer.C:
+		case <-notify:
+		case <-f.reachable:
+		case <-ctx.Done():
+			return
+		}
+
+		backoff = false
+		if f.consumer.Len() > 0 {
+			if err := f.forward(ctx); err != nil && ctx.Err() == nil {
+				log.Println("error forwarding stored messages to broker", err)
+				backoff = true
+			}
+		}
+
+		wait := forwardRetryDelay
+		if backoff {
+			wait = delay
+			if delay *= 2; delay > forwardMaxRetryDelay {
+				delay = forwardMaxRetryDelay
+			}
+			// a client that has been bridged while the forwarder was dialing does not trigger another attempt
+			select {
+			case <-f.reachable:
+			default:
+			}
+		} else {
+			delay = forwardRetryDelay
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// forward publishes the stored messages to the broker until the queue is empty.
+func (f *storeAndForward) forward(ctx context.Context) error {
+	c := client.New("", f.clientId)
+	c.Dial = func(context.Context) (net.Conn, error) { return f.dial() }
+	c.AutoReconnect = false
+	c.ConnectTimeout = forwardTimeout
+
+	if err := c.Connect(ctx); err != nil {
+		return err
+	}
+	defer func() { _ = c.Disconnect() }()
+
+	for {
+		packet, offset, err := f.consumer.Peek()
+		if err == queue.ErrEmpty {
+			return nil
+		} else if err == queue.ErrCorrupted {
+			log.Printf("skipping corrupted message %d in message queue\n", offset)
+			if err = f.consumer.Commit(offset); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		p, ok := packet.(*mqtt.PublishPacket)
+		if !ok {
+			return fmt.Errorf("unexpected %s packet in message queue", packet.Type())
+		}
+		publishCtx, cancel := context.WithTimeout(ctx, forwardTimeout)
+		err = c.Publish(publishCtx, p.TopicName, p.Payload, p.QoS, p.Retain)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if err = f.consumer.Commit(offset); err != nil {
+			return err
+		}
+	}
+}
+
+// close stops the forwarder, and closes the queue.
+func (f *storeAndForward) close() {
+	f.once.Do(func() {
+		f.cancel()
+		<-f.done
+		if err := f.queue.Close(); err != nil {
+			log.Println("error closing message queue", err)
+		}
+	})
+}
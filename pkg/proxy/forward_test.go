@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/queue"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func openStoreAndForward(t *testing.T, dials *int32) *storeAndForward {
+	dial := func() (net.Conn, error) {
+		atomic.AddInt32(dials, 1)
+		return nil, errors.New("broker unreachable")
+	}
+	f, err := newStoreAndForward(dial, "forward", tempDir(t), queue.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.close)
+	return f
+}
+
+func TestStoreAndForward_Backoff(t *testing.T) {
+	var dials int32
+	f := openStoreAndForward(t, &dials)
+
+	// the forwarder does not dial the broker again for each stored message while it backs off
+	for i := 0; i < 10; i++ {
+		if err := f.store(&mqtt.PublishPacket{TopicName: "sensors/1", QoS: mqtt.QoS1, Payload: []byte("1")}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertIntEquals(t, 1, int(atomic.LoadInt32(&dials)))
+
+	// but once the broker is reachable again
+	f.brokerReachable()
+	time.Sleep(50 * time.Millisecond)
+	assertIntEquals(t, 2, int(atomic.LoadInt32(&dials)))
+}
+
+func TestStoreAndForward_WillOnShutdown(t *testing.T) {
+	var dials int32
+	f := openStoreAndForward(t, &dials)
+
+	server, client := net.Pipe()
+	go func() { _, _ = io.Copy(ioutil.Discard, client) }()
+	defer client.Close()
+	channel := mqtt.NewCodecChannel(mqtt.NewDecodingStreamer(server), mqtt.NewEncoder(server))
+	connect, _ := mqtt.NewConnect().ClientId("c").Will("status/c", []byte("offline"), mqtt.QoS1, true).Build()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f.serve(ctx, server, channel, connect)
+	assertIntEquals(t, 0, f.consumer.Len())
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"sync"
+	"time"
+)
+
+// ErrPingTimeout is returned by brokerKeepAlive.run if the broker did not answer a PINGREQ within the keep alive.
+var ErrPingTimeout = errors.New("no PINGRESP received within keep alive")
+
+// brokerKeepAlive keeps the connection of a bridge to the broker alive on behalf of the client, whose PINGREQ packets
+// the proxy answers itself: like a client, it sends a PINGREQ to the broker whenever no packet has been sent to the
+// broker within the keep alive [MQTT-3.1.2-23], and considers the broker dead if the PINGRESP does not arrive before
+// the keep alive has passed again.
+type brokerKeepAlive struct {
+	sink     mqtt.PacketSink // the connection to the broker
+	interval time.Duration
+
+	mu        sync.Mutex
+	lastWrite time.Time
+	pinging   bool // a PINGREQ has been sent, and its PINGRESP has not arrived yet
+}
+
+func newBrokerKeepAlive(sink mqtt.PacketSink, interval time.Duration) *brokerKeepAlive {
+	return &brokerKeepAlive{sink: sink, interval: interval, lastWrite: time.Now()}
+}
+
+// WritePacket writes the packet to the broker, and records the time of the write.
+func (k *brokerKeepAlive) WritePacket(packet mqtt.Packet) error {
+	k.touch()
+	return k.sink.WritePacket(packet)
+}
+
+// ReadPacketFrom copies the packet to the broker, and records the time of the write.
+func (k *brokerKeepAlive) ReadPacketFrom(r mqtt.Reader) error {
+	k.touch()
+	return k.sink.ReadPacketFrom(r)
+}
+
+func (k *brokerKeepAlive) touch() {
+	k.mu.Lock()
+	k.lastWrite = time.Now()
+	k.mu.Unlock()
+}
+
+// pingResp is the target of the PINGRESP packets of the broker, which answer the PINGREQ packets of the proxy.
+func (k *brokerKeepAlive) pingResp(mqtt.Packet) error {
+	k.mu.Lock()
+	k.pinging = false
+	k.mu.Unlock()
+	return nil
+}
+
+// run sends PINGREQ packets to the broker until the context is done, or an error occurs. It returns ErrPingTimeout if
+// the broker does not answer a PINGREQ in time.
+func (k *brokerKeepAlive) run(ctx context.Context) error {
+	timer := time.NewTimer(k.interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil
+		}
+
+		k.mu.Lock()
+		pinging, idle := k.pinging, time.Since(k.lastWrite)
+		if !pinging && idle >= k.interval {
+			k.pinging = true
+		}
+		k.mu.Unlock()
+
+		switch {
+		case pinging:
+			return ErrPingTimeout
+		case idle >= k.interval:
+			if err := k.WritePacket(&mqtt.PingReqPacket{}); err != nil {
+				return err
+			}
+			timer.Reset(k.interval)
+		default:
+			timer.Reset(k.interval - idle)
+		}
+	}
+}
+
+// readKeepAlive reads the next packet of a client that the proxy serves itself. It returns ErrReadTimeout if the
+// client sends no packet within one and a half times the keep alive (in seconds, 0 disables the timeout)
+// [MQTT-3.1.2-24].
+func readKeepAlive(ctx context.Context, channel mqtt.Channel, keepAlive uint16) (mqtt.Packet, error) {
+	if keepAlive == 0 {
+		return mqtt.ReadNextContext(ctx, channel)
+	}
+
+	readCtx, cancel := context.WithTimeout(ctx, time.Duration(keepAlive)*time.Second*3/2)
+	defer cancel()
+	packet, err := mqtt.ReadNextContext(readCtx, channel)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, ErrReadTimeout
+	}
+	return packet, err
+}
@@ -0,0 +1,494 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/client"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/topic"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errMultiplexerClosed is returned when connecting a client after the multiplexer has been closed.
+var errMultiplexerClosed = errors.New("multiplexer closed")
+
+const (
+	// muxTimeout is the maximum time to wait for the broker when connecting, subscribing or publishing upstream.
+	muxTimeout = 10 * time.Second
+	// muxOutboxSize is the number of packets that can be queued for a multiplexed client. Clients that fall further
+	// behind are disconnected, so that they do not hold up the upstream connections that they share with others.
+	muxOutboxSize = 256
+)
+
+// multiplexer bridges many lightweight clients over a small pool of upstream connections, instead of opening a
+// connection to the broker for each of them. The proxy accepts the CONNECT of multiplexed clients itself, subscribes
+// to the filters of all clients upstream (each filter once, at QoS 1), and dispatches the messages to the clients that
+// subscribed to the filters. The messages of a client are published over one upstream connection, to keep their order.
+//
+// Multiplexed clients may publish and subscribe with QoS 0 and 1. Subscriptions with QoS 2 are granted QoS 1, and
+// clients that publish with QoS 2 are disconnected. Messages are acknowledged upstream when they are received by the
+// proxy. Since the broker only sends retained messages when the proxy subscribes upstream, the proxy keeps the retained
+// messages that the broker has sent for a filter, and sends them to the clients that subscribe to the filter later
+// [MQTT-3.3.1-6]. They are kept up to date with the retained messages of multiplexed clients, but retained messages
+// that other clients of the broker publish later reach the subscriptions without the retain flag [MQTT-3.3.1-9], so
+// the proxy does not notice them. Clients with overlapping subscriptions receive a message once for each matching
+// subscription.
+type multiplexer struct {
+	dial     func() (net.Conn, error)
+	clientId string
+	size     int
+
+	subMu sync.Mutex // serializes connecting, and changing the upstream subscriptions
+
+	mu            sync.Mutex
+	upstreams     []*client.Client            // nil until the first client connects
+	subscriptions map[string]*muxSubscription // by topic filter
+	next          int                         // the index of the upstream that gets the next client or filter
+	closed        bool
+}
+
+// muxSubscription is the upstream subscription of a topic filter, and the clients that subscribed to it.
+type muxSubscription struct {
+	filter   string
+	upstream *client.Client
+	clients  map[*muxClient]mqtt.QoS
+	retained map[string]*mqtt.PublishPacket // topic name -> the retained message that the broker sent for the filter
+}
+
+// retain stores the retained message, and returns false if the subscription has the same message already.
+func (s *muxSubscription) retain(p *mqtt.PublishPacket) bool {
+	if r, ok := s.retained[p.TopicName]; ok && r.QoS == p.QoS && bytes.Equal(r.Payload, p.Payload) {
+		return false
+	}
+	s.retained[p.TopicName] = &mqtt.PublishPacket{TopicName: p.TopicName, QoS: p.QoS, Retain: true, Payload: p.Payload}
+	return true
+}
+
+// retainedMessages returns the retained messages of the subscription, ordered by topic name.
+func (s *muxSubscription) retainedMessages() []*mqtt.PublishPacket {
+	messages := make([]*mqtt.PublishPacket, 0, len(s.retained))
+	for _, p := range s.retained {
+		messages = append(messages, p)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].TopicName < messages[j].TopicName
+	})
+	return messages
+}
+
+func newMultiplexer(dial func() (net.Conn, error), clientId string, size int) *multiplexer {
+	return &multiplexer{
+		dial:          dial,
+		clientId:      clientId,
+		size:          size,
+		subscriptions: make(map[string]*muxSubscription),
+	}
+}
+
+// multiplexable returns true if clients that connect with the CONNECT can be multiplexed: MQTT 3.1 and 3.1.1 clients
+// with a clean session, without credentials (which only the broker can check), and without a QoS 2 will.
+func multiplexable(connect *mqtt.ConnectPacket) bool {
+	return connect.ProtocolLevel != mqtt.ProtocolLevel5 &&
+		connect.CleanSession &&
+		!connect.UserNameFlag &&
+		!connect.PasswordFlag &&
+		(!connect.WillFlag || connect.WillQoS < mqtt.QoS2)
+}
+
+// start connects the upstream connections, unless they are connected already. The client library reconnects them when
+// they are lost, and restores their subscriptions.
+func (m *multiplexer) start(ctx context.Context) error {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+
+	m.mu.Lock()
+	started, closed := m.upstreams != nil, m.closed
+	m.mu.Unlock()
+	if closed {
+		return errMultiplexerClosed
+	}
+	if started {
+		return nil
+	}
+
+	upstreams := make([]*client.Client, m.size)
+	for i := range upstreams {
+		c := client.New("", fmt.Sprintf("%s-%d", m.clientId, i))
+		c.Dial = func(context.Context) (net.Conn, error) { return m.dial() }
+		c.ConnectTimeout = muxTimeout
+		c.OnConnectionLost = func(_ *client.Client, err error) {
+			log.Println("lost multiplexed upstream connection", err)
+		}
+		if err := c.Connect(ctx); err != nil {
+			for _, u := range upstreams[:i] {
+				_ = u.Disconnect()
+			}
+			return err
+		}
+		upstreams[i] = c
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		for _, u := range upstreams {
+			_ = u.Disconnect()
+		}
+		return errMultiplexerClosed
+	}
+	m.upstreams = upstreams
+	return nil
+}
+
+// nextUpstream returns the upstream connection for the next client or filter, round-robin. It needs to be called with
+// m.mu held.
+func (m *multiplexer) nextUpstream() *client.Client {
+	u := m.upstreams[m.next%len(m.upstreams)]
+	m.next++
+	return u
+}
+
+// serve handles a multiplexed client, whose CONNECT has been read, until it disconnects or the context is done.
+func (m *multiplexer) serve(ctx context.Context, conn net.Conn, channel mqtt.Channel, connect *mqtt.ConnectPacket) {
+	startCtx, cancel := context.WithTimeout(ctx, muxTimeout)
+	err := m.start(startCtx)
+	cancel()
+	if err != nil {
+		log.Printf("error connecting upstream for multiplexed client %s: %v\n", conn.RemoteAddr(), err)
+		_ = channel.WritePacket(&mqtt.ConnAckPacket{ReturnCode: mqtt.ConnectServerUnavailable})
+		conn.Close()
+		return
+	}
+
+	m.mu.Lock()
+	c := &muxClient{
+		mux:      m,
+		conn:     conn,
+		channel:  channel,
+		connect:  connect,
+		upstream: m.nextUpstream(),
+		outbox:   make(chan mqtt.Packet, muxOutboxSize),
+		done:     make(chan struct{}),
+		filters:  make(map[string]struct{}),
+	}
+	m.mu.Unlock()
+
+	go c.write()
+	c.send(&mqtt.ConnAckPacket{})
+
+	err = c.run(ctx)
+	graceful := err == nil
+	if !graceful {
+		logBridgeError(conn, err)
+	}
+	c.close()
+
+	filters := make([]string, 0, len(c.filters))
+	for filter := range c.filters {
+		filters = append(filters, filter)
+	}
+	m.unsubscribe(c, filters)
+
+	if !graceful && ctx.Err() == nil && connect.WillFlag {
+		// the broker does not know the client, so the proxy publishes its will (unless the server is shutting down, like
+		// the wills that the proxy keeps for other clients, see Server.KeepWills)
+		willCtx, cancel := context.WithTimeout(context.Background(), muxTimeout)
+		defer cancel()
+		will := &mqtt.PublishPacket{TopicName: connect.WillTopic, QoS: connect.WillQoS, Retain: connect.WillRetain,
+			Payload: connect.WillMessage}
+		if err = c.upstream.Publish(willCtx, will.TopicName, will.Payload, will.QoS, will.Retain); err != nil {
+			log.Printf("error publishing will of multiplexed client %s: %v\n", conn.RemoteAddr(), err)
+		} else {
+			m.published(will)
+		}
+	}
+}
+
+// subscribe adds the subscriptions of the client, subscribing to new filters upstream, and returns the SUBACK. The
+// retained messages of existing subscriptions are queued for the client right away, before the SUBACK.
+func (m *multiplexer) subscribe(ctx context.Context, c *muxClient, p *mqtt.SubscribePacket) *mqtt.SubAckPacket {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+
+	subAck := &mqtt.SubAckPacket{PacketId: p.PacketId, ReturnCodes: make([]mqtt.SubAckCode, len(p.Subscriptions))}
+	for i, sub := range p.Subscriptions {
+		code, err := m.subscribeFilter(ctx, c, sub.TopicFilter, minQoS(sub.QoS, mqtt.QoS1))
+		if err != nil {
+			log.Printf("error subscribing multiplexed client %s to %s: %v\n", c.conn.RemoteAddr(), sub.TopicFilter, err)
+		}
+		subAck.ReturnCodes[i] = code
+	}
+	return subAck
+}
+
+// subscribeFilter needs to be called with m.subMu held.
+func (m *multiplexer) subscribeFilter(ctx context.Context, c *muxClient, filter string, qos mqtt.QoS) (mqtt.SubAckCode,
+	error) {
+	if topic.IsShared(filter) {
+		return mqtt.Failure, errors.New("shared subscriptions are not supported for multiplexed clients")
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return mqtt.Failure, errMultiplexerClosed
+	}
+	if s, ok := m.subscriptions[filter]; ok {
+		// the retained messages are queued while m.mu is held, so that newer messages of the broker come after them
+		s.clients[c] = qos
+		for _, p := range s.retainedMessages() {
+			c.deliver(p, qos)
+		}
+		m.mu.Unlock()
+		c.filters[filter] = struct{}{}
+		return qos, nil
+	}
+	s := &muxSubscription{
+		filter:   filter,
+		upstream: m.nextUpstream(),
+		clients:  make(map[*muxClient]mqtt.QoS),
+		retained: make(map[string]*mqtt.PublishPacket),
+	}
+	m.subscriptions[filter] = s
+	// the client is added first, since retained messages may arrive before the SUBACK
+	s.clients[c] = qos
+	m.mu.Unlock()
+	c.filters[filter] = struct{}{}
+
+	subCtx, cancel := context.WithTimeout(ctx, muxTimeout)
+	defer cancel()
+	_, err := s.upstream.Subscribe(subCtx, filter, mqtt.QoS1, func(_ *client.Client, p *mqtt.PublishPacket) {
+		m.dispatch(filter, p)
+	})
+	if err != nil {
+		m.mu.Lock()
+		delete(m.subscriptions, filter)
+		m.mu.Unlock()
+		delete(c.filters, filter)
+		return mqtt.Failure, err
+	}
+	return qos, nil
+}
+
+// unsubscribe removes the subscriptions of the client, and unsubscribes from filters upstream that no client is
+// subscribed to anymore.
+func (m *multiplexer) unsubscribe(c *muxClient, filters []string) {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+
+	for _, filter := range filters {
+		delete(c.filters, filter)
+
+		m.mu.Lock()
+		s, ok := m.subscriptions[filter]
+		if ok {
+			delete(s.clients, c)
+			ok = len(s.clients) == 0
+		}
+		if ok {
+			delete(m.subscriptions, filter)
+		}
+		m.mu.Unlock()
+
+		if ok {
+			ctx, cancel := context.WithTimeout(context.Background(), muxTimeout)
+			if err := s.upstream.Unsubscribe(ctx, filter); err != nil {
+				log.Printf("error unsubscribing multiplexed filter %s: %v\n", filter, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// dispatch delivers a message of the upstream subscription of the filter to the clients that subscribed to it. Retained
+// messages, which the broker only sends in response to a subscription [MQTT-3.3.1-8], are kept for later subscribers.
+// They are dropped if the clients have received them already, e.g., when the broker sends them again after the client
+// library has restored the subscription on a new upstream connection.
+func (m *multiplexer) dispatch(filter string, p *mqtt.PublishPacket) {
+	m.mu.Lock()
+	s, ok := m.subscriptions[filter]
+	if !ok || p.Retain && !s.retain(p) {
+		m.mu.Unlock()
+		return
+	}
+	clients := make(map[*muxClient]mqtt.QoS, len(s.clients))
+	for c, qos := range s.clients {
+		clients[c] = qos
+	}
+	m.mu.Unlock()
+
+	for c, qos := range clients {
+		c.deliver(p, qos)
+	}
+}
+
+// published updates the retained messages of the subscriptions that match a retained message that the proxy has
+// published for a multiplexed client, since the broker forwards it to the subscriptions without the retain flag.
+func (m *multiplexer) published(p *mqtt.PublishPacket) {
+	if !p.Retain {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for filter, s := range m.subscriptions {
+		if !topic.Match(filter, p.TopicName) {
+			continue
+		}
+		if len(p.Payload) == 0 {
+			// an empty payload deletes the retained message [MQTT-3.3.1-10]
+			delete(s.retained, p.TopicName)
+		} else {
+			s.retain(p)
+		}
+	}
+}
+
+// close disconnects the upstream connections. Clients can not connect afterwards.
+func (m *multiplexer) close() {
+	m.mu.Lock()
+	m.closed = true
+	upstreams := m.upstreams
+	m.upstreams = nil
+	m.mu.Unlock()
+
+	for _, u := range upstreams {
+		_ = u.Disconnect()
+	}
+}
+
+// muxClient is the connection of a multiplexed client. Packets for the client are queued in the outbox, and written
+// by a separate goroutine, so that dispatching a message never waits for a slow client.
+type muxClient struct {
+	mux      *multiplexer
+	conn     net.Conn
+	channel  mqtt.Channel
+	connect  *mqtt.ConnectPacket
+	upstream *client.Client // publishes the messages of the client
+	ids      mqtt.PacketIdAllocator
+	outbox   chan mqtt.Packet
+	done     chan struct{}
+	once     sync.Once
+	filters  map[string]struct{} // guarded by mux.subMu
+}
+
+// run handles the packets of the client until it disconnects (returning nil), an error occurs, or the context is done.
+func (c *muxClient) run(ctx context.Context) error {
+	for {
+		packet, err := readKeepAlive(ctx, c.channel, c.connect.KeepAlive)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := packet.(*mqtt.DisconnectPacket); ok {
+			return nil
+		}
+		if err = c.handle(ctx, packet); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *muxClient) handle(ctx context.Context, packet mqtt.Packet) error {
+	switch p := packet.(type) {
+	case *mqtt.PublishPacket:
+		return c.publish(ctx, p)
+	case *mqtt.PubAckPacket:
+		c.ids.Release(p.PacketId)
+	case *mqtt.SubscribePacket:
+		c.send(c.mux.subscribe(ctx, c, p))
+	case *mqtt.UnsubscribePacket:
+		c.mux.unsubscribe(c, p.TopicFilters)
+		c.send(&mqtt.UnsubAckPacket{PacketId: p.PacketId})
+	case *mqtt.PingReqPacket:
+		c.send(&mqtt.PingRespPacket{})
+	default:
+		return fmt.Errorf("unexpected %s packet from multiplexed client", packet.Type())
+	}
+	return nil
+}
+
+// publish publishes the message upstream, and acknowledges QoS 1 messages once the broker has acknowledged them.
+func (c *muxClient) publish(ctx context.Context, p *mqtt.PublishPacket) error {
+	if p.QoS == mqtt.QoS2 {
+		return errors.New("QoS 2 is not supported for multiplexed clients")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, muxTimeout)
+	defer cancel()
+	if err := c.upstream.Publish(ctx, p.TopicName, p.Payload, p.QoS, p.Retain); err != nil {
+		return err
+	}
+	c.mux.published(p)
+	if p.QoS == mqtt.QoS1 {
+		c.send(&mqtt.PubAckPacket{PacketId: p.PacketId})
+	}
+	return nil
+}
+
+// deliver queues a message of a subscription of the client, with the QoS of the subscription at most. Clients whose
+// outbox is full are disconnected.
+func (c *muxClient) deliver(p *mqtt.PublishPacket, qos mqtt.QoS) {
+	message := &mqtt.PublishPacket{TopicName: p.TopicName, QoS: minQoS(p.QoS, qos), Retain: p.Retain, Payload: p.Payload}
+	if message.QoS > mqtt.QoS0 {
+		id, err := c.ids.Allocate()
+		if err != nil {
+			log.Printf("dropping message for multiplexed client %s: %v\n", c.conn.RemoteAddr(), err)
+			return
+		}
+		message.PacketId = id
+	}
+
+	select {
+	case c.outbox <- message:
+	case <-c.done:
+	default:
+		log.Printf("closing connection of multiplexed client %s: too many queued messages\n", c.conn.RemoteAddr())
+		if message.QoS > mqtt.QoS0 {
+			c.ids.Release(message.PacketId)
+		}
+		c.close()
+	}
+}
+
+// send queues a packet for the client. It is dropped if the connection has been closed.
+func (c *muxClient) send(p mqtt.Packet) {
+	select {
+	case c.outbox <- p:
+	case <-c.done:
+	}
+}
+
+func (c *muxClient) write() {
+	for {
+		select {
+		case p := <-c.outbox:
+			if err := c.channel.WritePacket(p); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *muxClient) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func minQoS(a mqtt.QoS, b mqtt.QoS) mqtt.QoS {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"context"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/broker"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upstreamTap records the types of the packets that the multiplexer sends to the broker.
+type upstreamTap struct {
+	mu    sync.Mutex
+	types []mqtt.PacketType
+}
+
+// tapConn passes the bytes that the multiplexer writes to the decoder of a tap.
+type tapConn struct {
+	net.Conn
+	w *io.PipeWriter
+}
+
+func (c tapConn) Write(b []byte) (int, error) {
+	if _, err := c.w.Write(b); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (tap *upstreamTap) dial(b *broker.Broker) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		r, w := io.Pipe()
+		go func() {
+			streamer := mqtt.NewDecodingStreamer(r)
+			for {
+				p, err := mqtt.ReadNext(streamer)
+				if err != nil {
+					return
+				}
+				tap.mu.Lock()
+				tap.types = append(tap.types, p.Type())
+				tap.mu.Unlock()
+			}
+		}()
+		return tapConn{b.Pipe(), w}, nil
+	}
+}
+
+func (tap *upstreamTap) count(packetType mqtt.PacketType) int {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+
+	n := 0
+	for _, t := range tap.types {
+		if t == packetType {
+			n++
+		}
+	}
+	return n
+}
+
+// assertCount asserts the number of packets of the type that the multiplexer has sent, which the tap decodes
+// asynchronously.
+func (tap *upstreamTap) assertCount(t *testing.T, packetType mqtt.PacketType, expected int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for tap.count(packetType) != expected && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := tap.count(packetType); n != expected {
+		t.Errorf("expected %d %s packets, got %d", expected, packetType, n)
+	}
+}
+
+// startMultiplexer starts a multiplexer with two upstream connections to a new in-memory broker.
+func startMultiplexer(t *testing.T) (*multiplexer, *broker.Broker, *upstreamTap) {
+	b := broker.New()
+	t.Cleanup(func() { _ = b.Close() })
+	tap := &upstreamTap{}
+
+	m := newMultiplexer(tap.dial(b), "mux", 2)
+	t.Cleanup(m.close)
+	if err := m.start(context.Background()); err != nil {
+		t.Fatal("error starting multiplexer", err)
+	}
+	return m, b, tap
+}
+
+// newTestMuxClient returns a multiplexed client without a writer, whose outbox the tests read.
+func newTestMuxClient(t *testing.T, m *multiplexer) (*muxClient, packetQueue) {
+	conn, other := net.Pipe()
+	t.Cleanup(func() { other.Close() })
+
+	m.mu.Lock()
+	c := &muxClient{
+		mux:      m,
+		conn:     conn,
+		upstream: m.nextUpstream(),
+		outbox:   make(chan mqtt.Packet, muxOutboxSize),
+		done:     make(chan struct{}),
+		filters:  make(map[string]struct{}),
+	}
+	m.mu.Unlock()
+	t.Cleanup(c.close)
+	return c, c.outbox
+}
+
+func muxSubscribe(t *testing.T, m *multiplexer, c *muxClient, filter string, qos mqtt.QoS) mqtt.SubAckCode {
+	t.Helper()
+	subAck := m.subscribe(context.Background(), c, &mqtt.SubscribePacket{PacketId: 1, Subscriptions: []mqtt.Subscription{
+		{TopicFilter: filter, QoS: qos},
+	}})
+	assertIntEquals(t, 1, len(subAck.ReturnCodes))
+	return subAck.ReturnCodes[0]
+}
+
+func TestMultiplexer_Dispatch(t *testing.T) {
+	m, b, tap := startMultiplexer(t)
+	first, firstOutbox := newTestMuxClient(t, m)
+	second, secondOutbox := newTestMuxClient(t, m)
+	third, thirdOutbox := newTestMuxClient(t, m)
+
+	assertIntEquals(t, int(mqtt.MaxQoS1), int(muxSubscribe(t, m, first, "sensors/#", mqtt.QoS2)))
+	assertIntEquals(t, int(mqtt.MaxQoS0), int(muxSubscribe(t, m, second, "sensors/#", mqtt.QoS0)))
+	assertIntEquals(t, int(mqtt.MaxQoS1), int(muxSubscribe(t, m, third, "sensors/+/temperature", mqtt.QoS1)))
+	assertIntEquals(t, int(mqtt.Failure), int(muxSubscribe(t, m, third, "$share/g/sensors/#", mqtt.QoS1)))
+
+	// the proxy subscribes to each filter once
+	tap.assertCount(t, mqtt.TypeSubscribe, 2)
+
+	b.Publish(&mqtt.PublishPacket{TopicName: "sensors/1/temperature", QoS: mqtt.QoS1, Payload: []byte("21")})
+	p := firstOutbox.next(t).(*mqtt.PublishPacket)
+	assertPayload(t, "21", p)
+	assertIntEquals(t, int(mqtt.QoS1), int(p.QoS))
+	p = secondOutbox.next(t).(*mqtt.PublishPacket)
+	assertPayload(t, "21", p)
+	assertIntEquals(t, int(mqtt.QoS0), int(p.QoS))
+	assertPayload(t, "21", thirdOutbox.next(t))
+
+	b.Publish(&mqtt.PublishPacket{TopicName: "sensors/1/humidity", Payload: []byte("40")})
+	assertPayload(t, "40", firstOutbox.next(t))
+	assertPayload(t, "40", secondOutbox.next(t))
+	thirdOutbox.assertEmpty(t)
+}
+
+func TestMultiplexer_Unsubscribe(t *testing.T) {
+	m, b, tap := startMultiplexer(t)
+	first, firstOutbox := newTestMuxClient(t, m)
+	second, secondOutbox := newTestMuxClient(t, m)
+	muxSubscribe(t, m, first, "a", mqtt.QoS0)
+	muxSubscribe(t, m, second, "a", mqtt.QoS0)
+
+	// the upstream subscription is kept while a client is subscribed to the filter
+	m.unsubscribe(first, []string{"a"})
+	tap.assertCount(t, mqtt.TypeUnsubscribe, 0)
+	b.Publish(&mqtt.PublishPacket{TopicName: "a", Payload: []byte("1")})
+	assertPayload(t, "1", secondOutbox.next(t))
+	firstOutbox.assertEmpty(t)
+
+	m.unsubscribe(second, []string{"a"})
+	tap.assertCount(t, mqtt.TypeUnsubscribe, 1)
+	assertIntEquals(t, 0, len(m.subscriptions))
+	b.Publish(&mqtt.PublishPacket{TopicName: "a", Payload: []byte("2")})
+	secondOutbox.assertEmpty(t)
+}
+
+func TestMultiplexer_Retained(t *testing.T) {
+	m, b, tap := startMultiplexer(t)
+	b.Publish(&mqtt.PublishPacket{TopicName: "status/1", QoS: mqtt.QoS1, Retain: true, Payload: []byte("online")})
+
+	first, firstOutbox := newTestMuxClient(t, m)
+	muxSubscribe(t, m, first, "status/#", mqtt.QoS1)
+	p := firstOutbox.next(t).(*mqtt.PublishPacket)
+	assertStringEquals(t, "online", string(p.Payload))
+	if !p.Retain {
+		t.Error("expected retained message")
+	}
+
+	// a later subscriber receives the retained message that the broker has sent for the existing subscription, while
+	// the earlier subscriber does not receive it again
+	second, secondOutbox := newTestMuxClient(t, m)
+	muxSubscribe(t, m, second, "status/#", mqtt.QoS1)
+	p = secondOutbox.next(t).(*mqtt.PublishPacket)
+	assertStringEquals(t, "online", string(p.Payload))
+	if !p.Retain {
+		t.Error("expected retained message")
+	}
+	firstOutbox.assertEmpty(t)
+	tap.assertCount(t, mqtt.TypeSubscribe, 1)
+
+	// the retained messages of multiplexed clients replace the retained messages of the subscriptions
+	err := first.publish(context.Background(), &mqtt.PublishPacket{TopicName: "status/1", QoS: mqtt.QoS1, PacketId: 1,
+		Retain: true, Payload: []byte("offline")})
+	if err != nil {
+		t.Fatal("error publishing", err)
+	}
+	assertPayload(t, "offline", secondOutbox.next(t))
+	third, thirdOutbox := newTestMuxClient(t, m)
+	muxSubscribe(t, m, third, "status/#", mqtt.QoS1)
+	assertStringEquals(t, "offline", string(thirdOutbox.next(t).(*mqtt.PublishPacket).Payload))
+
+	// retained messages that the broker sends again (e.g., after reconnecting) are not delivered again
+	m.dispatch("status/#", &mqtt.PublishPacket{TopicName: "status/1", QoS: mqtt.QoS1, Retain: true,
+		Payload: []byte("offline")})
+	secondOutbox.assertEmpty(t)
+	thirdOutbox.assertEmpty(t)
+}
+
+func TestMuxClient_OutboxOverflow(t *testing.T) {
+	m, _, _ := startMultiplexer(t)
+	c, outbox := newTestMuxClient(t, m)
+
+	for i := 0; i < muxOutboxSize; i++ {
+		c.deliver(&mqtt.PublishPacket{TopicName: "a", QoS: mqtt.QoS1, Payload: []byte("a")}, mqtt.QoS1)
+	}
+	select {
+	case <-c.done:
+		t.Fatal("client closed before its outbox is full")
+	default:
+	}
+
+	// the client falls behind, so it is disconnected instead of holding up the upstream connection
+	c.deliver(&mqtt.PublishPacket{TopicName: "a", QoS: mqtt.QoS1, Payload: []byte("a")}, mqtt.QoS1)
+	select {
+	case <-c.done:
+	default:
+		t.Fatal("expected client to be closed")
+	}
+	assertIntEquals(t, muxOutboxSize, len(outbox))
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"sync"
+)
+
+// PacketIdRemapper rewrites the packet identifiers of the flows of a client on its connection to the broker, so that
+// the proxy can inject its own packets into the connection (see Inject) without colliding with the identifiers of the
+// client. Packets from the client get identifiers allocated by the remapper (see Upstream), and the acknowledgements
+// of the broker are translated back to the identifiers of the client (see Downstream). Acknowledgements of injected
+// packets are not forwarded to the client.
+//
+// Only the flows started by the client are remapped: messages that the broker publishes to the client use the
+// identifiers of the broker in both directions.
+type PacketIdRemapper struct {
+	// OnInjectedAck is called with the acknowledgements of injected packets. It must not block.
+	OnInjectedAck func(ack mqtt.Packet)
+
+	mu       sync.Mutex
+	ids      mqtt.PacketIdAllocator
+	upstream map[uint16]uint16        // client identifier -> broker identifier
+	flows    map[uint16]*remappedFlow // broker identifier -> flow
+}
+
+type remappedFlow struct {
+	clientId uint16
+	injected bool
+}
+
+func NewPacketIdRemapper() *PacketIdRemapper {
+	return &PacketIdRemapper{
+		upstream: make(map[uint16]uint16),
+		flows:    make(map[uint16]*remappedFlow),
+	}
+}
+
+// Upstream returns a writer that rewrites the packet identifiers of the PUBLISH, PUBREL, SUBSCRIBE and UNSUBSCRIBE
+// packets of the client before writing them to the broker.
+func (r *PacketIdRemapper) Upstream(broker mqtt.Writer) mqtt.Writer {
+	return mqtt.WriterFunc(func(packet mqtt.Packet) error {
+		if err := r.toBroker(packet); err != nil {
+			return err
+		}
+		return broker.WritePacket(packet)
+	})
+}
+
+// Downstream returns a writer that translates the packet identifiers of the PUBACK, PUBREC, PUBCOMP, SUBACK and
+// UNSUBACK packets of the broker before writing them to the client. Acknowledgements of injected packets are passed to
+// OnInjectedAck instead.
+func (r *PacketIdRemapper) Downstream(client mqtt.Writer) mqtt.Writer {
+	return mqtt.WriterFunc(func(packet mqtt.Packet) error {
+		if r.toClient(packet) {
+			return client.WritePacket(packet)
+		}
+		return nil
+	})
+}
+
+// Inject assigns a packet identifier to a packet of the proxy (a QoS 0 or 1 PUBLISH, a SUBSCRIBE or an UNSUBSCRIBE),
+// and writes it to the broker, which must be the writer wrapped by Upstream. QoS 2 is not supported, since the PUBREL
+// of the proxy could not be told apart from the PUBRELs of the client.
+func (r *PacketIdRemapper) Inject(broker mqtt.Writer, packet mqtt.Packet) error {
+	if p, ok := packet.(*mqtt.PublishPacket); ok && p.QoS == mqtt.QoS2 {
+		return errors.New("QoS 2 messages can not be injected")
+	}
+	if _, ok := mqtt.PacketId(packet); !ok {
+		return broker.WritePacket(packet)
+	}
+
+	r.mu.Lock()
+	id, err := r.ids.Allocate()
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	r.flows[id] = &remappedFlow{injected: true}
+	r.mu.Unlock()
+
+	mqtt.SetPacketId(packet, id)
+	if err = broker.WritePacket(packet); err != nil {
+		r.release(id)
+	}
+	return err
+}
+
+func (r *PacketIdRemapper) toBroker(packet mqtt.Packet) error {
+	clientId, ok := mqtt.PacketId(packet)
+	if !ok {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, mapped := r.upstream[clientId]
+	switch packet.Type() {
+	case mqtt.TypePublish, mqtt.TypeSubscribe, mqtt.TypeUnsubscribe:
+		if !mapped {
+			// a PUBLISH that is sent again (with the DUP flag) keeps its identifier
+			var err error
+			if id, err = r.ids.Allocate(); err != nil {
+				return err
+			}
+			r.upstream[clientId] = id
+			r.flows[id] = &remappedFlow{clientId: clientId}
+		}
+	case mqtt.TypePubRel:
+		if !mapped {
+			// the broker does not know the identifier either, and answers with a PUBCOMP that is passed through
+			return nil
+		}
+	default:
+		// acknowledgements of messages published by the broker keep the identifiers of the broker
+		return nil
+	}
+
+	mqtt.SetPacketId(packet, id)
+	return nil
+}
+
+// toClient translates an acknowledgement of the broker, and returns false if it must not be forwarded to the client.
+func (r *PacketIdRemapper) toClient(packet mqtt.Packet) bool {
+	var complete bool
+	switch packet.Type() {
+	case mqtt.TypePubAck, mqtt.TypePubComp, mqtt.TypeSubAck, mqtt.TypeUnsubAck:
+		complete = true
+	case mqtt.TypePubRec:
+	default:
+		return true
+	}
+	id, _ := mqtt.PacketId(packet)
+
+	r.mu.Lock()
+	flow, ok := r.flows[id]
+	if ok && complete {
+		r.remove(id, flow)
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return true
+	}
+	if flow.injected {
+		if r.OnInjectedAck != nil {
+			r.OnInjectedAck(packet)
+		}
+		return false
+	}
+	mqtt.SetPacketId(packet, flow.clientId)
+	return true
+}
+
+func (r *PacketIdRemapper) release(id uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if flow, ok := r.flows[id]; ok {
+		r.remove(id, flow)
+	}
+}
+
+// remove needs to be called with r.mu held.
+func (r *PacketIdRemapper) remove(id uint16, flow *remappedFlow) {
+	delete(r.flows, id)
+	if !flow.injected {
+		delete(r.upstream, flow.clientId)
+	}
+	r.ids.Release(id)
+}
+
+// Len returns the number of flows with remapped packet identifiers.
+func (r *PacketIdRemapper) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.flows)
+}
+
+// remapsUpstream returns true if packets with the header need to be rewritten by PacketIdRemapper.Upstream.
+func remapsUpstream(header *mqtt.PacketHeader) bool {
+	switch header.Type {
+	case mqtt.TypePublish:
+		return (header.Flags&0b0110)>>1 > mqtt.QoS0
+	case mqtt.TypePubRel, mqtt.TypeSubscribe, mqtt.TypeUnsubscribe:
+		return true
+	default:
+		return false
+	}
+}
+
+// remapsDownstream returns true if packets with the header need to be translated by PacketIdRemapper.Downstream.
+func remapsDownstream(header *mqtt.PacketHeader) bool {
+	switch header.Type {
+	case mqtt.TypePubAck, mqtt.TypePubRec, mqtt.TypePubComp, mqtt.TypeSubAck, mqtt.TypeUnsubAck:
+		return true
+	default:
+		return false
+	}
+}
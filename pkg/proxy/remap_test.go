@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"testing"
+)
+
+// recorder is a writer that records the packets written to it.
+type recorder struct {
+	packets []mqtt.Packet
+}
+
+func (r *recorder) WritePacket(packet mqtt.Packet) error {
+	r.packets = append(r.packets, packet)
+	return nil
+}
+
+func (r *recorder) last(t *testing.T) mqtt.Packet {
+	t.Helper()
+	if len(r.packets) == 0 {
+		t.Fatal("expected packet")
+	}
+	return r.packets[len(r.packets)-1]
+}
+
+func assertPacketId(t *testing.T, expected uint16, packet mqtt.Packet) {
+	t.Helper()
+	if id, _ := mqtt.PacketId(packet); id != expected {
+		t.Errorf("expected packet identifier %d of %s, got %d", expected, packet.Type(), id)
+	}
+}
+
+func newTestRemapper() (*PacketIdRemapper, *recorder, *recorder, mqtt.Writer, mqtt.Writer) {
+	r := NewPacketIdRemapper()
+	client, broker := &recorder{}, &recorder{}
+	return r, client, broker, r.Downstream(client), r.Upstream(broker)
+}
+
+func TestPacketIdRemapper_Inject(t *testing.T) {
+	r, client, broker, toClient, toBroker := newTestRemapper()
+	var injectedAcks []mqtt.Packet
+	r.OnInjectedAck = func(ack mqtt.Packet) { injectedAcks = append(injectedAcks, ack) }
+
+	if err := r.Inject(broker, &mqtt.PublishPacket{TopicName: "a", QoS: mqtt.QoS1}); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	assertPacketId(t, 1, broker.last(t))
+
+	// the client uses the same identifier as the injected packet
+	_ = toBroker.WritePacket(&mqtt.PublishPacket{TopicName: "b", QoS: mqtt.QoS1, PacketId: 1})
+	assertPacketId(t, 2, broker.last(t))
+
+	_ = toClient.WritePacket(&mqtt.PubAckPacket{PacketId: 1})
+	if len(client.packets) != 0 || len(injectedAcks) != 1 {
+		t.Error("expected acknowledgement of injected packet not to be forwarded")
+	}
+	_ = toClient.WritePacket(&mqtt.PubAckPacket{PacketId: 2})
+	assertPacketId(t, 1, client.last(t))
+	assertIntEquals(t, 0, r.Len())
+}
+
+func TestPacketIdRemapper_Inject_QoS0(t *testing.T) {
+	r, _, broker, _, _ := newTestRemapper()
+
+	p := &mqtt.PublishPacket{TopicName: "a"}
+	if err := r.Inject(broker, p); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if broker.last(t) != p {
+		t.Error("expected packet to be written unchanged")
+	}
+	if err := r.Inject(broker, &mqtt.PublishPacket{TopicName: "a", QoS: mqtt.QoS2}); err == nil {
+		t.Error("expected error for QoS 2")
+	}
+	assertIntEquals(t, 0, r.Len())
+}
+
+func TestPacketIdRemapper_QoS2(t *testing.T) {
+	r, client, broker, toClient, toBroker := newTestRemapper()
+	_ = r.Inject(broker, &mqtt.SubscribePacket{Subscriptions: []mqtt.Subscription{{TopicFilter: "a"}}})
+
+	_ = toBroker.WritePacket(&mqtt.PublishPacket{TopicName: "a", QoS: mqtt.QoS2, PacketId: 5})
+	assertPacketId(t, 2, broker.last(t))
+
+	// a PUBLISH that is sent again keeps its identifier
+	_ = toBroker.WritePacket(&mqtt.PublishPacket{TopicName: "a", QoS: mqtt.QoS2, PacketId: 5, Dup: true})
+	assertPacketId(t, 2, broker.last(t))
+
+	_ = toClient.WritePacket(&mqtt.PubRecPacket{PacketId: 2})
+	assertPacketId(t, 5, client.last(t))
+	_ = toBroker.WritePacket(&mqtt.PubRelPacket{PacketId: 5})
+	assertPacketId(t, 2, broker.last(t))
+	_ = toClient.WritePacket(&mqtt.PubCompPacket{PacketId: 2})
+	assertPacketId(t, 5, client.last(t))
+
+	// only the injected SUBSCRIBE is left
+	assertIntEquals(t, 1, r.Len())
+}
+
+func TestPacketIdRemapper_SubscribeUnsubscribe(t *testing.T) {
+	r, client, broker, toClient, toBroker := newTestRemapper()
+	_ = r.Inject(broker, &mqtt.PublishPacket{TopicName: "a", QoS: mqtt.QoS1})
+
+	_ = toBroker.WritePacket(&mqtt.SubscribePacket{PacketId: 1, Subscriptions: []mqtt.Subscription{{TopicFilter: "a"}}})
+	assertPacketId(t, 2, broker.last(t))
+	_ = toBroker.WritePacket(&mqtt.UnsubscribePacket{PacketId: 2, TopicFilters: []string{"a"}})
+	assertPacketId(t, 3, broker.last(t))
+
+	_ = toClient.WritePacket(&mqtt.UnsubAckPacket{PacketId: 3})
+	assertPacketId(t, 2, client.last(t))
+	_ = toClient.WritePacket(&mqtt.SubAckPacket{PacketId: 2, ReturnCodes: []mqtt.SubAckCode{mqtt.MaxQoS0}})
+	assertPacketId(t, 1, client.last(t))
+}
+
+func TestPacketIdRemapper_BrokerFlows(t *testing.T) {
+	_, client, broker, toClient, toBroker := newTestRemapper()
+
+	// messages published by the broker keep the identifiers of the broker
+	_ = toClient.WritePacket(&mqtt.PublishPacket{TopicName: "a", QoS: mqtt.QoS2, PacketId: 9})
+	assertPacketId(t, 9, client.last(t))
+	_ = toBroker.WritePacket(&mqtt.PubRecPacket{PacketId: 9})
+	assertPacketId(t, 9, broker.last(t))
+	_ = toClient.WritePacket(&mqtt.PubRelPacket{PacketId: 9})
+	assertPacketId(t, 9, client.last(t))
+	_ = toBroker.WritePacket(&mqtt.PubCompPacket{PacketId: 9})
+	assertPacketId(t, 9, broker.last(t))
+}
+
+func assertIntEquals(t *testing.T, expected int, actual int) {
+	t.Helper()
+	if expected != actual {
+		t.Errorf("expected %d, got %d", expected, actual)
+	}
+}
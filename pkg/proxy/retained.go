@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/topic"
+	"sort"
+	"sync"
+	"time"
+)
+
+// retainedCacheSize is the maximum number of messages in the retained message cache. Once it is reached, the message
+// that has been stored longest ago is evicted.
+const retainedCacheSize = 10000
+
+// retainedCacheTTL is the time after which a cached message expires, unless the broker has sent it again in the
+// meantime. The cache does not notice when other clients of the broker replace or delete a retained message, since the
+// broker forwards their messages to existing subscriptions without the retain flag [MQTT-3.3.1-9].
+const retainedCacheTTL = time.Minute
+
+// retainedCache holds the retained messages that the broker has sent to clients of the proxy when they subscribed.
+// Messages with an empty payload delete the retained message of their topic [MQTT-3.3.1-10]. Retained messages that
+// clients publish are not cached, since the broker may not accept them, but they remove the cached message of their
+// topic, which is outdated if the broker accepts them. Messages expire after the TTL.
+type retainedCache struct {
+	size int
+	ttl  time.Duration
+
+	mu       sync.Mutex
+	messages map[string]*list.Element // topic name -> element of order
+	order    *list.List               // *cachedMessage, the message that has been stored longest ago first
+	topics   *topic.Matcher           // topic name -> *cachedMessage
+}
+
+type cachedMessage struct {
+	*mqtt.PublishPacket
+	stored time.Time
+}
+
+func newRetainedCache(size int, ttl time.Duration) *retainedCache {
+	return &retainedCache{
+		size:     size,
+		ttl:      ttl,
+		messages: make(map[string]*list.Element),
+		order:    list.New(),
+		topics:   topic.NewMatcher(),
+	}
+}
+
+// store caches a copy of the retained message, or deletes the cached message of its topic if the payload is empty.
+func (c *retainedCache) store(p *mqtt.PublishPacket) {
+	if len(p.Payload) == 0 {
+		c.remove(p.TopicName)
+		return
+	}
+	message := &cachedMessage{
+		PublishPacket: &mqtt.PublishPacket{TopicName: p.TopicName, QoS: p.QoS, Retain: true, Payload: p.Payload},
+		stored:        time.Now(),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.messages[p.TopicName]; ok {
+		c.topics.Remove(p.TopicName, e.Value)
+		e.Value = message
+		c.order.MoveToBack(e)
+	} else {
+		c.messages[p.TopicName] = c.order.PushBack(message)
+	}
+	if err := c.topics.Add(p.TopicName, message); err != nil {
+		// the broker sent an invalid topic name
+		c.removeElement(c.messages[p.TopicName])
+		return
+	}
+
+	for c.order.Len() > c.size {
+		c.removeElement(c.order.Front())
+	}
+}
+
+// remove deletes the cached message of the topic.
+func (c *retainedCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.messages[name]; ok {
+		c.removeElement(e)
+	}
+}
+
+// removeElement needs to be called with c.mu held.
+func (c *retainedCache) removeElement(e *list.Element) {
+	m := c.order.Remove(e).(*cachedMessage)
+	delete(c.messages, m.TopicName)
+	c.topics.Remove(m.TopicName, m)
+}
+
+// expire removes the messages that have been stored longer ago than the TTL. It needs to be called with c.mu held.
+func (c *retainedCache) expire(now time.Time) {
+	for e := c.order.Front(); e != nil && now.Sub(e.Value.(*cachedMessage).stored) >= c.ttl; e = c.order.Front() {
+		c.removeElement(e)
+	}
+}
+
+// match returns copies of the cached messages whose topics match the filter, ordered by topic name.
+func (c *retainedCache) match(filter string) []*mqtt.PublishPacket {
+	c.mu.Lock()
+	c.expire(time.Now())
+	values := c.topics.MatchNames(filter)
+	c.mu.Unlock()
+
+	messages := make([]*mqtt.PublishPacket, len(values))
+	for i, v := range values {
+		messages[i] = v.(*cachedMessage).Clone().(*mqtt.PublishPacket)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].TopicName < messages[j].TopicName
+	})
+	return messages
+}
+
+// Len returns the number of cached messages that have not expired.
+func (c *retainedCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(time.Now())
+	return c.order.Len()
+}
+
+// retainedServer serves the retained messages of the cache to the client of a bridge, at QoS 0, as soon as the broker
+// has granted its subscriptions, and keeps the cache up to date with the retained messages passing through the bridge.
+// Since the broker also sends its retained messages, those that the client has already received from the cache are
+// dropped.
+type retainedServer struct {
+	cache  *retainedCache
+	client mqtt.Writer
+	broker mqtt.Writer // acknowledges the dropped messages of the broker
+
+	mu      sync.Mutex
+	pending map[uint16][]string // packet identifier -> topic filters of the SUBSCRIBE packets that wait for the SUBACK
+	served  map[string][]byte   // topic name -> payload of the served messages that the broker has not sent yet
+}
+
+func newRetainedServer(cache *retainedCache, client mqtt.Writer, broker mqtt.Writer) *retainedServer {
+	return &retainedServer{
+		cache:   cache,
+		client:  client,
+		broker:  broker,
+		pending: make(map[uint16][]string),
+		served:  make(map[string][]byte),
+	}
+}
+
+// subscribe remembers the filters of the SUBSCRIBE until the SUBACK arrives. Shared subscriptions do not receive
+// retained messages.
+func (r *retainedServer) subscribe(p *mqtt.SubscribePacket) {
+	filters := make([]string, len(p.Subscriptions))
+	for i, sub := range p.Subscriptions {
+		if !topic.IsShared(sub.TopicFilter) {
+			filters[i] = sub.TopicFilter
+		}
+	}
+
+	r.mu.Lock()
+	r.pending[p.PacketId] = filters
+	r.mu.Unlock()
+}
+
+// subAck writes the SUBACK to the client, followed by the cached messages that match the filters that the broker has
+// granted.
+func (r *retainedServer) subAck(p *mqtt.SubAckPacket) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	filters := r.pending[p.PacketId]
+	delete(r.pending, p.PacketId)
+	if err := r.client.WritePacket(p); err != nil {
+		return err
+	}
+
+	for i, filter := range filters {
+		if filter == "" || i >= len(p.ReturnCodes) || p.ReturnCodes[i] == mqtt.Failure {
+			continue
+		}
+		for _, message := range r.cache.match(filter) {
+			message.QoS = mqtt.QoS0
+			if err := r.client.WritePacket(message); err != nil {
+				return err
+			}
+			r.served[message.TopicName] = message.Payload
+		}
+	}
+	return nil
+}
+
+// upstream returns a writer that remembers the SUBSCRIBE packets of the client, and removes the cached messages of the
+// topics of its retained messages, before writing the packets to next.
+func (r *retainedServer) upstream(next mqtt.Writer) mqtt.Writer {
+	return mqtt.WriterFunc(func(packet mqtt.Packet) error {
+		switch p := packet.(type) {
+		case *mqtt.SubscribePacket:
+			r.subscribe(p)
+		case *mqtt.PublishPacket:
+			if p.Retain {
+				r.cache.remove(p.TopicName)
+			}
+		}
+		return next.WritePacket(packet)
+	})
+}
+
+// downstream returns a writer that serves the cached messages after the SUBACK packets of the broker, and caches the
+// retained messages of the broker before writing them to the client, unless the client has already received them
+// from the cache.
+func (r *retainedServer) downstream() mqtt.Writer {
+	return mqtt.WriterFunc(func(packet mqtt.Packet) error {
+		switch p := packet.(type) {
+		case *mqtt.SubAckPacket:
+			return r.subAck(p)
+		case *mqtt.PublishPacket:
+			deliver, err := r.deliver(p)
+			if err != nil || !deliver {
+				return err
+			}
+		}
+		return r.client.WritePacket(packet)
+	})
+}
+
+// deliver caches a retained message of the broker, and returns false if the client has already received it from the
+// cache. The proxy acknowledges dropped QoS 1 messages. QoS 2 messages are always delivered, since the proxy could not
+// tell the PUBREL of the broker apart from those of messages that the client received.
+func (r *retainedServer) deliver(p *mqtt.PublishPacket) (bool, error) {
+	if !p.Retain {
+		return true, nil
+	}
+	r.cache.store(p)
+
+	r.mu.Lock()
+	payload, served := r.served[p.TopicName]
+	delete(r.served, p.TopicName)
+	r.mu.Unlock()
+
+	if !served || !bytes.Equal(payload, p.Payload) || p.QoS == mqtt.QoS2 {
+		return true, nil
+	}
+	if p.QoS == mqtt.QoS1 {
+		return false, r.broker.WritePacket(&mqtt.PubAckPacket{PacketId: p.PacketId})
+	}
+	return false, nil
+}
+
+// close forgets the pending subscriptions and the served messages once the bridge has stopped.
+func (r *retainedServer) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending = make(map[uint16][]string)
+	r.served = make(map[string][]byte)
+}
+
+// isRetained returns true if the header is the header of a retained PUBLISH.
+func isRetained(header *mqtt.PacketHeader) bool {
+	return header.Type == mqtt.TypePublish && header.Flags&0b0001 != 0
+}
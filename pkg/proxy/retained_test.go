@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"testing"
+	"time"
+)
+
+func TestRetainedCache(t *testing.T) {
+	c := newRetainedCache(10, time.Minute)
+	c.store(&mqtt.PublishPacket{TopicName: "status/2", QoS: mqtt.QoS1, Retain: true, Payload: []byte("2")})
+	c.store(&mqtt.PublishPacket{TopicName: "status/1", Retain: true, Payload: []byte("1")})
+	c.store(&mqtt.PublishPacket{TopicName: "other", Retain: true, Payload: []byte("other")})
+	assertIntEquals(t, 3, c.Len())
+
+	messages := c.match("status/+")
+	assertIntEquals(t, 2, len(messages))
+	assertStringEquals(t, "status/1", messages[0].TopicName)
+	assertStringEquals(t, "status/2", messages[1].TopicName)
+	assertIntEquals(t, int(mqtt.QoS1), int(messages[1].QoS))
+
+	// an empty payload deletes the retained message
+	c.store(&mqtt.PublishPacket{TopicName: "status/2", Retain: true})
+	assertIntEquals(t, 1, len(c.match("status/#")))
+	assertIntEquals(t, 2, c.Len())
+}
+
+func TestRetainedCache_Size(t *testing.T) {
+	c := newRetainedCache(2, time.Minute)
+	c.store(&mqtt.PublishPacket{TopicName: "a", Retain: true, Payload: []byte("a")})
+	c.store(&mqtt.PublishPacket{TopicName: "b", Retain: true, Payload: []byte("b")})
+	c.store(&mqtt.PublishPacket{TopicName: "a", Retain: true, Payload: []byte("newer")})
+
+	// the message that has been stored longest ago is evicted
+	c.store(&mqtt.PublishPacket{TopicName: "c", Retain: true, Payload: []byte("c")})
+	assertIntEquals(t, 2, c.Len())
+	messages := c.match("#")
+	assertIntEquals(t, 2, len(messages))
+	assertStringEquals(t, "newer", string(messages[0].Payload))
+	assertStringEquals(t, "c", messages[1].TopicName)
+}
+
+func TestRetainedCache_TTL(t *testing.T) {
+	c := newRetainedCache(10, 200*time.Millisecond)
+	c.store(&mqtt.PublishPacket{TopicName: "a", Retain: true, Payload: []byte("a")})
+	time.Sleep(120 * time.Millisecond)
+	c.store(&mqtt.PublishPacket{TopicName: "b", Retain: true, Payload: []byte("b")})
+	time.Sleep(120 * time.Millisecond)
+
+	// the message that the broker has not sent again within the TTL expires
+	messages := c.match("#")
+	assertIntEquals(t, 1, len(messages))
+	assertStringEquals(t, "b", messages[0].TopicName)
+	assertIntEquals(t, 1, c.Len())
+
+	time.Sleep(120 * time.Millisecond)
+	assertIntEquals(t, 0, len(c.match("#")))
+	assertIntEquals(t, 0, c.Len())
+}
+
+func TestRetainedServer(t *testing.T) {
+	cache := newRetainedCache(10, time.Minute)
+	client, broker := &recorder{}, &recorder{}
+	r := newRetainedServer(cache, client, broker)
+	upstream, downstream := r.upstream(broker), r.downstream()
+
+	// retained messages of the broker are cached
+	_ = downstream.WritePacket(&mqtt.PublishPacket{TopicName: "status/1", Retain: true, Payload: []byte("1")})
+	assertIntEquals(t, 1, cache.Len())
+	assertIntEquals(t, 1, len(client.packets))
+
+	// the client receives the cached message at QoS 0 once the broker has granted the subscription
+	_ = upstream.WritePacket(&mqtt.SubscribePacket{PacketId: 1, Subscriptions: []mqtt.Subscription{
+		{TopicFilter: "status/#", QoS: mqtt.QoS1},
+		{TopicFilter: "$share/g/status/#", QoS: mqtt.QoS1},
+		{TopicFilter: "status/+", QoS: mqtt.QoS1},
+	}})
+	assertIntEquals(t, 1, len(broker.packets))
+	assertIntEquals(t, 1, len(client.packets))
+
+	_ = downstream.WritePacket(&mqtt.SubAckPacket{PacketId: 1,
+		ReturnCodes: []mqtt.SubAckCode{mqtt.MaxQoS1, mqtt.MaxQoS1, mqtt.Failure}})
+	assertIntEquals(t, 3, len(client.packets))
+	assertIntEquals(t, int(mqtt.TypeSubAck), int(client.packets[1].Type()))
+	served := client.last(t).(*mqtt.PublishPacket)
+	assertStringEquals(t, "1", string(served.Payload))
+	assertIntEquals(t, int(mqtt.QoS0), int(served.QoS))
+
+	// the same retained message of the broker is acknowledged by the proxy, instead of being delivered again
+	_ = downstream.WritePacket(&mqtt.PublishPacket{TopicName: "status/1", QoS: mqtt.QoS1, PacketId: 3, Retain: true,
+		Payload: []byte("1")})
+	assertIntEquals(t, 3, len(client.packets))
+	assertIntEquals(t, int(mqtt.TypePubAck), int(broker.last(t).Type()))
+	assertPacketId(t, 3, broker.last(t))
+
+	// newer retained messages of the broker are delivered, and replace the cached message
+	_ = downstream.WritePacket(&mqtt.PublishPacket{TopicName: "status/1", Retain: true, Payload: []byte("newer")})
+	assertIntEquals(t, 4, len(client.packets))
+	assertStringEquals(t, "newer", string(cache.match("status/1")[0].Payload))
+
+	// as are messages that are not retained
+	_ = downstream.WritePacket(&mqtt.PublishPacket{TopicName: "status/1", Payload: []byte("1")})
+	assertIntEquals(t, 5, len(client.packets))
+}
+
+func TestRetainedServer_ClientMessages(t *testing.T) {
+	cache := newRetainedCache(10, time.Minute)
+	cache.store(&mqtt.PublishPacket{TopicName: "status/1", Retain: true, Payload: []byte("1")})
+	client, broker := &recorder{}, &recorder{}
+	upstream := newRetainedServer(cache, client, broker).upstream(broker)
+
+	// the retained messages of clients are not cached, since the broker may not accept them, but they replace the
+	// cached message of their topic
+	_ = upstream.WritePacket(&mqtt.PublishPacket{TopicName: "status/1", Retain: true, Payload: []byte("2")})
+	_ = upstream.WritePacket(&mqtt.PublishPacket{TopicName: "status/2", Retain: true, Payload: []byte("2")})
+	assertIntEquals(t, 0, cache.Len())
+	assertIntEquals(t, 2, len(broker.packets))
+}
+
+func TestRetainedServer_Close(t *testing.T) {
+	cache := newRetainedCache(10, time.Minute)
+	cache.store(&mqtt.PublishPacket{TopicName: "status/1", Retain: true, Payload: []byte("1")})
+	client, broker := &recorder{}, &recorder{}
+	r := newRetainedServer(cache, client, broker)
+	upstream, downstream := r.upstream(broker), r.downstream()
+
+	_ = upstream.WritePacket(&mqtt.SubscribePacket{PacketId: 1, Subscriptions: []mqtt.Subscription{
+		{TopicFilter: "status/#", QoS: mqtt.QoS1},
+	}})
+	_ = upstream.WritePacket(&mqtt.SubscribePacket{PacketId: 2, Subscriptions: []mqtt.Subscription{
+		{TopicFilter: "other", QoS: mqtt.QoS1},
+	}})
+	_ = downstream.WritePacket(&mqtt.SubAckPacket{PacketId: 1, ReturnCodes: []mqtt.SubAckCode{mqtt.MaxQoS1}})
+	assertIntEquals(t, 1, len(r.served))
+	assertIntEquals(t, 1, len(r.pending))
+
+	// the served messages that the broker has not sent yet are forgotten once the bridge has stopped
+	r.close()
+	assertIntEquals(t, 0, len(r.served))
+	assertIntEquals(t, 0, len(r.pending))
+}
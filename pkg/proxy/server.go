@@ -1,45 +1,514 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/queue"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func startBridgeHandler(clientConn net.Conn) {
-	brokerConn, err := net.Dial("tcp", "127.0.0.1:1884")
+const DefaultBrokerAddress = "127.0.0.1:1884"
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown has been called.
+var ErrServerClosed = errors.New("proxy: server closed")
+
+// Server accepts MQTT client connections and bridges each of them to a new connection to the broker.
+type Server struct {
+	// BrokerAddress is the TCP address of the broker that clients are bridged to.
+	BrokerAddress string
+
+	// Dial opens connections to the broker. If it is nil, the server dials BrokerAddress over TCP. Tests use it to
+	// connect the server to an in-process broker (see broker.Broker.Pipe).
+	Dial func() (net.Conn, error)
+
+	// Strict enables strict mode on client connections (see mqtt.DecodingStreamer.SetStrict). Connections of clients
+	// that send packets violating the MQTT specification are closed before the packet is forwarded to the broker. Strict
+	// mode checks the MUST rules of MQTT 3.1.1, including well-formed UTF-8 strings regardless of UTF8Mode. For MQTT 5
+	// clients it only checks the CONNECT, since it only knows the MQTT 3.1.1 formats of the other packets.
+	Strict bool
+
+	// UTF8Mode sets how client connections handle strings that are not valid UTF-8 or contain U+0000 (see
+	// mqtt.UTF8Mode). Clients that send such strings are disconnected in mqtt.UTF8Reject mode, and their strings are
+	// replaced before the packet is forwarded to the broker in mqtt.UTF8Replace mode. Like strict mode, it is disabled
+	// for MQTT 5 clients after the CONNECT.
+	UTF8Mode mqtt.UTF8Mode
+
+	// MaxPacketSize is the maximum size in bytes of packets that clients may send (see
+	// mqtt.DecodingStreamer.SetMaxPacketSize). Clients that exceed it are disconnected (MQTT 5 clients with a "Packet
+	// too large" DISCONNECT). 0 means no limit.
+	MaxPacketSize uint32
+
+	// SharedSubscriptions enables shared subscriptions ("$share/{group}/{filter}") for brokers that do not support
+	// them. The proxy subscribes to the filters of shared subscriptions over its own connection to the broker, and
+	// distributes the messages round-robin among the clients of each group, at QoS 0. Since the proxy only decodes MQTT
+	// 3.1.1 SUBSCRIBE packets, shared subscriptions of MQTT 5 clients are forwarded to the broker.
+	SharedSubscriptions bool
+
+	// RemapPacketIds rewrites the packet identifiers of MQTT 3.1.1 clients on their connections to the broker (see
+	// PacketIdRemapper), so that the proxy can send its own packets over these connections: the wills that the proxy
+	// keeps (see KeepWills) are published over the connection of the client, if it is still intact. It requires
+	// decoding all packets with packet identifiers, instead of copying them.
+	RemapPacketIds bool
+
+	// RetainedCache lets the proxy cache the retained messages that the broker sends to MQTT 3.1 and 3.1.1 clients
+	// (see retainedCache), and send the matching cached messages to clients as soon as the broker has granted their
+	// subscriptions, at QoS 0, instead of waiting for the broker to look up its retained messages. Cached messages expire
+	// after retainedCacheTTL, unless the broker sends them again.
+	RetainedCache bool
+
+	// LocalKeepAlive lets the proxy answer the PINGREQ packets of clients itself, instead of forwarding them to the
+	// broker, and keep the connections to the broker alive on behalf of the clients (see brokerKeepAlive). Bridges to
+	// brokers that do not answer a PINGREQ within the keep alive of the client are closed, and so are bridges to clients
+	// that send no packet within one and a half times their keep alive.
+	LocalKeepAlive bool
+
+	// KeepWills strips the will from the CONNECT of MQTT 3.1 and 3.1.1 clients before forwarding it to the broker, and
+	// lets the proxy publish the will instead, over a separate connection to the broker (or the connection of the
+	// client, see RemapPacketIds), if the client connection breaks without a DISCONNECT. Otherwise, the broker also
+	// publishes the will of clients that are still connected to the proxy when the proxy loses or closes the connection
+	// to the broker.
+	KeepWills bool
+
+	// StoreAndForwardDir enables store-and-forward for MQTT 3.1 and 3.1.1 clients: if the broker is unreachable, the
+	// proxy accepts the clients itself, and stores their QoS 1 and 2 messages in a durable queue in the directory until
+	// they can be forwarded to the broker (see storeAndForward). An empty directory disables store-and-forward.
+	StoreAndForwardDir string
+	// StoreAndForwardMaxBytes limits the size in bytes of the stored messages. The oldest messages are dropped when it
+	// is exceeded, even if they have not been forwarded yet (see queue.Options.MaxBytes). 0 means no limit.
+	StoreAndForwardMaxBytes int64
+	// StoreAndForwardMaxAge limits the time for which messages are stored. Older messages are dropped, even if they
+	// have not been forwarded yet (see queue.Options.MaxAge). 0 means no limit.
+	StoreAndForwardMaxAge time.Duration
+
+	// Multiplex is the number of upstream connections over which the proxy bridges lightweight clients (MQTT 3.1 and
+	// 3.1.1 clients with a clean session and without credentials, see multiplexer), instead of opening a connection to
+	// the broker for each of them. 0 disables multiplexing.
+	Multiplex int
+
+	// ConnectTimeout is the maximum time to wait for the CONNECT of a client. 0 means no timeout.
+	ConnectTimeout time.Duration
+
+	// WriteTimeout is the maximum time that writing to a client or the broker may block. Connections that exceed it are
+	// closed. 0 means no timeout.
+	WriteTimeout time.Duration
+
+	// Verbose logs every packet that clients send.
+	Verbose bool
+
+	mu        sync.Mutex
+	ctx       context.Context // cancelled by Shutdown
+	cancel    context.CancelFunc
+	listeners map[net.Listener]struct{}
+	handlers  sync.WaitGroup
+	shared    *sharedSubscriptions
+	mux       *multiplexer
+	retained  *retainedCache
+	forwarder *storeAndForward
+}
+
+func NewServer(brokerAddress string) *Server {
+	return &Server{BrokerAddress: brokerAddress}
+}
+
+func (s *Server) startBridgeHandler(ctx context.Context, clientConn net.Conn) {
+	clientConn = s.withWriteTimeout(clientConn)
+
+	clientStream := mqtt.NewDecodingStreamer(clientConn)
+	clientStream.SetStrict(s.Strict)
+	clientStream.SetUTF8Mode(s.UTF8Mode)
+	clientStream.SetMaxPacketSize(s.MaxPacketSize)
+
+	// other goroutines than the bridge may write to the client (see sharedSubscriptions)
+	client := mqtt.NewCodecChannel(clientStream, newLockedSink(mqtt.NewEncoder(clientConn)))
+
+	connect, err := s.readConnect(ctx, client)
 	if err != nil {
-		log.Println("error dialing broker", brokerConn)
+		log.Printf("error reading CONNECT of client %s: %v\n", clientConn.RemoteAddr(), err)
+		if errors.Is(err, mqtt.ErrUnsupportedVersion) {
+			_ = client.WritePacket(&mqtt.ConnAckPacket{ReturnCode: mqtt.ConnectUnacceptableProtocolVersion})
+		}
 		clientConn.Close()
 		return
 	}
+	if connect.ProtocolLevel == mqtt.ProtocolLevel5 {
+		clientStream.SetStrict(false)
+		clientStream.SetUTF8Mode(mqtt.UTF8PassThrough)
+	}
+
+	if s.Multiplex > 0 && multiplexable(connect) {
+		s.multiplexer().serve(ctx, clientConn, client, connect)
+		return
+	}
+
+	keepWill := s.KeepWills && connect.WillFlag && connect.ProtocolLevel != mqtt.ProtocolLevel5
+	forwarded := connect
+	if keepWill {
+		forwarded = stripWill(connect)
+	}
 
-	bridge := NewBridge(clientConn, brokerConn)
-	errors := bridge.Start()
+	brokerConn, err := s.dialBroker()
+	if err != nil && s.StoreAndForwardDir != "" && connect.ProtocolLevel != mqtt.ProtocolLevel5 {
+		log.Printf("broker unreachable, storing messages of client %s: %v\n", clientConn.RemoteAddr(), err)
+		forwarder, err := s.storeAndForward()
+		if err != nil {
+			log.Println("error opening message queue", err)
+			clientConn.Close()
+			return
+		}
+		forwarder.serve(ctx, clientConn, client, connect)
+		return
+	}
+	if err != nil {
+		log.Println("error dialing broker", err)
+		clientConn.Close()
+		return
+	}
+	s.wakeForwarder()
+	brokerConn = s.withWriteTimeout(brokerConn)
+
+	// other goroutines than the bridge may write to the broker (see PacketIdRemapper.Inject)
+	var brokerSink mqtt.PacketSink = newLockedSink(mqtt.NewEncoder(brokerConn))
+	var keepAlive *brokerKeepAlive
+	if s.LocalKeepAlive && connect.KeepAlive > 0 {
+		keepAlive = newBrokerKeepAlive(brokerSink, time.Duration(connect.KeepAlive)*time.Second)
+		brokerSink = keepAlive
+	}
+	broker := mqtt.NewCodecChannel(mqtt.NewDecodingStreamer(brokerConn), brokerSink)
+	if err = broker.WritePacket(forwarded); err != nil {
+		log.Println("error forwarding CONNECT to broker", err)
+		brokerConn.Close()
+		clientConn.Close()
+		return
+	}
+
+	bridge := NewChannelBridge(client, broker)
+	if s.LocalKeepAlive && connect.KeepAlive > 0 {
+		// the server disconnects clients that send no packet within one and a half times the keep alive [MQTT-3.1.2-24].
+		// The connection to the broker is closed without a DISCONNECT, so the broker publishes the will of the client.
+		// Without LocalKeepAlive, the PINGREQ packets reach the broker, which enforces the keep alive itself.
+		bridge.SetReadTimeoutLeft(time.Duration(connect.KeepAlive) * time.Second * 3 / 2)
+	}
+
+	// the SUBACK packets of the broker are written through the retained message server, if there is one
+	var retained *retainedServer
+	subAcks := mqtt.Writer(bridge.SinkLeft())
+	if s.RetainedCache && connect.ProtocolLevel != mqtt.ProtocolLevel5 {
+		// the dropped messages of the broker are acknowledged with the packet identifiers of the broker
+		retained = newRetainedServer(s.retainedCache(), bridge.SinkLeft(), bridge.SinkRight())
+		defer retained.close()
+		subAcks = retained.downstream()
+	}
+
+	// packets with packet identifiers are written through the remapper, if there is one
+	var remapper *PacketIdRemapper
+	var willAcks chan mqtt.Packet // receives the acknowledgement of a will that the proxy injected
+	toClient, toBroker := subAcks, mqtt.Writer(bridge.SinkRight())
+	if s.RemapPacketIds && connect.ProtocolLevel != mqtt.ProtocolLevel5 {
+		remapper = NewPacketIdRemapper()
+		toClient, toBroker = remapper.Downstream(subAcks), remapper.Upstream(bridge.SinkRight())
+		willAcks = make(chan mqtt.Packet, 1)
+		remapper.OnInjectedAck = func(ack mqtt.Packet) {
+			select {
+			case willAcks <- ack:
+			default:
+			}
+		}
+	}
+
+	var shared *sharedMember
+	if s.SharedSubscriptions && connect.ProtocolLevel != mqtt.ProtocolLevel5 {
+		// the shared subscriptions see the packet identifiers of the client
+		shared = s.sharedSubscriptions().newMember(clientConn, subAcks, toBroker)
+		defer shared.leaveAll()
+	}
+
+	bridge.SetRouterRight(func(header *mqtt.PacketHeader) mqtt.Writer {
+		if keepAlive != nil && header.Type == mqtt.TypePingResp {
+			return mqtt.WriterFunc(keepAlive.pingResp)
+		}
+		if retained != nil && isRetained(header) {
+			return retained.downstream()
+		}
+		if shared != nil && header.Type == mqtt.TypeSubAck && shared.expectsSubAck() {
+			if remapper != nil {
+				return remapper.Downstream(mqtt.WriterFunc(shared.subAck))
+			}
+			return mqtt.WriterFunc(shared.subAck)
+		}
+		if remapper != nil && remapsDownstream(header) {
+			return toClient
+		}
+		if header.Type == mqtt.TypeSubAck {
+			return subAcks
+		}
+		return bridge.SinkLeft()
+	})
 
 	// example of how the bridge can be used to intercept packets and manipulate the routing
-	bridge.SetRouterLeft(func(header *mqtt.PacketHeader) mqtt.Writer{
-		log.Printf("client %s sent %s\n", clientConn.RemoteAddr(), header.Type)
-		return bridge.SinkRight()
+	var disconnected int32 // set by the left router, and read once the first direction of the bridge has stopped
+	bridge.SetRouterLeft(func(header *mqtt.PacketHeader) mqtt.Writer {
+		if s.Verbose {
+			log.Printf("client %s sent %s\n", clientConn.RemoteAddr(), header.Type)
+		}
+		if header.Type == mqtt.TypeDisconnect {
+			atomic.StoreInt32(&disconnected, 1)
+		}
+		if s.LocalKeepAlive && header.Type == mqtt.TypePingReq {
+			return mqtt.WriterFunc(func(mqtt.Packet) error {
+				return bridge.SinkLeft().WritePacket(&mqtt.PingRespPacket{})
+			})
+		}
+		upstream := mqtt.Writer(bridge.SinkRight())
+		switch {
+		case shared != nil && header.Type == mqtt.TypeSubscribe:
+			upstream = mqtt.WriterFunc(shared.subscribe)
+		case shared != nil && header.Type == mqtt.TypeUnsubscribe:
+			upstream = mqtt.WriterFunc(shared.unsubscribe)
+		case remapper != nil && remapsUpstream(header):
+			upstream = toBroker
+		}
+		if retained != nil && (header.Type == mqtt.TypeSubscribe || isRetained(header)) {
+			return retained.upstream(upstream)
+		}
+		return upstream
 	})
 
-	err = <-errors
-	log.Println("first error:", err)
+	errs := bridge.StartContext(ctx)
+
+	if keepAlive != nil {
+		keepAliveCtx, stopKeepAlive := context.WithCancel(ctx)
+		defer stopKeepAlive()
+		go func() {
+			if err := keepAlive.run(keepAliveCtx); err != nil && keepAliveCtx.Err() == nil {
+				log.Printf("closing connection of client %s to broker: %v\n", clientConn.RemoteAddr(), err)
+				brokerConn.Close()
+			}
+		}()
+	}
+
+	err = <-errs
+	logBridgeError(clientConn, err)
+
+	// the client connection broke (rather than the connection to the broker), so the proxy publishes the will
+	publishWill := keepWill && atomic.LoadInt32(&disconnected) == 0 && ctx.Err() == nil && bridge.LeftStoppedFirst()
+	if publishWill && remapper != nil && connect.WillQoS < mqtt.QoS2 {
+		// the connection to the broker is still intact, so the will is published over it
+		if err = injectWill(remapper, bridge.SinkRight(), willAcks, connect); err != nil {
+			log.Printf("error injecting will of client %s: %v\n", clientConn.RemoteAddr(), err)
+		} else {
+			publishWill = false
+		}
+	}
+
+	if reason, ok := disconnectReason(ctx, err); ok && connect.ProtocolLevel == mqtt.ProtocolLevel5 {
+		// the client connection is still intact, so we stop the bridge before telling the client why it is closed
+		brokerConn.Close()
+		bridge.Wait()
+		_ = client.WritePacket(&mqtt.DisconnectPacket{ReasonCode: reason})
+	}
 
 	brokerConn.Close()
 	clientConn.Close()
 
-	for err := range errors {
+	for err := range errs {
 		log.Println("other errors:", err)
 	}
 
 	bridge.Wait()
+
+	if publishWill {
+		if err = s.publishWill(connect); err != nil {
+			log.Printf("error publishing will of client %s: %v\n", clientConn.RemoteAddr(), err)
+		}
+	}
 }
 
-func Serve(network string, address string) {
+// dialBroker opens a new connection to the broker.
+func (s *Server) dialBroker() (net.Conn, error) {
+	if s.Dial != nil {
+		return s.Dial()
+	}
+	return net.Dial("tcp", s.BrokerAddress)
+}
+
+// sharedSubscriptions returns the shared subscriptions of the server.
+func (s *Server) sharedSubscriptions() *sharedSubscriptions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shared == nil {
+		clientId := fmt.Sprintf("emma-proxy-shared-%x", time.Now().UnixNano())
+		s.shared = newSharedSubscriptions(s.dialBroker, clientId)
+		if s.ctx != nil && s.ctx.Err() != nil {
+			s.shared.close()
+		}
+	}
+	return s.shared
+}
+
+// retainedCache returns the retained message cache of the server.
+func (s *Server) retainedCache() *retainedCache {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.retained == nil {
+		s.retained = newRetainedCache(retainedCacheSize, retainedCacheTTL)
+	}
+	return s.retained
+}
+
+// storeAndForward returns the store-and-forward queue of the server, and opens it if necessary.
+func (s *Server) storeAndForward() (*storeAndForward, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.forwarder == nil {
+		clientId := fmt.Sprintf("emma-proxy-forward-%x", time.Now().UnixNano())
+		opts := queue.Options{MaxBytes: s.StoreAndForwardMaxBytes, MaxAge: s.StoreAndForwardMaxAge}
+		if s.StoreAndForwardMaxBytes > 0 && s.StoreAndForwardMaxBytes/4 < queue.DefaultSegmentSize {
+			// the queue keeps the segment that messages are appended to, so it may exceed the limit by a segment
+			opts.SegmentSize = s.StoreAndForwardMaxBytes/4 + 1
+		}
+		forwarder, err := newStoreAndForward(s.dialBroker, clientId, s.StoreAndForwardDir, opts)
+		if err != nil {
+			return nil, err
+		}
+		s.forwarder = forwarder
+		if s.ctx != nil && s.ctx.Err() != nil {
+			s.forwarder.close()
+		}
+	}
+	return s.forwarder, nil
+}
+
+// wakeForwarder lets the store-and-forward queue forward its messages, since the broker is reachable again.
+func (s *Server) wakeForwarder() {
+	s.mu.Lock()
+	forwarder := s.forwarder
+	s.mu.Unlock()
+
+	if forwarder != nil {
+		forwarder.brokerReachable()
+	}
+}
+
+// multiplexer returns the multiplexer of the server.
+func (s *Server) multiplexer() *multiplexer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mux == nil {
+		clientId := fmt.Sprintf("emma-proxy-mux-%x", time.Now().UnixNano())
+		s.mux = newMultiplexer(s.dialBroker, clientId, s.Multiplex)
+		if s.ctx != nil && s.ctx.Err() != nil {
+			s.mux.close()
+		}
+	}
+	return s.mux
+}
+
+// readConnect reads the first packet from the client, which must be a CONNECT.
+func (s *Server) readConnect(ctx context.Context, client mqtt.Channel) (*mqtt.ConnectPacket, error) {
+	if s.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ConnectTimeout)
+		defer cancel()
+	}
+
+	packet, err := mqtt.ReadNextContext(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	connect, ok := packet.(*mqtt.ConnectPacket)
+	if !ok {
+		return nil, fmt.Errorf("expected CONNECT packet, got %s", packet.Type())
+	}
+	return connect, nil
+}
+
+// disconnectReason returns the reason code of the DISCONNECT that MQTT 5 clients are sent when the bridge stopped
+// with the given error, and false if the client should not be sent a DISCONNECT.
+func disconnectReason(ctx context.Context, err error) (byte, bool) {
+	switch {
+	case ctx.Err() != nil:
+		return mqtt.ReasonServerShuttingDown, true
+	case errors.Is(err, mqtt.ErrPacketTooLarge):
+		return mqtt.ReasonPacketTooLarge, true
+	case errors.Is(err, ErrReadTimeout):
+		return mqtt.ReasonKeepAliveTimeout, true
+	default:
+		return 0, false
+	}
+}
+
+func logBridgeError(clientConn net.Conn, err error) {
+	switch {
+	case errors.Is(err, mqtt.ErrProtocolViolation), errors.Is(err, mqtt.ErrMalformedPacket):
+		log.Printf("closing connection of client %s: %v\n", clientConn.RemoteAddr(), err)
+	case errors.Is(err, ErrReadTimeout):
+		log.Printf("closing connection of client %s: keep alive timeout\n", clientConn.RemoteAddr())
+	case errors.Is(err, context.Canceled):
+		log.Printf("closing connection of client %s: server shutting down\n", clientConn.RemoteAddr())
+	default:
+		log.Println("first error:", err)
+	}
+}
+
+// withWriteTimeout wraps the connection so that every write sets a write deadline, if the server has a WriteTimeout.
+func (s *Server) withWriteTimeout(conn net.Conn) net.Conn {
+	if s.WriteTimeout <= 0 {
+		return conn
+	}
+	return &writeTimeoutConn{conn, s.WriteTimeout}
+}
+
+// writeTimeoutConn sets the write deadline of the connection before every write.
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *writeTimeoutConn) Write(b []byte) (int, error) {
+	if err := c.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// ListenAndServe listens on the given network address and then calls Serve.
+func (s *Server) ListenAndServe(network string, address string) error {
 	ln, err := net.Listen(network, address)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	return s.Serve(ln)
+}
+
+// Serve accepts client connections on the listener and bridges each of them to the broker. It blocks until accepting a
+// connection fails.
+//
+// After Shutdown has been called, Serve closes the listener and returns ErrServerClosed.
+func (s *Server) Serve(ln net.Listener) error {
+	ctx, ok := s.trackListener(ln)
+	if !ok {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackListener(ln)
+
+	if s.StoreAndForwardDir != "" {
+		// the messages that have been stored before the server was stopped are forwarded as well
+		if _, err := s.storeAndForward(); err != nil {
+			return err
+		}
 	}
 
 	log.Printf("listening for connections on %s\n", ln.Addr())
@@ -47,9 +516,90 @@ func Serve(network string, address string) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Fatal(err)
+			if ctx.Err() != nil {
+				return ErrServerClosed
+			}
+			return err
 		}
 		log.Printf("accepted connection from %s\n", conn.RemoteAddr())
-		go startBridgeHandler(conn)
+
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			s.startBridgeHandler(ctx, conn)
+		}()
+	}
+}
+
+// Shutdown stops the server: it closes all listeners, and stops all bridges. MQTT 5 clients are sent a DISCONNECT with
+// reason code "Server shutting down", and all connections are closed. Shutdown waits until all connections have been
+// closed, or the context is done, in which case it returns the error of the context.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.init()
+	s.cancel()
+	for ln := range s.listeners {
+		ln.Close()
 	}
+	if s.shared != nil {
+		s.shared.close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		// the upstream connections of the multiplexer and the message queue are closed last, once no client uses them
+		s.mu.Lock()
+		mux, forwarder := s.mux, s.forwarder
+		s.mu.Unlock()
+		if mux != nil {
+			mux.close()
+		}
+		if forwarder != nil {
+			forwarder.close()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// init initializes the internal state of the server. It needs to be called with s.mu held.
+func (s *Server) init() {
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		s.listeners = make(map[net.Listener]struct{})
+	}
+}
+
+// trackListener registers the listener so that Shutdown can close it, and returns the context of the server. It
+// returns false if the server has been shut down.
+func (s *Server) trackListener(ln net.Listener) (context.Context, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.init()
+	if s.ctx.Err() != nil {
+		return nil, false
+	}
+	s.listeners[ln] = struct{}{}
+	return s.ctx, true
+}
+
+func (s *Server) untrackListener(ln net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.listeners, ln)
+}
+
+// Serve starts a server that bridges clients to the broker at DefaultBrokerAddress.
+func Serve(network string, address string) {
+	log.Fatal(NewServer(DefaultBrokerAddress).ListenAndServe(network, address))
 }
@@ -0,0 +1,703 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/broker"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/client"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startServer starts a proxy in front of a new in-memory broker, and returns the broker and the address of the proxy.
+// The server is configured by the given function before it starts serving, and shut down when the test ends.
+func startServer(t *testing.T, configure func(s *Server)) (*Server, *broker.Broker, string) {
+	b := broker.New()
+	t.Cleanup(func() { _ = b.Close() })
+
+	s := NewServer("")
+	s.Dial = func() (net.Conn, error) { return b.Pipe(), nil }
+	if configure != nil {
+		configure(s)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- s.Serve(ln) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Error("error shutting down server", err)
+		}
+		if err := <-errs; err != ErrServerClosed {
+			t.Error("expected ErrServerClosed, got", err)
+		}
+	})
+
+	return s, b, ln.Addr().String()
+}
+
+// tempDir creates a temporary directory, which is removed when the test ends.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "emma-proxy-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+// connectClient connects a new client to the proxy. The client is configured by the given function before it
+// connects, and disconnected when the test ends.
+func connectClient(t *testing.T, address string, clientId string, configure func(c *client.Client)) *client.Client {
+	t.Helper()
+
+	c := client.New(address, clientId)
+	c.AutoReconnect = false
+	if configure != nil {
+		configure(c)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal("error connecting client", err)
+	}
+	t.Cleanup(func() { _ = c.Disconnect() })
+	return c
+}
+
+// subscribe subscribes the client to the filter, and returns a channel that receives the payloads of the messages.
+func subscribe(t *testing.T, c *client.Client, filter string, qos mqtt.QoS) chan string {
+	t.Helper()
+
+	messages := make(chan string, 16)
+	_, err := c.Subscribe(context.Background(), filter, qos, func(_ *client.Client, p *mqtt.PublishPacket) {
+		messages <- string(p.Payload)
+	})
+	if err != nil {
+		t.Fatal("error subscribing", err)
+	}
+	return messages
+}
+
+func publish(t *testing.T, c *client.Client, topicName string, payload string, qos mqtt.QoS, retain bool) {
+	t.Helper()
+	if err := c.Publish(context.Background(), topicName, []byte(payload), qos, retain); err != nil {
+		t.Fatal("error publishing", err)
+	}
+}
+
+func TestServer_PublishSubscribe(t *testing.T) {
+	_, _, address := startServer(t, nil)
+	sub := connectClient(t, address, "sub", nil)
+	pub := connectClient(t, address, "pub", nil)
+
+	messages := subscribe(t, sub, "sensors/+/temperature", mqtt.QoS2)
+	publish(t, pub, "sensors/1/humidity", "40", mqtt.QoS0, false)
+	publish(t, pub, "sensors/1/temperature", "21", mqtt.QoS0, false)
+	publish(t, pub, "sensors/2/temperature", "22", mqtt.QoS1, false)
+	publish(t, pub, "sensors/3/temperature", "23", mqtt.QoS2, false)
+
+	assertMessages(t, messages, "21", "22", "23")
+}
+
+func TestServer_Retained(t *testing.T) {
+	_, b, address := startServer(t, nil)
+	pub := connectClient(t, address, "pub", nil)
+
+	publish(t, pub, "status/1", "online", mqtt.QoS1, true)
+	assertStringEquals(t, "online", string(b.Retained("status/1").Payload))
+
+	sub := connectClient(t, address, "sub", nil)
+	assertMessages(t, subscribe(t, sub, "status/#", mqtt.QoS1), "online")
+}
+
+func TestServer_Will(t *testing.T) {
+	_, _, address := startServer(t, nil)
+	sub := connectClient(t, address, "sub", nil)
+	messages := subscribe(t, sub, "status/#", mqtt.QoS1)
+
+	var conn net.Conn
+	connectClient(t, address, "c", func(c *client.Client) {
+		c.Will = &mqtt.PublishPacket{TopicName: "status/c", QoS: mqtt.QoS1, Payload: []byte("offline")}
+		c.Dial = func(ctx context.Context) (net.Conn, error) {
+			var err error
+			conn, err = net.Dial("tcp", address)
+			return conn, err
+		}
+	})
+
+	// the proxy closes the connection to the broker when the client connection breaks, so the broker publishes the will
+	conn.Close()
+	assertMessages(t, messages, "offline")
+}
+
+func TestServer_SharedSubscriptions(t *testing.T) {
+	_, _, address := startServer(t, func(s *Server) { s.SharedSubscriptions = true })
+	first := connectClient(t, address, "first", nil)
+	second := connectClient(t, address, "second", nil)
+	pub := connectClient(t, address, "pub", nil)
+
+	firstMessages := subscribe(t, first, "$share/workers/jobs/#", mqtt.QoS0)
+	secondMessages := subscribe(t, second, "$share/workers/jobs/#", mqtt.QoS0)
+
+	for _, job := range []string{"1", "2", "3", "4"} {
+		publish(t, pub, "jobs/"+job, job, mqtt.QoS1, false)
+	}
+
+	// the messages are distributed round-robin among the members of the group
+	assertMessages(t, firstMessages, "1", "3")
+	assertMessages(t, secondMessages, "2", "4")
+}
+
+func TestServer_SharedSubscriptions_Unavailable(t *testing.T) {
+	var dials int32
+	_, _, address := startServer(t, func(s *Server) {
+		s.SharedSubscriptions = true
+		dial := s.Dial
+		s.Dial = func() (net.Conn, error) {
+			if atomic.AddInt32(&dials, 1) > 1 {
+				return nil, errors.New("broker unavailable")
+			}
+			return dial()
+		}
+	})
+	sub := connectClient(t, address, "sub", nil)
+
+	// the SUBACK waits for the upstream subscription, which fails since the proxy can not connect to the broker
+	_, err := sub.Subscribe(context.Background(), "$share/workers/jobs/#", mqtt.QoS0, func(*client.Client,
+		*mqtt.PublishPacket) {
+	})
+	if err != client.ErrSubscriptionRefused {
+		t.Error("expected ErrSubscriptionRefused, got", err)
+	}
+}
+
+func TestServer_RemapPacketIds(t *testing.T) {
+	_, _, address := startServer(t, func(s *Server) {
+		s.RemapPacketIds = true
+		s.SharedSubscriptions = true
+	})
+	sub := connectClient(t, address, "sub", nil)
+	pub := connectClient(t, address, "pub", nil)
+
+	messages := subscribe(t, sub, "sensors/#", mqtt.QoS2)
+	shared := subscribe(t, sub, "$share/g/jobs/#", mqtt.QoS0)
+	publish(t, pub, "sensors/1", "1", mqtt.QoS1, false)
+	publish(t, pub, "sensors/2", "2", mqtt.QoS2, false)
+	publish(t, pub, "jobs/1", "job", mqtt.QoS1, false)
+
+	assertMessages(t, messages, "1", "2")
+	assertMessages(t, shared, "job")
+}
+
+// startMultiplexingServer starts a proxy that multiplexes clients over two upstream connections, and returns a
+// function that returns the number of connections that the proxy opened to the broker.
+func startMultiplexingServer(t *testing.T) (string, func() int) {
+	var dials int32
+	_, _, address := startServer(t, func(s *Server) {
+		s.Multiplex = 2
+		dial := s.Dial
+		s.Dial = func() (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return dial()
+		}
+	})
+	return address, func() int { return int(atomic.LoadInt32(&dials)) }
+}
+
+func TestServer_Multiplex(t *testing.T) {
+	address, dials := startMultiplexingServer(t)
+	first := connectClient(t, address, "first", nil)
+	second := connectClient(t, address, "second", nil)
+	pub := connectClient(t, address, "pub", nil)
+
+	firstMessages := subscribe(t, first, "sensors/#", mqtt.QoS2)
+	secondMessages := subscribe(t, second, "sensors/+/temperature", mqtt.QoS0)
+	publish(t, pub, "sensors/1/humidity", "40", mqtt.QoS0, false)
+	publish(t, pub, "sensors/1/temperature", "21", mqtt.QoS1, false)
+
+	assertMessages(t, firstMessages, "40", "21")
+	assertMessages(t, secondMessages, "21")
+	assertIntEquals(t, 2, dials())
+
+	if err := first.Unsubscribe(context.Background(), "sensors/#"); err != nil {
+		t.Fatal("error unsubscribing", err)
+	}
+	publish(t, pub, "sensors/2/temperature", "22", mqtt.QoS1, false)
+	assertMessages(t, secondMessages, "22")
+	assertMessages(t, firstMessages)
+}
+
+func TestServer_Multiplex_Retained(t *testing.T) {
+	address, _ := startMultiplexingServer(t)
+	pub := connectClient(t, address, "pub", nil)
+	publish(t, pub, "status/1", "online", mqtt.QoS1, true)
+
+	first := connectClient(t, address, "first", nil)
+	firstMessages := subscribe(t, first, "status/#", mqtt.QoS1)
+	assertMessages(t, firstMessages, "online")
+
+	// the proxy is subscribed to the filter already, but the later subscriber receives the retained message as well
+	second := connectClient(t, address, "second", nil)
+	assertMessages(t, subscribe(t, second, "status/#", mqtt.QoS1), "online")
+	assertMessages(t, firstMessages)
+}
+
+func TestServer_Multiplex_Will(t *testing.T) {
+	address, _ := startMultiplexingServer(t)
+	sub := connectClient(t, address, "sub", nil)
+	messages := subscribe(t, sub, "status/#", mqtt.QoS1)
+
+	var conn net.Conn
+	connectClient(t, address, "c", func(c *client.Client) {
+		c.Will = &mqtt.PublishPacket{TopicName: "status/c", QoS: mqtt.QoS1, Payload: []byte("offline")}
+		c.Dial = func(ctx context.Context) (net.Conn, error) {
+			var err error
+			conn, err = net.Dial("tcp", address)
+			return conn, err
+		}
+	})
+	graceful := connectClient(t, address, "graceful", func(c *client.Client) {
+		c.Will = &mqtt.PublishPacket{TopicName: "status/graceful", QoS: mqtt.QoS0, Payload: []byte("offline")}
+	})
+
+	// the broker does not know the clients, so the proxy publishes the will when the client connection breaks
+	conn.Close()
+	_ = graceful.Disconnect()
+	assertMessages(t, messages, "offline")
+}
+
+func TestServer_Multiplex_WillOnShutdown(t *testing.T) {
+	s, b, address := startServer(t, func(s *Server) { s.Multiplex = 1 })
+	connectClient(t, address, "c", func(c *client.Client) {
+		c.Will = &mqtt.PublishPacket{TopicName: "status/c", QoS: mqtt.QoS1, Retain: true, Payload: []byte("offline")}
+	})
+
+	// like the wills that the proxy keeps for bridged clients, the will is not published when the server shuts down
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal("error shutting down server", err)
+	}
+	if will := b.Retained("status/c"); will != nil {
+		t.Error("unexpected will", will)
+	}
+}
+
+func TestServer_Multiplex_NotMultiplexable(t *testing.T) {
+	address, dials := startMultiplexingServer(t)
+	sub := connectClient(t, address, "sub", nil)
+	messages := subscribe(t, sub, "#", mqtt.QoS0)
+
+	pub := connectClient(t, address, "pub", func(c *client.Client) { c.CleanSession = false })
+	publish(t, pub, "a", "persistent", mqtt.QoS1, false)
+	assertMessages(t, messages, "persistent")
+
+	// the client with a persistent session is bridged over its own connection
+	assertIntEquals(t, 3, dials())
+}
+
+// startFakeBroker starts a proxy whose connections to the broker are passed to the test, and returns the address of
+// the proxy and a channel that receives the broker end of the connections.
+func startFakeBroker(t *testing.T, configure func(s *Server)) (string, chan mqtt.Channel) {
+	brokers := make(chan mqtt.Channel, 1)
+	_, _, address := startServer(t, func(s *Server) {
+		s.Dial = func() (net.Conn, error) {
+			proxyEnd, brokerEnd := net.Pipe()
+			t.Cleanup(func() { brokerEnd.Close() })
+			brokers <- mqtt.NewChannel(brokerEnd)
+			return proxyEnd, nil
+		}
+		if configure != nil {
+			configure(s)
+		}
+	})
+	return address, brokers
+}
+
+// dialRaw connects to the proxy without a client library, and sends the CONNECT.
+func dialRaw(t *testing.T, address string, connect *mqtt.ConnectPacket) mqtt.Channel {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ch := mqtt.NewChannel(conn)
+	if err = ch.WritePacket(connect); err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+// readWithin reads the next packet from the channel, or returns an error if none arrives within the timeout.
+func readWithin(ch mqtt.Channel, timeout time.Duration) (mqtt.Packet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return mqtt.ReadNextContext(ctx, ch)
+}
+
+func TestServer_RetainedCache(t *testing.T) {
+	_, _, address := startServer(t, func(s *Server) { s.RetainedCache = true })
+	pub := connectClient(t, address, "pub", nil)
+	publish(t, pub, "status/1", "online", mqtt.QoS1, true)
+	publish(t, pub, "status/2", "online", mqtt.QoS1, true)
+	publish(t, pub, "status/2", "", mqtt.QoS1, true)
+	publish(t, pub, "status/3", "online", mqtt.QoS0, false)
+
+	// the client receives the retained message once, although both the proxy and the broker send it
+	sub := connectClient(t, address, "sub", nil)
+	assertMessages(t, subscribe(t, sub, "status/#", mqtt.QoS1), "online")
+}
+
+func TestServer_StoreAndForward(t *testing.T) {
+	var unreachable int32 = 1
+	_, b, address := startServer(t, func(s *Server) {
+		s.StoreAndForwardDir = tempDir(t)
+		dial := s.Dial
+		s.Dial = func() (net.Conn, error) {
+			if atomic.LoadInt32(&unreachable) == 1 {
+				return nil, errors.New("broker unreachable")
+			}
+			return dial()
+		}
+	})
+
+	// the subscriber is connected to the broker directly
+	sub := connectClient(t, "", "sub", func(c *client.Client) {
+		c.Dial = func(context.Context) (net.Conn, error) { return b.Pipe(), nil }
+	})
+	messages := subscribe(t, sub, "sensors/#", mqtt.QoS2)
+
+	pub := connectClient(t, address, "pub", nil)
+	publish(t, pub, "sensors/1", "dropped", mqtt.QoS0, false)
+	publish(t, pub, "sensors/1", "1", mqtt.QoS1, false)
+	publish(t, pub, "sensors/2", "2", mqtt.QoS2, false)
+	if _, err := pub.Subscribe(context.Background(), "sensors/#", mqtt.QoS1, nil); err == nil {
+		t.Error("expected subscription to be refused while the broker is unreachable")
+	}
+	assertMessages(t, messages)
+
+	// the stored messages are forwarded once a client has been bridged to the broker again
+	atomic.StoreInt32(&unreachable, 0)
+	connectClient(t, address, "other", nil)
+	assertMessages(t, messages, "1", "2")
+}
+
+func TestServer_LocalKeepAlive(t *testing.T) {
+	address, brokers := startFakeBroker(t, func(s *Server) { s.LocalKeepAlive = true })
+	connect, _ := mqtt.NewConnect().ClientId("c").KeepAlive(1).Build()
+	client := dialRaw(t, address, connect)
+
+	broker := <-brokers
+	if p, err := readWithin(broker, time.Second); err != nil || p.Type() != mqtt.TypeConnect {
+		t.Fatal("expected CONNECT, got", p, err)
+	}
+	if err := broker.WritePacket(&mqtt.ConnAckPacket{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readWithin(client, time.Second); err != nil {
+		t.Fatal("error reading CONNACK", err)
+	}
+
+	// the proxy answers the PINGREQ of the client
+	if err := client.WritePacket(&mqtt.PingReqPacket{}); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := readWithin(client, time.Second); err != nil || p.Type() != mqtt.TypePingResp {
+		t.Fatal("expected PINGRESP, got", p, err)
+	}
+
+	// and keeps the connection to the broker alive on its own
+	if p, err := readWithin(broker, 2*time.Second); err != nil || p.Type() != mqtt.TypePingReq {
+		t.Fatal("expected PINGREQ, got", p, err)
+	}
+	if err := broker.WritePacket(&mqtt.PingRespPacket{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client sends nothing for one and a half times the keep alive, so the proxy closes its connections
+	if p, err := readWithin(client, 2*time.Second); err == nil {
+		t.Fatal("expected client connection to be closed, got", p)
+	}
+	for {
+		p, err := readWithin(broker, time.Second)
+		if err != nil {
+			break
+		}
+		if p.Type() != mqtt.TypePingReq {
+			t.Fatal("expected broker connection to be closed, got", p)
+		}
+	}
+}
+
+func TestServer_KeepAliveForwarded(t *testing.T) {
+	address, brokers := startFakeBroker(t, nil)
+	connect, _ := mqtt.NewConnect().ClientId("c").KeepAlive(1).Build()
+	client := dialRaw(t, address, connect)
+
+	broker := <-brokers
+	if _, err := readWithin(broker, time.Second); err != nil {
+		t.Fatal("error reading CONNECT", err)
+	}
+	if err := broker.WritePacket(&mqtt.ConnAckPacket{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readWithin(client, time.Second); err != nil {
+		t.Fatal("error reading CONNACK", err)
+	}
+
+	// the keep alive is left to the broker, so the proxy keeps the connection of the silent client open
+	time.Sleep(2 * time.Second)
+	if err := client.WritePacket(&mqtt.PingReqPacket{}); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := readWithin(broker, time.Second); err != nil || p.Type() != mqtt.TypePingReq {
+		t.Fatal("expected PINGREQ, got", p, err)
+	}
+}
+
+func TestServer_LocalKeepAlive_BrokerTimeout(t *testing.T) {
+	address, brokers := startFakeBroker(t, func(s *Server) { s.LocalKeepAlive = true })
+	connect, _ := mqtt.NewConnect().ClientId("c").KeepAlive(1).Build()
+	client := dialRaw(t, address, connect)
+
+	broker := <-brokers
+	if _, err := readWithin(broker, time.Second); err != nil {
+		t.Fatal("error reading CONNECT", err)
+	}
+	if err := broker.WritePacket(&mqtt.ConnAckPacket{}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// the broker reads, but never answers
+		for {
+			if _, err := mqtt.ReadNext(broker); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := client.WritePacket(&mqtt.PingReqPacket{}); err != nil {
+			return
+		}
+		if _, err := readWithin(client, time.Second); err != nil && err != context.DeadlineExceeded {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Error("expected client connection to be closed")
+}
+
+func TestServer_LocalKeepAlive_Will(t *testing.T) {
+	_, _, address := startServer(t, func(s *Server) { s.LocalKeepAlive = true })
+	sub := connectClient(t, address, "sub", nil)
+	messages := subscribe(t, sub, "status/#", mqtt.QoS1)
+
+	connect, _ := mqtt.NewConnect().ClientId("c").KeepAlive(1).Will("status/c", []byte("offline"), mqtt.QoS1, false).
+		Build()
+	client := dialRaw(t, address, connect)
+	if _, err := readWithin(client, time.Second); err != nil {
+		t.Fatal("error reading CONNACK", err)
+	}
+
+	select {
+	case m := <-messages:
+		assertStringEquals(t, "offline", m)
+	case <-time.After(3 * time.Second):
+		t.Error("expected will to be published")
+	}
+}
+
+func TestServer_KeepWills(t *testing.T) {
+	brokerConns := make(chan net.Conn, 16)
+	_, _, address := startServer(t, func(s *Server) {
+		s.KeepWills = true
+		dial := s.Dial
+		s.Dial = func() (net.Conn, error) {
+			conn, err := dial()
+			brokerConns <- conn
+			return conn, err
+		}
+	})
+	sub := connectClient(t, address, "sub", nil)
+	<-brokerConns
+	messages := subscribe(t, sub, "status/#", mqtt.QoS1)
+
+	var clientConn net.Conn
+	withWill := func(clientId string) func(c *client.Client) {
+		return func(c *client.Client) {
+			c.Will = &mqtt.PublishPacket{TopicName: "status/" + clientId, QoS: mqtt.QoS1, Payload: []byte(clientId)}
+			c.Dial = func(ctx context.Context) (net.Conn, error) {
+				var err error
+				clientConn, err = net.Dial("tcp", address)
+				return clientConn, err
+			}
+		}
+	}
+
+	// the broker does not know the will, so losing the connection to the broker does not publish it
+	connectClient(t, address, "upstream-lost", withWill("upstream-lost"))
+	(<-brokerConns).Close()
+
+	connectClient(t, address, "graceful", withWill("graceful")).Disconnect()
+	<-brokerConns
+
+	// but the proxy publishes it if the client connection breaks
+	connectClient(t, address, "broken", withWill("broken"))
+	<-brokerConns
+	clientConn.Close()
+
+	assertMessages(t, messages, "broken")
+}
+
+func TestServer_KeepWills_RemapPacketIds(t *testing.T) {
+	var dials int32
+	_, _, address := startServer(t, func(s *Server) {
+		s.KeepWills = true
+		s.RemapPacketIds = true
+		dial := s.Dial
+		s.Dial = func() (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return dial()
+		}
+	})
+	sub := connectClient(t, address, "sub", nil)
+	messages := subscribe(t, sub, "status/#", mqtt.QoS1)
+
+	var clientConn net.Conn
+	connectClient(t, address, "broken", func(c *client.Client) {
+		c.Will = &mqtt.PublishPacket{TopicName: "status/broken", QoS: mqtt.QoS1, Payload: []byte("broken")}
+		c.Dial = func(ctx context.Context) (net.Conn, error) {
+			var err error
+			clientConn, err = net.Dial("tcp", address)
+			return clientConn, err
+		}
+	})
+	clientConn.Close()
+
+	// the will is published over the connection of the client to the broker, rather than a new one
+	assertMessages(t, messages, "broken")
+	assertIntEquals(t, 2, int(atomic.LoadInt32(&dials)))
+}
+
+func TestServer_UTF8Reject(t *testing.T) {
+	_, _, address := startServer(t, func(s *Server) { s.UTF8Mode = mqtt.UTF8Reject })
+	sub := connectClient(t, address, "sub", nil)
+	messages := subscribe(t, sub, "#", mqtt.QoS0)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch := mqtt.NewChannel(conn)
+	connect, _ := mqtt.NewConnect().ClientId("c").Build()
+	if err = ch.WritePacket(connect); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mqtt.ReadNext(ch); err != nil {
+		t.Fatal("error reading CONNACK", err)
+	}
+
+	if err = ch.WritePacket(&mqtt.PublishPacket{TopicName: "a\xff", Payload: []byte("invalid")}); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = ch.Next(); err == nil {
+		t.Error("expected connection to be closed")
+	}
+	assertMessages(t, messages)
+}
+
+func TestServer_MaxPacketSize(t *testing.T) {
+	address, brokers := startFakeBroker(t, func(s *Server) { s.MaxPacketSize = 64 })
+	connect, _ := mqtt.NewConnect().Version(mqtt.ProtocolLevel5).ClientId("c").Build()
+	client := dialRaw(t, address, connect)
+
+	broker := <-brokers
+	if p, err := readWithin(broker, time.Second); err != nil || p.Type() != mqtt.TypeConnect {
+		t.Fatal("expected CONNECT, got", p, err)
+	}
+	if err := broker.WritePacket(&mqtt.ConnAckPacket{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readWithin(client, time.Second); err != nil {
+		t.Fatal("error reading CONNACK", err)
+	}
+
+	// the MQTT 5 client is told why it is disconnected
+	if err := client.WritePacket(&mqtt.PublishPacket{TopicName: "a", Payload: make([]byte, 100)}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := readWithin(client, time.Second)
+	if err != nil || p.Type() != mqtt.TypeDisconnect {
+		t.Fatal("expected DISCONNECT, got", p, err)
+	}
+	assertIntEquals(t, int(mqtt.ReasonPacketTooLarge), int(p.(*mqtt.DisconnectPacket).ReasonCode))
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	s, _, address := startServer(t, nil)
+
+	lost := make(chan error, 1)
+	connectClient(t, address, "c", func(c *client.Client) {
+		c.OnConnectionLost = func(_ *client.Client, err error) { lost <- err }
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Error("expected client connection to be closed")
+	}
+}
+
+func assertMessages(t *testing.T, messages chan string, expected ...string) {
+	t.Helper()
+
+	received := make(map[string]bool)
+	for range expected {
+		select {
+		case m := <-messages:
+			received[m] = true
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for messages", expected)
+		}
+	}
+	for _, m := range expected {
+		if !received[m] {
+			t.Errorf("expected message %s, got %v", m, received)
+		}
+	}
+	select {
+	case m := <-messages:
+		t.Error("unexpected message", m)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func assertStringEquals(t *testing.T, expected string, actual string) {
+	t.Helper()
+	if expected != actual {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
@@ -0,0 +1,552 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/client"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/topic"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// errSharedClosed is returned when joining a group after the shared subscriptions have been closed.
+var errSharedClosed = errors.New("shared subscriptions closed")
+
+const (
+	// sharedTimeout is the maximum time to wait for the broker when connecting, subscribing or unsubscribing upstream.
+	sharedTimeout = 10 * time.Second
+	// sharedReconnectDelay is the time to wait before reconnecting a lost upstream connection.
+	sharedReconnectDelay = time.Second
+	// sharedOutboxSize is the number of messages that can be queued for a member. Members that fall further behind are
+	// disconnected, so that they do not hold up the upstream connection that they share with others.
+	sharedOutboxSize = 256
+)
+
+// sharedSubscriptions implements shared subscriptions ("$share/{group}/{filter}") for brokers that do not support
+// them. Instead of forwarding shared subscriptions to the broker, the proxy subscribes to each filter once, over its
+// own upstream connection, and distributes the matching messages round-robin among the members of each group. Every
+// group of a filter receives every message. Messages are delivered to the members at QoS 0. Retained messages are not
+// delivered, since shared subscriptions do not receive retained messages when they are made (see MQTT 5, 4.8.2).
+type sharedSubscriptions struct {
+	dial     func() (net.Conn, error)
+	clientId string
+
+	subMu sync.Mutex // serializes connecting, and changing the upstream subscriptions
+
+	mu       sync.Mutex
+	upstream *client.Client            // nil while no group has been joined
+	groups   map[string]*sharedGroup   // by shared filter
+	filters  map[string][]*sharedGroup // topic filter -> groups
+	closed   bool
+}
+
+type sharedGroup struct {
+	name    string
+	filter  string
+	members []*sharedMember
+	next    int // the index of the member that receives the next message
+}
+
+func newSharedSubscriptions(dial func() (net.Conn, error), clientId string) *sharedSubscriptions {
+	return &sharedSubscriptions{
+		dial:     dial,
+		clientId: clientId,
+		groups:   make(map[string]*sharedGroup),
+		filters:  make(map[string][]*sharedGroup),
+	}
+}
+
+// start connects the upstream connection, unless it is connected already, and returns it. The client library
+// reconnects it when it is lost, and restores its subscriptions. It needs to be called with s.subMu held.
+func (s *sharedSubscriptions) start(ctx context.Context) (*client.Client, error) {
+	s.mu.Lock()
+	upstream, closed := s.upstream, s.closed
+	s.mu.Unlock()
+	if closed {
+		return nil, errSharedClosed
+	}
+	if upstream != nil {
+		return upstream, nil
+	}
+
+	upstream = client.New("", s.clientId)
+	upstream.Dial = func(context.Context) (net.Conn, error) { return s.dial() }
+	upstream.ConnectTimeout = sharedTimeout
+	upstream.ReconnectDelay = sharedReconnectDelay
+	upstream.OnConnectionLost = func(_ *client.Client, err error) {
+		log.Println("lost shared subscription connection", err)
+	}
+	if err := upstream.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		_ = upstream.Disconnect()
+		return nil, errSharedClosed
+	}
+	s.upstream = upstream
+	return upstream, nil
+}
+
+// join adds the member to the group of the shared filter, and subscribes to the topic filter upstream if no other group
+// has subscribed to it. It returns the return code for the SUBACK of the member once the broker has acknowledged the
+// upstream subscription.
+func (s *sharedSubscriptions) join(ctx context.Context, m *sharedMember, shared string, name string,
+	filter string) (mqtt.SubAckCode, error) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	upstream, err := s.start(ctx)
+	if err != nil {
+		return mqtt.Failure, err
+	}
+
+	s.mu.Lock()
+	if g, ok := s.groups[shared]; ok {
+		g.add(m)
+		s.mu.Unlock()
+		return mqtt.MaxQoS0, nil
+	}
+	// the group is added first, since messages may arrive before the SUBACK
+	g := &sharedGroup{name: name, filter: filter, members: []*sharedMember{m}}
+	s.groups[shared] = g
+	subscribed := len(s.filters[filter]) > 0
+	s.filters[filter] = append(s.filters[filter], g)
+	s.mu.Unlock()
+
+	if subscribed {
+		return mqtt.MaxQoS0, nil
+	}
+
+	_, err = upstream.Subscribe(ctx, filter, mqtt.QoS0, func(_ *client.Client, p *mqtt.PublishPacket) {
+		s.dispatch(filter, p)
+	})
+	if err != nil {
+		s.mu.Lock()
+		s.remove(shared, g)
+		last := len(s.filters) == 0
+		if last {
+			s.upstream = nil
+		}
+		s.mu.Unlock()
+		if last {
+			_ = upstream.Disconnect()
+		}
+		return mqtt.Failure, err
+	}
+	return mqtt.MaxQoS0, nil
+}
+
+func (g *sharedGroup) add(m *sharedMember) {
+	for _, member := range g.members {
+		if member == m {
+			return
+		}
+	}
+	g.members = append(g.members, m)
+}
+
+// remove removes the group of the shared filter. It needs to be called with s.mu held.
+func (s *sharedSubscriptions) remove(shared string, g *sharedGroup) {
+	delete(s.groups, shared)
+	groups := s.filters[g.filter]
+	for i, group := range groups {
+		if group == g {
+			groups = append(groups[:i], groups[i+1:]...)
+			break
+		}
+	}
+	if len(groups) > 0 {
+		s.filters[g.filter] = groups
+	} else {
+		delete(s.filters, g.filter)
+	}
+}
+
+// leave removes the member from the group of the shared filter, and unsubscribes from the topic filter upstream once
+// no group is left. The upstream connection is closed once no filter is left.
+func (s *sharedSubscriptions) leave(m *sharedMember, shared string) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	s.mu.Lock()
+	g, ok := s.groups[shared]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	for i, member := range g.members {
+		if member == m {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	if len(g.members) > 0 {
+		s.mu.Unlock()
+		return
+	}
+	s.remove(shared, g)
+	_, subscribed := s.filters[g.filter]
+	upstream, last := s.upstream, len(s.filters) == 0
+	if last {
+		s.upstream = nil
+	}
+	s.mu.Unlock()
+
+	if subscribed || upstream == nil {
+		return
+	}
+	if last {
+		// the upstream connection is no longer needed
+		_ = upstream.Disconnect()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+	defer cancel()
+	if err := upstream.Unsubscribe(ctx, g.filter); err != nil {
+		log.Println("error unsubscribing shared subscription", err)
+	}
+}
+
+// dispatch queues a copy of a message of the upstream subscription of the filter for one member of each group of the
+// filter. Retained messages, which the broker sends in reply to the upstream subscription, are dropped.
+func (s *sharedSubscriptions) dispatch(filter string, p *mqtt.PublishPacket) {
+	if p.Retain {
+		return
+	}
+	var receivers []*sharedMember
+
+	s.mu.Lock()
+	for _, g := range s.filters[filter] {
+		if len(g.members) == 0 {
+			continue
+		}
+		g.next %= len(g.members)
+		receivers = append(receivers, g.members[g.next])
+		g.next++
+	}
+	s.mu.Unlock()
+
+	for _, m := range receivers {
+		m.deliver(&mqtt.PublishPacket{TopicName: p.TopicName, QoS: mqtt.QoS0, Payload: p.Payload})
+	}
+}
+
+// close closes the upstream connection. Members can no longer join groups afterwards.
+func (s *sharedSubscriptions) close() {
+	s.mu.Lock()
+	s.closed = true
+	upstream := s.upstream
+	s.upstream = nil
+	s.mu.Unlock()
+
+	if upstream != nil {
+		_ = upstream.Disconnect()
+	}
+}
+
+// sharedMember intercepts the SUBSCRIBE and UNSUBSCRIBE packets of a client bridge. Shared subscriptions are handled by
+// the proxy, all other subscriptions are forwarded to the broker. If a SUBSCRIBE contains both, the SUBACK of the
+// broker is completed with the return codes of the shared subscriptions. Joining and leaving groups may wait for the
+// broker, so the member does it in a separate goroutine, in the order of the packets of the client. The messages of
+// the groups are queued in the outbox of the member, and written by another goroutine, so that dispatching a message
+// never waits for a slow client.
+type sharedMember struct {
+	shared *sharedSubscriptions
+	conn   net.Conn
+	client mqtt.Writer
+	broker mqtt.Writer
+	outbox chan mqtt.Packet
+	done   chan struct{}
+	once   sync.Once
+
+	mu      sync.Mutex
+	joined  map[string]struct{}
+	subAcks map[uint16]*pendingSubAck
+	tasks   []func() // joins and leaves that have not been run yet
+	running bool     // whether a goroutine runs the tasks
+}
+
+// pendingSubAck is a SUBACK that is sent to the client once the groups of its shared subscriptions have been joined,
+// and the broker has acknowledged its other subscriptions.
+type pendingSubAck struct {
+	codes   []pendingSubAckCode
+	joining bool // the groups of the shared subscriptions are being joined
+	waiting bool // the SUBACK of the broker has not been received yet
+}
+
+// pendingSubAckCode is the return code of a subscription in a pending SUBACK. Codes of forwarded subscriptions are
+// taken from the SUBACK of the broker.
+type pendingSubAckCode struct {
+	code      mqtt.SubAckCode
+	forwarded bool
+}
+
+// newMember returns the member for the client connection. The member writes to the client until leaveAll is called.
+func (s *sharedSubscriptions) newMember(conn net.Conn, client mqtt.Writer, broker mqtt.Writer) *sharedMember {
+	m := &sharedMember{
+		shared:  s,
+		conn:    conn,
+		client:  client,
+		broker:  broker,
+		outbox:  make(chan mqtt.Packet, sharedOutboxSize),
+		done:    make(chan struct{}),
+		joined:  make(map[string]struct{}),
+		subAcks: make(map[uint16]*pendingSubAck),
+	}
+	go m.write()
+	return m
+}
+
+// subscribe joins the groups of the shared subscriptions in the packet, and forwards the other subscriptions.
+func (m *sharedMember) subscribe(packet mqtt.Packet) error {
+	p := packet.(*mqtt.SubscribePacket)
+
+	codes := make([]pendingSubAckCode, len(p.Subscriptions))
+	var forward []mqtt.Subscription
+	for i, sub := range p.Subscriptions {
+		if !topic.IsShared(sub.TopicFilter) {
+			codes[i].forwarded = true
+			forward = append(forward, sub)
+		}
+	}
+	if len(forward) == len(p.Subscriptions) {
+		return m.broker.WritePacket(p)
+	}
+
+	pending := &pendingSubAck{codes: codes, joining: true, waiting: len(forward) > 0}
+	m.mu.Lock()
+	m.subAcks[p.PacketId] = pending
+	m.mu.Unlock()
+
+	m.enqueue(func() {
+		for i, sub := range p.Subscriptions {
+			if codes[i].forwarded {
+				continue
+			}
+			code := m.join(sub.TopicFilter)
+			m.mu.Lock()
+			codes[i].code = code
+			m.mu.Unlock()
+		}
+
+		m.mu.Lock()
+		pending.joining = false
+		complete := !pending.waiting
+		if complete {
+			delete(m.subAcks, p.PacketId)
+		}
+		m.mu.Unlock()
+		if !complete {
+			return
+		}
+		if err := m.client.WritePacket(pending.subAck(p.PacketId)); err != nil {
+			log.Println("error sending SUBACK of shared subscriptions", err)
+		}
+	})
+
+	if len(forward) == 0 {
+		return nil
+	}
+	return m.broker.WritePacket(&mqtt.SubscribePacket{PacketId: p.PacketId, Subscriptions: forward})
+}
+
+func (m *sharedMember) join(shared string) mqtt.SubAckCode {
+	name, filter, err := topic.ParseShared(shared)
+	if err != nil {
+		log.Println("invalid shared subscription", err)
+		return mqtt.Failure
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+	defer cancel()
+	code, err := m.shared.join(ctx, m, shared, name, filter)
+	if err != nil {
+		log.Println("error joining shared subscription", err)
+		return mqtt.Failure
+	}
+
+	m.mu.Lock()
+	m.joined[shared] = struct{}{}
+	m.mu.Unlock()
+	return code
+}
+
+// unsubscribe leaves the groups of the shared subscriptions in the packet, and forwards the other filters. If there
+// are none, the UNSUBACK is sent by the proxy once the groups have been left.
+func (m *sharedMember) unsubscribe(packet mqtt.Packet) error {
+	p := packet.(*mqtt.UnsubscribePacket)
+
+	var shared, forward []string
+	for _, filter := range p.TopicFilters {
+		if topic.IsShared(filter) {
+			shared = append(shared, filter)
+		} else {
+			forward = append(forward, filter)
+		}
+	}
+	if len(shared) == 0 {
+		return m.broker.WritePacket(p)
+	}
+
+	m.enqueue(func() {
+		for _, filter := range shared {
+			m.leave(filter)
+		}
+		if len(forward) > 0 {
+			return
+		}
+		if err := m.client.WritePacket(&mqtt.UnsubAckPacket{PacketId: p.PacketId}); err != nil {
+			log.Println("error sending UNSUBACK of shared subscriptions", err)
+		}
+	})
+
+	if len(forward) == 0 {
+		return nil
+	}
+	return m.broker.WritePacket(&mqtt.UnsubscribePacket{PacketId: p.PacketId, TopicFilters: forward})
+}
+
+func (m *sharedMember) leave(shared string) {
+	m.mu.Lock()
+	_, ok := m.joined[shared]
+	delete(m.joined, shared)
+	m.mu.Unlock()
+
+	if ok {
+		m.shared.leave(m, shared)
+	}
+}
+
+// enqueue runs the task after the tasks that have been enqueued before, in a separate goroutine.
+func (m *sharedMember) enqueue(task func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tasks = append(m.tasks, task)
+	if !m.running {
+		m.running = true
+		go m.run()
+	}
+}
+
+func (m *sharedMember) run() {
+	for {
+		m.mu.Lock()
+		if len(m.tasks) == 0 {
+			m.running = false
+			m.mu.Unlock()
+			return
+		}
+		task := m.tasks[0]
+		m.tasks = m.tasks[1:]
+		m.mu.Unlock()
+
+		task()
+	}
+}
+
+// expectsSubAck returns true if a SUBACK of the broker needs to be completed.
+func (m *sharedMember) expectsSubAck() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.subAcks) > 0
+}
+
+// subAck completes the SUBACK of the broker with the return codes of the shared subscriptions, and writes it to the
+// client, unless the groups of the shared subscriptions are still being joined.
+func (m *sharedMember) subAck(packet mqtt.Packet) error {
+	p := packet.(*mqtt.SubAckPacket)
+
+	m.mu.Lock()
+	pending, ok := m.subAcks[p.PacketId]
+	if ok {
+		j := 0
+		for i, c := range pending.codes {
+			if !c.forwarded {
+				continue
+			}
+			pending.codes[i].code = mqtt.Failure
+			if j < len(p.ReturnCodes) {
+				pending.codes[i].code = p.ReturnCodes[j]
+				j++
+			}
+		}
+		pending.waiting = false
+		if pending.joining {
+			m.mu.Unlock()
+			return nil
+		}
+		delete(m.subAcks, p.PacketId)
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return m.client.WritePacket(p)
+	}
+	return m.client.WritePacket(pending.subAck(p.PacketId))
+}
+
+// subAck returns the SUBACK with the return codes. It may only be called once the SUBACK is no longer pending.
+func (s *pendingSubAck) subAck(packetId uint16) *mqtt.SubAckPacket {
+	subAck := &mqtt.SubAckPacket{PacketId: packetId, ReturnCodes: make([]mqtt.SubAckCode, len(s.codes))}
+	for i, c := range s.codes {
+		subAck.ReturnCodes[i] = c.code
+	}
+	return subAck
+}
+
+// leaveAll leaves all groups once the pending joins and leaves are done, and stops writing to the client, e.g., after
+// the client has disconnected.
+func (m *sharedMember) leaveAll() {
+	m.enqueue(func() {
+		m.mu.Lock()
+		joined := m.joined
+		m.joined = make(map[string]struct{})
+		m.mu.Unlock()
+
+		for shared := range joined {
+			m.shared.leave(m, shared)
+		}
+		m.once.Do(func() { close(m.done) })
+	})
+}
+
+// deliver queues a message of a group for the client. Clients whose outbox is full are disconnected.
+func (m *sharedMember) deliver(p *mqtt.PublishPacket) {
+	select {
+	case m.outbox <- p:
+	case <-m.done:
+	default:
+		log.Printf("closing connection of client %s: too many queued shared subscription messages\n",
+			m.conn.RemoteAddr())
+		m.close()
+	}
+}
+
+func (m *sharedMember) write() {
+	for {
+		select {
+		case p := <-m.outbox:
+			if err := m.client.WritePacket(p); err != nil {
+				log.Println("error delivering shared subscription message", err)
+				m.close()
+				return
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// close closes the client connection, which stops the bridge of the client.
+func (m *sharedMember) close() {
+	m.once.Do(func() {
+		close(m.done)
+		m.conn.Close()
+	})
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"github.com/edgerun/emma-mqtt-proxy/pkg/broker"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"net"
+	"testing"
+	"time"
+)
+
+// packetQueue is a writer that queues the packets written to it, for writers that other goroutines write to.
+type packetQueue chan mqtt.Packet
+
+func (q packetQueue) WritePacket(packet mqtt.Packet) error {
+	q <- packet
+	return nil
+}
+
+func (q packetQueue) next(t *testing.T) mqtt.Packet {
+	t.Helper()
+	select {
+	case p := <-q:
+		return p
+	case <-time.After(time.Second):
+		t.Fatal("expected packet")
+		return nil
+	}
+}
+
+func (q packetQueue) assertEmpty(t *testing.T) {
+	t.Helper()
+	select {
+	case p := <-q:
+		t.Error("unexpected packet", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func startSharedSubscriptions(t *testing.T, dial func() (net.Conn, error)) *sharedSubscriptions {
+	s := newSharedSubscriptions(dial, "shared")
+	t.Cleanup(s.close)
+	return s
+}
+
+// newTestMember returns a member of the shared subscriptions, and the queues of its packets to the client and the
+// broker.
+func newTestMember(t *testing.T, s *sharedSubscriptions) (*sharedMember, packetQueue, packetQueue) {
+	conn, other := net.Pipe()
+	t.Cleanup(func() { other.Close() })
+	client, broker := make(packetQueue, 16), make(packetQueue, 16)
+	m := s.newMember(conn, client, broker)
+	t.Cleanup(m.leaveAll)
+	return m, client, broker
+}
+
+func joinShared(t *testing.T, m *sharedMember, client packetQueue, packetId uint16, filter string) mqtt.SubAckCode {
+	t.Helper()
+	err := m.subscribe(&mqtt.SubscribePacket{PacketId: packetId, Subscriptions: []mqtt.Subscription{
+		{TopicFilter: filter, QoS: mqtt.QoS1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subAck := client.next(t).(*mqtt.SubAckPacket)
+	assertPacketId(t, packetId, subAck)
+	return subAck.ReturnCodes[0]
+}
+
+func assertPayload(t *testing.T, expected string, packet mqtt.Packet) {
+	t.Helper()
+	p, ok := packet.(*mqtt.PublishPacket)
+	if !ok {
+		t.Fatal("expected PUBLISH, got", packet)
+	}
+	assertStringEquals(t, expected, string(p.Payload))
+	if p.Retain {
+		t.Error("expected message not to be retained")
+	}
+}
+
+func TestSharedSubscriptions_Rotation(t *testing.T) {
+	b := broker.New()
+	t.Cleanup(func() { _ = b.Close() })
+	b.Publish(&mqtt.PublishPacket{TopicName: "sensors/1", Retain: true, Payload: []byte("retained")})
+
+	s := startSharedSubscriptions(t, func() (net.Conn, error) { return b.Pipe(), nil })
+	m1, client1, _ := newTestMember(t, s)
+	m2, client2, _ := newTestMember(t, s)
+	other, client3, _ := newTestMember(t, s)
+	assertIntEquals(t, int(mqtt.MaxQoS0), int(joinShared(t, m1, client1, 1, "$share/g/sensors/+")))
+	assertIntEquals(t, int(mqtt.MaxQoS0), int(joinShared(t, m2, client2, 1, "$share/g/sensors/+")))
+	assertIntEquals(t, int(mqtt.MaxQoS0), int(joinShared(t, other, client3, 1, "$share/other/sensors/#")))
+
+	// the members of a group receive the messages in turn, and every group receives every message, but no retained
+	// messages
+	for _, payload := range []string{"0", "1", "2", "3"} {
+		b.Publish(&mqtt.PublishPacket{TopicName: "sensors/1", Payload: []byte(payload)})
+	}
+	assertPayload(t, "0", client1.next(t))
+	assertPayload(t, "2", client1.next(t))
+	assertPayload(t, "1", client2.next(t))
+	assertPayload(t, "3", client2.next(t))
+	for _, payload := range []string{"0", "1", "2", "3"} {
+		assertPayload(t, payload, client3.next(t))
+	}
+	client1.assertEmpty(t)
+	client2.assertEmpty(t)
+}
+
+func TestSharedSubscriptions_Leave(t *testing.T) {
+	b := broker.New()
+	t.Cleanup(func() { _ = b.Close() })
+	s := startSharedSubscriptions(t, func() (net.Conn, error) { return b.Pipe(), nil })
+	m1, client1, _ := newTestMember(t, s)
+	m2, client2, _ := newTestMember(t, s)
+	joinShared(t, m1, client1, 1, "$share/g/a")
+	joinShared(t, m2, client2, 1, "$share/g/a")
+
+	// the proxy answers the UNSUBSCRIBE of shared subscriptions itself
+	if err := m1.unsubscribe(&mqtt.UnsubscribePacket{PacketId: 2, TopicFilters: []string{"$share/g/a"}}); err != nil {
+		t.Fatal(err)
+	}
+	unsubAck := client1.next(t)
+	if unsubAck.Type() != mqtt.TypeUnsubAck {
+		t.Fatal("expected UNSUBACK, got", unsubAck)
+	}
+	assertPacketId(t, 2, unsubAck)
+
+	b.Publish(&mqtt.PublishPacket{TopicName: "a", Payload: []byte("0")})
+	b.Publish(&mqtt.PublishPacket{TopicName: "a", Payload: []byte("1")})
+	assertPayload(t, "0", client2.next(t))
+	assertPayload(t, "1", client2.next(t))
+	client1.assertEmpty(t)
+
+	// the upstream connection is closed once the last member has left
+	m2.leaveAll()
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		upstream := s.upstream
+		s.mu.Unlock()
+		if upstream == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected upstream connection to be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSharedSubscriptions_Close(t *testing.T) {
+	b := broker.New()
+	t.Cleanup(func() { _ = b.Close() })
+	s := startSharedSubscriptions(t, func() (net.Conn, error) { return b.Pipe(), nil })
+	m, client, _ := newTestMember(t, s)
+	joinShared(t, m, client, 1, "$share/g/a")
+
+	// no messages are delivered, and no groups can be joined, once the shared subscriptions are closed
+	s.close()
+	b.Publish(&mqtt.PublishPacket{TopicName: "a", Payload: []byte("0")})
+	client.assertEmpty(t)
+	assertIntEquals(t, int(mqtt.Failure), int(joinShared(t, m, client, 2, "$share/g/b")))
+}
+
+func TestSharedMember_Subscribe(t *testing.T) {
+	dialed := make(chan struct{})
+	b := broker.New()
+	t.Cleanup(func() { _ = b.Close() })
+	s := startSharedSubscriptions(t, func() (net.Conn, error) {
+		<-dialed
+		return b.Pipe(), nil
+	})
+	m, client, broker := newTestMember(t, s)
+
+	// the bridge is not held up while the proxy connects to the broker, and the other subscriptions are forwarded
+	err := m.subscribe(&mqtt.SubscribePacket{PacketId: 1, Subscriptions: []mqtt.Subscription{
+		{TopicFilter: "$share/g/a", QoS: mqtt.QoS1},
+		{TopicFilter: "b", QoS: mqtt.QoS1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded := broker.next(t).(*mqtt.SubscribePacket)
+	assertIntEquals(t, 1, len(forwarded.Subscriptions))
+	assertStringEquals(t, "b", forwarded.Subscriptions[0].TopicFilter)
+
+	// the SUBACK of the broker is completed once the group has been joined
+	if err = m.subAck(&mqtt.SubAckPacket{PacketId: 1, ReturnCodes: []mqtt.SubAckCode{mqtt.MaxQoS1}}); err != nil {
+		t.Fatal(err)
+	}
+	client.assertEmpty(t)
+	close(dialed)
+	subAck := client.next(t).(*mqtt.SubAckPacket)
+	assertIntEquals(t, 2, len(subAck.ReturnCodes))
+	assertIntEquals(t, int(mqtt.MaxQoS0), int(subAck.ReturnCodes[0]))
+	assertIntEquals(t, int(mqtt.MaxQoS1), int(subAck.ReturnCodes[1]))
+}
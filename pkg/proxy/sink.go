@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"sync"
+)
+
+// lockedSink serializes the writes to a sink, so that packets can be written to a connection from several goroutines
+// (e.g., by the bridge and by proxy features that send their own packets to the client).
+type lockedSink struct {
+	mu   sync.Mutex
+	sink mqtt.PacketSink
+}
+
+func newLockedSink(sink mqtt.PacketSink) *lockedSink {
+	return &lockedSink{sink: sink}
+}
+
+func (s *lockedSink) WritePacket(packet mqtt.Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sink.WritePacket(packet)
+}
+
+func (s *lockedSink) ReadPacketFrom(r mqtt.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sink.ReadPacketFrom(r)
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/client"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"net"
+	"time"
+)
+
+// willTimeout is the maximum time to wait for the broker when publishing a will that the proxy kept.
+const willTimeout = 10 * time.Second
+
+// stripWill returns a copy of the CONNECT without the will, which the proxy keeps instead of the broker (see
+// Server.KeepWills).
+func stripWill(connect *mqtt.ConnectPacket) *mqtt.ConnectPacket {
+	stripped := connect.Clone().(*mqtt.ConnectPacket)
+	stripped.WillFlag = false
+	stripped.WillQoS = mqtt.QoS0
+	stripped.WillRetain = false
+	stripped.WillTopic = ""
+	stripped.WillMessage = nil
+	stripped.WillProperties = nil
+	return stripped
+}
+
+// publishWill publishes the will of the CONNECT over a new connection to the broker, since the connection of the
+// client may be gone. The proxy connects with the credentials of the client, but with its own client identifier, so
+// that the session of the client is not taken over.
+func (s *Server) publishWill(connect *mqtt.ConnectPacket) error {
+	c := client.New("", fmt.Sprintf("emma-proxy-will-%x", time.Now().UnixNano()))
+	c.Dial = func(context.Context) (net.Conn, error) { return s.dialBroker() }
+	c.AutoReconnect = false
+	if connect.UserNameFlag {
+		c.UserName, c.Password = connect.UserName, connect.Password
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), willTimeout)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		return err
+	}
+	defer func() { _ = c.Disconnect() }()
+	return c.Publish(ctx, connect.WillTopic, connect.WillMessage, connect.WillQoS, connect.WillRetain)
+}
+
+// injectWill publishes the will of the CONNECT over the connection of the client to the broker, and waits for the
+// PUBACK of QoS 1 wills. The broker must be the writer wrapped by remapper.Upstream, and acks must receive the
+// acknowledgements of the injected packets (see PacketIdRemapper.OnInjectedAck). QoS 2 wills can not be injected.
+func injectWill(remapper *PacketIdRemapper, broker mqtt.Writer, acks <-chan mqtt.Packet,
+	connect *mqtt.ConnectPacket) error {
+	will := &mqtt.PublishPacket{
+		TopicName: connect.WillTopic,
+		QoS:       connect.WillQoS,
+		Retain:    connect.WillRetain,
+		Payload:   connect.WillMessage,
+	}
+	if err := remapper.Inject(broker, will); err != nil {
+		return err
+	}
+	if will.QoS == mqtt.QoS0 {
+		return nil
+	}
+
+	timer := time.NewTimer(willTimeout)
+	defer timer.Stop()
+	select {
+	case <-acks:
+		return nil
+	case <-timer.C:
+		return errors.New("will not acknowledged by the broker")
+	}
+}
@@ -0,0 +1,175 @@
+package queue
+
+import (
+	"fmt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Consumer reads the packets of a queue in order. Its offset (the offset of the next packet that it reads) is kept in
+// the directory of the queue, so that the consumer continues where it left off when the queue is opened again.
+// Consumers hold back the deletion of segments until they have committed their packets (see Queue.Compact).
+type Consumer struct {
+	q      *Queue
+	name   string
+	offset uint64 // guarded by q.mu
+}
+
+// Consumer returns the consumer with the name, and creates it if it does not exist. A new consumer starts with the
+// oldest packet of the queue. Names may consist of letters, digits, '_' and '-'.
+func (q *Queue) Consumer(name string) (*Consumer, error) {
+	if !consumerName.MatchString(name) {
+		return nil, fmt.Errorf("invalid consumer name %q", name)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, ErrClosed
+	}
+	if c, ok := q.consumers[name]; ok {
+		return c, nil
+	}
+
+	c := &Consumer{q: q, name: name, offset: q.first()}
+	if err := c.write(); err != nil {
+		return nil, err
+	}
+	q.consumers[name] = c
+	return c, nil
+}
+
+// RemoveConsumer removes the consumer with the name, so that it no longer holds back the deletion of segments.
+func (q *Queue) RemoveConsumer(name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if _, ok := q.consumers[name]; !ok {
+		return nil
+	}
+	delete(q.consumers, name)
+	if err := os.Remove(filepath.Join(q.dir, name+consumerSuffix)); err != nil {
+		return err
+	}
+	return q.compact(time.Now())
+}
+
+func (q *Queue) loadConsumer(name string) (*Consumer, error) {
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, name+consumerSuffix))
+	if err != nil {
+		return nil, err
+	}
+	offset, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid offset of consumer %s: %w", name, err)
+	}
+	return &Consumer{q: q, name: name, offset: offset}, nil
+}
+
+func (c *Consumer) Name() string {
+	return c.name
+}
+
+// Offset returns the offset of the next packet that the consumer reads.
+func (c *Consumer) Offset() uint64 {
+	c.q.mu.Lock()
+	defer c.q.mu.Unlock()
+	return c.offset
+}
+
+// Len returns the number of packets that the consumer has not committed yet.
+func (c *Consumer) Len() int {
+	c.q.mu.Lock()
+	defer c.q.mu.Unlock()
+
+	n := 0
+	for _, s := range c.q.segments {
+		switch {
+		case s.next() <= c.offset:
+		case s.base >= c.offset:
+			n += s.len()
+		default:
+			n += int(s.next() - c.offset)
+		}
+	}
+	return n
+}
+
+// Peek returns the next packet of the consumer and its offset, without committing it. It returns ErrEmpty if the
+// consumer has read all packets. Packets that have been deleted before the consumer read them are skipped. A packet
+// that has been damaged on the disk is returned as ErrCorrupted with its offset, so that the consumer can commit it to
+// skip it.
+func (c *Consumer) Peek() (mqtt.Packet, uint64, error) {
+	c.q.mu.Lock()
+	defer c.q.mu.Unlock()
+
+	if c.q.closed {
+		return nil, 0, ErrClosed
+	}
+	offset := c.q.seek(c.offset)
+	s := c.q.segment(offset)
+	if s == nil {
+		return nil, 0, ErrEmpty
+	}
+	packet, err := s.read(offset)
+	return packet, offset, err
+}
+
+// Commit marks the packets up to and including the offset as processed, so that the consumer continues with the
+// packet after it.
+func (c *Consumer) Commit(offset uint64) error {
+	c.q.mu.Lock()
+	defer c.q.mu.Unlock()
+
+	if c.q.closed {
+		return ErrClosed
+	}
+	if offset < c.offset {
+		return nil
+	}
+	if next := c.q.active().next(); offset >= next {
+		return fmt.Errorf("%w: %d", ErrOutOfRange, offset)
+	}
+
+	previous := c.offset
+	c.offset = offset + 1
+	if err := c.write(); err != nil {
+		c.offset = previous
+		return err
+	}
+	return c.q.compact(time.Now())
+}
+
+// write replaces the offset file of the consumer atomically. It needs to be called with q.mu held.
+func (c *Consumer) write() error {
+	name := filepath.Join(c.q.dir, c.name+consumerSuffix)
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(strconv.FormatUint(c.offset, 10)); err == nil && c.q.opts.Sync == SyncAlways {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	if c.q.opts.Sync == SyncAlways {
+		return syncDir(c.q.dir)
+	}
+	return nil
+}
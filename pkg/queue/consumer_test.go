@@ -0,0 +1,143 @@
+package queue
+
+import (
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func openConsumer(t *testing.T, q *Queue, name string) *Consumer {
+	t.Helper()
+	c, err := q.Consumer(name)
+	if err != nil {
+		t.Fatal("error opening consumer", err)
+	}
+	return c
+}
+
+// consume peeks and commits the next packet of the consumer, and checks its payload.
+func consume(t *testing.T, c *Consumer, expected string) {
+	t.Helper()
+	packet, offset, err := c.Peek()
+	if err != nil {
+		t.Fatal("error peeking", err)
+	}
+	assertStringEquals(t, expected, string(packet.(*mqtt.PublishPacket).Payload))
+	if err = c.Commit(offset); err != nil {
+		t.Fatal("error committing", err)
+	}
+}
+
+func TestConsumer(t *testing.T) {
+	q := openQueue(t, tempDir(t), Options{})
+	c := openConsumer(t, q, "forward")
+	if _, _, err := c.Peek(); err != ErrEmpty {
+		t.Fatal("expected ErrEmpty, got", err)
+	}
+
+	appendMessages(t, q, "0", "1", "2")
+	assertIntEquals(t, 3, c.Len())
+	consume(t, c, "0")
+	consume(t, c, "1")
+	assertIntEquals(t, 1, c.Len())
+	assertIntEquals(t, 2, int(c.Offset()))
+
+	// committing an older offset again is a no-op
+	if err := c.Commit(0); err != nil {
+		t.Error("error committing old offset", err)
+	}
+	assertIntEquals(t, 2, int(c.Offset()))
+	if err := c.Commit(3); err == nil {
+		t.Error("expected error committing offset that does not exist yet")
+	}
+
+	consume(t, c, "2")
+	if _, _, err := c.Peek(); err != ErrEmpty {
+		t.Error("expected ErrEmpty, got", err)
+	}
+}
+
+func TestConsumer_InvalidName(t *testing.T) {
+	q := openQueue(t, tempDir(t), Options{})
+	for _, name := range []string{"", "../x", "a b", "a.consumer"} {
+		if _, err := q.Consumer(name); err == nil {
+			t.Errorf("expected error for consumer name %q", name)
+		}
+	}
+}
+
+func TestConsumer_Reopen(t *testing.T) {
+	dir := tempDir(t)
+	q := openQueue(t, dir, Options{})
+	appendMessages(t, q, "0", "1", "2")
+	consume(t, openConsumer(t, q, "a"), "0")
+	openConsumer(t, q, "b")
+	_ = q.Close()
+
+	q = openQueue(t, dir, Options{})
+	a := openConsumer(t, q, "a")
+	b := openConsumer(t, q, "b")
+	assertIntEquals(t, 1, int(a.Offset()))
+	assertIntEquals(t, 0, int(b.Offset()))
+	consume(t, a, "1")
+	consume(t, b, "0")
+}
+
+func TestConsumer_CrashDuringCommit(t *testing.T) {
+	dir := tempDir(t)
+	q := openQueue(t, dir, Options{})
+	appendMessages(t, q, "0", "1")
+	consume(t, openConsumer(t, q, "a"), "0")
+
+	// the process crashes before the new offset file replaces the old one
+	name := filepath.Join(dir, "a"+consumerSuffix+".tmp")
+	if err := ioutil.WriteFile(name, []byte("2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openQueue(t, dir, Options{})
+	consume(t, openConsumer(t, q, "a"), "1")
+}
+
+func TestConsumer_Compaction(t *testing.T) {
+	dir := tempDir(t)
+	q := openQueue(t, dir, Options{SegmentSize: 30})
+	a := openConsumer(t, q, "a")
+	b := openConsumer(t, q, "b")
+	appendMessages(t, q, "0", "1", "2", "3", "4")
+	assertIntEquals(t, 3, len(segmentFiles(t, dir)))
+
+	consume(t, a, "0")
+	consume(t, a, "1")
+	consume(t, a, "2")
+	// b still holds back the first segment
+	assertIntEquals(t, 3, len(segmentFiles(t, dir)))
+
+	consume(t, b, "0")
+	consume(t, b, "1")
+	assertIntEquals(t, 2, len(segmentFiles(t, dir)))
+	assertIntEquals(t, 2, int(q.FirstOffset()))
+
+	// removing b releases the segments that only b has not committed
+	consume(t, a, "3")
+	if err := q.RemoveConsumer("b"); err != nil {
+		t.Fatal("error removing consumer", err)
+	}
+	assertIntEquals(t, 1, len(segmentFiles(t, dir)))
+	assertIntEquals(t, 4, int(q.FirstOffset()))
+	consume(t, a, "4")
+}
+
+func TestConsumer_SkipsDeleted(t *testing.T) {
+	dir := tempDir(t)
+	q := openQueue(t, dir, Options{SegmentSize: 30, MaxBytes: 96})
+	c := openConsumer(t, q, "a")
+
+	// the size limit deletes the first segment before the consumer reads it
+	appendMessages(t, q, "0", "1", "2", "3", "4")
+	assertIntEquals(t, 3, c.Len())
+	consume(t, c, "2")
+	consume(t, c, "3")
+	consume(t, c, "4")
+}
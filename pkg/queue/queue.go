@@ -0,0 +1,505 @@
+// Package queue implements a durable message queue for features that need to keep messages across restarts of the
+// proxy, e.g., store-and-forward. The queue is an append-only log of MQTT packets in the format of the mqtt.Encoder,
+// each prefixed with its length and a CRC-32C checksum, split into segment files. Every packet gets an offset, which
+// increases by one with every appended packet. Consumers read the packets in order, and their offsets are kept in the
+// directory of the queue as well, e.g.:
+//
+//	q, err := queue.Open("/var/lib/emma/queue", queue.Options{})
+//	...
+//	offset, err := q.Append(packet)
+//	...
+//	c, err := q.Consumer("forwarder")
+//	packet, offset, err := c.Peek() // returns ErrEmpty once the consumer has read all packets
+//	...
+//	err = c.Commit(offset) // the packet has been processed
+//
+// Segments are deleted once all consumers have committed their packets, or once they exceed the size or age limits of
+// the queue (see Options). A packet that has only partially been written when the process crashed is discarded when
+// the queue is opened again, as are the packets of a segment from the first one that fails its checksum.
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrClosed is returned by operations on a queue that has been closed.
+	ErrClosed = errors.New("queue: closed")
+	// ErrEmpty is returned by Consumer.Peek if the consumer has read all packets of the queue.
+	ErrEmpty = errors.New("queue: no more packets")
+	// ErrOutOfRange is returned by Queue.Read if the queue has no packet with the offset (anymore).
+	ErrOutOfRange = errors.New("queue: offset out of range")
+	// ErrCorrupted is returned by Queue.Read if the packet with the offset does not match its checksum.
+	ErrCorrupted = errors.New("queue: corrupted packet")
+)
+
+const (
+	segmentSuffix  = ".seg"
+	consumerSuffix = ".consumer"
+
+	// DefaultSegmentSize is the size at which a new segment is started, if Options.SegmentSize is 0.
+	DefaultSegmentSize = 16 << 20
+	// DefaultSyncInterval is the interval of SyncInterval, if Options.SyncInterval is 0.
+	DefaultSyncInterval = time.Second
+)
+
+var consumerName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// SyncPolicy determines when the queue flushes its files to the disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes every packet before Append returns, and every consumer offset before Commit returns.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval flushes the appended packets periodically (see Options.SyncInterval). Packets that have been appended
+	// since may get lost, and consumers may read packets again, if the machine crashes.
+	SyncInterval
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	default:
+		return fmt.Sprintf("SyncPolicy(%d)", int(p))
+	}
+}
+
+// ParseSyncPolicy parses the name of a SyncPolicy (as returned by SyncPolicy.String).
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	for _, p := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync policy %q", name)
+}
+
+// Options configure a queue. The zero value is a queue without limits that flushes every packet.
+type Options struct {
+	Sync SyncPolicy
+	// SyncInterval is the interval at which appended packets are flushed with SyncInterval. 0 means
+	// DefaultSyncInterval.
+	SyncInterval time.Duration
+
+	// SegmentSize is the size in bytes at which a new segment is started. 0 means DefaultSegmentSize.
+	SegmentSize int64
+
+	// MaxBytes limits the size in bytes of all segments. The oldest segments are deleted when it is exceeded, even if
+	// consumers have not read their packets yet. The segment that packets are appended to is kept, so the queue may
+	// exceed the limit by up to SegmentSize. 0 means no limit.
+	MaxBytes int64
+	// MaxAge limits the time for which packets are kept. Segments are deleted once their last packet is older, even if
+	// consumers have not read their packets yet. 0 means no limit. Since the limits are enforced by segment, packets
+	// may be deleted early, or kept longer than the limits, by the size of a segment.
+	MaxAge time.Duration
+}
+
+// Queue is a durable queue of MQTT packets. A Queue is safe for concurrent use.
+type Queue struct {
+	dir  string
+	opts Options
+
+	mu        sync.Mutex
+	segments  []*segment // ordered by offset, the last one is the one that packets are appended to
+	consumers map[string]*Consumer
+	dirty     bool // packets have been appended since the last flush
+	closed    bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens the queue in the directory, and creates it if it does not exist.
+func Open(dir string, opts Options) (*Queue, error) {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		dir:       dir,
+		opts:      opts,
+		consumers: make(map[string]*Consumer),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if err := q.load(); err != nil {
+		_ = q.closeSegments()
+		return nil, err
+	}
+
+	if opts.Sync == SyncInterval {
+		go q.syncPeriodically()
+	} else {
+		close(q.done)
+	}
+	return q, nil
+}
+
+// load opens the segments and reads the offsets of the consumers.
+func (q *Queue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		switch {
+		case strings.HasSuffix(name, segmentSuffix):
+			base, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+			if err != nil {
+				continue
+			}
+			s, err := openSegment(filepath.Join(q.dir, name), base)
+			if err != nil {
+				return err
+			}
+			q.segments = append(q.segments, s)
+		case strings.HasSuffix(name, consumerSuffix):
+			c, err := q.loadConsumer(strings.TrimSuffix(name, consumerSuffix))
+			if err != nil {
+				return err
+			}
+			q.consumers[c.name] = c
+		}
+	}
+	sort.Slice(q.segments, func(i, j int) bool {
+		return q.segments[i].base < q.segments[j].base
+	})
+
+	if len(q.segments) == 0 {
+		// the offsets continue after those of the consumers, if all segments have been deleted
+		var next uint64
+		for _, c := range q.consumers {
+			if c.offset > next {
+				next = c.offset
+			}
+		}
+		s, err := createSegment(q.dir, next)
+		if err != nil {
+			return err
+		}
+		q.segments = append(q.segments, s)
+	}
+
+	// packets that have not been flushed before a crash may be lost, and would otherwise be skipped by consumers
+	for _, c := range q.consumers {
+		if next := q.active().next(); c.offset > next {
+			c.offset = next
+		}
+	}
+	return q.compact(time.Now())
+}
+
+// Append appends the packet to the queue, and returns its offset.
+func (q *Queue) Append(packet mqtt.Packet) (uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return 0, ErrClosed
+	}
+
+	active := q.active()
+	if active.size >= q.opts.SegmentSize && active.len() > 0 {
+		if err := q.roll(); err != nil {
+			return 0, err
+		}
+		if err := q.compact(time.Now()); err != nil {
+			return 0, err
+		}
+		active = q.active()
+	}
+
+	offset, err := active.append(packet)
+	if err != nil {
+		return 0, err
+	}
+	if q.opts.Sync == SyncAlways {
+		if err = active.file.Sync(); err != nil {
+			return 0, err
+		}
+	} else {
+		q.dirty = true
+	}
+	if q.opts.MaxBytes > 0 && q.size() > q.opts.MaxBytes {
+		if err = q.compact(time.Now()); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// Read returns the packet with the offset. It returns ErrOutOfRange if the queue has no such packet, e.g., because it
+// has been deleted.
+func (q *Queue) Read(offset uint64) (mqtt.Packet, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, ErrClosed
+	}
+	s := q.segment(offset)
+	if s == nil {
+		return nil, ErrOutOfRange
+	}
+	return s.read(offset)
+}
+
+// FirstOffset returns the offset of the oldest packet in the queue, or NextOffset if the queue is empty.
+func (q *Queue) FirstOffset() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.first()
+}
+
+// NextOffset returns the offset that the next appended packet will get.
+func (q *Queue) NextOffset() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.active().next()
+}
+
+// Len returns the number of packets in the queue.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for _, s := range q.segments {
+		n += s.len()
+	}
+	return n
+}
+
+// Size returns the size in bytes of all segments.
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size()
+}
+
+// Compact deletes the segments whose packets have been committed by all consumers, and the segments that exceed the
+// size and age limits of the queue. The queue compacts itself when packets are appended or committed, but segments
+// only expire by age while the queue is compacted.
+func (q *Queue) Compact() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	return q.compact(time.Now())
+}
+
+// Sync flushes the segment that packets are appended to.
+func (q *Queue) Sync() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	return q.sync()
+}
+
+// Close flushes and closes the queue.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return ErrClosed
+	}
+	q.closed = true
+	close(q.stop)
+	q.mu.Unlock()
+
+	<-q.done
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.sync()
+	if closeErr := q.closeSegments(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (q *Queue) syncPeriodically() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.mu.Lock()
+			_ = q.sync()
+			q.mu.Unlock()
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// sync needs to be called with q.mu held.
+func (q *Queue) sync() error {
+	if !q.dirty {
+		return nil
+	}
+	if err := q.active().file.Sync(); err != nil {
+		return err
+	}
+	q.dirty = false
+	return nil
+}
+
+// roll starts a new segment. It needs to be called with q.mu held.
+func (q *Queue) roll() error {
+	if err := q.sync(); err != nil {
+		return err
+	}
+	s, err := createSegment(q.dir, q.active().next())
+	if err != nil {
+		return err
+	}
+	q.segments = append(q.segments, s)
+	return nil
+}
+
+// compact deletes the segments that are no longer needed (see Compact). The segment that packets are appended to
+// keeps the next offset, so it is rolled before it is deleted. It needs to be called with q.mu held.
+func (q *Queue) compact(now time.Time) error {
+	committed, ok := q.committed()
+	for {
+		s := q.segments[0]
+		if s.len() > 0 && !q.expired(s, now) && !(ok && s.next() <= committed) {
+			return nil
+		}
+		if len(q.segments) == 1 {
+			// the segment holds the newest packet, which is only deleted once it is older than MaxAge
+			if !q.aged(s, now) {
+				return nil
+			}
+			if err := q.roll(); err != nil {
+				return err
+			}
+		}
+		if err := s.remove(); err != nil {
+			return err
+		}
+		q.segments = q.segments[1:]
+	}
+}
+
+// expired returns true if the segment exceeds the age limit, or if the queue exceeds the size limit. It needs to be
+// called with q.mu held.
+func (q *Queue) expired(s *segment, now time.Time) bool {
+	if s.len() == 0 {
+		return false
+	}
+	return q.aged(s, now) || q.opts.MaxBytes > 0 && q.size() > q.opts.MaxBytes
+}
+
+// aged returns true if the segment has packets, and its last packet is older than MaxAge.
+func (q *Queue) aged(s *segment, now time.Time) bool {
+	return s.len() > 0 && q.opts.MaxAge > 0 && now.Sub(s.modified) > q.opts.MaxAge
+}
+
+// committed returns the lowest offset of the consumers, and false if there are no consumers. It needs to be called
+// with q.mu held.
+func (q *Queue) committed() (uint64, bool) {
+	var min uint64
+	ok := false
+	for _, c := range q.consumers {
+		if !ok || c.offset < min {
+			min, ok = c.offset, true
+		}
+	}
+	return min, ok
+}
+
+// active returns the segment that packets are appended to. It needs to be called with q.mu held.
+func (q *Queue) active() *segment {
+	return q.segments[len(q.segments)-1]
+}
+
+// first needs to be called with q.mu held.
+func (q *Queue) first() uint64 {
+	for _, s := range q.segments {
+		if s.len() > 0 {
+			return s.base
+		}
+	}
+	return q.active().next()
+}
+
+// segment returns the segment that contains the offset, or nil if there is none. It needs to be called with q.mu held.
+func (q *Queue) segment(offset uint64) *segment {
+	i := sort.Search(len(q.segments), func(i int) bool {
+		return q.segments[i].next() > offset
+	})
+	if i == len(q.segments) || q.segments[i].base > offset {
+		return nil
+	}
+	return q.segments[i]
+}
+
+// seek returns the offset of the first packet at or after the offset, skipping packets that have been deleted. It
+// needs to be called with q.mu held.
+func (q *Queue) seek(offset uint64) uint64 {
+	for _, s := range q.segments {
+		if s.len() == 0 || s.next() <= offset {
+			continue
+		}
+		if s.base > offset {
+			return s.base
+		}
+		return offset
+	}
+	return q.active().next()
+}
+
+// size needs to be called with q.mu held.
+func (q *Queue) size() int64 {
+	var size int64
+	for _, s := range q.segments {
+		size += s.size
+	}
+	return size
+}
+
+// closeSegments needs to be called with q.mu held.
+func (q *Queue) closeSegments() error {
+	var err error
+	for _, s := range q.segments {
+		if closeErr := s.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,313 @@
+package queue
+
+import (
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "emma-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func openQueue(t *testing.T, dir string, opts Options) *Queue {
+	t.Helper()
+	q, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal("error opening queue", err)
+	}
+	t.Cleanup(func() { _ = q.Close() })
+	return q
+}
+
+func message(payload string) *mqtt.PublishPacket {
+	return &mqtt.PublishPacket{TopicName: "sensors/1", QoS: mqtt.QoS1, Payload: []byte(payload)}
+}
+
+func appendMessages(t *testing.T, q *Queue, payloads ...string) {
+	t.Helper()
+	for _, payload := range payloads {
+		if _, err := q.Append(message(payload)); err != nil {
+			t.Fatal("error appending", err)
+		}
+	}
+}
+
+func assertRead(t *testing.T, q *Queue, offset uint64, expected string) {
+	t.Helper()
+	packet, err := q.Read(offset)
+	if err != nil {
+		t.Fatalf("error reading offset %d: %v", offset, err)
+	}
+	assertStringEquals(t, expected, string(packet.(*mqtt.PublishPacket).Payload))
+}
+
+// segmentFiles returns the names of the segment files in the directory.
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestQueue_AppendRead(t *testing.T) {
+	q := openQueue(t, tempDir(t), Options{})
+
+	for i, payload := range []string{"0", "1", "2"} {
+		offset, err := q.Append(message(payload))
+		if err != nil {
+			t.Fatal("error appending", err)
+		}
+		assertIntEquals(t, i, int(offset))
+	}
+	assertRead(t, q, 1, "1")
+	assertRead(t, q, 0, "0")
+	assertRead(t, q, 2, "2")
+	assertIntEquals(t, 3, q.Len())
+	assertIntEquals(t, 0, int(q.FirstOffset()))
+	assertIntEquals(t, 3, int(q.NextOffset()))
+
+	if _, err := q.Read(3); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange, got", err)
+	}
+}
+
+func TestQueue_AppendPacketTypes(t *testing.T) {
+	q := openQueue(t, tempDir(t), Options{})
+	appendMessages(t, q, "0")
+	subscribe := &mqtt.SubscribePacket{PacketId: 1, Subscriptions: []mqtt.Subscription{{TopicFilter: "a"}}}
+	if _, err := q.Append(subscribe); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Append(&mqtt.PingReqPacket{}); err != nil {
+		t.Fatal(err)
+	}
+
+	packet, err := q.Read(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStringEquals(t, "a", packet.(*mqtt.SubscribePacket).Subscriptions[0].TopicFilter)
+	if packet, err = q.Read(2); err != nil || packet.Type() != mqtt.TypePingReq {
+		t.Error("expected PINGREQ, got", packet, err)
+	}
+}
+
+func TestQueue_Segments(t *testing.T) {
+	dir := tempDir(t)
+	q := openQueue(t, dir, Options{SegmentSize: 30})
+
+	// each message takes 24 bytes (16 bytes and the header of its record), so every segment holds two messages
+	appendMessages(t, q, "0", "1", "2", "3", "4")
+	assertIntEquals(t, 3, len(segmentFiles(t, dir)))
+	for i, expected := range []string{"0", "1", "2", "3", "4"} {
+		assertRead(t, q, uint64(i), expected)
+	}
+	assertIntEquals(t, 120, int(q.Size()))
+}
+
+func TestQueue_Reopen(t *testing.T) {
+	dir := tempDir(t)
+	q := openQueue(t, dir, Options{SegmentSize: 30})
+	appendMessages(t, q, "0", "1", "2")
+	if err := q.Close(); err != nil {
+		t.Fatal("error closing queue", err)
+	}
+	if _, err := q.Append(message("closed")); err != ErrClosed {
+		t.Error("expected ErrClosed, got", err)
+	}
+
+	q = openQueue(t, dir, Options{SegmentSize: 30})
+	assertIntEquals(t, 3, q.Len())
+	appendMessages(t, q, "3")
+	for i, expected := range []string{"0", "1", "2", "3"} {
+		assertRead(t, q, uint64(i), expected)
+	}
+}
+
+func TestQueue_CrashDuringAppend(t *testing.T) {
+	// the record of the next message, as written by another queue
+	other := tempDir(t)
+	appendMessages(t, openQueue(t, other, Options{}), "2")
+	record, err := ioutil.ReadFile(segmentFiles(t, other)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, written := range []int{1, 5, 8, 10, 23} {
+		dir := tempDir(t)
+		q := openQueue(t, dir, Options{})
+		appendMessages(t, q, "0", "1")
+
+		// the process crashes after writing a part of the next message (the queue is not closed)
+		f, err := os.OpenFile(segmentFiles(t, dir)[0], os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.Write(record[:written])
+		_ = f.Close()
+
+		q = openQueue(t, dir, Options{})
+		assertIntEquals(t, 2, q.Len())
+		appendMessages(t, q, "2", "3")
+		for i, expected := range []string{"0", "1", "2", "3"} {
+			assertRead(t, q, uint64(i), expected)
+		}
+	}
+}
+
+func TestQueue_Corrupted(t *testing.T) {
+	dir := tempDir(t)
+	q := openQueue(t, dir, Options{})
+	appendMessages(t, q, "0", "1", "2")
+
+	// the payload of the second message is damaged on the disk
+	f, err := os.OpenFile(segmentFiles(t, dir)[0], os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteAt([]byte("x"), 47)
+	_ = f.Close()
+
+	if _, err = q.Read(1); err != ErrCorrupted {
+		t.Error("expected ErrCorrupted, got", err)
+	}
+	assertRead(t, q, 2, "2")
+	c := openConsumer(t, q, "a")
+	consume(t, c, "0")
+	if _, offset, err := c.Peek(); err != ErrCorrupted || offset != 1 {
+		t.Errorf("expected ErrCorrupted at offset 1, got %v at offset %d", err, offset)
+	}
+
+	// the segment is truncated at the damaged message when the queue is opened again
+	_ = q.Close()
+	q = openQueue(t, dir, Options{})
+	assertIntEquals(t, 1, q.Len())
+	appendMessages(t, q, "1")
+	assertRead(t, q, 0, "0")
+	assertRead(t, q, 1, "1")
+}
+
+func TestQueue_CrashDuringRoll(t *testing.T) {
+	dir := tempDir(t)
+	q := openQueue(t, dir, Options{SegmentSize: 30})
+	appendMessages(t, q, "0", "1")
+
+	// the process crashes after creating the next segment, but before writing to it
+	f, err := os.Create(filepath.Join(dir, "00000000000000000002"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	q = openQueue(t, dir, Options{SegmentSize: 30})
+	appendMessages(t, q, "2")
+	assertRead(t, q, 2, "2")
+	assertIntEquals(t, 3, q.Len())
+}
+
+func TestQueue_MaxBytes(t *testing.T) {
+	dir := tempDir(t)
+	q := openQueue(t, dir, Options{SegmentSize: 30, MaxBytes: 96})
+
+	appendMessages(t, q, "0", "1", "2", "3", "4")
+	// the oldest segment is deleted, although no consumer has read it
+	assertIntEquals(t, 2, len(segmentFiles(t, dir)))
+	assertIntEquals(t, 2, int(q.FirstOffset()))
+	assertIntEquals(t, 3, q.Len())
+	if _, err := q.Read(1); err != ErrOutOfRange {
+		t.Error("expected ErrOutOfRange, got", err)
+	}
+	assertRead(t, q, 2, "2")
+}
+
+func TestQueue_MaxBytes_SingleSegment(t *testing.T) {
+	dir := tempDir(t)
+	q := openQueue(t, dir, Options{MaxBytes: 100})
+
+	// the segment that packets are appended to is kept, even if it exceeds the limit on its own
+	appendMessages(t, q, "0", "1", "2", "3", "4")
+	assertIntEquals(t, 5, q.Len())
+	assertIntEquals(t, 0, int(q.FirstOffset()))
+	assertRead(t, q, 4, "4")
+	if err := q.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	assertIntEquals(t, 5, q.Len())
+}
+
+func TestQueue_MaxAge(t *testing.T) {
+	dir := tempDir(t)
+	q := openQueue(t, dir, Options{SegmentSize: 30, MaxAge: time.Hour})
+	appendMessages(t, q, "0", "1", "2")
+	_ = q.Close()
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range segmentFiles(t, dir) {
+		if err := os.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// all segments have expired, but the offsets continue
+	q = openQueue(t, dir, Options{SegmentSize: 30, MaxAge: time.Hour})
+	assertIntEquals(t, 0, q.Len())
+	assertIntEquals(t, 3, int(q.NextOffset()))
+	appendMessages(t, q, "3")
+	assertRead(t, q, 3, "3")
+	assertIntEquals(t, 3, int(q.FirstOffset()))
+}
+
+func TestQueue_SyncPolicies(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		dir := tempDir(t)
+		q := openQueue(t, dir, Options{Sync: policy, SyncInterval: time.Millisecond})
+		appendMessages(t, q, "0", "1")
+		time.Sleep(5 * time.Millisecond)
+		if err := q.Sync(); err != nil {
+			t.Error("error syncing", err)
+		}
+		if err := q.Close(); err != nil {
+			t.Error("error closing", err)
+		}
+
+		q = openQueue(t, dir, Options{Sync: policy})
+		assertIntEquals(t, 2, q.Len())
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		parsed, err := ParseSyncPolicy(policy.String())
+		if err != nil || parsed != policy {
+			t.Errorf("expected %s, got %s (%v)", policy, parsed, err)
+		}
+	}
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func assertIntEquals(t *testing.T, expected int, actual int) {
+	t.Helper()
+	if expected != actual {
+		t.Errorf("expected %d, got %d", expected, actual)
+	}
+}
+
+func assertStringEquals(t *testing.T, expected string, actual string) {
+	t.Helper()
+	if expected != actual {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
@@ -0,0 +1,157 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/edgerun/emma-mqtt-proxy/pkg/mqtt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// recordHeaderSize is the size of the header of each record in a segment: the length of the encoded packet, and the
+// CRC-32C of the encoded packet, both as big-endian uint32.
+const recordHeaderSize = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// segment is a file of the queue. It holds records of encoded packets with consecutive offsets, starting at its base
+// offset, which is the name of the file.
+type segment struct {
+	base      uint64
+	path      string
+	file      *os.File
+	positions []int64 // the positions of the records in the file
+	size      int64   // the size of the complete records in the file
+	modified  time.Time
+}
+
+func createSegment(dir string, base uint64) (*segment, error) {
+	path := filepath.Join(dir, fmt.Sprintf("%020d%s", base, segmentSuffix))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syncDir(dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &segment{base: base, path: path, file: f, modified: time.Now()}, nil
+}
+
+// openSegment opens the segment file, and finds the positions of its records. A record at the end of the file that is
+// incomplete, because the process crashed while writing it, is truncated, as is the rest of the file from the first
+// record whose checksum does not match.
+func openSegment(path string, base uint64) (*segment, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s := &segment{base: base, path: path, file: f, modified: info.ModTime()}
+	r := bufio.NewReader(f)
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err = io.ReadFull(r, header); err != nil {
+			break
+		}
+		length := int64(binary.BigEndian.Uint32(header))
+		if s.size+recordHeaderSize+length > info.Size() {
+			break
+		}
+		encoded := make([]byte, length)
+		if _, err = io.ReadFull(r, encoded); err != nil {
+			break
+		}
+		if _, err = decodeRecord(header, encoded); err != nil {
+			break
+		}
+		s.positions = append(s.positions, s.size)
+		s.size += recordHeaderSize + length
+	}
+
+	if s.size < info.Size() {
+		if err = f.Truncate(s.size); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// len returns the number of packets in the segment.
+func (s *segment) len() int {
+	return len(s.positions)
+}
+
+// next returns the offset of the packet after the last packet of the segment.
+func (s *segment) next() uint64 {
+	return s.base + uint64(len(s.positions))
+}
+
+func (s *segment) append(packet mqtt.Packet) (uint64, error) {
+	// the encoder sets the header of the packet, which belongs to the caller
+	buf := bytes.NewBuffer(make([]byte, recordHeaderSize))
+	if err := mqtt.NewEncoder(buf).WritePacket(packet.Clone()); err != nil {
+		return 0, err
+	}
+	record := buf.Bytes()
+	binary.BigEndian.PutUint32(record, uint32(len(record)-recordHeaderSize))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(record[recordHeaderSize:], crcTable))
+
+	if _, err := s.file.WriteAt(record, s.size); err != nil {
+		// a partially written record would be overwritten by the next one, or truncated when the queue is opened
+		return 0, err
+	}
+	offset := s.next()
+	s.positions = append(s.positions, s.size)
+	s.size += int64(buf.Len())
+	s.modified = time.Now()
+	return offset, nil
+}
+
+func (s *segment) read(offset uint64) (mqtt.Packet, error) {
+	i := offset - s.base
+	end := s.size
+	if i+1 < uint64(len(s.positions)) {
+		end = s.positions[i+1]
+	}
+	record := make([]byte, end-s.positions[i])
+	if _, err := s.file.ReadAt(record, s.positions[i]); err != nil {
+		return nil, err
+	}
+	return decodeRecord(record[:recordHeaderSize], record[recordHeaderSize:])
+}
+
+// decodeRecord verifies the checksum of the encoded packet against the header of its record, and decodes the packet.
+func decodeRecord(header []byte, encoded []byte) (mqtt.Packet, error) {
+	if int(binary.BigEndian.Uint32(header)) != len(encoded) ||
+		binary.BigEndian.Uint32(header[4:]) != crc32.Checksum(encoded, crcTable) {
+		return nil, ErrCorrupted
+	}
+	return mqtt.ReadNext(mqtt.NewDecodingStreamer(bytes.NewReader(encoded)))
+}
+
+func (s *segment) remove() error {
+	s.file.Close()
+	return os.Remove(s.path)
+}
+
+// syncDir flushes the directory, so that created and renamed files survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,291 @@
+package topic
+
+import (
+	"sync"
+)
+
+// Matcher maps topic filters to values (e.g. the subscribers of the filters), and finds the values of all filters that
+// match a topic name. The filters are stored in a trie with one node per topic level, so the cost of a lookup depends
+// on the number of levels of the topic name and the number of wildcard filters along its path, rather than the total
+// number of filters. A Matcher is safe for concurrent use.
+type Matcher struct {
+	mu    sync.RWMutex
+	root  node
+	count int
+}
+
+type node struct {
+	children map[string]*node
+	plus     *node
+	hash     *node
+
+	filter string
+	values []interface{}
+}
+
+// NewMatcher returns an empty Matcher.
+func NewMatcher() *Matcher {
+	return &Matcher{}
+}
+
+// Add adds the value to the topic filter. Values are compared with ==, so they must be comparable. Adding a value that
+// has already been added to the filter has no effect. An InvalidTopicError is returned if the filter is invalid.
+func (m *Matcher) Add(filter string, value interface{}) error {
+	if err := ValidateFilter(filter); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := &m.root
+	for rest, more := filter, true; more; {
+		var level string
+		level, rest, more = cutLevel(rest)
+		n = n.child(level)
+	}
+
+	if indexOf(n.values, value) >= 0 {
+		return nil
+	}
+	n.filter = filter
+	n.values = append(n.values, value)
+	m.count++
+	return nil
+}
+
+// Remove removes the value from the topic filter, and returns false if it had not been added.
+func (m *Matcher) Remove(filter string, value interface{}) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.root.remove(filter, value) {
+		return false
+	}
+	m.count--
+	return true
+}
+
+// Match returns the values of all filters that match the topic name. A value that has been added to several matching
+// filters is returned once per filter.
+func (m *Matcher) Match(name string) []interface{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var values []interface{}
+	m.root.match(name, true, IsSystem(name), func(n *node) {
+		values = append(values, n.values...)
+	})
+	return values
+}
+
+// MatchFilters returns all filters that match the topic name.
+func (m *Matcher) MatchFilters(name string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var filters []string
+	m.root.match(name, true, IsSystem(name), func(n *node) {
+		filters = append(filters, n.filter)
+	})
+	return filters
+}
+
+// MatchNames is the reverse of Match: it returns the values of all topic names (i.e., filters without wildcards) that
+// match the topic filter, e.g., to find the retained messages for a subscription. Values of wildcard filters are not
+// returned.
+func (m *Matcher) MatchNames(filter string) []interface{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var values []interface{}
+	m.root.matchNames(filter, true, func(n *node) {
+		values = append(values, n.values...)
+	})
+	return values
+}
+
+// Values returns the values of the topic filter.
+func (m *Matcher) Values(filter string) []interface{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	n := &m.root
+	for rest, more := filter, true; more && n != nil; {
+		var level string
+		level, rest, more = cutLevel(rest)
+		n = n.get(level)
+	}
+	if n == nil {
+		return nil
+	}
+	return append([]interface{}(nil), n.values...)
+}
+
+// Len returns the number of values that have been added over all filters.
+func (m *Matcher) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.count
+}
+
+func (n *node) get(level string) *node {
+	switch level {
+	case SingleLevelWildcard:
+		return n.plus
+	case MultiLevelWildcard:
+		return n.hash
+	default:
+		return n.children[level]
+	}
+}
+
+func (n *node) child(level string) *node {
+	if c := n.get(level); c != nil {
+		return c
+	}
+
+	c := &node{}
+	switch level {
+	case SingleLevelWildcard:
+		n.plus = c
+	case MultiLevelWildcard:
+		n.hash = c
+	default:
+		if n.children == nil {
+			n.children = make(map[string]*node)
+		}
+		n.children[level] = c
+	}
+	return c
+}
+
+func (n *node) empty() bool {
+	return len(n.values) == 0 && len(n.children) == 0 && n.plus == nil && n.hash == nil
+}
+
+// remove removes the value from the filter below the node, and prunes the nodes that become empty.
+func (n *node) remove(filter string, value interface{}) bool {
+	level, rest, more := cutLevel(filter)
+	c := n.get(level)
+	if c == nil {
+		return false
+	}
+
+	if more {
+		if !c.remove(rest, value) {
+			return false
+		}
+	} else {
+		i := indexOf(c.values, value)
+		if i < 0 {
+			return false
+		}
+		last := len(c.values) - 1
+		c.values[i] = c.values[last]
+		c.values[last] = nil
+		c.values = c.values[:last]
+	}
+
+	if c.empty() {
+		switch level {
+		case SingleLevelWildcard:
+			n.plus = nil
+		case MultiLevelWildcard:
+			n.hash = nil
+		default:
+			delete(n.children, level)
+		}
+	}
+	return true
+}
+
+// match calls fn with every node below n whose filter matches the topic name. Wildcards at the first level do not match
+// system topics.
+func (n *node) match(name string, first bool, system bool, fn func(*node)) {
+	level, rest, more := cutLevel(name)
+	wildcards := !(first && system)
+
+	if wildcards && n.hash != nil {
+		fn(n.hash)
+	}
+	if wildcards && n.plus != nil {
+		n.plus.matchRest(rest, more, fn)
+	}
+	if c := n.children[level]; c != nil {
+		c.matchRest(rest, more, fn)
+	}
+}
+
+func (n *node) matchRest(rest string, more bool, fn func(*node)) {
+	if more {
+		n.match(rest, false, false, fn)
+		return
+	}
+
+	if len(n.values) > 0 {
+		fn(n)
+	}
+	if n.hash != nil {
+		// "a/#" also matches "a"
+		fn(n.hash)
+	}
+}
+
+// matchNames calls fn with every node below n whose topic name matches the filter. Wildcards at the first level do not
+// match system topics.
+func (n *node) matchNames(filter string, first bool, fn func(*node)) {
+	level, rest, more := cutLevel(filter)
+
+	switch level {
+	case MultiLevelWildcard:
+		n.names(first, fn)
+	case SingleLevelWildcard:
+		for name, c := range n.children {
+			if !(first && IsSystem(name)) {
+				c.matchNamesRest(rest, more, fn)
+			}
+		}
+	default:
+		if c := n.children[level]; c != nil {
+			c.matchNamesRest(rest, more, fn)
+		}
+	}
+}
+
+func (n *node) matchNamesRest(rest string, more bool, fn func(*node)) {
+	if !more {
+		if len(n.values) > 0 {
+			fn(n)
+		}
+		return
+	}
+
+	if rest == MultiLevelWildcard && len(n.values) > 0 {
+		// "a/#" also matches "a"
+		fn(n)
+	}
+	n.matchNames(rest, false, fn)
+}
+
+// names calls fn with every node below n that has values, without following wildcards.
+func (n *node) names(first bool, fn func(*node)) {
+	for name, c := range n.children {
+		if first && IsSystem(name) {
+			continue
+		}
+		if len(c.values) > 0 {
+			fn(c)
+		}
+		c.names(false, fn)
+	}
+}
+
+func indexOf(values []interface{}, value interface{}) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
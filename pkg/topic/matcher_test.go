@@ -0,0 +1,252 @@
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func sortedFilters(m *Matcher, name string) []string {
+	filters := m.MatchFilters(name)
+	sort.Strings(filters)
+	return filters
+}
+
+func TestMatcher_MatchesLikeMatch(t *testing.T) {
+	m := NewMatcher()
+	for _, tt := range matchTests {
+		if err := m.Add(tt.filter, tt.filter); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+
+	for _, tt := range matchTests {
+		found := false
+		for _, v := range m.Match(tt.name) {
+			if v == tt.filter {
+				found = true
+			}
+		}
+		if found != tt.match {
+			t.Errorf("expected filter %q matching %q to be %t", tt.filter, tt.name, tt.match)
+		}
+	}
+}
+
+func TestMatcher_MatchNamesLikeMatch(t *testing.T) {
+	m := NewMatcher()
+	for _, tt := range matchTests {
+		if err := m.Add(tt.name, tt.name); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+
+	for _, tt := range matchTests {
+		found := false
+		for _, v := range m.MatchNames(tt.filter) {
+			if v == tt.name {
+				found = true
+			}
+		}
+		if found != tt.match {
+			t.Errorf("expected name %q matching %q to be %t", tt.name, tt.filter, tt.match)
+		}
+	}
+}
+
+func TestMatcher_MatchNames(t *testing.T) {
+	m := NewMatcher()
+	_ = m.Add("a", "a")
+	_ = m.Add("a/b", "a/b")
+	_ = m.Add("a/b/c", "a/b/c")
+	_ = m.Add("a/+", "a/+") // wildcard filters are not names
+	_ = m.Add("$SYS/a", "$SYS/a")
+
+	sorted := func(filter string) []string {
+		var names []string
+		for _, v := range m.MatchNames(filter) {
+			names = append(names, v.(string))
+		}
+		sort.Strings(names)
+		return names
+	}
+	assertStringsEqual(t, []string{"a", "a/b", "a/b/c"}, sorted("#"))
+	assertStringsEqual(t, []string{"a", "a/b", "a/b/c"}, sorted("a/#"))
+	assertStringsEqual(t, []string{"a/b"}, sorted("a/+"))
+	assertStringsEqual(t, []string{"a/b/c"}, sorted("+/+/c"))
+	assertStringsEqual(t, []string{"$SYS/a"}, sorted("$SYS/#"))
+	assertIntEquals(t, 0, len(sorted("b/#")))
+}
+
+func TestMatcher_Match(t *testing.T) {
+	m := NewMatcher()
+	_ = m.Add("a/b", 1)
+	_ = m.Add("a/+", 2)
+	_ = m.Add("a/#", 3)
+	_ = m.Add("#", 4)
+	_ = m.Add("a/b", 5)
+	_ = m.Add("a/b", 1) // duplicate
+
+	assertIntEquals(t, 5, m.Len())
+	assertStringsEqual(t, []string{"#", "a/#", "a/+", "a/b"}, sortedFilters(m, "a/b"))
+	assertStringsEqual(t, []string{"#", "a/#"}, sortedFilters(m, "a"))
+	assertStringsEqual(t, []string{"#", "a/#"}, sortedFilters(m, "a/b/c"))
+	assertStringsEqual(t, []string{"#"}, sortedFilters(m, "b"))
+	assertIntEquals(t, 5, len(m.Match("a/b")))
+	assertIntEquals(t, 0, len(m.Match("$SYS/a")))
+}
+
+func TestMatcher_Remove(t *testing.T) {
+	m := NewMatcher()
+	_ = m.Add("a/b/c", 1)
+	_ = m.Add("a/b/c", 2)
+	_ = m.Add("a/+/c", 1)
+
+	if m.Remove("a/b/c", 3) || m.Remove("a/b", 1) || m.Remove("x/y", 1) {
+		t.Error("removed value that has not been added")
+	}
+	if !m.Remove("a/b/c", 1) {
+		t.Error("expected value to be removed")
+	}
+	assertIntEquals(t, 2, m.Len())
+	assertIntEquals(t, 2, len(m.Match("a/b/c")))
+
+	m.Remove("a/b/c", 2)
+	m.Remove("a/+/c", 1)
+	assertIntEquals(t, 0, m.Len())
+	assertIntEquals(t, 0, len(m.Match("a/b/c")))
+	if !m.root.empty() {
+		t.Error("expected empty nodes to be pruned")
+	}
+}
+
+func TestMatcher_Values(t *testing.T) {
+	m := NewMatcher()
+	_ = m.Add("a/+", 1)
+
+	assertIntEquals(t, 1, len(m.Values("a/+")))
+	assertIntEquals(t, 0, len(m.Values("a/b")))
+	assertIntEquals(t, 0, len(m.Values("a/+/c")))
+}
+
+func TestMatcher_InvalidFilter(t *testing.T) {
+	if err := NewMatcher().Add("a/#/b", 1); !errors.Is(err, ErrInvalidWildcard) {
+		t.Error("expected ErrInvalidWildcard, got", err)
+	}
+}
+
+func TestMatcher_Concurrent(t *testing.T) {
+	m := NewMatcher()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			filter := fmt.Sprintf("a/%d/+", i)
+			for j := 0; j < 100; j++ {
+				_ = m.Add(filter, j)
+				m.Match(fmt.Sprintf("a/%d/x", i))
+				m.Remove(filter, j)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assertIntEquals(t, 0, m.Len())
+}
+
+// benchmarkFilter returns the i-th filter of the benchmarks. The filters have the form
+// site/<site>/device/<device>/<metric>, where 10% of the filters use a wildcard for the device, and 1% use a
+// multi-level wildcard for the site.
+func benchmarkFilter(i int) string {
+	switch {
+	case i%100 == 0:
+		return fmt.Sprintf("site/%d/#", i%1000)
+	case i%10 == 0:
+		return fmt.Sprintf("site/%d/device/+/metric%d", i%1000, i%7)
+	default:
+		return fmt.Sprintf("site/%d/device/%d/metric%d", i%1000, i, i%7)
+	}
+}
+
+func newBenchmarkMatcher(n int) *Matcher {
+	m := NewMatcher()
+	for i := 0; i < n; i++ {
+		_ = m.Add(benchmarkFilter(i), i)
+	}
+	return m
+}
+
+func benchmarkNames(n int) []string {
+	rnd := rand.New(rand.NewSource(1))
+	names := make([]string, 1024)
+	for i := range names {
+		device := rnd.Intn(n)
+		names[i] = fmt.Sprintf("site/%d/device/%d/metric%d", device%1000, device, device%7)
+	}
+	return names
+}
+
+func BenchmarkMatcher_Match100k(b *testing.B) {
+	m := newBenchmarkMatcher(100000)
+	names := benchmarkNames(100000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Match(names[i%len(names)])
+	}
+}
+
+func BenchmarkMatcher_Match100k_Parallel(b *testing.B) {
+	m := newBenchmarkMatcher(100000)
+	names := benchmarkNames(100000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			m.Match(names[i%len(names)])
+		}
+	})
+}
+
+func BenchmarkMatcher_Add100k(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		newBenchmarkMatcher(100000)
+	}
+}
+
+func BenchmarkMatch_Linear100k(b *testing.B) {
+	// baseline: matching the topic against every filter
+	filters := make([]string, 100000)
+	for i := range filters {
+		filters[i] = benchmarkFilter(i)
+	}
+	names := benchmarkNames(100000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		name := names[i%len(names)]
+		for _, filter := range filters {
+			Match(filter, name)
+		}
+	}
+}
+
+func assertIntEquals(t *testing.T, expected int, actual int) {
+	t.Helper()
+	if expected != actual {
+		t.Errorf("expected %d, got %d", expected, actual)
+	}
+}
+
+func assertStringsEqual(t *testing.T, expected []string, actual []string) {
+	t.Helper()
+	if fmt.Sprint(expected) != fmt.Sprint(actual) {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
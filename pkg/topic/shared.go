@@ -0,0 +1,37 @@
+package topic
+
+import (
+	"errors"
+	"strings"
+)
+
+// SharedPrefix is the prefix of shared subscription filters of the form "$share/{ShareName}/{filter}" (MQTT 5). The
+// messages matching the filter are distributed among the subscribers that share the name, instead of being sent to
+// each of them.
+const SharedPrefix = "$share/"
+
+// ErrInvalidSharedFilter is the reason of InvalidTopicError for malformed shared subscription filters.
+var ErrInvalidSharedFilter = errors.New("invalid shared subscription filter")
+
+// IsShared returns true if the topic filter is a shared subscription filter.
+func IsShared(filter string) bool {
+	return strings.HasPrefix(filter, SharedPrefix)
+}
+
+// ParseShared splits a shared subscription filter into the share name and the topic filter, e.g. "$share/g/a/+" into
+// "g" and "a/+". The share name must not be empty or contain wildcards, and the filter must be valid. An
+// InvalidTopicError is returned if the filter is not a valid shared subscription filter.
+func ParseShared(filter string) (group string, topicFilter string, err error) {
+	if !IsShared(filter) {
+		return "", "", &InvalidTopicError{filter, ErrInvalidSharedFilter}
+	}
+
+	group, topicFilter, ok := cutLevel(filter[len(SharedPrefix):])
+	if !ok || group == "" || strings.ContainsAny(group, SingleLevelWildcard+MultiLevelWildcard) {
+		return "", "", &InvalidTopicError{filter, ErrInvalidSharedFilter}
+	}
+	if err = ValidateFilter(topicFilter); err != nil {
+		return "", "", err
+	}
+	return group, topicFilter, nil
+}
@@ -0,0 +1,145 @@
+// Package topic implements the validation and matching of MQTT topic names and topic filters.
+//
+// Topic names are the topics of PUBLISH packets, topic filters are the topics of subscriptions, which can contain the
+// single-level wildcard "+" and the multi-level wildcard "#". Topics that start with "$" (e.g. "$SYS/broker/load") are
+// not matched by filters that start with a wildcard.
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Separator separates the levels of a topic.
+	Separator = "/"
+	// SingleLevelWildcard matches exactly one topic level.
+	SingleLevelWildcard = "+"
+	// MultiLevelWildcard matches any number of topic levels, including the parent level. It must be the last level of
+	// a filter.
+	MultiLevelWildcard = "#"
+
+	// MaxLength is the maximum length in bytes of topic names and filters, which are encoded as length-prefixed
+	// strings.
+	MaxLength = 65535
+)
+
+// Reasons why a topic name or filter is invalid. They can be used with errors.Is to classify an InvalidTopicError.
+var (
+	ErrEmpty           = errors.New("topic is empty")
+	ErrTooLong         = errors.New("topic is too long")
+	ErrInvalidUTF8     = errors.New("topic is not valid UTF-8")
+	ErrNullCharacter   = errors.New("topic contains the null character")
+	ErrWildcardInName  = errors.New("topic name contains wildcard characters")
+	ErrInvalidWildcard = errors.New("invalid use of wildcard in topic filter")
+)
+
+// InvalidTopicError is returned by ValidateName and ValidateFilter. Err is one of the reasons declared above.
+type InvalidTopicError struct {
+	Topic string
+	Err   error
+}
+
+func (e *InvalidTopicError) Error() string {
+	return fmt.Sprintf("invalid topic %q: %v", e.Topic, e.Err)
+}
+
+func (e *InvalidTopicError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateName checks that the topic name is not empty, fits into a length-prefixed string, is valid UTF-8 without
+// null characters, and contains no wildcards.
+func ValidateName(name string) error {
+	if err := validateString(name); err != nil {
+		return err
+	}
+	if strings.ContainsAny(name, SingleLevelWildcard+MultiLevelWildcard) {
+		return &InvalidTopicError{name, ErrWildcardInName}
+	}
+	return nil
+}
+
+// ValidateFilter checks the topic filter like ValidateName, except that wildcards are allowed if they occupy an entire
+// level, and the multi-level wildcard is the last level.
+func ValidateFilter(filter string) error {
+	if err := validateString(filter); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(filter); i++ {
+		switch filter[i] {
+		case '+':
+			if (i > 0 && filter[i-1] != '/') || (i < len(filter)-1 && filter[i+1] != '/') {
+				return &InvalidTopicError{filter, ErrInvalidWildcard}
+			}
+		case '#':
+			if (i > 0 && filter[i-1] != '/') || i != len(filter)-1 {
+				return &InvalidTopicError{filter, ErrInvalidWildcard}
+			}
+		}
+	}
+	return nil
+}
+
+func validateString(topic string) error {
+	switch {
+	case len(topic) == 0:
+		return &InvalidTopicError{topic, ErrEmpty}
+	case len(topic) > MaxLength:
+		return &InvalidTopicError{topic, ErrTooLong}
+	case !utf8.ValidString(topic):
+		return &InvalidTopicError{topic, ErrInvalidUTF8}
+	case strings.IndexByte(topic, 0) >= 0:
+		return &InvalidTopicError{topic, ErrNullCharacter}
+	}
+	return nil
+}
+
+// IsSystem returns true if the topic starts with "$". These topics are used by brokers for internal information, and
+// are not matched by filters that start with a wildcard.
+func IsSystem(topic string) bool {
+	return len(topic) > 0 && topic[0] == '$'
+}
+
+// IsFilter returns true if the topic contains wildcards.
+func IsFilter(topic string) bool {
+	return strings.ContainsAny(topic, SingleLevelWildcard+MultiLevelWildcard)
+}
+
+// Match returns true if the topic filter matches the topic name. Both are expected to be valid.
+func Match(filter string, name string) bool {
+	if IsSystem(name) && len(filter) > 0 && (filter[0] == '+' || filter[0] == '#') {
+		return false
+	}
+
+	for {
+		fLevel, fRest, fMore := cutLevel(filter)
+		nLevel, nRest, nMore := cutLevel(name)
+
+		switch {
+		case fLevel == MultiLevelWildcard:
+			return true
+		case fLevel != SingleLevelWildcard && fLevel != nLevel:
+			return false
+		}
+
+		if !fMore || !nMore {
+			// "a/#" also matches "a"
+			return fMore == nMore || (fMore && fRest == MultiLevelWildcard)
+		}
+		filter, name = fRest, nRest
+	}
+}
+
+// cutLevel returns the first level of the topic, and the rest after the separator. more is false if the topic has no
+// further levels.
+func cutLevel(topic string) (level string, rest string, more bool) {
+	i := strings.IndexByte(topic, '/')
+	if i < 0 {
+		return topic, "", false
+	}
+	return topic[:i], topic[i+1:], true
+}
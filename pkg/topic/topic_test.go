@@ -0,0 +1,138 @@
+package topic
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"a", "a/b/c", "/", "a//b", "$SYS/broker/load", "sport/tennis/player1", "ü/€"} {
+		if err := ValidateName(name); err != nil {
+			t.Errorf("unexpected error for %q: %v", name, err)
+		}
+	}
+
+	invalid := []struct {
+		name string
+		err  error
+	}{
+		{"", ErrEmpty},
+		{strings.Repeat("a", MaxLength+1), ErrTooLong},
+		{"a/\xff", ErrInvalidUTF8},
+		{"a/\x00", ErrNullCharacter},
+		{"a/+", ErrWildcardInName},
+		{"a/#", ErrWildcardInName},
+		{"a/b+", ErrWildcardInName},
+	}
+	for _, tt := range invalid {
+		err := ValidateName(tt.name)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("expected %v for %q, got %v", tt.err, tt.name, err)
+		}
+		var e *InvalidTopicError
+		if !errors.As(err, &e) || e.Topic != tt.name {
+			t.Errorf("expected InvalidTopicError for %q, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	valid := []string{"a", "a/b", "#", "+", "+/+", "/+", "+/", "a/#", "a/+/c", "+/#", "$SYS/#", "a//#"}
+	for _, filter := range valid {
+		if err := ValidateFilter(filter); err != nil {
+			t.Errorf("unexpected error for %q: %v", filter, err)
+		}
+	}
+
+	invalid := []struct {
+		filter string
+		err    error
+	}{
+		{"", ErrEmpty},
+		{"a/\xff", ErrInvalidUTF8},
+		{"a/\x00/b", ErrNullCharacter},
+		{"a/#/c", ErrInvalidWildcard},
+		{"a/b#", ErrInvalidWildcard},
+		{"#/", ErrInvalidWildcard},
+		{"a+/b", ErrInvalidWildcard},
+		{"a/+b", ErrInvalidWildcard},
+		{"++", ErrInvalidWildcard},
+	}
+	for _, tt := range invalid {
+		if err := ValidateFilter(tt.filter); !errors.Is(err, tt.err) {
+			t.Errorf("expected %v for %q, got %v", tt.err, tt.filter, err)
+		}
+	}
+}
+
+func TestIsSystem(t *testing.T) {
+	if !IsSystem("$SYS/broker") {
+		t.Error("expected system topic")
+	}
+	if IsSystem("a/$SYS") || IsSystem("") {
+		t.Error("unexpected system topic")
+	}
+}
+
+// matchTests are taken from the examples in section 4.7 of the MQTT 3.1.1 specification.
+var matchTests = []struct {
+	filter string
+	name   string
+	match  bool
+}{
+	{"sport/tennis/player1/#", "sport/tennis/player1", true},
+	{"sport/tennis/player1/#", "sport/tennis/player1/ranking", true},
+	{"sport/tennis/player1/#", "sport/tennis/player1/score/wimbledon", true},
+	{"sport/tennis/player1/#", "sport/tennis/player2", false},
+	{"sport/#", "sport", true},
+	{"sport/tennis/+", "sport/tennis/player1", true},
+	{"sport/tennis/+", "sport/tennis/player2", true},
+	{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+	{"sport/+", "sport", false},
+	{"sport/+", "sport/", true},
+	{"+/+", "/finance", true},
+	{"/+", "/finance", true},
+	{"+", "/finance", false},
+	{"#", "sport/tennis", true},
+	{"#", "/", true},
+	{"+/tennis/#", "sport/tennis", true},
+	{"a/b", "a/b", true},
+	{"a/b", "a/b/c", false},
+	{"a/b/c", "a/b", false},
+	{"#", "$SYS/broker", false},
+	{"+/broker", "$SYS/broker", false},
+	{"$SYS/#", "$SYS/broker", true},
+	{"$SYS/+", "$SYS/broker", true},
+}
+
+func TestMatch(t *testing.T) {
+	for _, tt := range matchTests {
+		if Match(tt.filter, tt.name) != tt.match {
+			t.Errorf("expected Match(%q, %q) to be %t", tt.filter, tt.name, tt.match)
+		}
+	}
+}
+
+func TestParseShared(t *testing.T) {
+	group, filter, err := ParseShared("$share/consumers/sensors/+/temperature")
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if group != "consumers" || filter != "sensors/+/temperature" {
+		t.Errorf("unexpected result %q %q", group, filter)
+	}
+
+	invalidFilters := []string{"a/b", "$share/", "$share/g", "$share//a", "$share/g+/a", "$share/#/a", "$SHARE/g/a"}
+	for _, invalid := range invalidFilters {
+		if _, _, err = ParseShared(invalid); !errors.Is(err, ErrInvalidSharedFilter) {
+			t.Errorf("expected ErrInvalidSharedFilter for %q, got %v", invalid, err)
+		}
+	}
+	if _, _, err = ParseShared("$share/g/a/#/b"); !errors.Is(err, ErrInvalidWildcard) {
+		t.Error("expected ErrInvalidWildcard, got", err)
+	}
+	if _, _, err = ParseShared("$share/g/"); !errors.Is(err, ErrEmpty) {
+		t.Error("expected ErrEmpty, got", err)
+	}
+}